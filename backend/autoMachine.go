@@ -0,0 +1,110 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"text/template"
+
+	"github.com/pborman/uuid"
+)
+
+// defaultAutoMachineName is used when a subnet with AutoMachines set
+// does not have an AutoMachineName.
+const defaultAutoMachineName = `d{{replace .HardwareAddr ":" "-"}}`
+
+// AutoMachineName is what the AutoMachineName template of a subnet
+// is expanded with.
+type AutoMachineName struct {
+	// HardwareAddr is the hardware address of the client.
+	HardwareAddr string
+	// Addr is the address the client was handed.
+	Addr string
+	// Hostname is the host name (option 12) the client sent, if any.
+	Hostname string
+	// Subnet is the name of the subnet.
+	Subnet string
+	// DnsZone is the DNS zone of the subnet, if it has one.
+	DnsZone string
+}
+
+func autoMachineNameTemplate(tmpl string) (*template.Template, error) {
+	if tmpl == "" {
+		tmpl = defaultAutoMachineName
+	}
+	return template.New("autoMachineName").Funcs(template.FuncMap{
+		"replace": func(s, old, new string) string { return strings.Replace(s, old, new, -1) },
+	}).Parse(tmpl)
+}
+
+// machineByHardwareAddr returns the machine that has hardwareAddr,
+// if there is one.
+func machineByHardwareAddr(machines *Store, hardwareAddr string) *Machine {
+	for _, i := range machines.Items() {
+		m := AsMachine(i)
+		for _, hw := range m.HardwareAddrs {
+			if sameHardwareAddr(hw, hardwareAddr) {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+// AutoMachine links lease to the Machine with hardwareAddr, if the
+// lease is in a subnet with AutoMachines set.  If there is no such
+// machine yet, it is created with the subnet's AutoMachineName and
+// AutoMachineProfiles, lease's address, and hardwareAddr.  hostname
+// is the host name the client sent, if any.  It returns the machine,
+// or nil if the subnet does not create machines.
+//
+// This function should be called for DHCPDISCOVER, once a lease has
+// been found or created for the client.
+func AutoMachine(dt *DataTracker, lease *Lease, hardwareAddr, hostname string) (*Machine, error) {
+	subnet := FindSubnet(dt, []net.IP{lease.Addr})
+	if subnet == nil || !subnet.AutoMachines {
+		return nil, nil
+	}
+	d, unlocker := dt.LockEnts("bootenvs", "machines", "tasks", "profiles", "templates", "params", "leases")
+	defer unlocker()
+	machine := machineByHardwareAddr(d("machines"), hardwareAddr)
+	if machine == nil {
+		tmpl, err := autoMachineNameTemplate(subnet.AutoMachineName)
+		if err != nil {
+			return nil, err
+		}
+		buf := &bytes.Buffer{}
+		if err := tmpl.Execute(buf, &AutoMachineName{
+			HardwareAddr: hardwareAddr,
+			Addr:         lease.Addr.String(),
+			Hostname:     hostname,
+			Subnet:       subnet.Name,
+			DnsZone:      subnet.DnsZone,
+		}); err != nil {
+			return nil, err
+		}
+		machine = dt.NewMachine()
+		machine.Name = strings.TrimSpace(buf.String())
+		machine.Uuid = uuid.NewRandom()
+		machine.Description = fmt.Sprintf("Created when %s first asked for an address in subnet %s", hardwareAddr, subnet.Name)
+		machine.Address = lease.Addr
+		machine.HardwareAddrs = []string{hardwareAddr}
+		machine.Profiles = append([]string{}, subnet.AutoMachineProfiles...)
+		if _, err := dt.Create(d, machine, nil); err != nil {
+			return nil, err
+		}
+		dt.Infof("debugDhcp", "Created machine %s for %s in subnet %s", machine.Name, hardwareAddr, subnet.Name)
+	}
+	if found := d("leases").Find(lease.Key()); found != nil {
+		l := AsLease(found)
+		if !uuid.Equal(l.Machine, machine.Uuid) {
+			l.Machine = machine.Uuid
+			if _, err := dt.Save(d, l, nil); err != nil {
+				return machine, err
+			}
+		}
+		lease.Machine = l.Machine
+	}
+	return machine, nil
+}
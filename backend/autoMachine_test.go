@@ -0,0 +1,65 @@
+package backend
+
+import (
+	"net"
+	"testing"
+
+	"github.com/pborman/uuid"
+)
+
+func TestAutoMachine(t *testing.T) {
+	dt := mkDT(nil)
+	via := []net.IP{net.ParseIP("192.168.124.1")}
+	func() {
+		d, unlocker := dt.LockEnts("templates", "bootenvs", "machines", "profiles", "tasks", "params", "subnets")
+		defer unlocker()
+		tests := []crudTest{
+			{"Create Template", dt.Create, &Template{p: dt, ID: "default"}, true, nil},
+			{"Create Bootenv", dt.Create, &BootEnv{p: dt, Name: "default", Templates: []TemplateInfo{{Name: "ipxe", Path: "{{ .Env.Name }}", ID: "default"}}}, true, nil},
+			{"Create Profile", dt.Create, &Profile{p: dt, Name: "discovered"}, true, nil},
+			{"Create Subnet with bad AutoMachineName", dt.Create, &Subnet{p: dt, Enabled: true, Name: "bad", Subnet: "192.168.125.0/24", ActiveStart: net.ParseIP("192.168.125.80"), ActiveEnd: net.ParseIP("192.168.125.254"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "MAC", AutoMachines: true, AutoMachineName: "{{.Fred"}, false, nil},
+			{"Create Subnet", dt.Create, &Subnet{p: dt, Enabled: true, Name: "sn", Subnet: "192.168.124.0/24", ActiveStart: net.ParseIP("192.168.124.80"), ActiveEnd: net.ParseIP("192.168.124.254"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "MAC",
+				DnsZone:             "example.com",
+				AutoMachines:        true,
+				AutoMachineName:     `{{if .Hostname}}{{.Hostname}}{{else}}d{{replace .HardwareAddr ":" "-"}}{{end}}.{{.DnsZone}}`,
+				AutoMachineProfiles: []string{"discovered"},
+			}, true, nil},
+		}
+		for _, test := range tests {
+			test.Test(t, d)
+		}
+	}()
+	discover := func(mac, hostname string) (*Lease, *Machine) {
+		lease, _, _ := FindOrCreateLease(dt, "MAC", mac, nil, via)
+		if lease == nil {
+			t.Fatalf("Expected a lease for %s", mac)
+		}
+		m, err := AutoMachine(dt, lease, mac, hostname)
+		if err != nil {
+			t.Fatalf("Failed to create a machine for %s: %v", mac, err)
+		}
+		return lease, m
+	}
+	lease, m := discover("00:11:22:33:44:55", "")
+	if m == nil || m.Name != "d00-11-22-33-44-55.example.com" || !m.Address.Equal(lease.Addr) ||
+		len(m.HardwareAddrs) != 1 || m.HardwareAddrs[0] != "00:11:22:33:44:55" ||
+		len(m.Profiles) != 1 || m.Profiles[0] != "discovered" {
+		t.Fatalf("Unexpected machine for 00:11:22:33:44:55: %+v", m)
+	}
+	_, m2 := discover("00:11:22:33:44:55", "fred")
+	if m2 == nil || !uuid.Equal(m2.Uuid, m.Uuid) {
+		t.Errorf("Expected the machine to be reused, got %+v", m2)
+	}
+	_, m3 := discover("00:11:22:33:44:56", "sw1")
+	if m3 == nil || m3.Name != "sw1.example.com" {
+		t.Errorf("Expected a machine named after the client, got %+v", m3)
+	}
+	d, unlocker := dt.LockEnts("machines", "leases")
+	defer unlocker()
+	if n := len(d("machines").Items()); n != 2 {
+		t.Errorf("Expected 2 machines, got %d", n)
+	}
+	if l := AsLease(d("leases").Find(lease.Key())); !uuid.Equal(l.Machine, m.Uuid) {
+		t.Errorf("Expected the lease to be linked to %s, got %s", m.Uuid, l.Machine)
+	}
+}
@@ -0,0 +1,260 @@
+package backend
+
+import (
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/digitalrebar/store"
+	"github.com/pborman/uuid"
+)
+
+// bootProgressLength is how many milestones are kept for each
+// machine or lease.  Once there are more, the oldest are dropped.
+const bootProgressLength = 100
+
+// BootMilestone records a client fetching one of the files it boots
+// from over TFTP or HTTP.  Together, the milestones of a machine show
+// how far it has got booting.
+//
+// swagger:model
+type BootMilestone struct {
+	// Milestone is the step of booting the file is for.  For
+	// rendered files, it is the Name of the template in the boot
+	// environment the file was rendered from, e.g. pxelinux, ipxe,
+	// or kickstart.  For static files, it is "kernel" or "initrd".
+	//
+	// required: true
+	Milestone string
+	// Path is the path of the file that was fetched.
+	//
+	// required: true
+	Path string
+	// Protocol is how the file was fetched, either "tftp" or
+	// "http".
+	//
+	// required: true
+	Protocol string
+	// BootEnv is the boot environment the file belongs to.
+	BootEnv string
+	// Machine is the machine the client was matched to, if any.
+	//
+	// swagger:strfmt uuid
+	Machine uuid.UUID
+	// Address is the address the client fetched the file from.
+	//
+	// swagger:strfmt ipv4
+	Address net.IP
+	// Time is when the file was fetched.
+	//
+	// required: true
+	// swagger:strfmt date-time
+	Time time.Time
+}
+
+// bootFile describes a rendered file for boot progress tracking.
+type bootFile struct {
+	milestone string
+	bootEnv   string
+	// machine is the key of the machine the file was rendered
+	// for, if it was rendered for one.
+	machine string
+}
+
+// staticFile is what a static file is to the boot environment it
+// belongs to.
+type staticFile struct {
+	bootEnv   string
+	milestone string
+}
+
+// bootProgress remembers the boot milestones of machines, keyed by
+// machine key, and of clients we could only match to a lease, keyed
+// by Hexaddr.  Milestones are only kept in memory, and are lost when
+// dr-provision restarts.
+//
+// statics holds the kernels and initrds of every boot environment,
+// keyed by path, so that fetches of any other static file can be
+// skipped without looking at the stores.
+type bootProgress struct {
+	sync.Mutex
+	machines map[string][]*BootMilestone
+	leases   map[string][]*BootMilestone
+	statics  map[string][]staticFile
+}
+
+func newBootProgress() *bootProgress {
+	return &bootProgress{
+		machines: map[string][]*BootMilestone{},
+		leases:   map[string][]*BootMilestone{},
+		statics:  map[string][]staticFile{},
+	}
+}
+
+// setStatics replaces the kernel and initrd paths recorded for the
+// boot environment name with those of env.  A nil env just removes
+// them.
+func (bp *bootProgress) setStatics(name string, env *BootEnv) {
+	bp.Lock()
+	defer bp.Unlock()
+	for file, sfs := range bp.statics {
+		kept := sfs[:0]
+		for _, sf := range sfs {
+			if sf.bootEnv != name {
+				kept = append(kept, sf)
+			}
+		}
+		if len(kept) == 0 {
+			delete(bp.statics, file)
+		} else {
+			bp.statics[file] = kept
+		}
+	}
+	if env == nil {
+		return
+	}
+	add := func(file, milestone string) {
+		sfs := append(bp.statics[file], staticFile{bootEnv: name, milestone: milestone})
+		sort.Slice(sfs, func(i, j int) bool { return sfs[i].bootEnv < sfs[j].bootEnv })
+		bp.statics[file] = sfs
+	}
+	if env.Kernel != "" {
+		add(env.pathFor(env.Kernel), "kernel")
+	}
+	for _, initrd := range env.Initrds {
+		add(env.pathFor(initrd), "initrd")
+	}
+}
+
+// staticsFor returns the boot environments file is the kernel or an
+// initrd of, if any.
+func (bp *bootProgress) staticsFor(file string) []staticFile {
+	bp.Lock()
+	defer bp.Unlock()
+	return append([]staticFile(nil), bp.statics[strings.TrimPrefix(path.Clean(file), "/")]...)
+}
+
+func appendMilestones(timeline []*BootMilestone, ms ...*BootMilestone) []*BootMilestone {
+	timeline = append(timeline, ms...)
+	if len(timeline) > bootProgressLength {
+		timeline = timeline[len(timeline)-bootProgressLength:]
+	}
+	return timeline
+}
+
+// staticMilestone picks the boot environment and milestone for a
+// static file out of sfs, preferring the boot environment of
+// machine, if any.
+func staticMilestone(sfs []staticFile, machine *Machine) (string, string) {
+	if machine != nil {
+		for _, sf := range sfs {
+			if sf.bootEnv == machine.BootEnv {
+				return sf.bootEnv, sf.milestone
+			}
+		}
+	}
+	return sfs[0].bootEnv, sfs[0].milestone
+}
+
+// noteBootFetch records a client at remoteIP fetching file over
+// proto.  boot describes the file if it was rendered, and is nil for
+// static files, which are only recorded if they are a kernel or an
+// initrd.  The client is matched to the machine the file was rendered
+// for, or the machine or lease with remoteIP.  Fetches that cannot be
+// matched to either are not recorded.
+func (p *DataTracker) noteBootFetch(file, proto string, remoteIP net.IP, boot *bootFile) {
+	var statics []staticFile
+	if boot == nil {
+		if statics = p.bootProgress.staticsFor(file); len(statics) == 0 {
+			return
+		}
+	}
+	d, unlocker := p.LockEnts("machines", "leases")
+	defer unlocker()
+	ms := &BootMilestone{Path: file, Protocol: proto, Address: remoteIP, Time: time.Now()}
+	var machine *Machine
+	if boot != nil && boot.machine != "" {
+		if m := d("machines").Find(boot.machine); m != nil {
+			machine = AsMachine(m)
+		}
+	}
+	if machine == nil && remoteIP != nil {
+		machine = machineByAddress(d("machines"), remoteIP)
+	}
+	if boot != nil {
+		ms.BootEnv, ms.Milestone = boot.bootEnv, boot.milestone
+	} else {
+		ms.BootEnv, ms.Milestone = staticMilestone(statics, machine)
+	}
+	bp := p.bootProgress
+	bp.Lock()
+	defer bp.Unlock()
+	if machine != nil {
+		ms.Machine = machine.Uuid
+		key := machine.Key()
+		timeline := bp.machines[key]
+		// Anything the machine fetched before we knew about it
+		// was recorded against its lease.
+		if remoteIP != nil {
+			if early, ok := bp.leases[Hexaddr(remoteIP)]; ok {
+				for _, e := range early {
+					e.Machine = machine.Uuid
+				}
+				timeline = appendMilestones(timeline, early...)
+				delete(bp.leases, Hexaddr(remoteIP))
+			}
+		}
+		bp.machines[key] = appendMilestones(timeline, ms)
+		p.publishers.Publish("machines", "bootprogress", key, ms)
+		return
+	}
+	if remoteIP == nil || d("leases").Find(Hexaddr(remoteIP)) == nil {
+		return
+	}
+	key := Hexaddr(remoteIP)
+	bp.leases[key] = appendMilestones(bp.leases[key], ms)
+}
+
+// forgetBootProgress drops the boot milestones of ref, if it is a
+// Machine or a Lease.
+func (p *DataTracker) forgetBootProgress(ref store.KeySaver) {
+	bp := p.bootProgress
+	bp.Lock()
+	defer bp.Unlock()
+	switch ref.(type) {
+	case *Machine:
+		delete(bp.machines, ref.Key())
+	case *Lease:
+		delete(bp.leases, ref.Key())
+	}
+}
+
+// MachineBootProgress returns the boot milestones of the machine with
+// key, oldest first.
+func (p *DataTracker) MachineBootProgress(key string) []*BootMilestone {
+	bp := p.bootProgress
+	bp.Lock()
+	defer bp.Unlock()
+	return copyMilestones(bp.machines[key])
+}
+
+// LeaseBootProgress returns the boot milestones of the client holding
+// addr that have not been matched to a machine yet, oldest first.
+func (p *DataTracker) LeaseBootProgress(addr net.IP) []*BootMilestone {
+	bp := p.bootProgress
+	bp.Lock()
+	defer bp.Unlock()
+	return copyMilestones(bp.leases[Hexaddr(addr)])
+}
+
+func copyMilestones(timeline []*BootMilestone) []*BootMilestone {
+	res := make([]*BootMilestone, len(timeline))
+	for i, ms := range timeline {
+		c := *ms
+		res[i] = &c
+	}
+	return res
+}
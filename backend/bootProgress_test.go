@@ -0,0 +1,119 @@
+package backend
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+func TestBootProgress(t *testing.T) {
+	dt := mkDT(nil)
+	rec := &eventRecorder{}
+	dt.publishers.Add(rec)
+	osDir := path.Join(tmpDir, "bootprog")
+	if err := os.MkdirAll(osDir, 0755); err != nil {
+		t.Fatalf("Failed to make %s: %v", osDir, err)
+	}
+	for _, f := range []string{"vmlinuz", "initrd.img", "other"} {
+		if err := ioutil.WriteFile(path.Join(osDir, f), []byte(f), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", f, err)
+		}
+	}
+	m1 := &Machine{p: dt, Name: "m1", Uuid: uuid.NewRandom(), BootEnv: "bootprog", Address: net.ParseIP("192.168.124.20")}
+	m2 := &Machine{p: dt, Name: "m2", Uuid: uuid.NewRandom(), BootEnv: "bootprog", Address: net.ParseIP("192.168.124.30")}
+	func() {
+		d, unlocker := dt.LockEnts("templates", "bootenvs", "machines", "profiles", "tasks", "params", "leases", "subnets", "reservations")
+		defer unlocker()
+		tests := []crudTest{
+			{"Create Bootenv", dt.Create, &BootEnv{p: dt, Name: "bootprog", OS: OsInfo{Name: "bootprog"}, Kernel: "vmlinuz", Initrds: []string{"initrd.img"},
+				Templates: []TemplateInfo{{Name: "ipxe", Path: "{{ .Machine.Path }}/boot.ipxe", Contents: "#!ipxe"}}}, true, nil},
+			{"Create Machine", dt.Create, m1, true, nil},
+			{"Create Subnet", dt.Create, &Subnet{p: dt, Enabled: true, Name: "sn", Subnet: "192.168.124.0/24", ActiveStart: net.ParseIP("192.168.124.80"), ActiveEnd: net.ParseIP("192.168.124.254"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "MAC"}, true, nil},
+			{"Create Lease", dt.Create, &Lease{p: dt, Addr: net.ParseIP("192.168.124.30"), Strategy: "MAC", Token: "00:11:22:33:44:55", ExpireTime: time.Now().Add(time.Hour)}, true, nil},
+		}
+		for _, test := range tests {
+			test.Test(t, d)
+		}
+	}()
+	fetch := func(remote, p string) {
+		req := httptest.NewRequest("GET", p, nil)
+		req.RemoteAddr = remote + ":4321"
+		res := httptest.NewRecorder()
+		dt.FS.ServeHTTP(res, req)
+		if res.Code != 200 {
+			t.Errorf("Failed to fetch %s: %d", p, res.Code)
+		}
+	}
+	fetch("192.168.124.30", "/bootprog/vmlinuz")
+	fetch("192.168.124.99", "/bootprog/vmlinuz")
+	fetch("192.168.124.20", "/"+path.Join(m1.Path(), "boot.ipxe"))
+	if src, err := dt.FS.TftpResponder()("bootprog/initrd.img", net.ParseIP("192.168.124.20")); err != nil {
+		t.Errorf("Failed to fetch initrd over TFTP: %v", err)
+	} else {
+		src.(io.Closer).Close()
+	}
+	fetch("192.168.124.20", "/bootprog/other")
+
+	early := dt.LeaseBootProgress(net.ParseIP("192.168.124.30"))
+	if len(early) != 1 || early[0].Milestone != "kernel" || early[0].BootEnv != "bootprog" || early[0].Machine != nil {
+		t.Errorf("Expected the lease to have fetched the kernel, got %+v", early)
+	}
+	timeline := dt.MachineBootProgress(m1.Key())
+	if len(timeline) != 2 ||
+		timeline[0].Milestone != "ipxe" || timeline[0].Protocol != "http" ||
+		timeline[1].Milestone != "initrd" || timeline[1].Protocol != "tftp" ||
+		!uuid.Equal(timeline[1].Machine, m1.Uuid) {
+		t.Errorf("Unexpected boot progress for m1: %+v", timeline)
+	}
+
+	func() {
+		d, unlocker := dt.LockEnts("templates", "bootenvs", "machines", "profiles", "tasks", "params")
+		defer unlocker()
+		(&crudTest{"Create Machine at the lease address", dt.Create, m2, true, nil}).Test(t, d)
+	}()
+	fetch("192.168.124.30", "/bootprog/initrd.img")
+	if timeline = dt.MachineBootProgress(m2.Key()); len(timeline) != 2 ||
+		timeline[0].Milestone != "kernel" || !uuid.Equal(timeline[0].Machine, m2.Uuid) ||
+		timeline[1].Milestone != "initrd" {
+		t.Errorf("Expected m2 to take over the milestones of its lease, got %+v", timeline)
+	}
+	if early = dt.LeaseBootProgress(net.ParseIP("192.168.124.30")); len(early) != 0 {
+		t.Errorf("Expected the lease milestones to have moved to m2, got %+v", early)
+	}
+	func() {
+		d, unlocker := dt.LockEnts("templates", "bootenvs", "machines", "profiles", "tasks", "params")
+		defer unlocker()
+		(&crudTest{"Change the Kernel", dt.Update, &BootEnv{p: dt, Name: "bootprog", OS: OsInfo{Name: "bootprog"}, Kernel: "other", Initrds: []string{"initrd.img"},
+			Templates: []TemplateInfo{{Name: "ipxe", Path: "{{ .Machine.Path }}/boot.ipxe", Contents: "#!ipxe"}}}, true, nil}).Test(t, d)
+	}()
+	fetch("192.168.124.30", "/bootprog/vmlinuz")
+	fetch("192.168.124.30", "/bootprog/other")
+	if timeline = dt.MachineBootProgress(m2.Key()); len(timeline) != 3 || timeline[2].Milestone != "kernel" || timeline[2].Path != "/bootprog/other" {
+		t.Errorf("Expected only the new kernel to be recorded for m2, got %+v", timeline)
+	}
+	events := 0
+	for _, e := range rec.events {
+		if e.Type == "machines" && e.Action == "bootprogress" {
+			events++
+		}
+	}
+	if events != 4 {
+		t.Errorf("Expected 4 machines.bootprogress events, got %d", events)
+	}
+
+	func() {
+		d, unlocker := dt.LockEnts("bootenvs", "machines", "tasks", "profiles", "params")
+		defer unlocker()
+		(&crudTest{"Remove Machine", dt.Remove, m1, true, nil}).Test(t, d)
+	}()
+	if timeline = dt.MachineBootProgress(m1.Key()); len(timeline) != 0 {
+		t.Errorf("Expected the boot progress of a removed machine to be forgotten, got %+v", timeline)
+	}
+}
@@ -84,6 +84,14 @@ type BootEnv struct {
 	//
 	// required: true
 	BootParams string
+	// HttpBootFile is a template that will be expanded to the path
+	// (relative to the root of the static file server) of the EFI
+	// binary that UEFI HTTP Boot clients using this boot environment
+	// should load, e.g. ipxe.efi, or
+	// {{.Env.PathFor "tftp" "EFI/BOOT/BOOTX64.EFI"}} for one from the
+	// install archive.  The DHCP server hands it out as a full URL.
+	// If it expands to a full URL, that URL is handed out as is.
+	HttpBootFile string
 	// The list of extra required parameters for this
 	// bootstate. They should be present as Machine.Params when
 	// the bootenv is applied to the machine.
@@ -107,6 +115,7 @@ type BootEnv struct {
 	// The list of initial machine tasks that the boot environment should get
 	Tasks          []string
 	bootParamsTmpl *template.Template
+	httpBootTmpl   *template.Template
 	p              *DataTracker
 	rootTemplate   *template.Template
 	tmplMux        sync.Mutex
@@ -233,6 +242,14 @@ func (b *BootEnv) genRoot(commonRoot *template.Template, e *Error) *template.Tem
 			b.bootParamsTmpl = tmpl.Option("missingkey=error")
 		}
 	}
+	if b.HttpBootFile != "" {
+		tmpl, err := template.New("httpBoot").Parse(b.HttpBootFile)
+		if err != nil {
+			e.Errorf("Error compiling HTTP boot file template: %v", err)
+		} else {
+			b.httpBootTmpl = tmpl.Option("missingkey=error")
+		}
+	}
 	if e.containsError {
 		return nil
 	}
@@ -449,6 +466,7 @@ func (b *BootEnv) BeforeDelete() error {
 }
 
 func (b *BootEnv) AfterDelete() {
+	b.p.bootProgress.setStatics(b.Name, nil)
 	if b.OnlyUnknown {
 		err := &Error{o: b}
 		rts := b.Render(b.stores, nil, err)
@@ -494,6 +512,7 @@ func (b *BootEnv) Render(d Stores, m *Machine, e *Error) renderers {
 }
 
 func (b *BootEnv) AfterSave() {
+	b.p.bootProgress.setStatics(b.Name, b)
 	if b.OnlyUnknown {
 		err := &Error{o: b}
 		rts := b.Render(b.stores, nil, err)
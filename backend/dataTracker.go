@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"text/template"
 
@@ -94,6 +95,7 @@ type DataTracker struct {
 	LogRoot             string
 	OurAddress          string
 	StaticPort, ApiPort int
+	StaticHttpsPort     int
 	Logger              *log.Logger
 	FS                  *FileSystem
 	Backend             store.Store
@@ -110,6 +112,13 @@ type DataTracker struct {
 	thunks              []func()
 	thunkMux            *sync.Mutex
 	publishers          *Publishers
+	addressOwner        AddressOwner
+	dhcpTransactions    *dhcpTransactionLog
+	subnetUsage         *subnetUsage
+	dhcpLimiter         *dhcpLimiter
+	leaseHistory        *leaseHistory
+	dhcpShadow          *dhcpShadow
+	bootProgress        *bootProgress
 }
 
 type Stores func(string) *Store
@@ -202,6 +211,21 @@ func (p *DataTracker) FileURL(remoteIP net.IP) string {
 	return p.urlFor("http", remoteIP, p.StaticPort)
 }
 
+// HttpBootURL returns the URL UEFI HTTP Boot clients should load
+// file from the static file server at local with.  It is an HTTPS
+// URL if the static file server serves HTTPS.
+func (p *DataTracker) HttpBootURL(local net.IP, file string) string {
+	host := p.OurAddress
+	if local.IsGlobalUnicast() || local.IsLoopback() {
+		host = local.String()
+	}
+	scheme, port := "http", p.StaticPort
+	if p.StaticHttpsPort != 0 {
+		scheme, port = "https", p.StaticHttpsPort
+	}
+	return fmt.Sprintf("%s://%s/%s", scheme, net.JoinHostPort(host, strconv.Itoa(port)), strings.TrimLeft(file, "/"))
+}
+
 func (p *DataTracker) ApiURL(remoteIP net.IP) string {
 	return p.urlFor("https", remoteIP, p.ApiPort)
 }
@@ -316,7 +340,15 @@ func NewDataTracker(backend store.Store,
 		thunks:            make([]func(), 0),
 		thunkMux:          &sync.Mutex{},
 		publishers:        publishers,
+		dhcpTransactions:  newDhcpTransactionLog(),
+		subnetUsage:       &subnetUsage{last: map[string]float64{}},
+		dhcpLimiter:       newDhcpLimiter(),
+		leaseHistory:      newLeaseHistory(),
+		dhcpShadow:        newDhcpShadow(),
+		bootProgress:      newBootProgress(),
 	}
+	res.FS.fetched = res.noteBootFetch
+	res.FS.transfers.limits = res.transferLimits
 
 	// Make sure incoming writable backend has all stores created
 	objs := allKeySavers(res)
@@ -359,6 +391,10 @@ func NewDataTracker(backend store.Store,
 		res.Create(d, user, nil)
 	}
 	res.defaultBootEnv = defaultPrefs["defaultBootEnv"]
+	for _, obj := range d("bootenvs").Items() {
+		env := AsBootEnv(obj)
+		res.bootProgress.setStatics(env.Name, env)
+	}
 	machines := d("machines")
 	for _, obj := range machines.Items() {
 		machine := AsMachine(obj)
@@ -446,8 +482,24 @@ func (p *DataTracker) SetPrefs(d Stores, prefs map[string]string) error {
 			if benvCheck(name, val) != nil && savePref(name, val) {
 				err.Merge(p.RenderUnknown(d))
 			}
+		case "subnetUsageThresholds":
+			if _, e := ParseUsageThresholds(val); e != nil {
+				err.Errorf("Preference %s: %s", name, e.Error())
+			} else {
+				savePref(name, val)
+			}
 		case "unknownTokenTimeout",
 			"knownTokenTimeout",
+			"leaseSweepInterval",
+			"leaseReapGrace",
+			"leaseHistoryLength",
+			"leaseHistoryRetention",
+			"dhcpClientRateLimit",
+			"dhcpRelayRateLimit",
+			"fileTransferLimit",
+			"fileTransferClientLimit",
+			"fileTransferBandwidth",
+			"fileTransferQueueTimeout",
 			"debugDhcp",
 			"debugRenderer",
 			"debugBootEnv":
@@ -597,6 +649,7 @@ func (p *DataTracker) Create(d Stores, ref store.KeySaver, ov ObjectValidator) (
 	if saved {
 		ref.(validator).clearStores()
 		d(prefix).Add(ref)
+		p.noteLeaseSaved(ref)
 
 		p.publishers.Publish(prefix, "create", key, ref)
 	}
@@ -626,6 +679,8 @@ func (p *DataTracker) Remove(d Stores, ref store.KeySaver, ov ObjectValidator) (
 	removed, err = store.Remove(item)
 	if removed {
 		d(prefix).Remove(item)
+		p.noteLeaseRemoved(item)
+		p.forgetBootProgress(item)
 		p.publishers.Publish(prefix, "delete", key, item)
 	}
 	return removed, err
@@ -677,6 +732,7 @@ func (p *DataTracker) Patch(d Stores, ref store.KeySaver, key string, patch json
 		return toSave, err
 	}
 	d(prefix).Add(toSave)
+	p.noteLeaseSaved(toSave)
 	p.publishers.Publish(prefix, "update", key, toSave)
 	return toSave, nil
 }
@@ -706,6 +762,7 @@ func (p *DataTracker) Update(d Stores, ref store.KeySaver, ov ObjectValidator) (
 	ref.(validator).clearStores()
 	if saved {
 		d(prefix).Add(ref)
+		p.noteLeaseSaved(ref)
 		p.publishers.Publish(prefix, "update", key, ref)
 	}
 	return saved, err
@@ -730,6 +787,7 @@ func (p *DataTracker) Save(d Stores, ref store.KeySaver, ov ObjectValidator) (sa
 	ref.(validator).clearStores()
 	if saved {
 		d(ref.Prefix()).Add(ref)
+		p.noteLeaseSaved(ref)
 		p.publishers.Publish(ref.Prefix(), "save", ref.Key(), ref)
 	}
 	return saved, err
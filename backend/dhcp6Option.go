@@ -0,0 +1,216 @@
+package backend
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DHCPv6 option codes from RFC 8415 and friends that dr-provision
+// either consumes from clients or knows how to hand out.
+const (
+	Option6ClientID      uint16 = 1
+	Option6ServerID      uint16 = 2
+	Option6IANA          uint16 = 3
+	Option6IAAddr        uint16 = 5
+	Option6ORO           uint16 = 6
+	Option6Preference    uint16 = 7
+	Option6ElapsedTime   uint16 = 8
+	Option6RelayMsg      uint16 = 9
+	Option6StatusCode    uint16 = 13
+	Option6RapidCommit   uint16 = 14
+	Option6UserClass     uint16 = 15
+	Option6VendorClass   uint16 = 16
+	Option6InterfaceID   uint16 = 18
+	Option6DNSServers    uint16 = 23
+	Option6DomainList    uint16 = 24
+	Option6SNTPServers   uint16 = 31
+	Option6BootFileURL   uint16 = 59
+	Option6BootFileParam uint16 = 60
+	Option6ClientArch    uint16 = 61
+)
+
+// knownOption6 returns whether ConvertOptionValueToByte6 can
+// encode options with this code.
+func knownOption6(code uint16) bool {
+	switch code {
+	case Option6Preference,
+		Option6DNSServers,
+		Option6SNTPServers,
+		Option6DomainList,
+		Option6BootFileURL,
+		Option6BootFileParam:
+		return true
+	}
+	return false
+}
+
+func validateOptions6(e *Error, opts []DhcpOption) {
+	for _, opt := range opts {
+		if !knownOption6(uint16(opt.Code)) {
+			e.Errorf("DHCPv6 option %d is not supported", opt.Code)
+		}
+		if len(opt.SubOptions) > 0 {
+			e.Errorf("DHCPv6 option %d cannot have SubOptions", opt.Code)
+		}
+	}
+}
+
+// ConvertByteToOptionValue6 converts the raw value of a DHCPv6
+// option into the string form used when expanding DhcpOption
+// templates.  Options we do not know how to decode are rendered as
+// hex strings.
+func ConvertByteToOptionValue6(code uint16, b []byte) string {
+	switch code {
+	// Multiple IPv6 addresses
+	case Option6DNSServers, Option6SNTPServers:
+		addrs := []string{}
+		for len(b) >= 16 {
+			addrs = append(addrs, net.IP(b[:16]).String())
+			b = b[16:]
+		}
+		return strings.Join(addrs, ",")
+
+	// Lists of 2 byte integers
+	case Option6ORO, Option6ClientArch:
+		vals := []string{}
+		for len(b) >= 2 {
+			vals = append(vals, fmt.Sprint(binary.BigEndian.Uint16(b)))
+			b = b[2:]
+		}
+		return strings.Join(vals, ",")
+
+	// 2 byte integer value
+	case Option6ElapsedTime:
+		if len(b) < 2 {
+			return ""
+		}
+		return fmt.Sprint(binary.BigEndian.Uint16(b))
+
+	// 1 byte integer value
+	case Option6Preference:
+		if len(b) < 1 {
+			return ""
+		}
+		return fmt.Sprint(b[0])
+
+	// String like value
+	case Option6BootFileURL:
+		return string(b)
+
+	// Lists of strings, each with a 2 byte length
+	case Option6UserClass, Option6BootFileParam:
+		return strings.Join(splitOpaque6(b), ",")
+
+	// Enterprise number followed by a list of strings
+	case Option6VendorClass:
+		if len(b) < 4 {
+			return ""
+		}
+		return strings.Join(splitOpaque6(b[4:]), ",")
+
+	case Option6DomainList:
+		return strings.Join(decodeDomainList(b), ",")
+	}
+	return hex.EncodeToString(b)
+}
+
+// ConvertOptionValueToByte6 converts the expanded string value of a
+// DhcpOption on an IPv6 subnet or reservation into the DHCPv6 wire
+// format for that option code.
+func ConvertOptionValueToByte6(code uint16, value string) ([]byte, error) {
+	switch code {
+	// Multiple IPv6 addresses
+	case Option6DNSServers, Option6SNTPServers:
+		res := []byte{}
+		for _, a := range strings.Split(value, ",") {
+			addr := net.ParseIP(strings.TrimSpace(a))
+			if addr == nil || addr.To4() != nil {
+				return nil, fmt.Errorf("Invalid IPv6 address %s for option %d", a, code)
+			}
+			res = append(res, addr.To16()...)
+		}
+		return res, nil
+
+	// 1 byte integer value
+	case Option6Preference:
+		ival, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+		return []byte{byte(ival)}, nil
+
+	// String like value
+	case Option6BootFileURL:
+		return []byte(value), nil
+
+	// Whitespace separated parameters, each with a 2 byte length
+	case Option6BootFileParam:
+		res := []byte{}
+		for _, param := range strings.Fields(value) {
+			l := make([]byte, 2)
+			binary.BigEndian.PutUint16(l, uint16(len(param)))
+			res = append(res, l...)
+			res = append(res, []byte(param)...)
+		}
+		return res, nil
+
+	// Comma separated domain names in DNS wire format
+	case Option6DomainList:
+		res := []byte{}
+		for _, domain := range strings.Split(value, ",") {
+			domain = strings.Trim(strings.TrimSpace(domain), ".")
+			if domain == "" {
+				continue
+			}
+			for _, label := range strings.Split(domain, ".") {
+				if len(label) == 0 || len(label) > 63 {
+					return nil, fmt.Errorf("Invalid domain name %s", domain)
+				}
+				res = append(res, byte(len(label)))
+				res = append(res, []byte(label)...)
+			}
+			res = append(res, 0)
+		}
+		return res, nil
+	}
+	return nil, errors.New("Invalid DHCPv6 Option: " + strconv.Itoa(int(code)) + " " + value)
+}
+
+func splitOpaque6(b []byte) []string {
+	res := []string{}
+	for len(b) >= 2 {
+		l := int(binary.BigEndian.Uint16(b))
+		b = b[2:]
+		if l > len(b) {
+			break
+		}
+		res = append(res, string(b[:l]))
+		b = b[l:]
+	}
+	return res
+}
+
+func decodeDomainList(b []byte) []string {
+	res := []string{}
+	labels := []string{}
+	for len(b) > 0 {
+		l := int(b[0])
+		b = b[1:]
+		if l == 0 {
+			res = append(res, strings.Join(labels, "."))
+			labels = []string{}
+			continue
+		}
+		if l > len(b) {
+			break
+		}
+		labels = append(labels, string(b[:l]))
+		b = b[l:]
+	}
+	return res
+}
@@ -0,0 +1,640 @@
+package backend
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// DhcpImportFormats are the formats that ImportDhcp understands.
+var DhcpImportFormats = []string{"dhcpd.conf", "dhcpd.leases", "dnsmasq"}
+
+// DhcpImport is the configuration or lease database of another DHCP
+// server to turn into Reservations and Leases.
+//
+// swagger:model
+type DhcpImport struct {
+	// Format is the format of Data.  It must be one of:
+	//
+	// dhcpd.conf: host declarations from an ISC dhcpd.conf.  They
+	// become Reservations.
+	//
+	// dhcpd.leases: an ISC dhcpd.leases file.  The active leases in
+	// it become Leases.
+	//
+	// dnsmasq: dhcp-host lines from a dnsmasq.conf, or the contents
+	// of a dhcp-hostsfile.  They become Reservations.
+	//
+	// required: true
+	Format string
+	// Data is the contents of the file to import.
+	//
+	// required: true
+	Data string
+}
+
+// DhcpImportResult is what ImportDhcp did, or would do if it were
+// not a dry run.
+//
+// swagger:model
+type DhcpImportResult struct {
+	// DryRun is true if nothing was actually created.
+	//
+	// required: true
+	DryRun bool
+	// Reservations are the Reservations that were (or would be)
+	// created.
+	Reservations []*Reservation
+	// Leases are the Leases that were (or would be) created.
+	Leases []*Lease
+	// Existing lists the imported objects that already exist
+	// exactly as imported, and so were left alone.
+	Existing []string
+	// Conflicts lists the imported objects that clash with
+	// existing objects or with each other.  An import with
+	// conflicts does not create anything.
+	Conflicts []string
+	// Warnings lists the parts of Data that could not be imported.
+	Warnings []string
+}
+
+func (r *DhcpImportResult) warnf(line int, f string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf("line %d: ", line)+fmt.Sprintf(f, args...))
+}
+
+func (r *DhcpImportResult) conflictf(f string, args ...interface{}) {
+	r.Conflicts = append(r.Conflicts, fmt.Sprintf(f, args...))
+}
+
+// iscOptionCodes maps the ISC dhcpd names of the options that can be
+// imported to their codes.
+var iscOptionCodes = map[string]dhcp.OptionCode{
+	"subnet-mask":          dhcp.OptionSubnetMask,
+	"time-offset":          dhcp.OptionTimeOffset,
+	"routers":              dhcp.OptionRouter,
+	"time-servers":         dhcp.OptionTimeServer,
+	"domain-name-servers":  dhcp.OptionDomainNameServer,
+	"log-servers":          dhcp.OptionLogServer,
+	"host-name":            dhcp.OptionHostName,
+	"domain-name":          dhcp.OptionDomainName,
+	"root-path":            dhcp.OptionRootPath,
+	"interface-mtu":        dhcp.OptionInterfaceMTU,
+	"broadcast-address":    dhcp.OptionBroadcastAddress,
+	"static-routes":        dhcp.OptionStaticRoute,
+	"nis-domain":           dhcp.OptionNetworkInformationServiceDomain,
+	"nis-servers":          dhcp.OptionNetworkInformationServers,
+	"ntp-servers":          dhcp.OptionNetworkTimeProtocolServers,
+	"netbios-name-servers": dhcp.OptionNetBIOSOverTCPIPNameServer,
+	"dhcp-lease-time":      dhcp.OptionIPAddressLeaseTime,
+	"dhcp-renewal-time":    dhcp.OptionRenewalTimeValue,
+	"dhcp-rebinding-time":  dhcp.OptionRebindingTimeValue,
+	"tftp-server-name":     dhcp.OptionTFTPServerName,
+	"bootfile-name":        dhcp.OptionBootFileName,
+}
+
+// parseImportMAC parses a hardware address the way ISC dhcpd and
+// dnsmasq write them, which allows leading zeros to be left off, and
+// returns it the way the MAC strategy sees it.
+func parseImportMAC(s string) (string, error) {
+	parts := strings.FieldsFunc(s, func(r rune) bool { return r == ':' || r == '-' })
+	for i := range parts {
+		if len(parts[i]) == 1 {
+			parts[i] = "0" + parts[i]
+		}
+	}
+	mac, err := net.ParseMAC(strings.Join(parts, ":"))
+	if err != nil {
+		return "", fmt.Errorf("%s is not a hardware address", s)
+	}
+	return mac.String(), nil
+}
+
+type iscToken struct {
+	val  string
+	line int
+}
+
+// iscTokens splits an ISC dhcpd file into tokens.  Comments are
+// dropped, quoted strings keep their quotes, and braces, semicolons
+// and commas are tokens of their own.
+func iscTokens(data string) []iscToken {
+	res := []iscToken{}
+	line := 1
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+		case c == '{' || c == '}' || c == ';' || c == ',':
+			res = append(res, iscToken{string(c), line})
+			i++
+		case c == '"':
+			j := i + 1
+			start := line
+			for j < len(data) && data[j] != '"' {
+				if data[j] == '\\' {
+					j++
+				}
+				if j < len(data) && data[j] == '\n' {
+					line++
+				}
+				j++
+			}
+			if j < len(data) {
+				j++
+			}
+			res = append(res, iscToken{data[i:j], start})
+			i = j
+		default:
+			j := i
+			for j < len(data) && !strings.ContainsRune(" \t\r\n#{};,\"", rune(data[j])) {
+				j++
+			}
+			res = append(res, iscToken{data[i:j], line})
+			i = j
+		}
+	}
+	return res
+}
+
+// iscStmt is a statement in an ISC dhcpd file.  Statements that end
+// in a block rather than a semicolon have a non-nil block.
+type iscStmt struct {
+	words []string
+	block []*iscStmt
+	line  int
+}
+
+// args returns the words of the statement after the first n, with
+// quotes and commas removed.
+func (s *iscStmt) args(n int) []string {
+	res := []string{}
+	if n > len(s.words) {
+		return res
+	}
+	for _, w := range s.words[n:] {
+		if w == "," {
+			continue
+		}
+		res = append(res, strings.Trim(w, `"`))
+	}
+	return res
+}
+
+func parseISC(toks []iscToken, nested bool) ([]*iscStmt, []iscToken, error) {
+	res := []*iscStmt{}
+	var cur *iscStmt
+	for len(toks) > 0 {
+		t := toks[0]
+		toks = toks[1:]
+		switch t.val {
+		case ";":
+			if cur != nil {
+				res = append(res, cur)
+				cur = nil
+			}
+		case "{":
+			if cur == nil {
+				cur = &iscStmt{line: t.line}
+			}
+			block, rest, err := parseISC(toks, true)
+			if err != nil {
+				return nil, nil, err
+			}
+			cur.block = block
+			res = append(res, cur)
+			cur = nil
+			toks = rest
+		case "}":
+			if !nested {
+				return nil, nil, fmt.Errorf("line %d: unexpected }", t.line)
+			}
+			if cur != nil {
+				return nil, nil, fmt.Errorf("line %d: missing ;", cur.line)
+			}
+			return res, toks, nil
+		default:
+			if cur == nil {
+				cur = &iscStmt{line: t.line}
+			}
+			cur.words = append(cur.words, t.val)
+		}
+	}
+	if nested {
+		return nil, nil, fmt.Errorf("missing }")
+	}
+	if cur != nil {
+		return nil, nil, fmt.Errorf("line %d: missing ;", cur.line)
+	}
+	return res, nil, nil
+}
+
+// importDhcpdHost turns a host declaration into a Reservation.
+func importDhcpdHost(host *iscStmt, res *DhcpImportResult) {
+	name := strings.Join(host.args(1), " ")
+	r := &Reservation{Strategy: "MAC"}
+	for _, s := range host.block {
+		if len(s.words) == 0 {
+			continue
+		}
+		args := s.args(1)
+		switch s.words[0] {
+		case "hardware":
+			if len(args) != 2 || args[0] != "ethernet" {
+				res.warnf(s.line, "host %s: only ethernet hardware addresses can be imported", name)
+				continue
+			}
+			mac, err := parseImportMAC(args[1])
+			if err != nil {
+				res.warnf(s.line, "host %s: %v", name, err)
+				continue
+			}
+			r.Token = mac
+		case "fixed-address":
+			if len(args) == 0 {
+				continue
+			}
+			if len(args) > 1 {
+				res.warnf(s.line, "host %s: only the first fixed-address is imported", name)
+			}
+			r.Addr = net.ParseIP(args[0]).To4()
+			if r.Addr == nil {
+				res.warnf(s.line, "host %s: fixed-address %s is not an IPv4 address", name, args[0])
+			}
+		case "next-server":
+			if len(args) == 0 {
+				continue
+			}
+			r.NextServer = net.ParseIP(args[0]).To4()
+			if r.NextServer == nil {
+				res.warnf(s.line, "host %s: next-server %s is not an IPv4 address", name, args[0])
+			}
+		case "filename":
+			if len(args) > 0 {
+				r.Options = append(r.Options, DhcpOption{Code: dhcp.OptionBootFileName, Value: args[0]})
+			}
+		case "option":
+			if len(args) == 0 {
+				continue
+			}
+			code, ok := iscOptionCodes[args[0]]
+			if !ok {
+				res.warnf(s.line, "host %s: option %s cannot be imported", name, args[0])
+				continue
+			}
+			r.Options = append(r.Options, DhcpOption{Code: code, Value: strings.Join(args[1:], ",")})
+		default:
+			res.warnf(s.line, "host %s: %s cannot be imported", name, s.words[0])
+		}
+	}
+	if r.Token == "" {
+		res.warnf(host.line, "host %s has no hardware ethernet address, skipped", name)
+		return
+	}
+	if r.Addr == nil {
+		res.warnf(host.line, "host %s has no fixed-address, skipped", name)
+		return
+	}
+	res.Reservations = append(res.Reservations, r)
+}
+
+// importDhcpdConf imports the host declarations in stmts, including
+// the ones in groups, subnets, and shared networks.
+func importDhcpdConf(stmts []*iscStmt, res *DhcpImportResult) {
+	for _, s := range stmts {
+		if s.block == nil || len(s.words) == 0 {
+			continue
+		}
+		if s.words[0] == "host" {
+			importDhcpdHost(s, res)
+		} else {
+			importDhcpdConf(s.block, res)
+		}
+	}
+}
+
+// parseDhcpdTime parses the value of the ends statement of a lease.
+func parseDhcpdTime(args []string) (time.Time, error) {
+	switch {
+	case len(args) == 2 && args[0] == "epoch":
+		secs, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(secs, 0), nil
+	case len(args) == 3:
+		return time.Parse("2006/01/02 15:04:05", args[1]+" "+args[2])
+	}
+	return time.Time{}, fmt.Errorf("%s is not a time", strings.Join(args, " "))
+}
+
+// importDhcpdLeases imports the leases in stmts that are active.
+// dhcpd appends to its lease file as leases change, so later
+// entries for an address replace earlier ones.
+func importDhcpdLeases(stmts []*iscStmt, res *DhcpImportResult) {
+	leases := map[string]*Lease{}
+	for _, s := range stmts {
+		if s.block == nil || len(s.words) != 2 || s.words[0] != "lease" {
+			continue
+		}
+		addr := net.ParseIP(s.words[1]).To4()
+		if addr == nil {
+			res.warnf(s.line, "lease %s is not for an IPv4 address", s.words[1])
+			continue
+		}
+		l := &Lease{Addr: addr, Strategy: "MAC"}
+		active := true
+		for _, f := range s.block {
+			if len(f.words) == 0 {
+				continue
+			}
+			args := f.args(1)
+			switch f.words[0] {
+			case "ends":
+				if len(args) == 1 && args[0] == "never" {
+					res.warnf(f.line, "lease %s never ends, use a reservation instead", addr)
+					active = false
+					continue
+				}
+				t, err := parseDhcpdTime(args)
+				if err != nil {
+					res.warnf(f.line, "lease %s: %v", addr, err)
+					active = false
+					continue
+				}
+				l.ExpireTime = t
+			case "binding":
+				if len(args) == 2 && args[0] == "state" && args[1] != "active" {
+					active = false
+				}
+			case "hardware":
+				if len(args) != 2 || args[0] != "ethernet" {
+					continue
+				}
+				mac, err := parseImportMAC(args[1])
+				if err != nil {
+					res.warnf(f.line, "lease %s: %v", addr, err)
+					continue
+				}
+				l.Token = mac
+			}
+		}
+		if !active || l.Token == "" || l.ExpireTime.Before(time.Now()) {
+			delete(leases, l.Key())
+			continue
+		}
+		leases[l.Key()] = l
+	}
+	keys := make([]string, 0, len(leases))
+	for k := range leases {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		res.Leases = append(res.Leases, leases[k])
+	}
+}
+
+// isDnsmasqLeaseTime returns whether f is a lease time, which is a
+// number of seconds optionally followed by a unit.
+func isDnsmasqLeaseTime(f string) bool {
+	rest := strings.TrimLeft(f, "0123456789")
+	return len(rest) < len(f) && (rest == "" || (len(rest) == 1 && strings.Contains("smhdw", rest)))
+}
+
+// importDnsmasq imports dhcp-host lines from a dnsmasq.conf, or the
+// lines of a dhcp-hostsfile, which are the same without the leading
+// dhcp-host=.
+func importDnsmasq(data string, res *DhcpImportResult) {
+	for n, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if parts := strings.SplitN(line, "=", 2); len(parts) == 2 {
+			if strings.TrimSpace(parts[0]) != "dhcp-host" {
+				continue
+			}
+			line = parts[1]
+		}
+		r := &Reservation{Strategy: "MAC"}
+		name := ""
+		ignore := false
+		for _, f := range strings.Split(line, ",") {
+			f = strings.TrimSpace(f)
+			switch {
+			case f == "" || f == "infinite":
+			case f == "ignore":
+				ignore = true
+			case strings.HasPrefix(f, "id:"):
+				res.warnf(n+1, "client identifiers cannot be imported, use the ClientID strategy instead")
+			case strings.HasPrefix(f, "set:") || strings.HasPrefix(f, "tag:") || strings.HasPrefix(f, "net:"):
+			case strings.HasPrefix(f, "["):
+				res.warnf(n+1, "IPv6 address %s cannot be imported", f)
+			case net.ParseIP(f) != nil:
+				if r.Addr = net.ParseIP(f).To4(); r.Addr == nil {
+					res.warnf(n+1, "IPv6 address %s cannot be imported", f)
+				}
+			case strings.Contains(f, ":"):
+				mac, err := parseImportMAC(f)
+				if err != nil {
+					res.warnf(n+1, "%v", err)
+				} else if r.Token != "" {
+					res.warnf(n+1, "only the first hardware address is imported")
+				} else {
+					r.Token = mac
+				}
+			case isDnsmasqLeaseTime(f):
+			default:
+				name = f
+			}
+		}
+		switch {
+		case ignore:
+		case r.Token == "":
+			res.warnf(n+1, "no hardware address, skipped")
+		case r.Addr == nil:
+			res.warnf(n+1, "no IPv4 address, skipped")
+		default:
+			if name != "" {
+				r.Options = append(r.Options, DhcpOption{Code: dhcp.OptionHostName, Value: name})
+			}
+			res.Reservations = append(res.Reservations, r)
+		}
+	}
+}
+
+// ParseDhcpImport turns imp into the Reservations and Leases it
+// describes, without looking at what already exists.
+func ParseDhcpImport(imp *DhcpImport) (*DhcpImportResult, error) {
+	e := &Error{Code: 422, Type: ValidationError, Model: "dhcp"}
+	res := &DhcpImportResult{
+		Reservations: []*Reservation{},
+		Leases:       []*Lease{},
+		Existing:     []string{},
+		Conflicts:    []string{},
+		Warnings:     []string{},
+	}
+	switch imp.Format {
+	case "dhcpd.conf", "dhcpd.leases":
+		stmts, _, err := parseISC(iscTokens(imp.Data), false)
+		if err != nil {
+			e.Errorf("%s: %v", imp.Format, err)
+			return nil, e
+		}
+		if imp.Format == "dhcpd.conf" {
+			importDhcpdConf(stmts, res)
+		} else {
+			importDhcpdLeases(stmts, res)
+		}
+	case "dnsmasq":
+		importDnsmasq(imp.Data, res)
+	default:
+		e.Errorf("Format must be one of %s", strings.Join(DhcpImportFormats, ", "))
+		return nil, e
+	}
+	return res, nil
+}
+
+// importConflicts drops the objects in res that already exist, and
+// records the ones that conflict with existing objects or with each
+// other.
+func importConflicts(d Stores, res *DhcpImportResult) {
+	tokens := map[string]string{}
+	for _, i := range d("reservations").Items() {
+		r := AsReservation(i)
+		tokens[r.Strategy+":"+r.Token] = r.Key()
+	}
+	seenAddrs := map[string]bool{}
+	seenTokens := map[string]bool{}
+	reservations := []*Reservation{}
+	for _, r := range res.Reservations {
+		tok := r.Strategy + ":" + r.Token
+		if seenAddrs[r.Key()] || seenTokens[tok] {
+			res.conflictf("Reservation %s for %s %s is imported more than once", r.Addr, r.Strategy, r.Token)
+			continue
+		}
+		seenAddrs[r.Key()] = true
+		seenTokens[tok] = true
+		if i := d("reservations").Find(r.Key()); i != nil {
+			old := AsReservation(i)
+			if old.Strategy == r.Strategy && old.Token == r.Token {
+				res.Existing = append(res.Existing, fmt.Sprintf("Reservation %s", r.Addr))
+			} else {
+				res.conflictf("Reservation %s already exists for %s %s", r.Addr, old.Strategy, old.Token)
+			}
+			continue
+		}
+		if key, ok := tokens[tok]; ok {
+			res.conflictf("%s %s already has Reservation %s, not %s", r.Strategy, r.Token, key, r.Addr)
+			continue
+		}
+		if i := d("leases").Find(r.Key()); i != nil {
+			if l := AsLease(i); !l.Expired() && (l.Strategy != r.Strategy || l.Token != r.Token) {
+				res.conflictf("Reservation %s is leased to %s %s", r.Addr, l.Strategy, l.Token)
+				continue
+			}
+		}
+		reservations = append(reservations, r)
+	}
+	res.Reservations = reservations
+
+	for _, i := range d("leases").Items() {
+		l := AsLease(i)
+		tokens[l.Strategy+":"+l.Token] = l.Key()
+	}
+	leases := []*Lease{}
+	for _, l := range res.Leases {
+		tok := l.Strategy + ":" + l.Token
+		if seenTokens[tok] {
+			res.conflictf("Lease %s for %s %s is imported more than once", l.Addr, l.Strategy, l.Token)
+			continue
+		}
+		seenTokens[tok] = true
+		if i := d("leases").Find(l.Key()); i != nil {
+			old := AsLease(i)
+			if old.Strategy == l.Strategy && old.Token == l.Token {
+				res.Existing = append(res.Existing, fmt.Sprintf("Lease %s", l.Addr))
+				continue
+			}
+			if !old.Expired() {
+				res.conflictf("Lease %s already exists for %s %s", l.Addr, old.Strategy, old.Token)
+				continue
+			}
+		}
+		if key, ok := tokens[tok]; ok && key != l.Key() {
+			res.conflictf("%s %s already has Lease or Reservation %s, not %s", l.Strategy, l.Token, key, l.Addr)
+			continue
+		}
+		if i := d("reservations").Find(l.Key()); i != nil {
+			if r := AsReservation(i); r.Strategy != l.Strategy || r.Token != l.Token {
+				res.conflictf("Lease %s is reserved for %s %s", l.Addr, r.Strategy, r.Token)
+			} else {
+				leases = append(leases, l)
+			}
+			continue
+		}
+		if s := l.Subnet(d); s == nil || !s.InSubnetRange(l.Addr) {
+			res.conflictf("Lease %s is not in the range of any subnet", l.Addr)
+			continue
+		}
+		leases = append(leases, l)
+	}
+	res.Leases = leases
+}
+
+// ImportDhcp creates the Reservations and Leases described by imp.
+// If dryRun is true, or if any of them conflict with what already
+// exists, nothing is created, and the result says what would have
+// been.
+func (p *DataTracker) ImportDhcp(imp *DhcpImport, dryRun bool) (*DhcpImportResult, error) {
+	res, err := ParseDhcpImport(imp)
+	if err != nil {
+		return nil, err
+	}
+	res.DryRun = dryRun
+	d, unlocker := p.LockEnts("subnets", "reservations", "leases")
+	defer unlocker()
+	importConflicts(d, res)
+	if dryRun {
+		return res, nil
+	}
+	if len(res.Conflicts) > 0 {
+		e := &Error{Code: 409, Type: ConflictError, Model: "dhcp"}
+		for _, c := range res.Conflicts {
+			e.Errorf("%s", c)
+		}
+		return res, e
+	}
+	e := &Error{Code: 422, Type: ValidationError, Model: "dhcp"}
+	for _, r := range res.Reservations {
+		if _, err := p.Create(d, r, nil); err != nil {
+			e.Merge(err)
+		}
+	}
+	for _, l := range res.Leases {
+		if old := d("leases").Find(l.Key()); old != nil {
+			if _, err := p.Remove(d, old, nil); err != nil {
+				e.Merge(err)
+				continue
+			}
+		}
+		if _, err := p.Create(d, l, nil); err != nil {
+			e.Merge(err)
+		}
+	}
+	p.checkAllSubnetUsage(d)
+	return res, e.OrNil()
+}
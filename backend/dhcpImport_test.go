@@ -0,0 +1,216 @@
+package backend
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+var testDhcpdConf = `
+# A comment
+option domain-name "example.com";
+subnet 10.2.1.0 netmask 255.255.255.0 {
+  range 10.2.1.100 10.2.1.200;
+  host alpha {
+    hardware ethernet 0:11:22:33:44:5a;
+    fixed-address 10.2.1.10;
+    option host-name "alpha";
+    option routers 10.2.1.1, 10.2.1.2;
+    filename "pxelinux.0";
+    next-server 10.2.1.5;
+    option foo-bar 12;
+  }
+}
+group {
+  host "beta" { hardware ethernet 00:11:22:33:44:5b; fixed-address 10.2.1.11; }
+  host gamma { fixed-address 10.2.1.12; }
+}
+`
+
+var testDhcpdLeases = `
+lease 10.2.1.100 {
+  starts 4 2017/09/14 12:00:00;
+  ends 4 2017/09/14 13:00:00;
+  binding state free;
+  hardware ethernet 00:11:22:33:44:60;
+}
+lease 10.2.1.101 {
+  ends epoch %d; # some time
+  binding state active;
+  hardware ethernet 00:11:22:33:44:61;
+  client-hostname "delta";
+}
+lease 10.2.1.102 {
+  ends 4 2017/09/14 13:00:00;
+  binding state active;
+  hardware ethernet 00:11:22:33:44:62;
+}
+lease 10.2.1.102 {
+  ends epoch %d;
+  binding state active;
+  hardware ethernet 00:11:22:33:44:62;
+}
+lease 10.2.1.103 {
+  ends epoch %d;
+  binding state active;
+  hardware ethernet 00:11:22:33:44:63;
+}
+lease 10.2.1.103 {
+  ends epoch %d;
+  binding state free;
+  hardware ethernet 00:11:22:33:44:63;
+}
+`
+
+var testDnsmasq = `
+# dnsmasq.conf
+domain=example.com
+dhcp-host=00:11:22:33:44:70,epsilon,10.2.1.20,12h
+dhcp-host=00:11:22:33:44:71,10.2.1.21,set:pxe,infinite
+dhcp-host=00:11:22:33:44:72,ignore
+dhcp-host=zeta,10.2.1.23
+00:11:22:33:44:74,id:01:02:03,10.2.1.24
+`
+
+func TestDhcpImportParse(t *testing.T) {
+	res, err := ParseDhcpImport(&DhcpImport{Format: "dhcpd.conf", Data: testDhcpdConf})
+	if err != nil {
+		t.Fatalf("Failed to parse dhcpd.conf: %v", err)
+	}
+	if len(res.Reservations) != 2 {
+		t.Fatalf("Expected 2 reservations from dhcpd.conf, got %d", len(res.Reservations))
+	}
+	alpha := res.Reservations[0]
+	if !alpha.Addr.Equal(net.ParseIP("10.2.1.10")) || alpha.Token != "00:11:22:33:44:5a" || alpha.Strategy != "MAC" {
+		t.Errorf("Unexpected reservation for alpha: %s %s %s", alpha.Addr, alpha.Strategy, alpha.Token)
+	}
+	if !alpha.NextServer.Equal(net.ParseIP("10.2.1.5")) {
+		t.Errorf("Expected next server 10.2.1.5 for alpha, got %s", alpha.NextServer)
+	}
+	expected := []DhcpOption{
+		{Code: dhcp.OptionHostName, Value: "alpha"},
+		{Code: dhcp.OptionRouter, Value: "10.2.1.1,10.2.1.2"},
+		{Code: dhcp.OptionBootFileName, Value: "pxelinux.0"},
+	}
+	if len(alpha.Options) != len(expected) {
+		t.Errorf("Expected options %v for alpha, got %v", expected, alpha.Options)
+	} else {
+		for i := range expected {
+			if !reflect.DeepEqual(alpha.Options[i], expected[i]) {
+				t.Errorf("Expected option %v for alpha, got %v", expected[i], alpha.Options[i])
+			}
+		}
+	}
+	if res.Reservations[1].Token != "00:11:22:33:44:5b" {
+		t.Errorf("Expected beta to be imported, got %s", res.Reservations[1].Token)
+	}
+	if len(res.Warnings) != 2 {
+		t.Errorf("Expected warnings for option foo-bar and host gamma, got %v", res.Warnings)
+	}
+
+	if _, err := ParseDhcpImport(&DhcpImport{Format: "dhcpd.conf", Data: "host alpha { fixed-address 10.2.1.10 }"}); err == nil {
+		t.Errorf("Expected a missing ; to be an error")
+	}
+	if _, err := ParseDhcpImport(&DhcpImport{Format: "dhcpd.conf", Data: "host alpha { fixed-address 10.2.1.10; "}); err == nil {
+		t.Errorf("Expected a missing } to be an error")
+	}
+	if _, err := ParseDhcpImport(&DhcpImport{Format: "fred", Data: ""}); err == nil {
+		t.Errorf("Expected an unknown format to be an error")
+	}
+
+	future := time.Now().Add(time.Hour).Unix()
+	res, err = ParseDhcpImport(&DhcpImport{Format: "dhcpd.leases", Data: fmt.Sprintf(testDhcpdLeases, future, future, future, future)})
+	if err != nil {
+		t.Fatalf("Failed to parse dhcpd.leases: %v", err)
+	}
+	if len(res.Leases) != 2 {
+		t.Fatalf("Expected 2 active leases, got %d", len(res.Leases))
+	}
+	for i, addr := range []string{"10.2.1.101", "10.2.1.102"} {
+		l := res.Leases[i]
+		if !l.Addr.Equal(net.ParseIP(addr)) || l.ExpireTime.Unix() != future {
+			t.Errorf("Expected lease %s expiring at %d, got %s expiring at %d", addr, future, l.Addr, l.ExpireTime.Unix())
+		}
+	}
+
+	res, err = ParseDhcpImport(&DhcpImport{Format: "dnsmasq", Data: testDnsmasq})
+	if err != nil {
+		t.Fatalf("Failed to parse dnsmasq: %v", err)
+	}
+	if len(res.Reservations) != 3 {
+		t.Fatalf("Expected 3 reservations from dnsmasq, got %d", len(res.Reservations))
+	}
+	r := res.Reservations[0]
+	if !r.Addr.Equal(net.ParseIP("10.2.1.20")) || r.Token != "00:11:22:33:44:70" || len(r.Options) != 1 || r.Options[0].Value != "epsilon" {
+		t.Errorf("Unexpected reservation for epsilon: %s %s %v", r.Addr, r.Token, r.Options)
+	}
+	if len(res.Reservations[1].Options) != 0 {
+		t.Errorf("Expected no options for 10.2.1.21, got %v", res.Reservations[1].Options)
+	}
+	if len(res.Warnings) != 2 {
+		t.Errorf("Expected warnings for zeta and the client identifier, got %v", res.Warnings)
+	}
+}
+
+func exists(dt *DataTracker, prefix, key string) bool {
+	d, unlocker := dt.LockEnts(prefix)
+	defer unlocker()
+	return d(prefix).Find(key) != nil
+}
+
+func TestDhcpImport(t *testing.T) {
+	dt := mkDT(nil)
+	func() {
+		d, unlocker := dt.LockEnts("subnets", "reservations", "leases", "preferences", "bootenvs")
+		defer unlocker()
+		startObjs := []crudTest{
+			{"Subnet", dt.Create, &Subnet{p: dt, Enabled: true, Name: "sn", Subnet: "10.2.1.0/24", ActiveStart: net.ParseIP("10.2.1.100"), ActiveEnd: net.ParseIP("10.2.1.200"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "MAC"}, true, nil},
+			{"Same Reservation", dt.Create, &Reservation{p: dt, Addr: net.ParseIP("10.2.1.20"), Strategy: "MAC", Token: "00:11:22:33:44:70"}, true, nil},
+			{"Other Reservation", dt.Create, &Reservation{p: dt, Addr: net.ParseIP("10.2.1.21"), Strategy: "MAC", Token: "00:11:22:33:44:99"}, true, nil},
+		}
+		for _, obj := range startObjs {
+			obj.Test(t, d)
+		}
+	}()
+	imp := &DhcpImport{Format: "dnsmasq", Data: testDnsmasq}
+	res, err := dt.ImportDhcp(imp, true)
+	if err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+	if !res.DryRun || len(res.Existing) != 1 || len(res.Conflicts) != 1 || len(res.Reservations) != 1 {
+		t.Errorf("Expected 1 existing, 1 conflicting, and 1 new reservation, got %v, %v, and %d", res.Existing, res.Conflicts, len(res.Reservations))
+	}
+	if _, err := dt.ImportDhcp(imp, false); err == nil {
+		t.Errorf("Expected an import with conflicts to fail")
+	} else if e, ok := err.(*Error); !ok || e.Code != 409 {
+		t.Errorf("Expected a conflict error, got %v", err)
+	}
+	if exists(dt, "reservations", Hexaddr(net.ParseIP("10.2.1.24"))) {
+		t.Errorf("An import with conflicts should not create anything")
+	}
+
+	imp.Data = "dhcp-host=00:11:22:33:44:74,10.2.1.24\n"
+	if _, err := dt.ImportDhcp(imp, false); err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if !exists(dt, "reservations", Hexaddr(net.ParseIP("10.2.1.24"))) {
+		t.Errorf("Expected reservation 10.2.1.24 to be created")
+	}
+
+	future := time.Now().Add(time.Hour).Unix()
+	imp = &DhcpImport{Format: "dhcpd.leases", Data: fmt.Sprintf(testDhcpdLeases, future, future, future, future)}
+	if _, err := dt.ImportDhcp(imp, false); err != nil {
+		t.Fatalf("Lease import failed: %v", err)
+	}
+	if !exists(dt, "leases", Hexaddr(net.ParseIP("10.2.1.101"))) {
+		t.Errorf("Expected lease 10.2.1.101 to be created")
+	}
+	res, err = dt.ImportDhcp(imp, true)
+	if err != nil || len(res.Existing) != 2 || len(res.Leases) != 0 {
+		t.Errorf("Expected the leases to already exist, got %v, %v", res, err)
+	}
+}
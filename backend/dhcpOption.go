@@ -3,6 +3,7 @@ package backend
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"html/template"
@@ -67,7 +68,6 @@ func ConvertByteToOptionValue(code dhcp.OptionCode, b []byte) string {
 		dhcp.OptionRootPath,
 		dhcp.OptionExtensionsPath,
 		dhcp.OptionNetworkInformationServiceDomain,
-		dhcp.OptionVendorSpecificInformation, // This is wrong, but ...
 		dhcp.OptionNetBIOSOverTCPIPScope,
 		dhcp.OptionNetworkInformationServicePlusDomain,
 		dhcp.OptionTFTPServerName,
@@ -80,6 +80,11 @@ func ConvertByteToOptionValue(code dhcp.OptionCode, b []byte) string {
 		dhcp.OptionTZDatabaseString:
 		return string(b[:len(b)])
 
+	// Vendor sub-options
+	case dhcp.OptionVendorSpecificInformation,
+		OptionVendorIdentifyingInformation:
+		return subOptionsToValue(code, b)
+
 	// 4 byte integer value
 	case dhcp.OptionTimeOffset,
 		dhcp.OptionPathMTUAgingTimeout,
@@ -115,6 +120,11 @@ func ConvertByteToOptionValue(code dhcp.OptionCode, b []byte) string {
 		dhcp.OptionDHCPMessageType:
 		return fmt.Sprint(b[0])
 
+	// Opaque sub-options, which are decoded with the relay
+	// template function.
+	case dhcp.OptionRelayAgentInformation:
+		return net.HardwareAddr(b).String()
+
 		// Empty
 	case dhcp.Pad, dhcp.End:
 		return ""
@@ -123,6 +133,55 @@ func ConvertByteToOptionValue(code dhcp.OptionCode, b []byte) string {
 	return ""
 }
 
+// Relay agent information (option 82) sub-options
+const (
+	// RelayCircuitID identifies the circuit the request came in on (RFC 3046)
+	RelayCircuitID byte = 1
+	// RelayRemoteID identifies the remote end of the circuit (RFC 3046)
+	RelayRemoteID byte = 2
+	// RelayLinkSelection is the subnet the client is on, when the
+	// relay cannot use giaddr for that (RFC 3527)
+	RelayLinkSelection byte = 5
+)
+
+// OptionSubnetSelection is the subnet selection option from RFC 3011,
+// which lets a client or relay ask for an address from a subnet
+// other than the one giaddr is on.
+const OptionSubnetSelection dhcp.OptionCode = 118
+
+// ParseRelayInfo splits the value of a relay agent information
+// option into its sub-options.
+func ParseRelayInfo(buf []byte) map[byte][]byte {
+	res := map[byte][]byte{}
+	for len(buf) >= 2 {
+		code, l := buf[0], int(buf[1])
+		buf = buf[2:]
+		if l > len(buf) {
+			break
+		}
+		res[code] = buf[:l]
+		buf = buf[l:]
+	}
+	return res
+}
+
+// relayFuncs returns the template functions that let option
+// templates get at the relay agent information sub-options in
+// srcOpts.  {{relay 1}} expands to the circuit-id, formatted the
+// same way as the tokens of the CircuitID strategy.
+func relayFuncs(srcOpts map[int]string) template.FuncMap {
+	raw, _ := hex.DecodeString(strings.Replace(srcOpts[int(dhcp.OptionRelayAgentInformation)], ":", "", -1))
+	info := ParseRelayInfo(raw)
+	return template.FuncMap{
+		"relay": func(code int) string {
+			if v, ok := info[byte(code)]; ok {
+				return net.HardwareAddr(v).String()
+			}
+			return ""
+		},
+	}
+}
+
 func ConvertOptionValueToByte(code dhcp.OptionCode, value string) ([]byte, error) {
 	switch code {
 	// Single IP-like address
@@ -177,7 +236,6 @@ func ConvertOptionValueToByte(code dhcp.OptionCode, value string) ([]byte, error
 		dhcp.OptionRootPath,
 		dhcp.OptionExtensionsPath,
 		dhcp.OptionNetworkInformationServiceDomain,
-		dhcp.OptionVendorSpecificInformation, // This is wrong, but ...
 		dhcp.OptionNetBIOSOverTCPIPScope,
 		dhcp.OptionNetworkInformationServicePlusDomain,
 		dhcp.OptionTFTPServerName,
@@ -190,6 +248,11 @@ func ConvertOptionValueToByte(code dhcp.OptionCode, value string) ([]byte, error
 		dhcp.OptionTZDatabaseString:
 		return []byte(value), nil
 
+	// Vendor sub-options
+	case dhcp.OptionVendorSpecificInformation,
+		OptionVendorIdentifyingInformation:
+		return valueToSubOptions(code, value)
+
 	// 4 byte integer value
 	case dhcp.OptionTimeOffset,
 		dhcp.OptionPathMTUAgingTimeout,
@@ -253,7 +316,8 @@ func ConvertOptionValueToByte(code dhcp.OptionCode, value string) ([]byte, error
 // DhcpOption is a representation of a specific DHCP option.
 // swagger:model
 type DhcpOption struct {
-	// Code is a DHCP Option Code.
+	// Code is a DHCP Option Code.  Options attached to IPv6 subnets
+	// and reservations use DHCPv6 option codes instead.
 	//
 	// required: true
 	Code dhcp.OptionCode
@@ -263,18 +327,54 @@ type DhcpOption struct {
 	//
 	// required: true
 	Value string
+	// SubOptions build the value of a vendor-specific information
+	// option (43) or vendor-identifying vendor-specific information
+	// option (125) out of sub-options, instead of Value.
+	SubOptions []DhcpSubOption `json:",omitempty"`
+}
+
+func (o *DhcpOption) render(srcOpts map[int]string, funcs template.FuncMap) (string, error) {
+	return renderOptionValue(o.Value, srcOpts, funcs)
+}
+
+func renderOptionValue(value string, srcOpts map[int]string, funcs template.FuncMap) (string, error) {
+	tmpl, err := template.New("dhcp_option").Funcs(funcs).Parse(value)
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, srcOpts); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
 }
 
 func (o *DhcpOption) RenderToDHCP(srcOpts map[int]string) (code dhcp.OptionCode, val []byte, err error) {
 	code = o.Code
-	tmpl, err := template.New("dhcp_option").Parse(o.Value)
+	if len(o.SubOptions) > 0 {
+		subs, err := renderSubOptions(o.SubOptions, srcOpts, relayFuncs(srcOpts))
+		if err != nil {
+			return code, nil, err
+		}
+		val, err = EncodeSubOptions(code, subs)
+		return code, val, err
+	}
+	str, err := o.render(srcOpts, relayFuncs(srcOpts))
 	if err != nil {
 		return code, nil, err
 	}
-	buf := &bytes.Buffer{}
-	if err := tmpl.Execute(buf, srcOpts); err != nil {
+	val, err = ConvertOptionValueToByte(code, str)
+	return code, val, err
+}
+
+// RenderToDHCP6 is RenderToDHCP for options attached to IPv6
+// subnets and reservations, where Code is a DHCPv6 option code.
+func (o *DhcpOption) RenderToDHCP6(srcOpts map[int]string) (code uint16, val []byte, err error) {
+	code = uint16(o.Code)
+	str, err := o.render(srcOpts, nil)
+	if err != nil {
 		return code, nil, err
 	}
-	val, err = ConvertOptionValueToByte(code, buf.String())
+	val, err = ConvertOptionValueToByte6(code, str)
 	return code, val, err
 }
@@ -0,0 +1,206 @@
+package backend
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// dhcpBucket is a token bucket for one DHCP client or relay.
+type dhcpBucket struct {
+	tokens    float64
+	last      time.Time
+	dropped   int64
+	throttled bool
+}
+
+// bucketSize is how many tokens a bucket for limit packets per
+// minute holds, which is a quarter of limit.  It is never less than
+// 2, so that a client can always follow a DHCPDISCOVER with a
+// DHCPREQUEST.
+func bucketSize(limit int) float64 {
+	if limit < 8 {
+		return 2
+	}
+	return float64(limit) / 4
+}
+
+// refill refills the bucket for the time since it was last used.
+// limit is in packets per minute.
+func (b *dhcpBucket) refill(now time.Time, limit int) {
+	size := bucketSize(limit)
+	b.tokens += now.Sub(b.last).Minutes() * float64(limit)
+	if b.tokens > size {
+		b.tokens = size
+	}
+	b.last = now
+}
+
+// dhcpLimiter rate limits DHCP packets per client hardware address
+// and per relay agent.
+type dhcpLimiter struct {
+	sync.Mutex
+	clients   map[string]*dhcpBucket
+	relays    map[string]*dhcpBucket
+	dropped   int64
+	lastPrune time.Time
+}
+
+func newDhcpLimiter() *dhcpLimiter {
+	return &dhcpLimiter{
+		clients: map[string]*dhcpBucket{},
+		relays:  map[string]*dhcpBucket{},
+	}
+}
+
+// prune forgets the buckets that have been idle long enough to
+// refill, so that clients that come and go do not use up memory.
+func (l *dhcpLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+	for _, buckets := range []map[string]*dhcpBucket{l.clients, l.relays} {
+		for k, b := range buckets {
+			if now.Sub(b.last) >= time.Minute {
+				delete(buckets, k)
+			}
+		}
+	}
+}
+
+// DhcpThrottle is sent as a dhcp.throttled event when packets from
+// a client or relay agent start being dropped.
+//
+// swagger:model
+type DhcpThrottle struct {
+	// HardwareAddr is the client hardware address of the packet
+	// that was dropped.
+	//
+	// required: true
+	HardwareAddr string
+	// Relay is the relay agent the packet came through, if any.
+	Relay net.IP
+	// Limit is the limit in packets per minute that was exceeded.
+	//
+	// required: true
+	Limit int
+	// ByRelay is true if the packet was dropped because the relay
+	// agent, rather than the client, exceeded Limit.
+	//
+	// required: true
+	ByRelay bool
+}
+
+// DhcpDrops counts the DHCP packets that were dropped because of the
+// dhcpClientRateLimit and dhcpRelayRateLimit preferences.
+//
+// swagger:model
+type DhcpDrops struct {
+	// Total is the number of packets dropped since dr-provision
+	// started.
+	//
+	// required: true
+	Total int64
+	// Clients is the number of packets dropped for each client
+	// hardware address that has been sending recently.
+	//
+	// required: true
+	Clients map[string]int64
+	// Relays is the number of packets dropped for each relay agent
+	// that has been sending recently.
+	//
+	// required: true
+	Relays map[string]int64
+}
+
+// AllowDhcp returns whether a DHCP packet from the client with
+// hardwareAddr, sent through relay (if it is not nil or unspecified),
+// should be handled.  Each client may send dhcpClientRateLimit
+// packets per minute, and each relay agent dhcpRelayRateLimit, in
+// bursts of up to a quarter of that.  A limit of 0 is no limit.
+// Tokens are only taken once the packet is within both limits, so a
+// packet dropped for one limit does not count against the other.
+func (p *DataTracker) AllowDhcp(hardwareAddr string, relay net.IP) bool {
+	clientLimit := p.intPref("dhcpClientRateLimit", 0)
+	relayLimit := p.intPref("dhcpRelayRateLimit", 0)
+	if relay != nil && relay.IsUnspecified() {
+		relay = nil
+	}
+	if clientLimit <= 0 && (relayLimit <= 0 || relay == nil) {
+		return true
+	}
+	now := time.Now()
+	l := p.dhcpLimiter
+	l.Lock()
+	defer l.Unlock()
+	l.prune(now)
+	bucket := func(buckets map[string]*dhcpBucket, key string, limit int) *dhcpBucket {
+		b, ok := buckets[key]
+		if !ok {
+			b = &dhcpBucket{tokens: bucketSize(limit), last: now}
+			buckets[key] = b
+		}
+		b.refill(now, limit)
+		return b
+	}
+	drop := func(b *dhcpBucket, key string, limit int, byRelay bool) bool {
+		l.dropped++
+		b.dropped++
+		if !b.throttled {
+			b.throttled = true
+			p.Infof("debugDhcp", "Throttling DHCP packets from %s via %s", hardwareAddr, relay)
+			p.publishers.Publish("dhcp", "throttled", key, &DhcpThrottle{
+				HardwareAddr: hardwareAddr,
+				Relay:        relay,
+				Limit:        limit,
+				ByRelay:      byRelay,
+			})
+		}
+		return false
+	}
+	var clientBucket, relayBucket *dhcpBucket
+	if clientLimit > 0 {
+		clientBucket = bucket(l.clients, hardwareAddr, clientLimit)
+		if clientBucket.tokens < 1 {
+			return drop(clientBucket, hardwareAddr, clientLimit, false)
+		}
+	}
+	if relayLimit > 0 && relay != nil {
+		relayBucket = bucket(l.relays, relay.String(), relayLimit)
+		if relayBucket.tokens < 1 {
+			return drop(relayBucket, relay.String(), relayLimit, true)
+		}
+	}
+	for _, b := range []*dhcpBucket{clientBucket, relayBucket} {
+		if b != nil {
+			b.tokens--
+			b.throttled = false
+		}
+	}
+	return true
+}
+
+// DhcpDrops returns how many DHCP packets have been dropped by rate
+// limiting.
+func (p *DataTracker) DhcpDrops() *DhcpDrops {
+	l := p.dhcpLimiter
+	l.Lock()
+	defer l.Unlock()
+	res := &DhcpDrops{
+		Total:   l.dropped,
+		Clients: map[string]int64{},
+		Relays:  map[string]int64{},
+	}
+	for k, b := range l.clients {
+		if b.dropped > 0 {
+			res.Clients[k] = b.dropped
+		}
+	}
+	for k, b := range l.relays {
+		if b.dropped > 0 {
+			res.Relays[k] = b.dropped
+		}
+	}
+	return res
+}
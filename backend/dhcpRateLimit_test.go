@@ -0,0 +1,90 @@
+package backend
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func (r *eventRecorder) throttled() []*DhcpThrottle {
+	res := []*DhcpThrottle{}
+	for _, e := range r.events {
+		if e.Type == "dhcp" && e.Action == "throttled" {
+			res = append(res, e.Object.(*DhcpThrottle))
+		}
+	}
+	return res
+}
+
+func TestDhcpBucket(t *testing.T) {
+	now := time.Now()
+	b := &dhcpBucket{tokens: 0, last: now}
+	b.refill(now.Add(8*time.Second), 8)
+	if b.tokens < 1 || b.tokens >= 2 {
+		t.Errorf("Expected 1 token after 8 seconds at 8 per minute, got %v", b.tokens)
+	}
+	b.refill(now.Add(time.Hour), 8)
+	if b.tokens != 2 {
+		t.Errorf("Expected an idle bucket to refill to no more than its size, got %v", b.tokens)
+	}
+	// Even the lowest limits allow a DHCPDISCOVER and a DHCPREQUEST.
+	if bucketSize(1) != 2 || bucketSize(100) != 25 {
+		t.Errorf("Unexpected bucket sizes %v and %v", bucketSize(1), bucketSize(100))
+	}
+}
+
+func TestDhcpRateLimit(t *testing.T) {
+	dt := mkDT(nil)
+	rec := &eventRecorder{}
+	dt.publishers.Add(rec)
+	relay := net.ParseIP("10.3.0.1")
+	if !dt.AllowDhcp("00:11:22:33:44:55", nil) {
+		t.Errorf("Expected packets to be allowed with no limits set")
+	}
+	func() {
+		d, unlocker := dt.LockEnts("preferences", "bootenvs")
+		defer unlocker()
+		if err := dt.SetPrefs(d, map[string]string{"dhcpClientRateLimit": "8", "dhcpRelayRateLimit": "12"}); err != nil {
+			t.Fatalf("Failed to set rate limits: %v", err)
+		}
+		if err := dt.SetPrefs(d, map[string]string{"dhcpRelayRateLimit": "fred"}); err == nil {
+			t.Errorf("Expected a non-integer rate limit to be refused")
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		if !dt.AllowDhcp("00:11:22:33:44:55", net.IPv4zero) {
+			t.Errorf("Expected packet %d from the client to be allowed", i)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if dt.AllowDhcp("00:11:22:33:44:55", net.IPv4zero) {
+			t.Errorf("Expected packet %d past the client limit to be dropped", i)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if !dt.AllowDhcp(fmt.Sprintf("00:11:22:33:44:6%d", i), relay) {
+			t.Errorf("Expected packet %d through the relay to be allowed", i)
+		}
+	}
+	if dt.AllowDhcp("00:11:22:33:44:63", relay) {
+		t.Errorf("Expected a packet past the relay limit to be dropped")
+	}
+	if b := dt.dhcpLimiter.clients["00:11:22:33:44:63"]; b == nil || b.tokens != bucketSize(8) {
+		t.Errorf("Expected a packet dropped by the relay limit to not count against the client")
+	}
+	events := rec.throttled()
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 throttled events, got %d", len(events))
+	}
+	if events[0].HardwareAddr != "00:11:22:33:44:55" || events[0].Relay != nil || events[0].Limit != 8 || events[0].ByRelay {
+		t.Errorf("Unexpected throttled event for the client: %+v", events[0])
+	}
+	if events[1].HardwareAddr != "00:11:22:33:44:63" || !events[1].Relay.Equal(relay) || events[1].Limit != 12 || !events[1].ByRelay {
+		t.Errorf("Unexpected throttled event for the relay: %+v", events[1])
+	}
+	drops := dt.DhcpDrops()
+	if drops.Total != 4 || drops.Clients["00:11:22:33:44:55"] != 3 || drops.Relays["10.3.0.1"] != 1 || len(drops.Clients) != 1 {
+		t.Errorf("Unexpected drop counts: %+v", drops)
+	}
+}
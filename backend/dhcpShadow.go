@@ -0,0 +1,339 @@
+package backend
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// dhcpShadowClientLimit is how many clients the shadow report
+// remembers.  Once there are more, the one we heard from least
+// recently is forgotten.
+const dhcpShadowClientLimit = 10000
+
+// DhcpShadowClient compares what the DHCP server would have done for
+// a client in shadow mode with the address the client actually got
+// from the DHCP server that is really answering it.
+//
+// swagger:model
+type DhcpShadowClient struct {
+	// HardwareAddr is the client hardware address.
+	//
+	// required: true
+	HardwareAddr string
+	// Strategy is the leasing strategy that matched the client,
+	// if any did.
+	Strategy string
+	// Token is the token for the client using Strategy.
+	Token string
+	// Subnet is the name of the subnet the client was handled in,
+	// if any.
+	Subnet string
+	// Decided is true once we have worked out what we would have
+	// done with a DHCPDISCOVER or DHCPREQUEST from the client.
+	//
+	// required: true
+	Decided bool
+	// Reply is the type of DHCP message we would have sent in
+	// reply to the last DHCPDISCOVER or DHCPREQUEST, or empty if we
+	// would not have answered.
+	Reply string
+	// Offered is the address we would have handed out in Reply, if
+	// any.
+	Offered net.IP
+	// Actual is the address the client was last seen requesting
+	// from another DHCP server or using, if it has been seen.
+	Actual net.IP
+	// Match is true if Offered and Actual are the same address.
+	//
+	// required: true
+	Match bool
+	// Time is when we last heard from the client.
+	//
+	// required: true
+	// swagger:strfmt date-time
+	Time time.Time
+}
+
+// DhcpShadowReport summarizes how the decisions the DHCP server made
+// in shadow mode compare with what clients actually got.
+//
+// swagger:model
+type DhcpShadowReport struct {
+	// Clients are the clients we have heard from in shadow mode,
+	// sorted by hardware address.
+	//
+	// required: true
+	Clients []*DhcpShadowClient
+	// Matched is the number of clients that got the address we
+	// would have handed out.
+	//
+	// required: true
+	Matched int
+	// Mismatched is the number of clients that got a different
+	// address than the one we would have handed out.
+	//
+	// required: true
+	Mismatched int
+	// NotOffered is the number of clients that got an address when
+	// we would not have handed them one.
+	//
+	// required: true
+	NotOffered int
+	// Unobserved is the number of clients we would have handed an
+	// address to that have not been seen with an address yet.
+	//
+	// required: true
+	Unobserved int
+}
+
+// dhcpShadow is what the DHCP server remembers in shadow mode.  The
+// leases it would have handed out are kept here, keyed by Hexaddr,
+// instead of in the leases store.
+type dhcpShadow struct {
+	sync.Mutex
+	leases  map[string]*Lease
+	clients map[string]*DhcpShadowClient
+}
+
+func newDhcpShadow() *dhcpShadow {
+	return &dhcpShadow{
+		leases:  map[string]*Lease{},
+		clients: map[string]*DhcpShadowClient{},
+	}
+}
+
+// expire forgets the shadow leases that have expired.
+func (sh *dhcpShadow) expire() {
+	for k, l := range sh.leases {
+		if l.Expired() {
+			delete(sh.leases, k)
+		}
+	}
+}
+
+// find returns the lease for key as the shadow server sees it: the
+// shadow lease if there is one, otherwise a copy of the real one.
+func (sh *dhcpShadow) find(leases *Store, key string) *Lease {
+	if l, ok := sh.leases[key]; ok {
+		return l
+	}
+	if found := leases.Find(key); found != nil {
+		l := *AsLease(found)
+		return &l
+	}
+	return nil
+}
+
+// hold records that strat:token would hold addr until expire, and
+// forgets any other address it would have held.
+func (sh *dhcpShadow) hold(addr net.IP, strat, token string, expire time.Time) *Lease {
+	for k, l := range sh.leases {
+		if l.Strategy == strat && l.Token == token && !l.Addr.Equal(addr) {
+			delete(sh.leases, k)
+		}
+	}
+	lease := &Lease{Addr: addr, Strategy: strat, Token: token, ExpireTime: expire}
+	sh.leases[lease.Key()] = lease
+	return lease
+}
+
+// ShadowLease works out the lease FindOrCreateLease would hand out
+// for the passed information, without creating or changing any
+// leases.  The lease is remembered as a shadow lease, so that later
+// shadow decisions take it into account the way the real ones would.
+//
+// This function should be called for DHCPDISCOVER in shadow mode.
+func ShadowLease(dt *DataTracker,
+	strat, token string,
+	req net.IP,
+	via []net.IP) (lease *Lease, subnet *Subnet, reservation *Reservation) {
+	d, unlocker := dt.LockEnts("subnets", "reservations", "leases")
+	defer unlocker()
+	sh := dt.dhcpShadow
+	sh.Lock()
+	defer sh.Unlock()
+	sh.expire()
+	var addr net.IP
+	if reservation = reservationFor(d("reservations"), strat, token, req); reservation != nil {
+		held := sh.find(d("leases"), reservation.Key())
+		if held == nil || held.Expired() || (held.Strategy == strat && held.Token == token) {
+			addr = reservation.Addr
+		} else {
+			reservation = nil
+		}
+	}
+	if addr == nil {
+		subnet = leasingSubnetFor(d("subnets"), strat, via)
+		if subnet == nil || !subnet.Enabled {
+			return nil, nil, nil
+		}
+		used := subnet.peekUsed(d)
+		for k, l := range sh.leases {
+			if subnet.InActiveRange(l.Addr) {
+				shadow := *l
+				used[k] = &shadow
+			}
+		}
+		reserved := false
+		for _, i := range used {
+			if r, ok := i.(*Reservation); ok && r.Strategy == strat && r.Token == token {
+				reserved = true
+			}
+		}
+		for _, i := range used {
+			if l, ok := i.(*Lease); ok && !reserved &&
+				l.Strategy == strat && l.Token == token &&
+				(req == nil || req.IsUnspecified() || l.Addr.Equal(req)) {
+				addr = l.Addr
+				break
+			}
+		}
+		if addr == nil {
+			if l, _ := subnet.peek(used, strat, token, req); l != nil {
+				addr = l.Addr
+			}
+		}
+		if addr == nil {
+			return nil, nil, nil
+		}
+	}
+	lease = sh.hold(addr, strat, token, time.Now().Add(time.Minute))
+	return
+}
+
+// ShadowFindLease works out what FindLease would do for the passed
+// information, without changing any leases.  If it would hand out a
+// lease, the lease is remembered as a shadow lease.
+//
+// This function should be called for DHCPREQUEST in shadow mode.
+func ShadowFindLease(dt *DataTracker,
+	strat, token string,
+	req net.IP) (lease *Lease, subnet *Subnet, reservation *Reservation, err error) {
+	d, unlocker := dt.LockEnts("subnets", "reservations", "leases")
+	defer unlocker()
+	sh := dt.dhcpShadow
+	sh.Lock()
+	defer sh.Unlock()
+	sh.expire()
+	hexreq := Hexaddr(req)
+	found := sh.find(d("leases"), hexreq)
+	if found == nil {
+		err = LeaseNAK(fmt.Errorf("No lease for %s exists", hexreq))
+		return
+	}
+	if found.Token != token || found.Strategy != strat {
+		if !found.Expired() {
+			err = LeaseNAK(fmt.Errorf("Lease for %s owned by %s:%s",
+				hexreq, found.Strategy, found.Token))
+			return
+		}
+		if s := found.Subnet(d); s != nil && !s.MayAllocate(found.Addr) {
+			err = LeaseNAK(fmt.Errorf("Lease for %s is not ours to hand out", hexreq))
+			return
+		}
+	}
+	subnet = found.Subnet(d)
+	reservation = found.Reservation(d)
+	if reservation != nil && (reservation.Strategy != found.Strategy || reservation.Token != found.Token) {
+		err = LeaseNAK(fmt.Errorf("Reservation %s (%s:%s conflicts with %s:%s",
+			reservation.Addr,
+			reservation.Strategy,
+			reservation.Token,
+			found.Strategy,
+			found.Token))
+		return nil, nil, nil, err
+	}
+	var expire time.Time
+	if subnet != nil {
+		if !subnet.Enabled {
+			return nil, nil, nil, nil
+		}
+		expire = time.Now().Add(subnet.LeaseTimeFor(found.Addr))
+	} else if reservation != nil {
+		expire = time.Now().Add(2 * time.Hour)
+	} else {
+		err = LeaseNAK(fmt.Errorf("Lease %s has no reservation or subnet, it is dead to us.", found.Addr))
+		return
+	}
+	lease = sh.hold(found.Addr, strat, token, expire)
+	return
+}
+
+// client returns what we know about the client with hardwareAddr,
+// making room for it if we have not heard from it before.
+func (sh *dhcpShadow) client(hardwareAddr string, now time.Time) *DhcpShadowClient {
+	c, ok := sh.clients[hardwareAddr]
+	if !ok {
+		if len(sh.clients) >= dhcpShadowClientLimit {
+			oldest := ""
+			for k, v := range sh.clients {
+				if oldest == "" || v.Time.Before(sh.clients[oldest].Time) {
+					oldest = k
+				}
+			}
+			delete(sh.clients, oldest)
+		}
+		c = &DhcpShadowClient{HardwareAddr: hardwareAddr}
+		sh.clients[hardwareAddr] = c
+	}
+	c.Time = now
+	return c
+}
+
+func (c *DhcpShadowClient) compare() {
+	c.Match = c.Offered != nil && c.Actual != nil && c.Offered.Equal(c.Actual)
+}
+
+// RecordShadowDecision records what the DHCP server would have done
+// with a DHCPDISCOVER or DHCPREQUEST in shadow mode, as described by
+// t.  offered is the address the reply would have handed out, if any.
+func (p *DataTracker) RecordShadowDecision(t *DhcpTransaction, offered net.IP) {
+	sh := p.dhcpShadow
+	sh.Lock()
+	defer sh.Unlock()
+	c := sh.client(t.HardwareAddr, t.Time)
+	c.Decided = true
+	c.Strategy, c.Token, c.Subnet = t.Strategy, t.Token, t.Subnet
+	c.Reply = t.Reply
+	c.Offered = offered
+	c.compare()
+}
+
+// RecordShadowActual records that the client with hardwareAddr was
+// seen requesting addr from another DHCP server, or using it.
+func (p *DataTracker) RecordShadowActual(hardwareAddr string, addr net.IP) {
+	sh := p.dhcpShadow
+	sh.Lock()
+	defer sh.Unlock()
+	c := sh.client(hardwareAddr, time.Now())
+	c.Actual = addr
+	c.compare()
+}
+
+// DhcpShadowReport compares the decisions the DHCP server made in
+// shadow mode with the addresses clients actually got.
+func (p *DataTracker) DhcpShadowReport() *DhcpShadowReport {
+	sh := p.dhcpShadow
+	sh.Lock()
+	defer sh.Unlock()
+	res := &DhcpShadowReport{Clients: make([]*DhcpShadowClient, 0, len(sh.clients))}
+	for _, c := range sh.clients {
+		client := *c
+		res.Clients = append(res.Clients, &client)
+		switch {
+		case c.Match:
+			res.Matched++
+		case c.Offered != nil && c.Actual != nil:
+			res.Mismatched++
+		case c.Offered == nil && c.Actual != nil && c.Decided:
+			res.NotOffered++
+		case c.Offered != nil:
+			res.Unobserved++
+		}
+	}
+	sort.Slice(res.Clients, func(i, j int) bool { return res.Clients[i].HardwareAddr < res.Clients[j].HardwareAddr })
+	return res
+}
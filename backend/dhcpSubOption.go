@@ -0,0 +1,318 @@
+package backend
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net"
+	"strconv"
+	"strings"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// OptionVendorIdentifyingInformation is the vendor-identifying
+// vendor-specific information option from RFC 3925, which carries
+// sub-options for one or more vendors identified by their IANA
+// enterprise numbers.
+const OptionVendorIdentifyingInformation dhcp.OptionCode = 125
+
+// DhcpSubOption is one sub-option of a vendor-specific information
+// option (43), or one vendor of a vendor-identifying vendor-specific
+// information option (125).
+//
+// swagger:model
+type DhcpSubOption struct {
+	// Code is the sub-option code.  For the vendors of option 125,
+	// it is the IANA enterprise number of the vendor.
+	//
+	// required: true
+	Code uint32
+	// Type says how Value is encoded.  It must be one of "ip",
+	// "ips" (a comma separated list of addresses), "string", "hex"
+	// (hex bytes, optionally separated by colons), "bool" ("true"
+	// or "false"), "uint8", "uint16", or "uint32".  The vendors of
+	// option 125 must be "enterprise", and have SubOptions instead
+	// of a Value.
+	//
+	// required: true
+	Type string
+	// Value is a text/template that will be expanded and then
+	// converted as Type says.
+	Value string
+	// SubOptions are the sub-options for an "enterprise" vendor.
+	SubOptions []DhcpSubOption `json:",omitempty"`
+}
+
+// hasSubOptions returns whether code is an option that can be built
+// out of sub-options.
+func hasSubOptions(code dhcp.OptionCode) bool {
+	return code == dhcp.OptionVendorSpecificInformation || code == OptionVendorIdentifyingInformation
+}
+
+func encodeSubOptionValue(typ, value string) ([]byte, error) {
+	switch typ {
+	case "ip":
+		addr := net.ParseIP(strings.TrimSpace(value)).To4()
+		if addr == nil {
+			return nil, fmt.Errorf("%q is not an IPv4 address", value)
+		}
+		return []byte(addr), nil
+	case "ips":
+		res := []byte{}
+		for _, a := range strings.Split(value, ",") {
+			addr := net.ParseIP(strings.TrimSpace(a)).To4()
+			if addr == nil {
+				return nil, fmt.Errorf("%q is not an IPv4 address", a)
+			}
+			res = append(res, addr...)
+		}
+		return res, nil
+	case "string":
+		return []byte(value), nil
+	case "hex":
+		res, err := hex.DecodeString(strings.Replace(strings.TrimSpace(value), ":", "", -1))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not hex: %v", value, err)
+		}
+		return res, nil
+	case "bool":
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		if b {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case "uint8", "uint16", "uint32":
+		size, _ := strconv.Atoi(typ[4:])
+		i, err := strconv.ParseUint(strings.TrimSpace(value), 0, size)
+		if err != nil {
+			return nil, err
+		}
+		res := make([]byte, 4)
+		binary.BigEndian.PutUint32(res, uint32(i))
+		return res[4-size/8:], nil
+	}
+	return nil, fmt.Errorf("unknown sub-option type %q", typ)
+}
+
+// encodeSubOptionList encodes sub-options as code, length, and value
+// triples, the way RFC 2132 says option 43 should be.
+func encodeSubOptionList(subs []DhcpSubOption) ([]byte, error) {
+	res := []byte{}
+	for _, sub := range subs {
+		if sub.Code < 1 || sub.Code > 254 {
+			return nil, fmt.Errorf("sub-option code %d is not between 1 and 254", sub.Code)
+		}
+		if len(sub.SubOptions) > 0 {
+			return nil, fmt.Errorf("sub-option %d cannot have sub-options", sub.Code)
+		}
+		val, err := encodeSubOptionValue(sub.Type, sub.Value)
+		if err != nil {
+			return nil, fmt.Errorf("sub-option %d: %v", sub.Code, err)
+		}
+		if len(val) > 255 {
+			return nil, fmt.Errorf("sub-option %d is longer than 255 bytes", sub.Code)
+		}
+		res = append(res, byte(sub.Code), byte(len(val)))
+		res = append(res, val...)
+	}
+	return res, nil
+}
+
+// EncodeSubOptions builds the value of option code (43 or 125) out of
+// subs.
+func EncodeSubOptions(code dhcp.OptionCode, subs []DhcpSubOption) ([]byte, error) {
+	var res []byte
+	switch code {
+	case dhcp.OptionVendorSpecificInformation:
+		var err error
+		if res, err = encodeSubOptionList(subs); err != nil {
+			return nil, err
+		}
+	case OptionVendorIdentifyingInformation:
+		res = []byte{}
+		for _, vendor := range subs {
+			if vendor.Type != "enterprise" {
+				return nil, fmt.Errorf("option 125 vendor %d must have Type enterprise", vendor.Code)
+			}
+			data, err := encodeSubOptionList(vendor.SubOptions)
+			if err != nil {
+				return nil, fmt.Errorf("enterprise %d: %v", vendor.Code, err)
+			}
+			if len(data) > 255 {
+				return nil, fmt.Errorf("enterprise %d has more than 255 bytes of sub-options", vendor.Code)
+			}
+			buf := make([]byte, 5)
+			binary.BigEndian.PutUint32(buf, vendor.Code)
+			buf[4] = byte(len(data))
+			res = append(res, append(buf, data...)...)
+		}
+	default:
+		return nil, fmt.Errorf("option %d cannot have sub-options", code)
+	}
+	if len(res) > 255 {
+		return nil, fmt.Errorf("option %d is longer than 255 bytes", code)
+	}
+	return res, nil
+}
+
+// decodeSubOptionList is the reverse of encodeSubOptionList.  We do
+// not know what type the values are, so they are decoded as hex.
+func decodeSubOptionList(buf []byte) ([]DhcpSubOption, error) {
+	res := []DhcpSubOption{}
+	for len(buf) > 0 {
+		code := buf[0]
+		if code == 0 {
+			buf = buf[1:]
+			continue
+		}
+		if code == 255 {
+			break
+		}
+		if len(buf) < 2 || int(buf[1]) > len(buf)-2 {
+			return nil, fmt.Errorf("sub-option %d is truncated", code)
+		}
+		l := int(buf[1])
+		res = append(res, DhcpSubOption{
+			Code:  uint32(code),
+			Type:  "hex",
+			Value: net.HardwareAddr(buf[2 : 2+l]).String(),
+		})
+		buf = buf[2+l:]
+	}
+	return res, nil
+}
+
+// DecodeSubOptions splits the value of option code (43 or 125) into
+// its sub-options.
+func DecodeSubOptions(code dhcp.OptionCode, buf []byte) ([]DhcpSubOption, error) {
+	switch code {
+	case dhcp.OptionVendorSpecificInformation:
+		return decodeSubOptionList(buf)
+	case OptionVendorIdentifyingInformation:
+		res := []DhcpSubOption{}
+		for len(buf) > 0 {
+			if len(buf) < 5 || int(buf[4]) > len(buf)-5 {
+				return nil, fmt.Errorf("option 125 is truncated")
+			}
+			l := int(buf[4])
+			subs, err := decodeSubOptionList(buf[5 : 5+l])
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, DhcpSubOption{
+				Code:       binary.BigEndian.Uint32(buf),
+				Type:       "enterprise",
+				SubOptions: subs,
+			})
+			buf = buf[5+l:]
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("option %d does not have sub-options", code)
+}
+
+// subOptionsToValue converts the value of option code (43 or 125) to
+// the JSON form of its sub-options.  Values that are not made of
+// sub-options are converted the way they used to be.
+func subOptionsToValue(code dhcp.OptionCode, buf []byte) string {
+	subs, err := DecodeSubOptions(code, buf)
+	if err == nil {
+		if res, err := json.Marshal(subs); err == nil {
+			return string(res)
+		}
+	}
+	if code == dhcp.OptionVendorSpecificInformation {
+		return string(buf)
+	}
+	return net.HardwareAddr(buf).String()
+}
+
+// valueToSubOptions is the reverse of subOptionsToValue.  Values that
+// are not a JSON list of sub-options are only allowed for option 43,
+// which is sent as is.
+func valueToSubOptions(code dhcp.OptionCode, value string) ([]byte, error) {
+	if !strings.HasPrefix(strings.TrimSpace(value), "[") {
+		if code == dhcp.OptionVendorSpecificInformation {
+			return []byte(value), nil
+		}
+		return nil, fmt.Errorf("option %d must be a list of sub-options", code)
+	}
+	subs := []DhcpSubOption{}
+	if err := json.Unmarshal([]byte(value), &subs); err != nil {
+		return nil, fmt.Errorf("option %d: %v", code, err)
+	}
+	return EncodeSubOptions(code, subs)
+}
+
+// renderSubOptions expands the Value templates of subs.
+func renderSubOptions(subs []DhcpSubOption, srcOpts map[int]string, funcs template.FuncMap) ([]DhcpSubOption, error) {
+	res := make([]DhcpSubOption, len(subs))
+	for i, sub := range subs {
+		res[i] = sub
+		if sub.Value != "" {
+			val, err := renderOptionValue(sub.Value, srcOpts, funcs)
+			if err != nil {
+				return nil, fmt.Errorf("sub-option %d: %v", sub.Code, err)
+			}
+			res[i].Value = val
+		}
+		if len(sub.SubOptions) > 0 {
+			nested, err := renderSubOptions(sub.SubOptions, srcOpts, funcs)
+			if err != nil {
+				return nil, fmt.Errorf("enterprise %d: %v", sub.Code, err)
+			}
+			res[i].SubOptions = nested
+		}
+	}
+	return res, nil
+}
+
+// validateSubOptions makes sure the options in opts that have
+// SubOptions can be encoded.  Sub-options whose values are templates
+// cannot be checked until they are rendered.
+func validateSubOptions(e *Error, opts []DhcpOption) {
+	for _, opt := range opts {
+		if len(opt.SubOptions) == 0 {
+			continue
+		}
+		if !hasSubOptions(opt.Code) {
+			e.Errorf("Option %d cannot have SubOptions", opt.Code)
+			continue
+		}
+		if opt.Value != "" {
+			e.Errorf("Option %d cannot have both a Value and SubOptions", opt.Code)
+		}
+		subs := stubTemplates(opt.SubOptions)
+		if _, err := EncodeSubOptions(opt.Code, subs); err != nil {
+			e.Errorf("Option %d: %v", opt.Code, err)
+		}
+	}
+}
+
+// stubTemplates replaces the sub-option values in subs that are
+// templates with something valid for their type, so that everything
+// else about them can be checked.
+func stubTemplates(subs []DhcpSubOption) []DhcpSubOption {
+	stubs := map[string]string{"ip": "0.0.0.0", "ips": "0.0.0.0", "hex": "", "bool": "false"}
+	res := make([]DhcpSubOption, len(subs))
+	for i, sub := range subs {
+		res[i] = sub
+		if strings.Contains(sub.Value, "{{") {
+			if stub, ok := stubs[sub.Type]; ok {
+				res[i].Value = stub
+			} else if strings.HasPrefix(sub.Type, "uint") {
+				res[i].Value = "0"
+			} else {
+				res[i].Value = ""
+			}
+		}
+		res[i].SubOptions = stubTemplates(sub.SubOptions)
+	}
+	return res
+}
@@ -0,0 +1,97 @@
+package backend
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+func TestDhcpSubOptions(t *testing.T) {
+	opt := &DhcpOption{
+		Code: dhcp.OptionVendorSpecificInformation,
+		SubOptions: []DhcpSubOption{
+			{Code: 1, Type: "ip", Value: "10.1.1.1"},
+			{Code: 2, Type: "string", Value: "{{index . 12}}"},
+			{Code: 3, Type: "uint16", Value: "8080"},
+			{Code: 4, Type: "bool", Value: "true"},
+			{Code: 5, Type: "hex", Value: "de:ad:be:ef"},
+		},
+	}
+	code, val, err := opt.RenderToDHCP(map[int]string{12: "sw1"})
+	if err != nil {
+		t.Fatalf("Failed to render sub-options: %v", err)
+	}
+	expect := []byte{1, 4, 10, 1, 1, 1, 2, 3, 's', 'w', '1', 3, 2, 0x1f, 0x90, 4, 1, 1, 5, 4, 0xde, 0xad, 0xbe, 0xef}
+	if code != dhcp.OptionVendorSpecificInformation || !bytes.Equal(val, expect) {
+		t.Errorf("Expected option 43 to be %v, got %d %v", expect, code, val)
+	}
+	str := ConvertByteToOptionValue(code, val)
+	if str != `[{"Code":1,"Type":"hex","Value":"0a:01:01:01"},{"Code":2,"Type":"hex","Value":"73:77:31"},{"Code":3,"Type":"hex","Value":"1f:90"},{"Code":4,"Type":"hex","Value":"01"},{"Code":5,"Type":"hex","Value":"de:ad:be:ef"}]` {
+		t.Errorf("Unexpected decoded sub-options: %s", str)
+	}
+	if back, err := ConvertOptionValueToByte(code, str); err != nil || !bytes.Equal(back, expect) {
+		t.Errorf("Expected decoded sub-options to encode to %v, got %v: %v", expect, back, err)
+	}
+	if back, err := ConvertOptionValueToByte(code, "PXEClient"); err != nil || string(back) != "PXEClient" {
+		t.Errorf("Expected a plain option 43 to be sent as is, got %v: %v", back, err)
+	}
+	if s := ConvertByteToOptionValue(code, []byte{6, 1, 8, 255}); s != `[{"Code":6,"Type":"hex","Value":"08"}]` {
+		t.Errorf("Expected PXE vendor options to decode, got %s", s)
+	}
+
+	vivso := []DhcpSubOption{
+		{Code: 3561, Type: "enterprise", SubOptions: []DhcpSubOption{{Code: 1, Type: "string", Value: "onie"}}},
+		{Code: 9, Type: "enterprise", SubOptions: []DhcpSubOption{{Code: 2, Type: "uint8", Value: "7"}}},
+	}
+	val, err = EncodeSubOptions(OptionVendorIdentifyingInformation, vivso)
+	expect = []byte{0, 0, 0x0d, 0xe9, 6, 1, 4, 'o', 'n', 'i', 'e', 0, 0, 0, 9, 3, 2, 1, 7}
+	if err != nil || !bytes.Equal(val, expect) {
+		t.Fatalf("Expected option 125 to be %v, got %v: %v", expect, val, err)
+	}
+	decoded, err := DecodeSubOptions(OptionVendorIdentifyingInformation, val)
+	if err != nil || len(decoded) != 2 || decoded[0].Code != 3561 || decoded[0].Type != "enterprise" ||
+		len(decoded[0].SubOptions) != 1 || decoded[0].SubOptions[0].Value != "6f:6e:69:65" {
+		t.Errorf("Unexpected decoded option 125: %+v: %v", decoded, err)
+	}
+	if _, err := DecodeSubOptions(OptionVendorIdentifyingInformation, val[:8]); err == nil {
+		t.Errorf("Expected a truncated option 125 to fail to decode")
+	}
+
+	for _, bad := range []struct {
+		code dhcp.OptionCode
+		subs []DhcpSubOption
+	}{
+		{dhcp.OptionVendorSpecificInformation, []DhcpSubOption{{Code: 0, Type: "uint8", Value: "1"}}},
+		{dhcp.OptionVendorSpecificInformation, []DhcpSubOption{{Code: 1, Type: "uint8", Value: "256"}}},
+		{dhcp.OptionVendorSpecificInformation, []DhcpSubOption{{Code: 1, Type: "ip", Value: "fred"}}},
+		{dhcp.OptionVendorSpecificInformation, []DhcpSubOption{{Code: 1, Type: "float", Value: "1.0"}}},
+		{dhcp.OptionVendorSpecificInformation, vivso},
+		{OptionVendorIdentifyingInformation, []DhcpSubOption{{Code: 1, Type: "string", Value: "fred"}}},
+		{dhcp.OptionRouter, []DhcpSubOption{{Code: 1, Type: "string", Value: "fred"}}},
+	} {
+		if _, err := EncodeSubOptions(bad.code, bad.subs); err == nil {
+			t.Errorf("Expected sub-options %+v for option %d to be refused", bad.subs, bad.code)
+		}
+	}
+
+	dt := mkDT(nil)
+	d, unlocker := dt.LockEnts("subnets", "reservations", "leases")
+	defer unlocker()
+	tests := []crudTest{
+		{"Reservation with sub-options", dt.Create, &Reservation{p: dt, Addr: net.ParseIP("192.168.124.10"), Token: "sw1", Strategy: "MAC", Options: []DhcpOption{*opt}}, true, nil},
+		{"Reservation with templated option 125", dt.Create, &Reservation{p: dt, Addr: net.ParseIP("192.168.124.11"), Token: "sw2", Strategy: "MAC", Options: []DhcpOption{
+			{Code: OptionVendorIdentifyingInformation, SubOptions: []DhcpSubOption{{Code: 3561, Type: "enterprise", SubOptions: []DhcpSubOption{{Code: 2, Type: "ip", Value: "{{.ProvisionerAddress}}"}}}}},
+		}}, true, nil},
+		{"Reservation with bad sub-option", dt.Create, &Reservation{p: dt, Addr: net.ParseIP("192.168.124.12"), Token: "sw3", Strategy: "MAC", Options: []DhcpOption{
+			{Code: dhcp.OptionVendorSpecificInformation, SubOptions: []DhcpSubOption{{Code: 1, Type: "ip", Value: "fred"}}},
+		}}, false, nil},
+		{"Reservation with sub-options on the wrong option", dt.Create, &Reservation{p: dt, Addr: net.ParseIP("192.168.124.13"), Token: "sw4", Strategy: "MAC", Options: []DhcpOption{
+			{Code: dhcp.OptionBootFileName, SubOptions: []DhcpSubOption{{Code: 1, Type: "string", Value: "fred"}}},
+		}}, false, nil},
+	}
+	for _, test := range tests {
+		test.Test(t, d)
+	}
+}
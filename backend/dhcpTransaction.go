@@ -0,0 +1,120 @@
+package backend
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dhcpTransactionLogSize is how many DHCP transactions we remember.
+// Once there are more, the oldest ones are forgotten.
+const dhcpTransactionLogSize = 1000
+
+// DhcpTransaction records what the DHCP server did with a single
+// packet from a client.
+//
+// swagger:model
+type DhcpTransaction struct {
+	// Time is when the packet was received.
+	//
+	// required: true
+	// swagger:strfmt date-time
+	Time time.Time
+	// Xid is the transaction ID the client sent, in hex.
+	//
+	// required: true
+	Xid string
+	// HardwareAddr is the client hardware address from the packet.
+	//
+	// required: true
+	HardwareAddr string
+	// MessageType is the type of DHCP message the client sent.
+	//
+	// required: true
+	MessageType string
+	// Strategy is the leasing strategy that matched the client,
+	// if any did.
+	Strategy string
+	// Token is the token for the client using Strategy.
+	Token string
+	// Subnet is the name of the subnet the client was handled in,
+	// if any.
+	Subnet string
+	// Reservation is the address of the reservation the client
+	// matched, if any.
+	Reservation net.IP
+	// Addr is the address the transaction was about.
+	Addr net.IP
+	// Reply is the type of DHCP message we sent back, or empty if
+	// we did not answer.
+	Reply string
+	// Options are the DHCP options we sent back.
+	Options []DhcpOption
+	// Shadow is true if the packet was handled in shadow mode, in
+	// which case Reply and Options are what we would have sent, and
+	// nothing was actually sent.
+	Shadow bool
+	// Outcome says what we decided to do and why, including the
+	// reason for a NAK or for not answering.
+	//
+	// required: true
+	Outcome string
+}
+
+// dhcpTransactionLog is a fixed size ring of DhcpTransactions.
+type dhcpTransactionLog struct {
+	sync.Mutex
+	ring []*DhcpTransaction
+	next int
+}
+
+func newDhcpTransactionLog() *dhcpTransactionLog {
+	return &dhcpTransactionLog{ring: make([]*DhcpTransaction, 0, dhcpTransactionLogSize)}
+}
+
+func (l *dhcpTransactionLog) add(t *DhcpTransaction) {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.ring) < cap(l.ring) {
+		l.ring = append(l.ring, t)
+		return
+	}
+	l.ring[l.next] = t
+	l.next = (l.next + 1) % len(l.ring)
+}
+
+// sameHardwareAddr compares hardware addresses, ignoring case and
+// whether they are written with colons or dashes.
+func sameHardwareAddr(a, b string) bool {
+	if ha, err := net.ParseMAC(a); err == nil {
+		if hb, err := net.ParseMAC(b); err == nil {
+			return ha.String() == hb.String()
+		}
+	}
+	return strings.EqualFold(a, b)
+}
+
+// RecordDhcpTransaction remembers t, and publishes it as a
+// dhcp.transaction event keyed by the client hardware address.
+func (p *DataTracker) RecordDhcpTransaction(t *DhcpTransaction) {
+	p.dhcpTransactions.add(t)
+	p.publishers.Publish("dhcp", "transaction", t.HardwareAddr, t)
+}
+
+// DhcpTransactions returns the DHCP transactions we remember, oldest
+// first.  If hardwareAddr is not empty, only transactions with that
+// client hardware address are returned.
+func (p *DataTracker) DhcpTransactions(hardwareAddr string) []*DhcpTransaction {
+	l := p.dhcpTransactions
+	l.Lock()
+	defer l.Unlock()
+	res := make([]*DhcpTransaction, 0, len(l.ring))
+	for i := range l.ring {
+		t := l.ring[(l.next+i)%len(l.ring)]
+		if hardwareAddr == "" || sameHardwareAddr(hardwareAddr, t.HardwareAddr) {
+			res = append(res, t)
+		}
+	}
+	return res
+}
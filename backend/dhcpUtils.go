@@ -17,7 +17,7 @@ type LeaseNAK error
 
 func findLease(d Stores, dt *DataTracker, strat, token string, req net.IP) (lease *Lease, err error) {
 	reservations, leases := d("reservations"), d("leases")
-	hexreq := Hexaddr(req.To4())
+	hexreq := Hexaddr(req)
 	found := leases.Find(hexreq)
 	if found == nil {
 		err = LeaseNAK(fmt.Errorf("No lease for %s exists", hexreq))
@@ -32,6 +32,14 @@ func findLease(d Stores, dt *DataTracker, strat, token string, req net.IP) (leas
 		lease = nil
 		return
 	}
+	if lease.Token != token || lease.Strategy != strat {
+		// It is expired, but we may not be allowed to hand it out again.
+		if subnet := lease.Subnet(d); subnet != nil && !subnet.MayAllocate(lease.Addr) {
+			err = LeaseNAK(fmt.Errorf("Lease for %s is not ours to hand out", hexreq))
+			lease = nil
+			return
+		}
+	}
 	// This is the lease we want, but if there is a conflicting reservation we
 	// may force the client to give it up.
 	if rfound := reservations.Find(lease.Key()); rfound != nil {
@@ -92,7 +100,9 @@ func FindLease(dt *DataTracker,
 	return
 }
 
-func findViaReservation(leases, reservations *Store, strat, token string, req net.IP) (lease *Lease, reservation *Reservation) {
+// reservationFor returns the reservation for strat:token.  If req is
+// a valid address, only a reservation for req will do.
+func reservationFor(reservations *Store, strat, token string, req net.IP) (reservation *Reservation) {
 	if req != nil && req.IsGlobalUnicast() {
 		hex := Hexaddr(req)
 		ok := reservations.Find(hex)
@@ -111,6 +121,11 @@ func findViaReservation(leases, reservations *Store, strat, token string, req ne
 			reservation = nil
 		}
 	}
+	return
+}
+
+func findViaReservation(leases, reservations *Store, strat, token string, req net.IP) (lease *Lease, reservation *Reservation) {
+	reservation = reservationFor(reservations, strat, token, req)
 	if reservation == nil {
 		return
 	}
@@ -151,19 +166,26 @@ func findViaReservation(leases, reservations *Store, strat, token string, req ne
 	return
 }
 
-func findViaSubnet(leases, subnets, reservations *Store, strat, token string, req net.IP, vias []net.IP) (lease *Lease, subnet *Subnet) {
+// leasingSubnetFor returns the non-proxy subnet that hands out
+// addresses to strat clients reached via one of vias.
+func leasingSubnetFor(subnets *Store, strat string, vias []net.IP) (subnet *Subnet) {
 	for _, idx := range subnets.Items() {
 		candidate := AsSubnet(idx)
 		for _, via := range vias {
 			if via == nil || !via.IsGlobalUnicast() {
 				continue
 			}
-			if candidate.subnet().Contains(via) && candidate.Strategy == strat {
+			if candidate.subnet().Contains(via) && candidate.HasStrategy(strat) && !candidate.Proxy {
 				subnet = candidate
 				break
 			}
 		}
 	}
+	return
+}
+
+func findViaSubnet(leases, subnets, reservations *Store, strat, token string, req net.IP, vias []net.IP) (lease *Lease, subnet *Subnet) {
+	subnet = leasingSubnetFor(subnets, strat, vias)
 	if subnet == nil {
 		// There is no subnet that can handle the vias we want
 		return
@@ -179,7 +201,13 @@ func findViaSubnet(leases, subnets, reservations *Store, strat, token string, re
 		Hexaddr(subnet.ActiveStart),
 		Hexaddr(subnet.ActiveEnd))(&reservations.Index)
 	usedAddrs := map[string]store.KeySaver{}
+	keyLen := len(Hexaddr(subnet.ActiveStart))
 	for _, i := range currLeases.Items() {
+		if len(i.Key()) != keyLen {
+			// Keys from the other address family can sort
+			// between our endpoints.  Ignore them.
+			continue
+		}
 		currLease := AsLease(i)
 		// While we are iterating over leases, see if we run across a candidate.
 		if (req == nil || req.IsUnspecified() || currLease.Addr.Equal(req)) &&
@@ -190,6 +218,9 @@ func findViaSubnet(leases, subnets, reservations *Store, strat, token string, re
 		usedAddrs[currLease.Key()] = currLease
 	}
 	for _, i := range currReservations.Items() {
+		if len(i.Key()) != keyLen {
+			continue
+		}
 		// While we are iterating over reservations, see if any candidate we found is still kosher.
 		currRes := AsReservation(i)
 		if lease != nil &&
@@ -208,7 +239,7 @@ func findViaSubnet(leases, subnets, reservations *Store, strat, token string, re
 		return
 	}
 	subnet.p.Infof("debugDhcp", "Subnet %s: %s:%s is in my range, attempting lease creation.", subnet.Name, strat, token)
-	lease, _ = subnet.next(usedAddrs, token, req)
+	lease, _ = subnet.next(usedAddrs, strat, token, req)
 	if lease != nil {
 		if leases.Find(lease.Key()) == nil {
 			leases.Add(lease)
@@ -253,3 +284,81 @@ func FindOrCreateLease(dt *DataTracker,
 	}
 	return
 }
+
+// FindProxy finds the Subnet and Reservation that should supply boot
+// information to a client that gets its address from some other DHCP
+// server.  Only enabled subnets marked as Proxy are considered,
+// unless proxyAll is set, in which case every enabled subnet is.
+// Reservations are only considered for a proxy subnet, or for any
+// subnet if proxyAll is set.
+//
+// This function should be called for proxyDHCP traffic.  It never
+// creates or modifies a Lease.
+func FindProxy(dt *DataTracker,
+	strat, token string,
+	via []net.IP,
+	proxyAll bool) (subnet *Subnet, reservation *Reservation) {
+	d, unlocker := dt.LockEnts("subnets", "reservations")
+	defer unlocker()
+	for _, idx := range d("subnets").Items() {
+		candidate := AsSubnet(idx)
+		if !candidate.Enabled ||
+			!(candidate.Proxy || proxyAll) ||
+			!candidate.HasStrategy(strat) {
+			continue
+		}
+		for _, v := range via {
+			if v != nil && v.IsGlobalUnicast() && candidate.subnet().Contains(v) {
+				subnet = candidate
+				break
+			}
+		}
+		if subnet != nil {
+			break
+		}
+	}
+	if subnet == nil && !proxyAll {
+		return
+	}
+	for _, i := range d("reservations").Items() {
+		candidate := AsReservation(i)
+		if candidate.Strategy == strat && candidate.Token == token {
+			reservation = candidate
+			break
+		}
+	}
+	return
+}
+
+// HaveProxySubnets returns whether any enabled Subnet is a proxy
+// subnet.
+func HaveProxySubnets(dt *DataTracker) bool {
+	d, unlocker := dt.LockEnts("subnets")
+	defer unlocker()
+	for _, idx := range d("subnets").Items() {
+		if candidate := AsSubnet(idx); candidate.Enabled && candidate.Proxy {
+			return true
+		}
+	}
+	return false
+}
+
+// FindSubnet returns the enabled Subnet that contains one of the
+// addresses in via, if there is one.  The DHCP servers use it to
+// figure out which leasing strategies to try for a client.
+func FindSubnet(dt *DataTracker, via []net.IP) *Subnet {
+	d, unlocker := dt.LockEnts("subnets")
+	defer unlocker()
+	for _, idx := range d("subnets").Items() {
+		candidate := AsSubnet(idx)
+		if !candidate.Enabled {
+			continue
+		}
+		for _, v := range via {
+			if v != nil && v.IsGlobalUnicast() && candidate.subnet().Contains(v) {
+				return candidate
+			}
+		}
+	}
+	return nil
+}
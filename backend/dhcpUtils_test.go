@@ -1,9 +1,13 @@
 package backend
 
 import (
+	"fmt"
+	"math/big"
 	"net"
 	"testing"
 	"time"
+
+	"github.com/digitalrebar/store"
 )
 
 type ltf struct {
@@ -225,3 +229,213 @@ func TestDHCPCreateSubnet(t *testing.T) {
 		obj.test(t, dt)
 	}
 }
+
+func TestDHCPCreateSubnet6(t *testing.T) {
+	dt := mkDT(nil)
+	func() {
+		d, unlocker := dt.LockEnts("subnets", "leases", "reservations")
+		defer unlocker()
+		// An IPv6 subnet with 3 active addresses, and an IPv4 subnet
+		// whose active range keys sort around the IPv6 lease keys.
+		startObjs := []crudTest{
+			{"Create Subnet", dt.Create, &Subnet{p: dt, Enabled: true, Name: "test6", Subnet: "2001:db8::/64", ActiveStart: net.ParseIP("2001:db8::80"), ActiveEnd: net.ParseIP("2001:db8::82"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "DUID"}, true, nil},
+			{"Create IPv4 Subnet", dt.Create, &Subnet{p: dt, Enabled: true, Name: "test4", Subnet: "32.1.13.0/24", ActiveStart: net.ParseIP("32.1.13.184"), ActiveEnd: net.ParseIP("32.1.13.185"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "mac"}, true, nil},
+			{"Create Reservation", dt.Create, &Reservation{p: dt, Addr: net.ParseIP("2001:db8::81"), Token: "res1", Strategy: "DUID"}, true, nil},
+		}
+		for _, obj := range startObjs {
+			obj.Test(t, d)
+		}
+	}()
+	via := net.ParseIP("2001:db8::1")
+	createTests := []ltc{
+		{"Create lease using pickNextFree", "DUID", "sub1", nil, via, true, net.ParseIP("2001:db8::80")},
+		{"Create lease skipping reservation", "DUID", "sub2", nil, via, true, net.ParseIP("2001:db8::82")},
+		{"Create lease from reservation", "DUID", "res1", nil, via, true, net.ParseIP("2001:db8::81")},
+		{"Fail to get lease due to address range exhaustion", "DUID", "sub3", nil, via, false, nil},
+		{"Refresh lease with requested address", "DUID", "sub1", net.ParseIP("2001:db8::80"), via, true, net.ParseIP("2001:db8::80")},
+		{"Create IPv4 lease using pickNextFree", "mac", "v4a", nil, net.ParseIP("32.1.13.1"), true, net.ParseIP("32.1.13.184")},
+		{"Create IPv4 lease using pickNextFree", "mac", "v4b", nil, net.ParseIP("32.1.13.1"), true, net.ParseIP("32.1.13.185")},
+	}
+	for _, obj := range createTests {
+		obj.test(t, dt)
+	}
+	ltfs := []ltf{
+		{"Renew subnet lease using IPv6 address", "DUID", "sub1", net.ParseIP("2001:db8::80"), true, false},
+		{"Fail to renew lease owned by another token", "DUID", "sub3", net.ParseIP("2001:db8::82"), false, true},
+	}
+	for _, l := range ltfs {
+		l.find(t, dt)
+	}
+	func() {
+		d, unlocker := dt.LockEnts("subnets", "leases", "reservations")
+		defer unlocker()
+		lease := AsLease(d("leases").Find(Hexaddr(net.ParseIP("2001:db8::82"))))
+		lease.ExpireTime = time.Now().Add(-2 * time.Hour)
+	}()
+	expireTests := []ltc{
+		{"Fail to recycle an expired IPv6 lease for an IPv4 client", "mac", "v4c", nil, net.ParseIP("32.1.13.1"), false, nil},
+		{"Take over expired IPv6 lease via pickMostExpired", "DUID", "sub3", nil, via, true, net.ParseIP("2001:db8::82")},
+	}
+	for _, obj := range expireTests {
+		obj.test(t, dt)
+	}
+}
+
+func TestDHCPProxy(t *testing.T) {
+	dt := mkDT(nil)
+	if HaveProxySubnets(dt) {
+		t.Errorf("Should not have proxy subnets before any are created")
+	}
+	func() {
+		d, unlocker := dt.LockEnts("subnets", "leases", "reservations")
+		defer unlocker()
+		startObjs := []crudTest{
+			{"Create Proxy Subnet", dt.Create, &Subnet{p: dt, Enabled: true, Proxy: true, Name: "proxy", Subnet: "192.168.125.0/24", ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "mac"}, true, nil},
+			{"Create Subnet", dt.Create, &Subnet{p: dt, Enabled: true, Name: "test", Subnet: "192.168.124.0/24", ActiveStart: net.ParseIP("192.168.124.80"), ActiveEnd: net.ParseIP("192.168.124.83"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "mac"}, true, nil},
+			{"Create Reservation", dt.Create, &Reservation{p: dt, Addr: net.ParseIP("192.168.125.10"), Token: "res1", Strategy: "mac"}, true, nil},
+		}
+		for _, obj := range startObjs {
+			obj.Test(t, d)
+		}
+	}()
+	createTests := []ltc{
+		{"Fail to create lease in a proxy subnet", "mac", "sub1", nil, net.ParseIP("192.168.125.1"), false, nil},
+		{"Create lease in a normal subnet", "mac", "sub1", nil, net.ParseIP("192.168.124.1"), true, net.ParseIP("192.168.124.80")},
+	}
+	for _, obj := range createTests {
+		obj.test(t, dt)
+	}
+	if !HaveProxySubnets(dt) {
+		t.Errorf("Expected to have a proxy subnet")
+	}
+	if s, r := FindProxy(dt, "mac", "res1", []net.IP{net.ParseIP("192.168.125.1")}, false); s == nil || s.Name != "proxy" || r == nil {
+		t.Errorf("Expected to find the proxy subnet and reservation, got %v and %v", s, r)
+	}
+	if s, _ := FindProxy(dt, "mac2", "res1", []net.IP{net.ParseIP("192.168.125.1")}, false); s != nil {
+		t.Errorf("Should not have found a proxy subnet for the wrong strategy")
+	}
+	if s, r := FindProxy(dt, "mac", "res1", []net.IP{net.ParseIP("192.168.124.1")}, false); s != nil || r != nil {
+		t.Errorf("Should not have found a proxy subnet or reservation for a normal subnet")
+	}
+	if s, _ := FindProxy(dt, "mac", "sub1", []net.IP{net.ParseIP("192.168.124.1")}, true); s == nil || s.Name != "test" {
+		t.Errorf("Expected every subnet to be a proxy subnet when proxying everything, got %v", s)
+	}
+	if s, r := FindProxy(dt, "mac", "res1", nil, true); s != nil || r == nil {
+		t.Errorf("Expected to find just a reservation when proxying everything, got %v and %v", s, r)
+	}
+}
+
+func TestDHCPCreateSubnetStrategies(t *testing.T) {
+	dt := mkDT(nil)
+	func() {
+		d, unlocker := dt.LockEnts("subnets", "leases", "reservations")
+		defer unlocker()
+		startObjs := []crudTest{
+			{"Create Subnet", dt.Create, &Subnet{p: dt, Enabled: true, Name: "test", Subnet: "192.168.124.0/24", ActiveStart: net.ParseIP("192.168.124.80"), ActiveEnd: net.ParseIP("192.168.124.83"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "MAC", Strategies: []string{"CircuitID", "MAC"}}, true, nil},
+			{"Create Reservation", dt.Create, &Reservation{p: dt, Addr: net.ParseIP("192.168.124.83"), Token: "00:01:02", Strategy: "CircuitID"}, true, nil},
+		}
+		for _, obj := range startObjs {
+			obj.Test(t, d)
+		}
+	}()
+	via := net.ParseIP("192.168.124.1")
+	createTests := []ltc{
+		{"Create lease using CircuitID", "CircuitID", "00:01:01", nil, via, true, net.ParseIP("192.168.124.80")},
+		{"Create lease using MAC", "MAC", "01:23:45:67:89:ab", nil, via, true, net.ParseIP("192.168.124.81")},
+		{"Create lease from CircuitID reservation", "CircuitID", "00:01:02", nil, via, true, net.ParseIP("192.168.124.83")},
+		{"Fail to create lease using a strategy the subnet does not use", "ClientID", "01:23:45:67:89:ab", nil, via, false, nil},
+	}
+	for _, obj := range createTests {
+		obj.test(t, dt)
+	}
+	d, unlocker := dt.LockEnts("leases")
+	defer unlocker()
+	if l := AsLease(d("leases").Find(Hexaddr(net.ParseIP("192.168.124.81")))); l.Strategy != "MAC" {
+		t.Errorf("Expected lease for 192.168.124.81 to use the MAC strategy, not %s", l.Strategy)
+	}
+}
+
+func TestDHCPCreateSubnetPickers(t *testing.T) {
+	dt := mkDT(nil)
+	if err := RegisterPicker("hashed", pickNone); err == nil {
+		t.Errorf("Expected registering the hashed picker again to fail")
+	}
+	if err := RegisterPicker("testNone", pickNone); err != nil {
+		t.Errorf("Failed to register testNone picker: %v", err)
+	}
+	defer delete(pickStrategies, "testNone")
+	var subnet *Subnet
+	func() {
+		d, unlocker := dt.LockEnts("subnets", "leases", "reservations")
+		defer unlocker()
+		startObjs := []crudTest{
+			{"Create Subnet with an unknown picker", dt.Create, &Subnet{p: dt, Enabled: true, Name: "bad", Subnet: "192.168.125.0/24", ActiveStart: net.ParseIP("192.168.125.80"), ActiveEnd: net.ParseIP("192.168.125.89"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "mac", Pickers: []string{"fred"}}, false, nil},
+			{"Create Subnet with a duplicate picker", dt.Create, &Subnet{p: dt, Enabled: true, Name: "bad", Subnet: "192.168.125.0/24", ActiveStart: net.ParseIP("192.168.125.80"), ActiveEnd: net.ParseIP("192.168.125.89"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "mac", Pickers: []string{"hashed", "hashed"}}, false, nil},
+			{"Create Subnet", dt.Create, &Subnet{p: dt, Enabled: true, Name: "test", Subnet: "192.168.124.0/24", ActiveStart: net.ParseIP("192.168.124.80"), ActiveEnd: net.ParseIP("192.168.124.89"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "mac", Pickers: []string{"hashed", "testNone"}}, true, nil},
+		}
+		for _, obj := range startObjs {
+			obj.Test(t, d)
+		}
+		subnet = AsSubnet(d("subnets").Find("test"))
+	}()
+	via := net.ParseIP("192.168.124.1")
+	first, _, _ := FindOrCreateLease(dt, "mac", "hash1", nil, []net.IP{via})
+	if first == nil {
+		t.Fatalf("Expected the hashed picker to create a lease")
+	}
+	func() {
+		d, unlocker := dt.LockEnts("subnets", "leases", "reservations")
+		defer unlocker()
+		if _, err := dt.Remove(d, first, nil); err != nil {
+			t.Fatalf("Failed to remove lease %s: %v", first.Addr, err)
+		}
+	}()
+	hashTests := []ltc{
+		{"Get the same address from the hashed picker", "mac", "hash1", nil, via, true, first.Addr},
+	}
+	for _, obj := range hashTests {
+		obj.test(t, dt)
+	}
+
+	subnet.Pickers = []string{"random"}
+	seen := map[string]bool{}
+	for i := 0; i < 9; i++ {
+		lease, _, _ := FindOrCreateLease(dt, "mac", fmt.Sprintf("rand%d", i), nil, []net.IP{via})
+		if lease == nil {
+			t.Fatalf("Expected the random picker to create lease %d", i)
+		}
+		if !subnet.InActiveRange(lease.Addr) || seen[lease.Addr.String()] || lease.Addr.Equal(first.Addr) {
+			t.Errorf("Random picker handed out %s, which is out of range or already used", lease.Addr)
+		}
+		seen[lease.Addr.String()] = true
+	}
+	randomTests := []ltc{
+		{"Fail to get a random lease due to address range exhaustion", "mac", "rand9", nil, via, false, nil},
+	}
+	for _, obj := range randomTests {
+		obj.test(t, dt)
+	}
+}
+
+type ownNothing struct{}
+
+func (o ownNothing) Owns(s *Subnet, addr net.IP) bool { return false }
+
+func TestDHCPPickFromLimit(t *testing.T) {
+	dt := mkDT(nil)
+	dt.SetAddressOwner(ownNothing{})
+	s := &Subnet{p: dt, ActiveStart: net.ParseIP("2001:db8::1"), ActiveEnd: net.ParseIP("2001:db8::ffff:ffff:ffff:ffff")}
+	done := make(chan *Lease)
+	go func() {
+		lease, _ := pickFrom(s, map[string]store.KeySaver{}, "DUID", "limit", big.NewInt(0), false)
+		done <- lease
+	}()
+	select {
+	case lease := <-done:
+		if lease != nil {
+			t.Errorf("Expected no address when we own none of the range, got %s", lease.Addr)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("pickFrom did not give up on a huge range")
+	}
+}
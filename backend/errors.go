@@ -12,6 +12,7 @@ const (
 	ValidationError     = "ValidationError"
 	TemplateRenderError = "TemplateRenderError"
 	StillInUseError     = "StillInUseError"
+	ConflictError       = "ConflictError"
 )
 
 //
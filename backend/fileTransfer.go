@@ -0,0 +1,388 @@
+package backend
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrTransferBusy is returned when a file transfer waited in the
+// queue for longer than the fileTransferQueueTimeout preference
+// allows without getting a slot.
+var ErrTransferBusy = errors.New("Too many file transfers in progress, try again later")
+
+// transferLimits are the limits a transferLimiter enforces.  A limit
+// of 0 is no limit.
+type transferLimits struct {
+	// global is how many transfers may run at once.
+	global int
+	// perClient is how many transfers each client may run at once.
+	perClient int
+	// bandwidth is the total bytes per second all transfers may
+	// send.
+	bandwidth int
+	// timeout is how long a transfer may wait for a slot.
+	timeout time.Duration
+}
+
+// transferWaiter is a transfer waiting in a client's queue.
+type transferWaiter struct {
+	ready  chan struct{}
+	queued time.Time
+}
+
+// transferClient is the running and queued transfers of one client.
+type transferClient struct {
+	active  int
+	waiting []*transferWaiter
+}
+
+// transferLimiter limits how many TFTP and HTTP file transfers run at
+// once, overall and for each client, and how fast they send.
+// Transfers that cannot start right away wait in a queue for their
+// client, and the queues are served round robin, so that a client
+// asking for many files at once cannot starve the others.
+type transferLimiter struct {
+	sync.Mutex
+	limits  func() transferLimits
+	active  int
+	clients map[string]*transferClient
+	// rotation is the clients with queued transfers, in the order
+	// they will be served in.
+	rotation []string
+	// sendAt is when the bandwidth allows the next byte to be sent.
+	sendAt time.Time
+
+	served, waited, timedOut int64
+	waitTotal, waitMax       time.Duration
+}
+
+func newTransferLimiter() *transferLimiter {
+	return &transferLimiter{
+		limits:  func() transferLimits { return transferLimits{} },
+		clients: map[string]*transferClient{},
+	}
+}
+
+// FileTransferClient is the transfers of one client.
+//
+// swagger:model
+type FileTransferClient struct {
+	// Active is how many transfers the client has running.
+	//
+	// required: true
+	Active int
+	// Queued is how many transfers the client has waiting for a
+	// slot.
+	//
+	// required: true
+	Queued int
+}
+
+// FileTransferStats reports on the TFTP and HTTP file transfers that
+// are running and waiting because of the fileTransferLimit and
+// fileTransferClientLimit preferences.
+//
+// swagger:model
+type FileTransferStats struct {
+	// Active is how many transfers are running.
+	//
+	// required: true
+	Active int
+	// Queued is how many transfers are waiting for a slot.
+	//
+	// required: true
+	Queued int
+	// Clients is the running and waiting transfers of each client
+	// that has any, by address.
+	//
+	// required: true
+	Clients map[string]*FileTransferClient
+	// Served is how many transfers have been started since
+	// dr-provision started.
+	//
+	// required: true
+	Served int64
+	// Waited is how many of the Served transfers had to wait for
+	// a slot.
+	//
+	// required: true
+	Waited int64
+	// TimedOut is how many transfers gave up waiting for a slot.
+	//
+	// required: true
+	TimedOut int64
+	// AverageWait is the average time in milliseconds the Waited
+	// transfers waited for a slot.
+	//
+	// required: true
+	AverageWait int64
+	// MaxWait is the longest time in milliseconds a transfer has
+	// waited for a slot.
+	//
+	// required: true
+	MaxWait int64
+	// OldestWait is how long in milliseconds the transfer that has
+	// been waiting the longest has waited so far.
+	//
+	// required: true
+	OldestWait int64
+}
+
+func (l *transferLimiter) canStart(c *transferClient, limits transferLimits) bool {
+	return (limits.global <= 0 || l.active < limits.global) &&
+		(limits.perClient <= 0 || c.active < limits.perClient)
+}
+
+func (l *transferLimiter) start(c *transferClient) {
+	l.active++
+	c.active++
+	l.served++
+}
+
+// dispatch starts as many queued transfers as the limits allow,
+// taking one from each client in turn.
+func (l *transferLimiter) dispatch(now time.Time, limits transferLimits) {
+	for started := true; started && len(l.rotation) > 0; {
+		started = false
+		for i := 0; i < len(l.rotation); {
+			key := l.rotation[i]
+			c := l.clients[key]
+			if !l.canStart(c, limits) {
+				i++
+				continue
+			}
+			w := c.waiting[0]
+			c.waiting = c.waiting[1:]
+			l.start(c)
+			l.noteWait(now.Sub(w.queued))
+			close(w.ready)
+			started = true
+			// The client goes to the back of the line, or out of
+			// it if it has nothing else queued.
+			l.rotation = append(l.rotation[:i], l.rotation[i+1:]...)
+			if len(c.waiting) > 0 {
+				l.rotation = append(l.rotation, key)
+			}
+		}
+	}
+}
+
+func (l *transferLimiter) noteWait(wait time.Duration) {
+	l.waited++
+	l.waitTotal += wait
+	if wait > l.waitMax {
+		l.waitMax = wait
+	}
+}
+
+// acquire waits for a slot for a transfer to remoteIP, and returns
+// the function that gives it back once the transfer is done.  It
+// returns ErrTransferBusy if no slot became free in time.
+func (l *transferLimiter) acquire(remoteIP net.IP) (func(), error) {
+	key := ""
+	if remoteIP != nil {
+		key = remoteIP.String()
+	}
+	limits := l.limits()
+	now := time.Now()
+	l.Lock()
+	c, ok := l.clients[key]
+	if !ok {
+		c = &transferClient{}
+		l.clients[key] = c
+	}
+	release := func() {
+		l.Lock()
+		defer l.Unlock()
+		l.active--
+		c.active--
+		if c.active == 0 && len(c.waiting) == 0 {
+			delete(l.clients, key)
+		}
+		l.dispatch(time.Now(), l.limits())
+	}
+	if len(c.waiting) == 0 && l.canStart(c, limits) {
+		l.start(c)
+		l.Unlock()
+		return release, nil
+	}
+	w := &transferWaiter{ready: make(chan struct{}), queued: now}
+	if len(c.waiting) == 0 {
+		l.rotation = append(l.rotation, key)
+	}
+	c.waiting = append(c.waiting, w)
+	l.Unlock()
+	var timeout <-chan time.Time
+	if limits.timeout > 0 {
+		timer := time.NewTimer(limits.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-w.ready:
+		return release, nil
+	case <-timeout:
+	}
+	l.Lock()
+	defer l.Unlock()
+	select {
+	case <-w.ready:
+		// We got a slot while timing out.
+		return release, nil
+	default:
+	}
+	for i := range c.waiting {
+		if c.waiting[i] == w {
+			c.waiting = append(c.waiting[:i], c.waiting[i+1:]...)
+			break
+		}
+	}
+	if len(c.waiting) == 0 {
+		for i := range l.rotation {
+			if l.rotation[i] == key {
+				l.rotation = append(l.rotation[:i], l.rotation[i+1:]...)
+				break
+			}
+		}
+		if c.active == 0 {
+			delete(l.clients, key)
+		}
+	}
+	l.timedOut++
+	return nil, ErrTransferBusy
+}
+
+// throttle waits until the bandwidth limit allows n more bytes to be
+// sent.
+func (l *transferLimiter) throttle(n int) {
+	rate := l.limits().bandwidth
+	if rate <= 0 || n <= 0 {
+		return
+	}
+	now := time.Now()
+	l.Lock()
+	if l.sendAt.Before(now) {
+		l.sendAt = now
+	}
+	at := l.sendAt
+	l.sendAt = l.sendAt.Add(time.Duration(n) * time.Second / time.Duration(rate))
+	l.Unlock()
+	time.Sleep(at.Sub(now))
+}
+
+// chunk is how many bytes to send between calls to throttle, which
+// is about a tenth of a second worth at the bandwidth limit.
+func (l *transferLimiter) chunk(n int) int {
+	rate := l.limits().bandwidth
+	if rate <= 0 {
+		return n
+	}
+	max := rate / 10
+	if max < 512 {
+		max = 512
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+func (l *transferLimiter) stats() *FileTransferStats {
+	now := time.Now()
+	l.Lock()
+	defer l.Unlock()
+	res := &FileTransferStats{
+		Active:   l.active,
+		Clients:  map[string]*FileTransferClient{},
+		Served:   l.served,
+		Waited:   l.waited,
+		TimedOut: l.timedOut,
+		MaxWait:  int64(l.waitMax / time.Millisecond),
+	}
+	if l.waited > 0 {
+		res.AverageWait = int64(l.waitTotal/time.Millisecond) / l.waited
+	}
+	for key, c := range l.clients {
+		res.Queued += len(c.waiting)
+		res.Clients[key] = &FileTransferClient{Active: c.active, Queued: len(c.waiting)}
+		if len(c.waiting) > 0 {
+			if wait := int64(now.Sub(c.waiting[0].queued) / time.Millisecond); wait > res.OldestWait {
+				res.OldestWait = wait
+			}
+		}
+	}
+	return res
+}
+
+// tftpTransfer is a file being sent over TFTP.  It holds a transfer
+// slot until it is closed.
+type tftpTransfer struct {
+	src     io.Reader
+	size    int64
+	limiter *transferLimiter
+	once    sync.Once
+	release func()
+}
+
+func (t *tftpTransfer) Read(buf []byte) (int, error) {
+	n, err := t.src.Read(buf[:t.limiter.chunk(len(buf))])
+	t.limiter.throttle(n)
+	return n, err
+}
+
+// Size is the size of the file being sent.
+func (t *tftpTransfer) Size() int64 {
+	return t.size
+}
+
+// Close gives back the transfer slot and closes the file being sent.
+func (t *tftpTransfer) Close() error {
+	t.once.Do(t.release)
+	if c, ok := t.src.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// throttledWriter sends an HTTP response no faster than the
+// bandwidth limit allows.
+type throttledWriter struct {
+	http.ResponseWriter
+	limiter *transferLimiter
+}
+
+func (w *throttledWriter) Write(buf []byte) (int, error) {
+	written := 0
+	for len(buf) > 0 {
+		n := w.limiter.chunk(len(buf))
+		w.limiter.throttle(n)
+		n, err := w.ResponseWriter.Write(buf[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		buf = buf[n:]
+	}
+	return written, nil
+}
+
+// transferLimits reads the limits on file transfers from the
+// preferences.
+func (p *DataTracker) transferLimits() transferLimits {
+	return transferLimits{
+		global:    p.intPref("fileTransferLimit", 0),
+		perClient: p.intPref("fileTransferClientLimit", 0),
+		bandwidth: p.intPref("fileTransferBandwidth", 0) * 1024,
+		timeout:   time.Duration(p.intPref("fileTransferQueueTimeout", 0)) * time.Second,
+	}
+}
+
+// FileTransfers reports on the TFTP and HTTP file transfers that are
+// running and waiting for a slot.
+func (p *DataTracker) FileTransfers() *FileTransferStats {
+	return p.FS.transfers.stats()
+}
@@ -0,0 +1,124 @@
+package backend
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTransferLimiter(t *testing.T) {
+	l := newTransferLimiter()
+	l.limits = func() transferLimits { return transferLimits{global: 1} }
+	a, b := net.ParseIP("192.168.124.10"), net.ParseIP("192.168.124.20")
+	release, err := l.acquire(a)
+	if err != nil {
+		t.Fatalf("Expected the first transfer to start: %v", err)
+	}
+	started := make(chan string, 3)
+	queue := func(name string, ip net.IP, depth int) {
+		go func() {
+			rel, err := l.acquire(ip)
+			if err != nil {
+				t.Errorf("%s: Unexpected error: %v", name, err)
+				return
+			}
+			started <- name
+			rel()
+		}()
+		for l.stats().Queued != depth {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	queue("a2", a, 1)
+	queue("a3", a, 2)
+	queue("b1", b, 3)
+	stats := l.stats()
+	if stats.Active != 1 || stats.Queued != 3 || stats.Clients[a.String()].Queued != 2 || stats.Clients[b.String()].Queued != 1 {
+		t.Errorf("Unexpected stats while queued: %+v", stats)
+	}
+	release()
+	order := ""
+	for i := 0; i < 3; i++ {
+		order += <-started + " "
+	}
+	if order != "a2 b1 a3 " {
+		t.Errorf("Expected clients to take turns, got %s", order)
+	}
+	for l.stats().Active != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	stats = l.stats()
+	if stats.Served != 4 || stats.Waited != 3 || stats.Queued != 0 || len(stats.Clients) != 0 {
+		t.Errorf("Unexpected stats once idle: %+v", stats)
+	}
+
+	l.limits = func() transferLimits { return transferLimits{global: 1, timeout: 20 * time.Millisecond} }
+	release, _ = l.acquire(a)
+	if _, err := l.acquire(b); err != ErrTransferBusy {
+		t.Errorf("Expected %v, got %v", ErrTransferBusy, err)
+	}
+	release()
+	if stats = l.stats(); stats.TimedOut != 1 || stats.Queued != 0 || stats.Active != 0 {
+		t.Errorf("Unexpected stats after timing out: %+v", stats)
+	}
+
+	l.limits = func() transferLimits { return transferLimits{perClient: 1, timeout: 20 * time.Millisecond} }
+	release, _ = l.acquire(a)
+	if _, err := l.acquire(a); err != ErrTransferBusy {
+		t.Errorf("Expected a second transfer for the same client to wait, got %v", err)
+	}
+	if relB, err := l.acquire(b); err != nil {
+		t.Errorf("Expected another client to start right away: %v", err)
+	} else {
+		relB()
+	}
+	release()
+}
+
+func TestFSTransferLimits(t *testing.T) {
+	fs := NewFS(tmpDir, log.New(os.Stdout, "fs", 0))
+	limits := transferLimits{global: 1, timeout: 20 * time.Millisecond}
+	fs.transfers.limits = func() transferLimits { return limits }
+	if err := ioutil.WriteFile(tmpDir+"/limited", bytes.Repeat([]byte("x"), 3072), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	src, err := fs.TftpResponder()("limited", net.ParseIP("192.168.124.10"))
+	if err != nil {
+		t.Fatalf("Failed to fetch over TFTP: %v", err)
+	}
+	if sz := src.(interface{ Size() int64 }).Size(); sz != 3072 {
+		t.Errorf("Expected size 3072, got %d", sz)
+	}
+	if _, err := fs.TftpResponder()("limited", net.ParseIP("192.168.124.20")); err != ErrTransferBusy {
+		t.Errorf("Expected a second TFTP transfer to be refused, got %v", err)
+	}
+	req := httptest.NewRequest("GET", "/limited", nil)
+	req.RemoteAddr = "192.168.124.20:4321"
+	res := httptest.NewRecorder()
+	fs.ServeHTTP(res, req)
+	if res.Code != http.StatusServiceUnavailable || res.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected %d with Retry-After, got %d", http.StatusServiceUnavailable, res.Code)
+	}
+	src.(io.Closer).Close()
+
+	limits.bandwidth = 10240
+	res = httptest.NewRecorder()
+	start := time.Now()
+	fs.ServeHTTP(res, req)
+	if res.Code != http.StatusOK || res.Body.Len() != 3072 {
+		t.Errorf("Expected the file once the TFTP transfer closed, got %d with %d bytes", res.Code, res.Body.Len())
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Expected 3072 bytes at 10240 bytes per second to take at least 150ms, took %v", elapsed)
+	}
+	if stats := fs.transfers.stats(); stats.Active != 0 || stats.Served != 2 || stats.TimedOut != 2 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
@@ -8,18 +8,39 @@ import (
 	"net/http"
 	"os"
 	"path"
-	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+// dynamicFile renders a file on demand.  Along with the rendered
+// file, it returns a version that changes whenever anything the file
+// is rendered from does, or "" if the file must not be cached.
+type dynamicFile func(net.IP) (*bytes.Reader, string, error)
+
+// fileVersion is the last version of a rendered file we handed out,
+// and when it appeared.
+type fileVersion struct {
+	version string
+	modTime time.Time
+}
+
 // FileSystem provides the routines to allow the static HTTP and TFTP services to render
 // templates on demand..
 type FileSystem struct {
 	sync.Mutex
 	lower    string
 	logger   *log.Logger
-	dynamics map[string]func(net.IP) (*bytes.Reader, error)
+	dynamics map[string]dynamicFile
+	versions map[string]fileVersion
+	// bootFiles describes the dynamic files that are part of
+	// booting, and fetched is called with them whenever a client
+	// fetches a file, so that boot progress can be tracked.
+	bootFiles map[string]*bootFile
+	fetched   func(p, proto string, remoteIP net.IP, boot *bootFile)
+	// transfers limits how many files are sent at once, and how
+	// fast.
+	transfers *transferLimiter
 }
 
 // NewFS creates a new initialized filesystem that will fall back to
@@ -27,9 +48,12 @@ type FileSystem struct {
 // rendered.
 func NewFS(backingFSPath string, logger *log.Logger) *FileSystem {
 	return &FileSystem{
-		lower:    backingFSPath,
-		logger:   logger,
-		dynamics: map[string]func(net.IP) (*bytes.Reader, error){},
+		lower:     backingFSPath,
+		logger:    logger,
+		dynamics:  map[string]dynamicFile{},
+		versions:  map[string]fileVersion{},
+		bootFiles: map[string]*bootFile{},
+		transfers: newTransferLimiter(),
 	}
 }
 
@@ -40,14 +64,52 @@ func NewFS(backingFSPath string, logger *log.Logger) *FileSystem {
 // no template to be expanded for p and FileSystem should fall back to
 // serving a static file.
 func (fs *FileSystem) Open(p string, remoteIP net.IP) (*bytes.Reader, error) {
+	out, _, _, err := fs.open(p, remoteIP)
+	return out, err
+}
+
+// open is Open, but also returns the ETag and modification time of
+// the rendered file.  The ETag is empty if the file must not be
+// cached.  The modification time is when we first rendered the
+// current version of the file, and never goes backwards.
+func (fs *FileSystem) open(p string, remoteIP net.IP) (*bytes.Reader, string, time.Time, error) {
 	p = path.Clean(p)
 	fs.Lock()
 	res, ok := fs.dynamics[p]
 	fs.Unlock()
 	if !ok {
-		return nil, nil
+		return nil, "", time.Time{}, nil
+	}
+	out, version, err := res(remoteIP)
+	if err != nil || version == "" {
+		return out, "", time.Time{}, err
+	}
+	fs.Lock()
+	defer fs.Unlock()
+	v, ok := fs.versions[p]
+	if !ok || v.version != version {
+		// Last-Modified only has a resolution of a second, so make
+		// sure a new version never looks as old as the last one.
+		modTime := time.Now().Truncate(time.Second)
+		if ok && !modTime.After(v.modTime) {
+			modTime = v.modTime.Add(time.Second)
+		}
+		v = fileVersion{version: version, modTime: modTime}
+		fs.versions[p] = v
 	}
-	return res(remoteIP)
+	return out, `"` + version + `"`, v.modTime, nil
+}
+
+// contentTypes are the content types of files used for booting and
+// installing whose extensions the mime package may not know about.
+var contentTypes = map[string]string{
+	".cfg":     "text/plain; charset=utf-8",
+	".conf":    "text/plain; charset=utf-8",
+	".ipxe":    "text/plain; charset=utf-8",
+	".ks":      "text/plain; charset=utf-8",
+	".preseed": "text/plain; charset=utf-8",
+	".seed":    "text/plain; charset=utf-8",
+	".efi":     "application/octet-stream",
 }
 
 // ServeHTTP implements http.Handler for the FileSystem.
@@ -65,43 +127,105 @@ func (fs *FileSystem) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	} else {
 		raddr = net.ParseIP(raddrStr)
 	}
-	out, err := fs.Open(p, raddr)
+	if r.Method != "HEAD" {
+		release, err := fs.transfers.acquire(raddr)
+		if err != nil {
+			fs.logger.Printf("Static FS: Not sending %s to %s: %v", p, raddrStr, err)
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+		if fs.transfers.limits().bandwidth > 0 {
+			w = &throttledWriter{ResponseWriter: w, limiter: fs.transfers}
+		}
+	}
+	if ct, ok := contentTypes[path.Ext(p)]; ok {
+		w.Header().Set("Content-Type", ct)
+	}
+	out, etag, modTime, err := fs.open(p, raddr)
 	if err != nil {
 		fs.logger.Printf("Static FS: Failed to render template for %s: %v", p, err)
+		w.Header().Del("Content-Type")
 		w.WriteHeader(http.StatusInternalServerError)
 	} else if out != nil {
-		w.Header().Set("Content-Length", strconv.FormatInt(out.Size(), 10))
-		io.Copy(w, out)
+		if etag != "" {
+			w.Header().Set("Etag", etag)
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		if r.Method != "HEAD" {
+			fs.noteFetch(p, "http", raddr)
+		}
+		http.ServeContent(w, r, p, modTime, out)
 	} else {
+		if fi, err := os.Stat(path.Join(fs.lower, p)); err == nil && fi.Mode().IsRegular() && r.Method != "HEAD" {
+			fs.noteFetch(p, "http", raddr)
+		}
 		http.ServeFile(w, r, path.Join(fs.lower, p))
 	}
 }
 
+// noteFetch records that a client at remoteIP fetched p over proto.
+func (fs *FileSystem) noteFetch(p, proto string, remoteIP net.IP) {
+	fs.Lock()
+	fetched, boot := fs.fetched, fs.bootFiles[path.Clean(p)]
+	fs.Unlock()
+	if fetched != nil {
+		fetched(path.Clean(p), proto, remoteIP, boot)
+	}
+}
+
 // TftpResponder returns a function that allows the TFTP midlayer to
-// serve files from the FileSystem.
+// serve files from the FileSystem.  The returned reader holds a
+// transfer slot until it is closed.
 func (fs *FileSystem) TftpResponder() func(string, net.IP) (io.Reader, error) {
 	return func(toSend string, remoteIP net.IP) (io.Reader, error) {
 		p := path.Clean("/" + toSend)
+		release, err := fs.transfers.acquire(remoteIP)
+		if err != nil {
+			fs.logger.Printf("Static FS: Not sending %s to %s: %v", p, remoteIP, err)
+			return nil, err
+		}
 		out, err := fs.Open(p, remoteIP)
 		if err != nil {
+			release()
 			fs.logger.Printf("Static FS: Failed to render template for %s: %v", p, err)
 			return nil, err
 		}
 		if out != nil {
-			return out, nil
+			fs.noteFetch(p, "tftp", remoteIP)
+			return &tftpTransfer{src: out, size: out.Size(), limiter: fs.transfers, release: release}, nil
+		}
+		f, err := os.Open(path.Join(fs.lower, p))
+		if err != nil {
+			release()
+			return nil, err
+		}
+		fs.noteFetch(p, "tftp", remoteIP)
+		res := &tftpTransfer{src: f, limiter: fs.transfers, release: release}
+		if fi, err := f.Stat(); err == nil {
+			res.size = fi.Size()
 		}
-		return os.Open(path.Join(fs.lower, p))
+		return res, nil
 	}
 }
 
-func (fs *FileSystem) addDynamic(path string, t func(net.IP) (*bytes.Reader, error)) {
+func (fs *FileSystem) addDynamic(path string, boot *bootFile, t dynamicFile) {
 	fs.Lock()
 	fs.dynamics[path] = t
+	if boot != nil {
+		fs.bootFiles[path] = boot
+	} else {
+		delete(fs.bootFiles, path)
+	}
 	fs.Unlock()
 }
 
 func (fs *FileSystem) delDynamic(path string) {
 	fs.Lock()
 	delete(fs.dynamics, path)
+	delete(fs.versions, path)
+	delete(fs.bootFiles, path)
 	fs.Unlock()
 }
@@ -0,0 +1,72 @@
+package backend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestFSServeHTTP(t *testing.T) {
+	fs := NewFS(tmpDir, log.New(os.Stdout, "fs", 0))
+	version := "v1"
+	fs.addDynamic("/default.ipxe", nil, func(net.IP) (*bytes.Reader, string, error) {
+		return bytes.NewReader([]byte("#!ipxe\nchain " + version + "\n")), version, nil
+	})
+	fs.addDynamic("/token", nil, func(net.IP) (*bytes.Reader, string, error) {
+		return bytes.NewReader([]byte("token")), "", nil
+	})
+	get := func(p string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", p, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		fs.ServeHTTP(rec, req)
+		return rec
+	}
+	res := get("/default.ipxe", nil)
+	etag, lastMod := res.Header().Get("Etag"), res.Header().Get("Last-Modified")
+	if res.Code != http.StatusOK || res.Body.String() != "#!ipxe\nchain v1\n" {
+		t.Fatalf("Expected the rendered file, got %d: %q", res.Code, res.Body.String())
+	}
+	if etag != `"v1"` || lastMod == "" {
+		t.Errorf("Expected ETag \"v1\" and a Last-Modified, got %q and %q", etag, lastMod)
+	}
+	if ct := res.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("Expected a text/plain Content-Type, got %q", ct)
+	}
+	if res = get("/default.ipxe", map[string]string{"If-None-Match": etag}); res.Code != http.StatusNotModified {
+		t.Errorf("Expected If-None-Match to get %d, got %d", http.StatusNotModified, res.Code)
+	}
+	if res = get("/default.ipxe", map[string]string{"If-Modified-Since": lastMod}); res.Code != http.StatusNotModified {
+		t.Errorf("Expected If-Modified-Since to get %d, got %d", http.StatusNotModified, res.Code)
+	}
+	res = get("/default.ipxe", map[string]string{"Range": "bytes=7-11"})
+	if res.Code != http.StatusPartialContent || res.Body.String() != "chain" {
+		t.Errorf("Expected a partial response with chain, got %d: %q", res.Code, res.Body.String())
+	}
+	version = "v2"
+	res = get("/default.ipxe", map[string]string{"If-None-Match": etag, "If-Modified-Since": lastMod})
+	if res.Code != http.StatusOK || res.Header().Get("Etag") != `"v2"` {
+		t.Errorf("Expected the new version, got %d with ETag %q", res.Code, res.Header().Get("Etag"))
+	}
+	if res = get("/default.ipxe", map[string]string{"If-Modified-Since": lastMod}); res.Code != http.StatusOK {
+		t.Errorf("Expected a new version to look modified, got %d", res.Code)
+	}
+	res = get("/token", nil)
+	if res.Header().Get("Etag") != "" || res.Header().Get("Last-Modified") != "" || res.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("Expected an uncacheable file to not be cached, got headers %v", res.Header())
+	}
+	if err := ioutil.WriteFile(tmpDir+"/static.cfg", []byte("static"), 0644); err != nil {
+		t.Fatalf("Failed to write static file: %v", err)
+	}
+	res = get("/static.cfg", nil)
+	if res.Code != http.StatusOK || res.Body.String() != "static" || res.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Errorf("Expected the static file as text/plain, got %d: %q (%s)", res.Code, res.Body.String(), res.Header().Get("Content-Type"))
+	}
+}
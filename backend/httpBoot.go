@@ -0,0 +1,52 @@
+package backend
+
+import (
+	"bytes"
+	"net"
+	"strings"
+)
+
+// machineByAddress returns the machine with addr, if there is one.
+func machineByAddress(machines *Store, addr net.IP) *Machine {
+	for _, i := range machines.Items() {
+		m := AsMachine(i)
+		if m.Address != nil && m.Address.Equal(addr) {
+			return m
+		}
+	}
+	return nil
+}
+
+// HttpBootFile returns the file a UEFI HTTP Boot client with
+// hardwareAddr that is being handed addr should load.  It is the
+// expanded HttpBootFile of the boot environment of the client's
+// machine, or of the unknownBootEnv if the client does not have a
+// machine yet.  It returns "" if that boot environment does not have
+// an HttpBootFile.
+func HttpBootFile(dt *DataTracker, addr net.IP, hardwareAddr string) (string, error) {
+	d, unlocker := dt.LockEnts("machines", "bootenvs", "profiles")
+	defer unlocker()
+	machine := machineByHardwareAddr(d("machines"), hardwareAddr)
+	if machine == nil && addr != nil {
+		machine = machineByAddress(d("machines"), addr)
+	}
+	envName := dt.pref("unknownBootEnv")
+	if machine != nil {
+		envName = machine.BootEnv
+	}
+	found := d("bootenvs").Find(envName)
+	if found == nil {
+		return "", nil
+	}
+	env := AsBootEnv(found)
+	if !env.Available || env.httpBootTmpl == nil {
+		return "", nil
+	}
+	rd := newRenderData(d, dt, machine, env)
+	rd.remoteIP = addr
+	buf := &bytes.Buffer{}
+	if err := env.httpBootTmpl.Execute(buf, rd); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
@@ -0,0 +1,50 @@
+package backend
+
+import (
+	"net"
+	"testing"
+
+	"github.com/pborman/uuid"
+)
+
+func TestHttpBootFile(t *testing.T) {
+	dt := mkDT(nil)
+	func() {
+		d, unlocker := dt.LockEnts("templates", "bootenvs", "machines", "profiles", "tasks", "params")
+		defer unlocker()
+		tests := []crudTest{
+			{"Create Template", dt.Create, &Template{p: dt, ID: "default"}, true, nil},
+			{"Create Bootenv", dt.Create, &BootEnv{p: dt, Name: "default", Templates: []TemplateInfo{{Name: "ipxe", Path: "{{ .Env.Name }}", ID: "default"}}}, true, nil},
+			{"Create Bootenv with invalid HttpBootFile", dt.Create, &BootEnv{p: dt, Name: "bad", HttpBootFile: "{{ .Env.Name }", Templates: []TemplateInfo{{Name: "ipxe", Path: "{{ .Env.Name }}", ID: "default"}}}, false, nil},
+			{"Create Bootenv with HttpBootFile", dt.Create, &BootEnv{p: dt, Name: "fedora-install", OS: OsInfo{Name: "fedora"}, HttpBootFile: `{{ .Env.PathFor "tftp" "EFI/BOOT/BOOTX64.EFI" }}`, Templates: []TemplateInfo{{Name: "ipxe", Path: "{{ .Env.Name }}", ID: "default"}}}, true, nil},
+			{"Create Bootenv with machine HttpBootFile", dt.Create, &BootEnv{p: dt, Name: "custom", HttpBootFile: "{{ .Machine.Name }}.efi", Templates: []TemplateInfo{{Name: "ipxe", Path: "{{ .Env.Name }}", ID: "default"}}}, true, nil},
+			{"Create Machine by hardware address", dt.Create, &Machine{p: dt, Name: "m1", Uuid: uuid.NewRandom(), BootEnv: "fedora-install", HardwareAddrs: []string{"00:11:22:33:44:55"}}, true, nil},
+			{"Create Machine by address", dt.Create, &Machine{p: dt, Name: "m2", Uuid: uuid.NewRandom(), BootEnv: "custom", Address: net.ParseIP("192.168.124.20")}, true, nil},
+		}
+		for _, test := range tests {
+			test.Test(t, d)
+		}
+	}()
+	for _, c := range []struct {
+		addr, hw, file string
+	}{
+		{"192.168.124.10", "00:11:22:33:44:55", "fedora/install/EFI/BOOT/BOOTX64.EFI"},
+		{"192.168.124.20", "00:11:22:33:44:66", "m2.efi"},
+		{"192.168.124.30", "00:11:22:33:44:77", ""},
+	} {
+		file, err := HttpBootFile(dt, net.ParseIP(c.addr), c.hw)
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %v", c.hw, err)
+		} else if file != c.file {
+			t.Errorf("%s: Expected HTTP boot file %q, got %q", c.hw, c.file, file)
+		}
+	}
+	local := net.ParseIP("192.168.124.1")
+	if u := dt.HttpBootURL(local, "/ipxe.efi"); u != "http://192.168.124.1:8091/ipxe.efi" {
+		t.Errorf("Unexpected HTTP boot URL %s", u)
+	}
+	dt.StaticHttpsPort = 8443
+	if u := dt.HttpBootURL(nil, "ipxe.efi"); u != "https://127.0.0.1:8443/ipxe.efi" {
+		t.Errorf("Unexpected HTTPS boot URL %s", u)
+	}
+}
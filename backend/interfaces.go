@@ -41,7 +41,7 @@ func (dt *DataTracker) GetInterfaces() ([]*Interface, error) {
 			continue
 		}
 		var sip string
-		var firstIp string
+		var firstIp, firstIp6 string
 
 		addrs, err := intf.Addrs()
 		if err != nil {
@@ -55,12 +55,13 @@ func (dt *DataTracker) GetInterfaces() ([]*Interface, error) {
 			if !thisIP.IsGlobalUnicast() {
 				continue
 			}
-			// Only deal with IPv4 for now.
+			// Prefer IPv4 addresses as the active address, but
+			// fall back to IPv6 for interfaces that only have that.
 			if thisIP.To4() == nil {
-				continue
-			}
-
-			if firstIp == "" {
+				if firstIp6 == "" {
+					firstIp6 = addr.String()
+				}
+			} else if firstIp == "" {
 				firstIp = addr.String()
 			}
 			if dt.OurAddress != "" && dt.OurAddress == addr.String() {
@@ -70,6 +71,9 @@ func (dt *DataTracker) GetInterfaces() ([]*Interface, error) {
 		}
 
 		if sip == "" {
+			if firstIp == "" {
+				firstIp = firstIp6
+			}
 			if firstIp == "" {
 				continue
 			}
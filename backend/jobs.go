@@ -452,7 +452,7 @@ func (j *Job) RenderActions() ([]*JobAction, error) {
 	err := &Error{}
 	actions := []*JobAction{}
 	for _, r := range renderers {
-		rr, err1 := r.write(addr)
+		rr, _, err1 := r.write(addr)
 		if err1 != nil {
 			err.Merge(err1)
 		} else {
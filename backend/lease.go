@@ -9,12 +9,20 @@ import (
 
 	"github.com/digitalrebar/provision/backend/index"
 	"github.com/digitalrebar/store"
+	"github.com/pborman/uuid"
 )
 
 var hexDigit = []byte{'0', '1', '2', '3', '4', '5', '6', '7', '8', '9', 'A', 'B', 'C', 'D', 'E', 'F'}
 
+// Hexaddr returns the uppercase hex representation of an address.
+// IPv4 addresses are always rendered in their 4 byte form, and IPv6
+// addresses in their 16 byte form, so keys for both families sort
+// correctly within their own family.
 func Hexaddr(addr net.IP) string {
 	b := addr.To4()
+	if b == nil {
+		b = addr.To16()
+	}
 	s := make([]byte, len(b)*2)
 	for i, tn := range b {
 		s[i*2], s[i*2+1] = hexDigit[tn>>4], hexDigit[tn&0xf]
@@ -26,10 +34,10 @@ func Hexaddr(addr net.IP) string {
 // swagger:model
 type Lease struct {
 	validate
-	// Addr is the IP address that the lease handed out.
+	// Addr is the IP address that the lease handed out.  It can
+	// be either an IPv4 or an IPv6 address.
 	//
 	// required: true
-	// swagger:strfmt ipv4
 	Addr net.IP
 	// Token is the unique token for this lease based on the
 	// Strategy this lease used.
@@ -48,6 +56,11 @@ type Lease struct {
 	//
 	// required: true
 	Strategy string
+	// Machine is the UUID of the machine the lease was handed out
+	// to, if the lease is in a subnet with AutoMachines set.
+	//
+	// swagger:strfmt uuid
+	Machine uuid.UUID
 
 	p *DataTracker
 }
@@ -266,6 +279,7 @@ func (l *Lease) Invalidate() {
 	l.ExpireTime = time.Now().Add(2 * time.Second)
 	l.Token = ""
 	l.Strategy = ""
+	l.Machine = nil
 }
 
 var leaseLockMap = map[string][]string{
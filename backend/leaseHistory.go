@@ -0,0 +1,229 @@
+package backend
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/digitalrebar/store"
+)
+
+// Default values for the leaseHistoryLength and
+// leaseHistoryRetention preferences.
+const (
+	defaultLeaseHistoryLength    = 50
+	defaultLeaseHistoryRetention = 30 * 86400
+)
+
+// LeaseHistoryEntry records one client holding an address.
+//
+// swagger:model
+type LeaseHistoryEntry struct {
+	// Strategy is the leasing strategy of the client.
+	//
+	// required: true
+	Strategy string
+	// Token is the token for the client using Strategy.
+	//
+	// required: true
+	Token string
+	// Start is when the address was handed to the client.
+	//
+	// required: true
+	// swagger:strfmt date-time
+	Start time.Time
+	// End is when the client stopped holding the address: when its
+	// lease expired (or will expire if it is not renewed), or when
+	// the lease was given to someone else or removed, whichever came
+	// first.
+	//
+	// required: true
+	// swagger:strfmt date-time
+	End time.Time
+	// Current is true if the address is still leased to the client.
+	//
+	// required: true
+	Current bool
+}
+
+// leaseHistory remembers who has held each address, keyed by
+// Hexaddr.  Entries are only ever appended to, except that End and
+// Current are updated until the address changes hands.  The history
+// of an address is only saved when it changes hands, so renewals do
+// not rewrite it; the End of a current entry comes from the lease
+// itself instead.
+type leaseHistory struct {
+	sync.Mutex
+	entries map[string][]*LeaseHistoryEntry
+	backend store.Store
+}
+
+func newLeaseHistory() *leaseHistory {
+	return &leaseHistory{entries: map[string][]*LeaseHistoryEntry{}}
+}
+
+// SetLeaseHistoryStore loads the lease history from st, and saves it
+// there as it changes from then on.  Without a store, the history is
+// only kept in memory.  It must be called before the DHCP servers
+// are started.
+func (p *DataTracker) SetLeaseHistoryStore(st store.Store) error {
+	h := p.leaseHistory
+	h.Lock()
+	defer h.Unlock()
+	keys, err := st.Keys()
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		entries := []*LeaseHistoryEntry{}
+		if err := st.Load(k, &entries); err != nil {
+			return fmt.Errorf("lease history %s: %v", k, err)
+		}
+		h.entries[k] = entries
+	}
+	h.backend = st
+	return nil
+}
+
+// trim drops the entries for key that are past the retention limits.
+func (h *leaseHistory) trim(key string, now time.Time, length, retention int) {
+	entries := h.entries[key]
+	if len(entries) > length {
+		entries = entries[len(entries)-length:]
+	}
+	if retention > 0 {
+		cutoff := now.Add(-time.Duration(retention) * time.Second)
+		for len(entries) > 0 && !entries[0].Current && entries[0].End.Before(cutoff) {
+			entries = entries[1:]
+		}
+	}
+	if len(entries) == 0 {
+		delete(h.entries, key)
+		return
+	}
+	h.entries[key] = entries
+}
+
+// save writes the entries for key to the backing store, if there is
+// one.
+func (h *leaseHistory) save(key string) error {
+	if h.backend == nil {
+		return nil
+	}
+	if len(h.entries[key]) == 0 {
+		// There may be nothing saved for key yet.
+		h.backend.Remove(key)
+		return nil
+	}
+	return h.backend.Save(key, h.entries[key])
+}
+
+// noteLeaseSaved records that ref was saved, if it is a Lease.  If
+// the lease belongs to someone other than the last client to hold its
+// address, or was invalidated, the last client's entry is ended, and
+// a new entry is started for the new owner.  Renewals only update the
+// End of the current entry in memory.
+func (p *DataTracker) noteLeaseSaved(ref store.KeySaver) {
+	l, ok := ref.(*Lease)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	length := p.intPref("leaseHistoryLength", defaultLeaseHistoryLength)
+	if length <= 0 {
+		return
+	}
+	h := p.leaseHistory
+	h.Lock()
+	defer h.Unlock()
+	key := l.Key()
+	entries := h.entries[key]
+	var last *LeaseHistoryEntry
+	if len(entries) > 0 && entries[len(entries)-1].Current {
+		last = entries[len(entries)-1]
+	}
+	switch {
+	case last != nil && last.Strategy == l.Strategy && last.Token == l.Token:
+		last.End = l.ExpireTime
+		return
+	case last == nil && l.Token == "":
+		return
+	default:
+		if last != nil {
+			last.Current = false
+			if last.End.After(now) {
+				last.End = now
+			}
+		}
+		if l.Token != "" {
+			h.entries[key] = append(entries, &LeaseHistoryEntry{
+				Strategy: l.Strategy,
+				Token:    l.Token,
+				Start:    now,
+				End:      l.ExpireTime,
+				Current:  true,
+			})
+		}
+	}
+	h.trim(key, now, length, p.intPref("leaseHistoryRetention", defaultLeaseHistoryRetention))
+	if err := h.save(key); err != nil {
+		p.Printf("Failed to save lease history for %s: %v", l.Addr, err)
+	}
+}
+
+// noteLeaseRemoved ends the entry for the client that held ref, if it
+// is a Lease.
+func (p *DataTracker) noteLeaseRemoved(ref store.KeySaver) {
+	l, ok := ref.(*Lease)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	h := p.leaseHistory
+	h.Lock()
+	defer h.Unlock()
+	key := l.Key()
+	entries := h.entries[key]
+	if len(entries) == 0 || !entries[len(entries)-1].Current {
+		return
+	}
+	last := entries[len(entries)-1]
+	last.Current = false
+	if last.End.After(now) {
+		last.End = now
+	}
+	if err := h.save(key); err != nil {
+		p.Printf("Failed to save lease history for %s: %v", l.Addr, err)
+	}
+}
+
+// LeaseHistory returns who has held addr, oldest first, limited by
+// the leaseHistoryLength and leaseHistoryRetention preferences.  The
+// End of the current entry is the expire time of the lease for addr.
+func (p *DataTracker) LeaseHistory(addr net.IP) []*LeaseHistoryEntry {
+	length := p.intPref("leaseHistoryLength", defaultLeaseHistoryLength)
+	retention := p.intPref("leaseHistoryRetention", defaultLeaseHistoryRetention)
+	d, unlocker := p.LockEnts("leases")
+	defer unlocker()
+	var lease *Lease
+	if l := d("leases").Find(Hexaddr(addr)); l != nil {
+		lease = AsLease(l)
+	}
+	h := p.leaseHistory
+	h.Lock()
+	defer h.Unlock()
+	key := Hexaddr(addr)
+	if length > 0 {
+		h.trim(key, time.Now(), length, retention)
+	}
+	res := make([]*LeaseHistoryEntry, 0, len(h.entries[key]))
+	for _, e := range h.entries[key] {
+		entry := *e
+		if entry.Current && lease != nil && lease.Strategy == entry.Strategy && lease.Token == entry.Token {
+			entry.End = lease.ExpireTime
+		}
+		res = append(res, &entry)
+	}
+	return res
+}
@@ -0,0 +1,92 @@
+package backend
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/store"
+)
+
+func TestLeaseHistory(t *testing.T) {
+	dt := mkDT(nil)
+	hs, _ := store.Open("memory:///")
+	if err := dt.SetLeaseHistoryStore(hs); err != nil {
+		t.Fatalf("Failed to set lease history store: %v", err)
+	}
+	addr := net.ParseIP("192.168.124.80")
+	now := time.Now()
+	lease := &Lease{p: dt, Addr: addr, Strategy: "MAC", Token: "l1", ExpireTime: now.Add(time.Hour)}
+	func() {
+		d, unlocker := dt.LockEnts("subnets", "reservations", "leases", "preferences", "bootenvs")
+		defer unlocker()
+		startObjs := []crudTest{
+			{"Initial Subnet", dt.Create, &Subnet{p: dt, Enabled: true, Name: "sn", Subnet: "192.168.124.0/24", ActiveStart: net.ParseIP("192.168.124.80"), ActiveEnd: net.ParseIP("192.168.124.254"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "MAC"}, true, nil},
+			{"Lease", dt.Create, lease, true, nil},
+		}
+		for _, obj := range startObjs {
+			obj.Test(t, d)
+		}
+		lease.ExpireTime = now.Add(2 * time.Hour)
+		dt.Save(d, lease, nil)
+	}()
+	hist := dt.LeaseHistory(addr)
+	if len(hist) != 1 || hist[0].Token != "l1" || !hist[0].Current || !hist[0].End.Equal(now.Add(2*time.Hour)) {
+		t.Fatalf("Expected a renewed entry for l1, got %+v", hist)
+	}
+	saved := []*LeaseHistoryEntry{}
+	if err := hs.Load(Hexaddr(addr), &saved); err != nil || len(saved) != 1 || !saved[0].End.Equal(now.Add(time.Hour)) {
+		t.Fatalf("Expected the renewal to not be saved, got %+v (%v)", saved, err)
+	}
+
+	func() {
+		d, unlocker := dt.LockEnts("leases")
+		defer unlocker()
+		// Take the lease over, the way the address pickers do.
+		lease.Token = "l2"
+		dt.Save(d, lease, nil)
+	}()
+	hist = dt.LeaseHistory(addr)
+	if len(hist) != 2 || hist[0].Current || hist[0].End.After(time.Now()) || hist[1].Token != "l2" || !hist[1].Current {
+		t.Fatalf("Expected l1 to be ended and l2 to hold the address, got %+v", hist)
+	}
+
+	func() {
+		d, unlocker := dt.LockEnts("leases", "preferences", "bootenvs")
+		defer unlocker()
+		if _, err := dt.Remove(d, lease, nil); err != nil {
+			t.Fatalf("Failed to remove lease: %v", err)
+		}
+		if err := dt.SetPrefs(d, map[string]string{"leaseHistoryLength": "2"}); err != nil {
+			t.Fatalf("Failed to set leaseHistoryLength: %v", err)
+		}
+	}()
+	hist = dt.LeaseHistory(addr)
+	if len(hist) != 2 || hist[1].Current {
+		t.Fatalf("Expected removing the lease to end l2, got %+v", hist)
+	}
+
+	func() {
+		d, unlocker := dt.LockEnts("subnets", "reservations", "leases")
+		defer unlocker()
+		lease = &Lease{p: dt, Addr: addr, Strategy: "MAC", Token: "l3", ExpireTime: now.Add(time.Hour)}
+		if _, err := dt.Create(d, lease, nil); err != nil {
+			t.Fatalf("Failed to create lease: %v", err)
+		}
+	}()
+	hist = dt.LeaseHistory(addr)
+	if len(hist) != 2 || hist[0].Token != "l2" || hist[1].Token != "l3" {
+		t.Fatalf("Expected only the last 2 entries to be kept, got %+v", hist)
+	}
+
+	dt2 := mkDT(nil)
+	if err := dt2.SetLeaseHistoryStore(hs); err != nil {
+		t.Fatalf("Failed to load lease history: %v", err)
+	}
+	if hist = dt2.LeaseHistory(addr); len(hist) != 2 || hist[1].Token != "l3" {
+		t.Errorf("Expected the lease history to be loaded from the store, got %+v", hist)
+	}
+	if hist = dt2.LeaseHistory(net.ParseIP("192.168.124.81")); len(hist) != 0 {
+		t.Errorf("Expected no history for an address that was never leased, got %+v", hist)
+	}
+}
@@ -0,0 +1,142 @@
+package backend
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LeaseSweeper periodically walks the lease table looking for
+// expired leases.  Leases are otherwise only reclaimed lazily when
+// an address picker needs them, so without the sweeper a busy
+// subnet would accumulate leases forever.
+//
+// Each lease that expires is announced once with a leases.expire
+// event.  Leases that have been expired for longer than the
+// leaseReapGrace preference are removed from the lease table, and
+// announced with a leases.reap event that carries the final state of
+// the lease so that event consumers can archive it.
+//
+// Each pass also checks how full every subnet is, so that subnets
+// whose leases expire send subnets.below threshold events.
+type LeaseSweeper struct {
+	dt        *DataTracker
+	done      chan struct{}
+	stopped   chan struct{}
+	mux       sync.Mutex
+	announced map[string]time.Time
+}
+
+// Default values for the leaseSweepInterval and leaseReapGrace
+// preferences, in seconds.
+const (
+	defaultLeaseSweepInterval = 60
+	defaultLeaseReapGrace     = 86400
+)
+
+func (p *DataTracker) intPref(name string, def int) int {
+	if val, err := strconv.Atoi(p.pref(name)); err == nil {
+		return val
+	}
+	return def
+}
+
+// NewLeaseSweeper creates a LeaseSweeper for the DataTracker.  It
+// does nothing until Start is called.
+func (p *DataTracker) NewLeaseSweeper() *LeaseSweeper {
+	return &LeaseSweeper{
+		dt:        p,
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+		announced: map[string]time.Time{},
+	}
+}
+
+// Start runs Sweep in the background every leaseSweepInterval
+// seconds until Shutdown is called.  Setting leaseSweepInterval to 0
+// pauses sweeping.
+func (s *LeaseSweeper) Start() *LeaseSweeper {
+	go func() {
+		defer close(s.stopped)
+		for {
+			interval := s.dt.intPref("leaseSweepInterval", defaultLeaseSweepInterval)
+			enabled := interval > 0
+			if !enabled {
+				// Check back every so often to see if we have been turned back on.
+				interval = defaultLeaseSweepInterval
+			}
+			select {
+			case <-s.done:
+				return
+			case <-time.After(time.Duration(interval) * time.Second):
+			}
+			if enabled {
+				s.Sweep(time.Now())
+			}
+		}
+	}()
+	return s
+}
+
+// Sweep makes one pass over the lease table, announcing leases that
+// have expired as of now and reaping leases that have been expired
+// for longer than the grace period.  It returns the number of leases
+// that were announced and reaped.
+func (s *LeaseSweeper) Sweep(now time.Time) (expired, reaped int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	grace := time.Duration(s.dt.intPref("leaseReapGrace", defaultLeaseReapGrace)) * time.Second
+	d, unlocker := s.dt.LockEnts("subnets", "reservations", "leases")
+	defer unlocker()
+	seen := map[string]struct{}{}
+	toReap := []*Lease{}
+	for _, i := range d("leases").Items() {
+		lease := AsLease(i)
+		if !lease.ExpireTime.Before(now) {
+			continue
+		}
+		key := lease.Key()
+		seen[key] = struct{}{}
+		if last, ok := s.announced[key]; !ok || !last.Equal(lease.ExpireTime) {
+			s.announced[key] = lease.ExpireTime
+			s.dt.publishers.Publish("leases", "expire", key, lease)
+			expired++
+		}
+		if lease.ExpireTime.Add(grace).Before(now) {
+			toReap = append(toReap, lease)
+		}
+	}
+	for _, lease := range toReap {
+		key := lease.Key()
+		if ok, err := s.dt.Remove(d, lease, nil); !ok {
+			s.dt.Printf("Lease sweeper failed to reap lease %s: %v", lease.Addr, err)
+			continue
+		}
+		delete(seen, key)
+		s.dt.publishers.Publish("leases", "reap", key, lease)
+		reaped++
+	}
+	// Forget about leases that have been renewed or removed.
+	for key := range s.announced {
+		if _, ok := seen[key]; !ok {
+			delete(s.announced, key)
+		}
+	}
+	if expired > 0 || reaped > 0 {
+		s.dt.Infof("debugDhcp", "Lease sweeper: %d leases expired, %d leases reaped", expired, reaped)
+	}
+	s.dt.checkAllSubnetUsage(d)
+	return
+}
+
+// Shutdown stops the background sweeper.
+func (s *LeaseSweeper) Shutdown(ctx context.Context) error {
+	close(s.done)
+	select {
+	case <-s.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package backend
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type eventRecorder struct {
+	events []*Event
+}
+
+func (r *eventRecorder) Publish(e *Event) error {
+	r.events = append(r.events, e)
+	return nil
+}
+func (r *eventRecorder) Reserve() error { return nil }
+func (r *eventRecorder) Release()       {}
+func (r *eventRecorder) Unload()        {}
+
+func (r *eventRecorder) count(action string) int {
+	res := 0
+	for _, e := range r.events {
+		if e.Type == "leases" && e.Action == action {
+			res++
+		}
+	}
+	return res
+}
+
+func TestLeaseSweeper(t *testing.T) {
+	dt := mkDT(nil)
+	rec := &eventRecorder{}
+	dt.publishers.Add(rec)
+	now := time.Now()
+	func() {
+		d, unlocker := dt.LockEnts("subnets", "reservations", "leases", "preferences", "bootenvs")
+		defer unlocker()
+		startObjs := []crudTest{
+			{"Initial Subnet", dt.Create, &Subnet{p: dt, Enabled: true, Name: "sn", Subnet: "192.168.124.0/24", ActiveStart: net.ParseIP("192.168.124.80"), ActiveEnd: net.ParseIP("192.168.124.254"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "mac"}, true, nil},
+			{"Valid Lease", dt.Create, &Lease{p: dt, Addr: net.ParseIP("192.168.124.80"), Strategy: "mac", Token: "l1", ExpireTime: now.Add(time.Hour)}, true, nil},
+			{"Recently Expired Lease", dt.Create, &Lease{p: dt, Addr: net.ParseIP("192.168.124.81"), Strategy: "mac", Token: "l2", ExpireTime: now.Add(-time.Minute)}, true, nil},
+			{"Stale Lease", dt.Create, &Lease{p: dt, Addr: net.ParseIP("192.168.124.82"), Strategy: "mac", Token: "l3", ExpireTime: now.Add(-2 * time.Hour)}, true, nil},
+		}
+		for _, obj := range startObjs {
+			obj.Test(t, d)
+		}
+		if err := dt.SetPrefs(d, map[string]string{"leaseReapGrace": "3600"}); err != nil {
+			t.Fatalf("Failed to set leaseReapGrace: %v", err)
+		}
+	}()
+	sweeper := dt.NewLeaseSweeper()
+	if expired, reaped := sweeper.Sweep(now); expired != 2 || reaped != 1 {
+		t.Errorf("Expected first sweep to expire 2 leases and reap 1, got %d and %d", expired, reaped)
+	}
+	if expired, reaped := sweeper.Sweep(now); expired != 0 || reaped != 0 {
+		t.Errorf("Expected second sweep to do nothing, got %d expired and %d reaped", expired, reaped)
+	}
+	if rec.count("expire") != 2 || rec.count("reap") != 1 {
+		t.Errorf("Expected 2 expire and 1 reap events, got %d and %d", rec.count("expire"), rec.count("reap"))
+	}
+	func() {
+		d, unlocker := dt.LockEnts("leases")
+		defer unlocker()
+		if d("leases").Find(Hexaddr(net.ParseIP("192.168.124.82"))) != nil {
+			t.Errorf("Stale lease should have been reaped")
+		}
+		if d("leases").Find(Hexaddr(net.ParseIP("192.168.124.81"))) == nil {
+			t.Errorf("Recently expired lease should not have been reaped")
+		}
+	}()
+	// Two hours on, the valid lease has expired and the recently
+	// expired one is past the grace period.
+	if expired, reaped := sweeper.Sweep(now.Add(2 * time.Hour)); expired != 1 || reaped != 1 {
+		t.Errorf("Expected third sweep to expire 1 lease and reap 1, got %d and %d", expired, reaped)
+	}
+}
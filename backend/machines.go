@@ -47,6 +47,11 @@ type Machine struct {
 	//
 	// swagger:strfmt ipv4
 	Address net.IP
+	// HardwareAddrs are the hardware addresses of the network
+	// interfaces of the machine, if they are known.  Machines
+	// created by the AutoMachines setting of a subnet start out
+	// with the address they first sent a DHCPDISCOVER from.
+	HardwareAddrs []string
 	// The boot environment that the machine should boot into.  This
 	// must be the name of a boot environment present in the backend.
 	// If this field is not present or blank, the global default bootenv
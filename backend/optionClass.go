@@ -0,0 +1,159 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// OptionClass selects extra DHCP options for the clients that match
+// it, based on what the client says about itself in its request.
+// A class matches a client when every one of Arch, VendorClass,
+// and UserClass that is set matches.  A class with none of them set
+// matches every client.
+//
+// swagger:model
+type OptionClass struct {
+	// Name describes the clients the class is for.
+	//
+	// required: true
+	Name string
+	// Arch is the list of client system architecture types (as
+	// sent in option 93) the class matches.  Common ones are 0 for
+	// legacy BIOS, 6 for 32 bit x86 UEFI, 7 and 9 for 64 bit x86
+	// UEFI, 11 for 64 bit ARM UEFI, and 16 for x86 UEFI HTTP boot.
+	Arch []int
+	// VendorClass is matched against the start of the vendor class
+	// identifier (option 60), e.g. PXEClient or HTTPClient.
+	VendorClass string
+	// UserClass is matched against the user class (option 77),
+	// e.g. iPXE.
+	UserClass string
+	// NextServer, if set, is the next server for clients that
+	// match the class.
+	//
+	// swagger:strfmt ipv4
+	NextServer net.IP
+	// Options are the DHCP options handed out to clients that
+	// match the class, in addition to and overriding the options
+	// of the subnet or reservation the class is attached to.
+	Options []DhcpOption
+}
+
+// DefaultOptionClasses are the option classes used for a subnet
+// that does not set any and does not hand out a boot file (option
+// 67) itself.  They cover iPXE chainloading, legacy BIOS and x86
+// UEFI PXE clients, and x86_64 UEFI HTTP Boot clients.
+func DefaultOptionClasses() []OptionClass {
+	return []OptionClass{
+		{
+			Name:      "iPXE",
+			UserClass: "iPXE",
+			Options:   []DhcpOption{{Code: dhcp.OptionBootFileName, Value: "default.ipxe"}},
+		},
+		{
+			Name:    "Legacy BIOS",
+			Arch:    []int{0},
+			Options: []DhcpOption{{Code: dhcp.OptionBootFileName, Value: "lpxelinux.0"}},
+		},
+		{
+			Name:    "x86 UEFI",
+			Arch:    []int{6},
+			Options: []DhcpOption{{Code: dhcp.OptionBootFileName, Value: "bootia32.efi"}},
+		},
+		{
+			Name:    "x86_64 UEFI",
+			Arch:    []int{7, 9},
+			Options: []DhcpOption{{Code: dhcp.OptionBootFileName, Value: "bootx64.efi"}},
+		},
+		{
+			Name:        "x86_64 UEFI HTTP Boot",
+			Arch:        []int{16},
+			VendorClass: "HTTPClient",
+			Options:     []DhcpOption{{Code: dhcp.OptionBootFileName, Value: "ipxe.efi"}},
+		},
+	}
+}
+
+// userClasses splits a user class option into the classes in it.
+// RFC 3004 says each class is prefixed with its length, but many
+// clients (iPXE included) just send a bare string, so the whole
+// option is always included as well.
+func userClasses(b []byte) [][]byte {
+	res := [][]byte{b}
+	for len(b) > 0 && int(b[0]) < len(b) {
+		res = append(res, b[1:1+int(b[0])])
+		b = b[1+int(b[0]):]
+	}
+	return res
+}
+
+// Matches returns whether a client that sent options matches the
+// class.
+func (c *OptionClass) Matches(options dhcp.Options) bool {
+	if len(c.Arch) > 0 {
+		found := false
+		arches := options[dhcp.OptionClientArchitecture]
+		for i := 0; i+1 < len(arches) && !found; i += 2 {
+			arch := int(binary.BigEndian.Uint16(arches[i:]))
+			for _, a := range c.Arch {
+				if a == arch {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if c.VendorClass != "" && !bytes.HasPrefix(options[dhcp.OptionVendorClassIdentifier], []byte(c.VendorClass)) {
+		return false
+	}
+	if c.UserClass != "" {
+		found := false
+		for _, uc := range userClasses(options[dhcp.OptionUserClass]) {
+			if string(uc) == c.UserClass {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchOptionClass returns the first of classes that a client that
+// sent options matches, or nil if there is none.
+func MatchOptionClass(classes []OptionClass, options dhcp.Options) *OptionClass {
+	for i := range classes {
+		if classes[i].Matches(options) {
+			return &classes[i]
+		}
+	}
+	return nil
+}
+
+func validateOptionClasses(e *Error, classes []OptionClass) {
+	for _, c := range classes {
+		if c.Name == "" {
+			e.Errorf("Option classes must have a Name")
+		}
+		for _, a := range c.Arch {
+			if a < 0 || a > 0xffff {
+				e.Errorf("Option class %s: %d is not a valid client architecture", c.Name, a)
+			}
+		}
+		validateMaybeZeroIP4(e, c.NextServer)
+		for _, opt := range c.Options {
+			if opt.Value == "" && len(opt.SubOptions) == 0 {
+				e.Errorf("Option class %s: option %d has no value", c.Name, opt.Code)
+			}
+		}
+		validateSubOptions(e, c.Options)
+	}
+}
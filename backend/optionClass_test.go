@@ -0,0 +1,68 @@
+package backend
+
+import (
+	"testing"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+func TestOptionClassMatches(t *testing.T) {
+	bios := dhcp.Options{
+		dhcp.OptionClientArchitecture:    []byte{0, 0},
+		dhcp.OptionVendorClassIdentifier: []byte("PXEClient:Arch:00000:UNDI:002001"),
+	}
+	uefi := dhcp.Options{
+		dhcp.OptionClientArchitecture:    []byte{0, 7},
+		dhcp.OptionVendorClassIdentifier: []byte("PXEClient:Arch:00007:UNDI:003016"),
+	}
+	arm := dhcp.Options{
+		dhcp.OptionClientArchitecture:    []byte{0, 11},
+		dhcp.OptionVendorClassIdentifier: []byte("PXEClient:Arch:00011:UNDI:003000"),
+	}
+	ipxe := dhcp.Options{
+		dhcp.OptionClientArchitecture:    []byte{0, 7},
+		dhcp.OptionVendorClassIdentifier: []byte("PXEClient:Arch:00007:UNDI:003016"),
+		dhcp.OptionUserClass:             []byte("iPXE"),
+	}
+	rfc3004 := dhcp.Options{
+		dhcp.OptionUserClass: []byte{4, 'i', 'P', 'X', 'E', 3, 'l', 'a', 'b'},
+	}
+	tests := []struct {
+		class   OptionClass
+		options dhcp.Options
+		matches bool
+	}{
+		{OptionClass{Name: "any"}, dhcp.Options{}, true},
+		{OptionClass{Name: "bios", Arch: []int{0}}, bios, true},
+		{OptionClass{Name: "bios", Arch: []int{0}}, uefi, false},
+		{OptionClass{Name: "bios", Arch: []int{0}}, dhcp.Options{}, false},
+		{OptionClass{Name: "uefi", Arch: []int{7, 9}}, uefi, true},
+		{OptionClass{Name: "arm", Arch: []int{11}, VendorClass: "PXEClient"}, arm, true},
+		{OptionClass{Name: "arm", Arch: []int{11}, VendorClass: "HTTPClient"}, arm, false},
+		{OptionClass{Name: "ipxe", UserClass: "iPXE"}, ipxe, true},
+		{OptionClass{Name: "ipxe", UserClass: "iPXE"}, uefi, false},
+		{OptionClass{Name: "ipxe", UserClass: "iPXE"}, rfc3004, true},
+		{OptionClass{Name: "lab", UserClass: "lab"}, rfc3004, true},
+	}
+	for _, test := range tests {
+		if m := test.class.Matches(test.options); m != test.matches {
+			t.Errorf("Option class %s matching %v: expected %v, got %v", test.class.Name, test.options, test.matches, m)
+		}
+	}
+	defaults := DefaultOptionClasses()
+	for _, test := range []struct {
+		options dhcp.Options
+		name    string
+	}{
+		{bios, "Legacy BIOS"},
+		{uefi, "x86_64 UEFI"},
+		{ipxe, "iPXE"},
+	} {
+		if c := MatchOptionClass(defaults, test.options); c == nil || c.Name != test.name {
+			t.Errorf("Expected default option class %s for %v, got %v", test.name, test.options, c)
+		}
+	}
+	if c := MatchOptionClass(defaults, arm); c != nil {
+		t.Errorf("Expected no default option class for ARM UEFI, got %s", c.Name)
+	}
+}
@@ -2,24 +2,30 @@ package backend
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/url"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"text/template"
+	"text/template/parse"
 
 	"github.com/digitalrebar/store"
 )
 
 type renderer struct {
 	path, name string
-	write      func(net.IP) (*bytes.Reader, error)
+	write      dynamicFile
+	boot       *bootFile
 }
 
 func (r renderer) register(fs *FileSystem) {
-	fs.addDynamic(r.path, r.write)
+	fs.addDynamic(r.path, r.boot, r.write)
 }
 
 func (r renderer) deregister(fs *FileSystem) {
@@ -70,7 +76,7 @@ func newRenderedTemplate(r *RenderData,
 	return renderer{
 		path: path,
 		name: tmplKey,
-		write: func(remoteIP net.IP) (*bytes.Reader, error) {
+		write: func(remoteIP net.IP) (*bytes.Reader, string, error) {
 			objs, unlocker := p.LockEnts("tasks", "machines", "bootenvs", "profiles")
 			defer unlocker()
 			var rd *RenderData
@@ -79,7 +85,7 @@ func newRenderedTemplate(r *RenderData,
 			for i, prefix := range prefixes {
 				item := objs(prefix).Find(keys[i])
 				if item == nil {
-					return nil, fmt.Errorf("%s:%s has vanished", prefix, keys[i])
+					return nil, "", fmt.Errorf("%s:%s has vanished", prefix, keys[i])
 				}
 				switch item.(type) {
 				case renderable:
@@ -95,14 +101,95 @@ func newRenderedTemplate(r *RenderData,
 			buf := bytes.Buffer{}
 			tmpl := target.templates().Lookup(tmplKey)
 			if err := tmpl.Execute(&buf, rd); err != nil {
-				return nil, err
+				return nil, "", err
 			}
 			p.Debugf("debugRenderer", "Content:\n%s\n", string(buf.Bytes()))
-			return bytes.NewReader(buf.Bytes()), nil
+			version := ""
+			if !rd.uncacheable {
+				version = rd.version(tmplKey)
+			}
+			return bytes.NewReader(buf.Bytes()), version, nil
 		},
 	}
 }
 
+// templatesUsed returns the names of the templates in root that
+// rendering name can run, name included, in sorted order.
+func templatesUsed(root *template.Template, name string) []string {
+	seen := map[string]bool{}
+	var walk func(name string)
+	var visit func(n parse.Node)
+	walk = func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		if t := root.Lookup(name); t != nil && t.Tree != nil {
+			visit(t.Tree.Root)
+		}
+	}
+	visit = func(n parse.Node) {
+		switch n := n.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, c := range n.Nodes {
+				visit(c)
+			}
+		case *parse.TemplateNode:
+			walk(n.Name)
+		case *parse.IfNode:
+			visit(n.List)
+			visit(n.ElseList)
+		case *parse.RangeNode:
+			visit(n.List)
+			visit(n.ElseList)
+		case *parse.WithNode:
+			visit(n.List)
+			visit(n.ElseList)
+		}
+	}
+	walk(name)
+	res := make([]string, 0, len(seen))
+	for name := range seen {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// version returns a hash of everything that went into rendering
+// tmplKey for r: the machine, the boot environment or task, the
+// profiles the machine gets parameters from, the templates rendering
+// tmplKey runs, and the address we are talking to the client on.  If
+// none of them change, rendering the template again gives the same
+// result.
+func (r *RenderData) version(tmplKey string) string {
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	fmt.Fprintf(h, "%s\x00%s\x00", tmplKey, r.p.LocalIP(r.remoteIP))
+	enc.Encode(r.target)
+	profiles := []string{}
+	if r.Machine != nil {
+		enc.Encode(r.Machine.Machine)
+		profiles = append(profiles, r.Machine.Profiles...)
+	}
+	for _, name := range append(profiles, r.p.GlobalProfileName) {
+		if profile := r.d("profiles").Find(name); profile != nil {
+			enc.Encode(profile)
+		}
+	}
+	root := r.target.templates()
+	for _, name := range templatesUsed(root, tmplKey) {
+		fmt.Fprintf(h, "%s\x00", name)
+		if t := root.Lookup(name); t != nil && t.Tree != nil {
+			fmt.Fprintf(h, "%s\x00", t.Tree.Root)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
 type rMachine struct {
 	*Machine
 	renderData *RenderData
@@ -165,6 +252,15 @@ type RenderData struct {
 	target   renderable
 	p        *DataTracker
 	remoteIP net.IP
+	// uncacheable is set if the template asked for something that is
+	// different every time it is rendered.
+	uncacheable bool
+	// overrides are parameters that take precedence over the ones
+	// the machine and profiles have, for previewing renders.
+	overrides map[string]interface{}
+	// preview is set when rendering for a preview rather than for
+	// a client, so no real tokens are handed out.
+	preview bool
 }
 
 func newRenderData(d Stores, p *DataTracker, m *Machine, r renderable) *RenderData {
@@ -194,7 +290,14 @@ func (r *RenderData) ApiURL() string {
 	return r.p.ApiURL(r.remoteIP)
 }
 
+// previewToken is what GenerateToken returns when previewing renders.
+const previewToken = "<token>"
+
 func (r *RenderData) GenerateToken() string {
+	r.uncacheable = true
+	if r.preview {
+		return previewToken
+	}
 	var t string
 	if r.Machine == nil {
 		ttl := 600
@@ -254,6 +357,9 @@ func (r *RenderData) ParseUrl(segment, rawUrl string) (string, error) {
 
 // ParamExists is a helper function for determining the existence of a machine parameter.
 func (r *RenderData) ParamExists(key string) bool {
+	if _, ok := r.overrides[key]; ok {
+		return true
+	}
 	if r.Machine != nil {
 		_, ok := r.Machine.GetParam(r.d, key, true)
 		if ok {
@@ -271,6 +377,9 @@ func (r *RenderData) ParamExists(key string) bool {
 
 // Param is a helper function for extracting a parameter from Machine.Params
 func (r *RenderData) Param(key string) (interface{}, error) {
+	if v, ok := r.overrides[key]; ok {
+		return v, nil
+	}
 	if r.Machine != nil {
 		v, ok := r.Machine.GetParam(r.d, key, true)
 		if ok {
@@ -286,34 +395,54 @@ func (r *RenderData) Param(key string) (interface{}, error) {
 	return nil, fmt.Errorf("No such machine parameter %s", key)
 }
 
-func (r *RenderData) makeRenderers(e *Error) renderers {
-	toRender, requiredParams := r.target.renderInfo()
+// checkParams reports the required parameters of the target that
+// are missing.
+func (r *RenderData) checkParams(e *Error) {
+	_, requiredParams := r.target.renderInfo()
 	for _, param := range requiredParams {
 		if !r.ParamExists(param) {
 			e.Errorf("Missing required parameter %s for %s %s", param, r.target.Prefix(), r.target.Key())
 		}
 	}
+}
+
+// renderPath expands the Path of ti.  Paths of boot environment
+// templates are absolute, and paths of task templates are relative.
+func (r *RenderData) renderPath(ti *TemplateInfo) (string, error) {
+	if ti.pathTmpl == nil {
+		return "", nil
+	}
+	buf := &bytes.Buffer{}
+	if err := ti.pathTmpl.Execute(buf, r); err != nil {
+		return "", fmt.Errorf("Error rendering template %s path %s: %v",
+			ti.Name,
+			ti.Path,
+			err)
+	}
+	if r.target.Prefix() == "tasks" {
+		return path.Clean(buf.String()), nil
+	}
+	return path.Clean("/" + buf.String()), nil
+}
+
+func (r *RenderData) makeRenderers(e *Error) renderers {
+	toRender, _ := r.target.renderInfo()
+	r.checkParams(e)
 	rts := make(renderers, len(toRender))
 	for i := range toRender {
-		tmplPath := ""
 		ti := &toRender[i]
-		if ti.pathTmpl != nil {
-			// first, render the path
-			buf := &bytes.Buffer{}
-			if err := ti.pathTmpl.Execute(buf, r); err != nil {
-				e.Errorf("Error rendering template %s path %s: %v",
-					ti.Name,
-					ti.Path,
-					err)
-				continue
-			}
-			if r.target.Prefix() == "tasks" {
-				tmplPath = path.Clean(buf.String())
-			} else {
-				tmplPath = path.Clean("/" + buf.String())
-			}
+		tmplPath, err := r.renderPath(ti)
+		if err != nil {
+			e.Errorf("%v", err)
+			continue
 		}
 		rts[i] = newRenderedTemplate(r, ti.id(), tmplPath)
+		if r.Env != nil {
+			rts[i].boot = &bootFile{milestone: ti.Name, bootEnv: r.Env.Name}
+			if r.Machine != nil {
+				rts[i].boot.machine = r.Machine.Key()
+			}
+		}
 	}
 	return renderers(rts)
 }
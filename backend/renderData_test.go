@@ -405,3 +405,41 @@ func TestRenderData(t *testing.T) {
 	}()
 
 }
+
+func TestRenderDataVersion(t *testing.T) {
+	dt := mkDT(nil)
+	d, unlocker := dt.LockEnts("templates", "bootenvs", "machines", "profiles", "tasks")
+	defer unlocker()
+	inc := &Template{p: dt, ID: "versionInc", Contents: "included"}
+	other := &Template{p: dt, ID: "versionOther", Contents: "unrelated"}
+	for _, test := range []crudTest{
+		{"Create included template", dt.Create, inc, true, nil},
+		{"Create unrelated template", dt.Create, other, true, nil},
+		{"Create main template", dt.Create, &Template{p: dt, ID: "versionMain", Contents: `{{if true}}{{template "versionInc" .}}{{end}}`}, true, nil},
+		{"Create bootenv", dt.Create, &BootEnv{p: dt, Name: "versioned", Templates: []TemplateInfo{{Name: "main", Path: "versioned.ipxe", ID: "versionMain"}}}, true, nil},
+	} {
+		test.Test(t, d)
+	}
+	if used := templatesUsed(AsBootEnv(d("bootenvs").Find("versioned")).templates(), "versionMain"); len(used) != 2 || used[0] != "versionInc" || used[1] != "versionMain" {
+		t.Errorf("Expected versionMain to use itself and versionInc, got %v", used)
+	}
+	version := func() string {
+		be := AsBootEnv(d("bootenvs").Find("versioned"))
+		return newRenderData(d, dt, nil, be).version("versionMain")
+	}
+	first := version()
+	other.Contents = "still unrelated"
+	if ok, err := dt.Update(d, other, nil); !ok {
+		t.Fatalf("Failed to update unrelated template: %v", err)
+	}
+	if v := version(); v != first {
+		t.Errorf("Expected changing an unused template to keep the version, went from %s to %s", first, v)
+	}
+	inc.Contents = "included again"
+	if ok, err := dt.Update(d, inc, nil); !ok {
+		t.Fatalf("Failed to update included template: %v", err)
+	}
+	if v := version(); v == first {
+		t.Errorf("Expected changing an included template to change the version")
+	}
+}
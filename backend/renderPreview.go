@@ -0,0 +1,143 @@
+package backend
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/pborman/uuid"
+)
+
+// RenderedFile is one template of a boot environment or task
+// rendered for a machine.
+//
+// swagger:model
+type RenderedFile struct {
+	// Name is the Name of the template in the boot environment or
+	// task.
+	//
+	// required: true
+	Name string
+	// Path is the expanded Path of the template.  For boot
+	// environments, it is where the static file server and the
+	// TFTP server would serve the file.  For tasks, it is where
+	// the file would be written on the machine, or empty if the
+	// file would be run as a script.
+	Path string
+	// Contents is the rendered file.
+	Contents string
+	// Error is the error rendering the file, if there was one.
+	Error string
+}
+
+// RenderPreview is what the templates of a boot environment or task
+// render to for a machine.
+//
+// swagger:model
+type RenderPreview struct {
+	// Machine is the machine the templates were rendered for.
+	//
+	// required: true
+	// swagger:strfmt uuid
+	Machine uuid.UUID
+	// BootEnv is the boot environment that was rendered, if a
+	// boot environment was.
+	BootEnv string
+	// Task is the task that was rendered, if a task was.
+	Task string
+	// Files are the rendered templates, in the order they are
+	// listed in the boot environment or task.
+	//
+	// required: true
+	Files []*RenderedFile
+	// Errors are the required parameters that are missing, and
+	// any other errors that kept the templates from being
+	// rendered.
+	//
+	// required: true
+	Errors []string
+}
+
+// RenderPreview renders the templates of the boot environment
+// bootEnv, or of the task task, for the machine with machineKey,
+// without making them available over TFTP or HTTP.  If neither is
+// given, the machine's own boot environment is rendered.  Parameters
+// in overrides take precedence over the machine's own, so that
+// changes can be tried out before they are made.  GenerateToken
+// renders as a placeholder rather than a usable token.
+func (p *DataTracker) RenderPreview(machineKey, bootEnv, task string, overrides map[string]interface{}) (*RenderPreview, error) {
+	d, unlocker := p.LockEnts("tasks", "machines", "bootenvs", "profiles", "templates")
+	defer unlocker()
+	e := &Error{Code: http.StatusNotFound, Type: "API_ERROR", Model: "machines", Key: machineKey}
+	found := d("machines").Find(machineKey)
+	if found == nil {
+		e.Errorf("Render: %s: Not Found", machineKey)
+		return nil, e
+	}
+	machine := AsMachine(found)
+	if bootEnv != "" && task != "" {
+		e.Code = http.StatusBadRequest
+		e.Errorf("Render: only one of bootenv or task may be given")
+		return nil, e
+	}
+	if bootEnv == "" && task == "" {
+		bootEnv = machine.BootEnv
+	}
+	var target renderable
+	if task != "" {
+		if t := d("tasks").Find(task); t != nil {
+			target = AsTask(t)
+		} else {
+			e.Model, e.Key = "tasks", task
+		}
+	} else if b := d("bootenvs").Find(bootEnv); b != nil {
+		target = AsBootEnv(b)
+	} else {
+		e.Model, e.Key = "bootenvs", bootEnv
+	}
+	if target == nil {
+		e.Errorf("Render: %s: Not Found", e.Key)
+		return nil, e
+	}
+	res := &RenderPreview{
+		Machine: machine.Uuid,
+		BootEnv: bootEnv,
+		Task:    task,
+		Files:   []*RenderedFile{},
+		Errors:  []string{},
+	}
+	root := target.templates()
+	if root == nil {
+		res.Errors = append(res.Errors, "Templates of "+target.Prefix()+" "+target.Key()+" failed to compile")
+		return res, nil
+	}
+	rd := newRenderData(d, p, machine, target)
+	rd.remoteIP = machine.Address
+	rd.overrides = overrides
+	rd.preview = true
+	paramErrs := &Error{}
+	rd.checkParams(paramErrs)
+	res.Errors = append(res.Errors, paramErrs.Messages...)
+	toRender, _ := target.renderInfo()
+	for i := range toRender {
+		ti := &toRender[i]
+		file := &RenderedFile{Name: ti.Name}
+		res.Files = append(res.Files, file)
+		tmplPath, err := rd.renderPath(ti)
+		if err != nil {
+			file.Error = err.Error()
+			continue
+		}
+		file.Path = tmplPath
+		tmpl := root.Lookup(ti.id())
+		if tmpl == nil {
+			file.Error = "Missing template " + ti.id()
+			continue
+		}
+		buf := &bytes.Buffer{}
+		if err := tmpl.Execute(buf, rd); err != nil {
+			file.Error = err.Error()
+		}
+		file.Contents = buf.String()
+	}
+	return res, nil
+}
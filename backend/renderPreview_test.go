@@ -0,0 +1,89 @@
+package backend
+
+import (
+	"net"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/pborman/uuid"
+)
+
+func TestRenderPreview(t *testing.T) {
+	dt := mkDT(nil)
+	m := &Machine{p: dt, Name: "m1", Uuid: uuid.NewRandom(), BootEnv: "default", Address: net.ParseIP("192.168.124.20")}
+	func() {
+		d, unlocker := dt.LockEnts("templates", "bootenvs", "machines", "profiles", "tasks", "params")
+		defer unlocker()
+		tests := []crudTest{
+			{"Create Template", dt.Create, &Template{p: dt, ID: "default", Contents: "default {{ .Machine.Name }}"}, true, nil},
+			{"Create preview Template", dt.Create, &Template{p: dt, ID: "preview", Contents: `{{ .Param "foo" }} {{ .Machine.Name }} {{ .GenerateToken }}`}, true, nil},
+			{"Create Bootenv", dt.Create, &BootEnv{p: dt, Name: "default", Templates: []TemplateInfo{{Name: "ipxe", Path: "{{ .Machine.Path }}/default.ipxe", ID: "default"}}}, true, nil},
+			{"Create Bootenv with required params", dt.Create, &BootEnv{p: dt, Name: "needsfoo", RequiredParams: []string{"foo"},
+				Templates: []TemplateInfo{
+					{Name: "cfg", Path: "{{ .Machine.Path }}/preview.cfg", ID: "preview"},
+					{Name: "broken", Path: `{{ .Param "bar" }}`, ID: "default"},
+				}}, true, nil},
+			{"Create Task", dt.Create, &Task{p: dt, Name: "t1", Templates: []TemplateInfo{{Name: "script", ID: "preview"}}}, true, nil},
+			{"Create Machine", dt.Create, m, true, nil},
+		}
+		for _, test := range tests {
+			test.Test(t, d)
+		}
+	}()
+
+	res, err := dt.RenderPreview(m.Key(), "", "", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error previewing the machine's bootenv: %v", err)
+	}
+	if res.BootEnv != "default" || len(res.Files) != 1 || res.Files[0].Contents != "default m1" ||
+		res.Files[0].Path != "/"+path.Join(m.Path(), "default.ipxe") || len(res.Errors) != 0 {
+		t.Errorf("Unexpected preview of the machine's bootenv: %+v %+v", res, res.Files)
+	}
+
+	res, err = dt.RenderPreview(m.Key(), "needsfoo", "", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error previewing needsfoo: %v", err)
+	}
+	if len(res.Errors) != 1 || !strings.Contains(res.Errors[0], "Missing required parameter foo") {
+		t.Errorf("Expected a missing parameter error, got %v", res.Errors)
+	}
+	if len(res.Files) != 2 || res.Files[0].Error == "" || res.Files[1].Error == "" {
+		t.Errorf("Expected both files to fail to render, got %+v %+v", res.Files[0], res.Files[1])
+	}
+
+	res, err = dt.RenderPreview(m.Key(), "needsfoo", "", map[string]interface{}{"foo": "bar", "bar": "baz"})
+	if err != nil {
+		t.Fatalf("Unexpected error previewing needsfoo with overrides: %v", err)
+	}
+	if len(res.Errors) != 0 || res.Files[0].Error != "" || res.Files[0].Contents != "bar m1 "+previewToken ||
+		res.Files[1].Path != "/baz" || res.Files[1].Contents != "default m1" {
+		t.Errorf("Unexpected preview with overrides: %v %+v %+v", res.Errors, res.Files[0], res.Files[1])
+	}
+	if out, _ := dt.FS.Open("/"+path.Join(m.Path(), "preview.cfg"), nil); out != nil {
+		t.Errorf("Expected a preview to not be served over TFTP or HTTP")
+	}
+
+	res, err = dt.RenderPreview(m.Key(), "", "t1", map[string]interface{}{"foo": "task"})
+	if err != nil {
+		t.Fatalf("Unexpected error previewing t1: %v", err)
+	}
+	if res.Task != "t1" || res.BootEnv != "" || len(res.Files) != 1 || res.Files[0].Path != "" || res.Files[0].Contents != "task m1 "+previewToken {
+		t.Errorf("Unexpected preview of t1: %+v %+v", res, res.Files)
+	}
+
+	for _, c := range []struct {
+		machine, bootEnv, task string
+		code                   int
+	}{
+		{uuid.NewRandom().String(), "", "", 404},
+		{m.Key(), "missing", "", 404},
+		{m.Key(), "", "missing", 404},
+		{m.Key(), "default", "t1", 400},
+	} {
+		_, err := dt.RenderPreview(c.machine, c.bootEnv, c.task, nil)
+		if be, ok := err.(*Error); !ok || be.Code != c.code {
+			t.Errorf("%s/%s/%s: Expected an error with code %d, got %v", c.machine, c.bootEnv, c.task, c.code, err)
+		}
+	}
+}
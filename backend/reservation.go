@@ -15,21 +15,27 @@ import (
 type Reservation struct {
 	validate
 	// Addr is the IP address permanently assigned to the strategy/token combination.
+	// It can be either an IPv4 or an IPv6 address.
 	//
 	// required: true
-	// swagger:strfmt ipv4
 	Addr net.IP
 	// Token is the unique identifier that the strategy for this Reservation should use.
 	//
 	// required: true
 	Token string
 	// NextServer is the address the server should contact next.
+	// It must be in the same address family as Addr.
 	//
 	// required: false
-	// swagger:strfmt ipv4
 	NextServer net.IP
-	// Options is the list of DHCP options that apply to this Reservation
+	// Options is the list of DHCP options that apply to this Reservation.
+	// If Addr is an IPv6 address, the option codes are DHCPv6 option codes.
 	Options []DhcpOption
+	// OptionClasses is the ordered list of option classes for this
+	// Reservation.  The first class the client matches adds its
+	// options to (and overrides) Options.  They are not supported
+	// for IPv6 reservations.
+	OptionClasses []OptionClass
 	// Strategy is the leasing strategy that will be used determine what to use from
 	// the DHCP packet to handle lease management.
 	//
@@ -210,6 +216,19 @@ func (r *Reservation) Validate() error {
 	e := &Error{Code: 422, Type: ValidationError, o: r}
 	validateIP4(e, r.Addr)
 	validateMaybeZeroIP4(e, r.NextServer)
+	if r.Addr != nil && len(r.NextServer) != 0 && !r.NextServer.IsUnspecified() &&
+		(r.Addr.To4() == nil) != (r.NextServer.To4() == nil) {
+		e.Errorf("NextServer %s is not in the same address family as %s", r.NextServer, r.Addr)
+	}
+	if r.Addr != nil && r.Addr.To4() == nil {
+		validateOptions6(e, r.Options)
+		if len(r.OptionClasses) > 0 {
+			e.Errorf("OptionClasses are not supported on IPv6 reservations")
+		}
+	} else {
+		validateSubOptions(e, r.Options)
+	}
+	validateOptionClasses(e, r.OptionClasses)
 	if len(r.NextServer) == 0 || r.NextServer.IsUnspecified() {
 		r.NextServer = nil
 	}
@@ -20,6 +20,8 @@ func TestReservationCrud(t *testing.T) {
 		{"Test Token Update", dt.Update, &Reservation{p: dt, Addr: net.ParseIP("192.168.124.10"), Token: "token2", Strategy: "token"}, false, nil},
 		{"Test Strategy Update", dt.Update, &Reservation{p: dt, Addr: net.ParseIP("192.168.124.10"), Token: "token", Strategy: "token2"}, false, nil},
 		{"Test Expire Update", dt.Update, &Reservation{p: dt, Addr: net.ParseIP("192.168.124.10"), Token: "token", Strategy: "token"}, true, nil},
+		{"Test IPv6 Create with IPv4 NextServer", dt.Create, &Reservation{p: dt, Addr: net.ParseIP("2001:db8::10"), Token: "token6", Strategy: "DUID", NextServer: net.ParseIP("192.168.124.1")}, false, nil},
+		{"Test IPv6 Create with IPv6 NextServer", dt.Create, &Reservation{p: dt, Addr: net.ParseIP("2001:db8::10"), Token: "token6", Strategy: "DUID", NextServer: net.ParseIP("2001:db8::1")}, true, nil},
 	}
 	for _, test := range tests {
 		test.Test(t, d)
@@ -27,8 +29,8 @@ func TestReservationCrud(t *testing.T) {
 	// List test.
 	bes := d("reservations").Items()
 	if bes != nil {
-		if len(bes) != 1 {
-			t.Errorf("List function should have returned: 1, but got %d\n", len(bes))
+		if len(bes) != 2 {
+			t.Errorf("List function should have returned: 2, but got %d\n", len(bes))
 		}
 	} else {
 		t.Errorf("List function returned nil!!")
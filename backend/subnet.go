@@ -1,12 +1,15 @@
 package backend
 
 import (
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"math/big"
 	"net"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/digitalrebar/provision/backend/index"
@@ -14,14 +17,25 @@ import (
 	dhcp "github.com/krolaw/dhcp4"
 )
 
-type picker func(*Subnet, map[string]store.KeySaver, string, net.IP) (*Lease, bool)
+// Picker is an address picking strategy.  It is passed the subnet,
+// the leases and reservations in the subnet's active range (keyed by
+// Hexaddr), the strategy and token of the client that needs a lease,
+// and the address the client asked for (if any).  It returns the
+// lease to hand out, or nil, and whether the remaining Pickers in the
+// subnet's list should be tried.  A new lease only needs its Addr,
+// Strategy, and Token filled in.
+//
+// Pickers are called with the subnets, reservations, and leases
+// locked, and must not hand out an address that the subnet may not
+// allocate.
+type Picker func(s *Subnet, usedAddrs map[string]store.KeySaver, strat, token string, hint net.IP) (*Lease, bool)
 
-func pickNone(s *Subnet, usedAddrs map[string]store.KeySaver, token string, hint net.IP) (*Lease, bool) {
+func pickNone(s *Subnet, usedAddrs map[string]store.KeySaver, strat, token string, hint net.IP) (*Lease, bool) {
 	// There are no free addresses, and don't fall through to using the most expired one.
 	return nil, false
 }
 
-func pickMostExpired(s *Subnet, usedAddrs map[string]store.KeySaver, token string, hint net.IP) (*Lease, bool) {
+func pickMostExpired(s *Subnet, usedAddrs map[string]store.KeySaver, strat, token string, hint net.IP) (*Lease, bool) {
 	currLeases := []*Lease{}
 	for _, obj := range usedAddrs {
 		lease, ok := obj.(*Lease)
@@ -38,98 +52,237 @@ func pickMostExpired(s *Subnet, usedAddrs map[string]store.KeySaver, token strin
 			// If we got to a non-expired lease, we are done
 			break
 		}
+		if !s.MayAllocate(lease.Addr) {
+			continue
+		}
 		// Because if how usedAddrs is built, we are guaranteed that an expired
 		// lease here is not associated with a reservation.
 		lease.Token = token
-		lease.Strategy = s.Strategy
+		lease.Strategy = strat
 		return lease, false
 	}
 	return nil, true
 }
 
-func pickHint(s *Subnet, usedAddrs map[string]store.KeySaver, token string, hint net.IP) (*Lease, bool) {
+func pickHint(s *Subnet, usedAddrs map[string]store.KeySaver, strat, token string, hint net.IP) (*Lease, bool) {
 	if hint == nil || !s.InActiveRange(hint) {
 		return nil, true
 	}
 	hex := Hexaddr(hint)
 	res, found := usedAddrs[hex]
 	if !found {
+		if !s.MayAllocate(hint) {
+			return nil, true
+		}
 		lease := &Lease{
 			Addr:     hint,
 			Token:    token,
-			Strategy: s.Strategy,
+			Strategy: strat,
 		}
 		return lease, false
 	}
 	if lease, ok := res.(*Lease); ok {
-		if lease.Token == token && lease.Strategy == s.Strategy {
+		if lease.Token == token && lease.Strategy == strat {
 			// hey, we already have a lease.  How nice.
 			return lease, false
 		}
-		if lease.Expired() {
+		if lease.Expired() && s.MayAllocate(hint) {
 			// We don't own this lease, but it is
 			// expired, so we can steal it.
 			lease.Token = token
-			lease.Strategy = s.Strategy
+			lease.Strategy = strat
 			return lease, false
 		}
 	}
 	return nil, false
 }
 
-func pickNextFree(s *Subnet, usedAddrs map[string]store.KeySaver, token string, hint net.IP) (*Lease, bool) {
+func pickNextFree(s *Subnet, usedAddrs map[string]store.KeySaver, strat, token string, hint net.IP) (*Lease, bool) {
+	start := familyIP(s.ActiveStart)
 	if s.nextLeasableIP == nil {
-		s.nextLeasableIP = net.IP(make([]byte, 4))
-		copy(s.nextLeasableIP, s.ActiveStart.To4())
+		s.nextLeasableIP = net.IP(make([]byte, len(start)))
+		copy(s.nextLeasableIP, start)
 	}
 	one := big.NewInt(1)
 	end := &big.Int{}
 	curr := &big.Int{}
-	end.SetBytes(s.ActiveEnd.To4())
-	curr.SetBytes(s.nextLeasableIP.To4())
+	end.SetBytes(familyIP(s.ActiveEnd))
+	curr.SetBytes(familyIP(s.nextLeasableIP))
 	// First, check from nextLeasableIp to ActiveEnd
 	for curr.Cmp(end) < 1 {
-		addr := net.IP(curr.Bytes()).To4()
+		addr := intToIP(curr, len(start))
 		hex := Hexaddr(addr)
 		curr.Add(curr, one)
-		if _, ok := usedAddrs[hex]; !ok {
+		if _, ok := usedAddrs[hex]; !ok && s.MayAllocate(addr) {
 			s.nextLeasableIP = addr
 			return &Lease{
 				Addr:     addr,
 				Token:    token,
-				Strategy: s.Strategy,
+				Strategy: strat,
 			}, false
 		}
 	}
 	// Next, check from ActiveStart to nextLeasableIP
-	end.SetBytes(s.nextLeasableIP.To4())
-	curr.SetBytes(s.ActiveStart.To4())
+	end.SetBytes(familyIP(s.nextLeasableIP))
+	curr.SetBytes(start)
 	for curr.Cmp(end) < 1 {
-		addr := net.IP(curr.Bytes()).To4()
+		addr := intToIP(curr, len(start))
 		hex := Hexaddr(addr)
 		curr.Add(curr, one)
-		if _, ok := usedAddrs[hex]; !ok {
+		if _, ok := usedAddrs[hex]; !ok && s.MayAllocate(addr) {
 			s.nextLeasableIP = addr
 			return &Lease{
 				Addr:     addr,
 				Token:    token,
-				Strategy: s.Strategy,
+				Strategy: strat,
+			}, false
+		}
+	}
+	// No free address, but we can use the most expired one.
+	return nil, true
+}
+
+// maxPickAttempts is how many addresses pickFrom will look at before
+// giving up.  IPv6 active ranges can be far too large to search all
+// of, and when we share them with a failover partner most of what
+// we look at may not be ours to hand out.
+const maxPickAttempts = 1 << 16
+
+// pickFrom tries to create a Lease with the first free address in
+// the active range, starting offset addresses past ActiveStart and
+// wrapping around to it.  If home is true, an expired lease at the
+// starting address is taken over as well.  No more than
+// maxPickAttempts addresses are looked at.
+func pickFrom(s *Subnet, usedAddrs map[string]store.KeySaver, strat, token string, offset *big.Int, home bool) (*Lease, bool) {
+	start := familyIP(s.ActiveStart)
+	first, end, curr := &big.Int{}, &big.Int{}, &big.Int{}
+	first.SetBytes(start)
+	end.SetBytes(familyIP(s.ActiveEnd))
+	curr.Add(first, offset)
+	one := big.NewInt(1)
+	attempts := s.activeRangeSize()
+	if attempts > maxPickAttempts {
+		attempts = maxPickAttempts
+	}
+	for i := attempts; i > 0; i-- {
+		if curr.Cmp(end) > 0 {
+			curr.Set(first)
+		}
+		addr := intToIP(curr, len(start))
+		curr.Add(curr, one)
+		atHome := home
+		home = false
+		res, found := usedAddrs[Hexaddr(addr)]
+		if !found {
+			if !s.MayAllocate(addr) {
+				continue
+			}
+			return &Lease{
+				Addr:     addr,
+				Token:    token,
+				Strategy: strat,
 			}, false
 		}
+		lease, ok := res.(*Lease)
+		if !ok {
+			continue
+		}
+		if lease.Token == token && lease.Strategy == strat {
+			return lease, false
+		}
+		if atHome && lease.Expired() && s.MayAllocate(addr) {
+			lease.Token = token
+			lease.Strategy = strat
+			return lease, false
+		}
 	}
 	// No free address, but we can use the most expired one.
 	return nil, true
 }
 
+// activeRange returns the number of addresses in the active range
+// as a big.Int, or nil if the range is empty.
+func (s *Subnet) activeRange() *big.Int {
+	size := s.activeRangeSize()
+	if size <= 0 {
+		return nil
+	}
+	return big.NewInt(size)
+}
+
+func pickHashed(s *Subnet, usedAddrs map[string]store.KeySaver, strat, token string, hint net.IP) (*Lease, bool) {
+	size := s.activeRange()
+	if size == nil {
+		return nil, true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(strat + ":" + token))
+	offset := &big.Int{}
+	offset.SetUint64(h.Sum64())
+	offset.Mod(offset, size)
+	return pickFrom(s, usedAddrs, strat, token, offset, true)
+}
+
+func pickRandom(s *Subnet, usedAddrs map[string]store.KeySaver, strat, token string, hint net.IP) (*Lease, bool) {
+	size := s.activeRange()
+	if size == nil {
+		return nil, true
+	}
+	offset, err := rand.Int(rand.Reader, size)
+	if err != nil {
+		return nil, true
+	}
+	return pickFrom(s, usedAddrs, strat, token, offset, false)
+}
+
+// familyIP returns the 4 byte form of an IPv4 address and the 16
+// byte form of anything else.
+func familyIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
+
+// intToIP converts i into an address that is size bytes long,
+// restoring any leading zero bytes that big.Int dropped.
+func intToIP(i *big.Int, size int) net.IP {
+	b := i.Bytes()
+	res := net.IP(make([]byte, size))
+	copy(res[size-len(b):], b)
+	return res
+}
+
 var (
-	pickStrategies = map[string]picker{}
+	pickStrategies = map[string]Picker{}
 )
 
+// RegisterPicker makes p available to subnets as the address picking
+// strategy called name.  It must be called before any subnets are
+// loaded, and fails if name is already registered.
+func RegisterPicker(name string, p Picker) error {
+	if name == "" || p == nil {
+		return fmt.Errorf("A picker must have a name and a function")
+	}
+	if _, ok := pickStrategies[name]; ok {
+		return fmt.Errorf("Picker %s is already registered", name)
+	}
+	pickStrategies[name] = p
+	return nil
+}
+
+// DhcpStrategies are the names of the token strategies the DHCP
+// servers know how to use.  MAC, ClientID, CircuitID, and RemoteID
+// are handled by the DHCPv4 server, and DUID by the DHCPv6 server.
+var DhcpStrategies = []string{"MAC", "ClientID", "CircuitID", "RemoteID", "DUID"}
+
 func init() {
 	pickStrategies["none"] = pickNone
 	pickStrategies["hint"] = pickHint
 	pickStrategies["nextFree"] = pickNextFree
 	pickStrategies["mostExpired"] = pickMostExpired
+	pickStrategies["hashed"] = pickHashed
+	pickStrategies["random"] = pickRandom
 }
 
 // Subnet represents a DHCP Subnet
@@ -149,10 +302,11 @@ type Subnet struct {
 	Enabled bool
 	// Subnet is the network address in CIDR form that all leases
 	// acquired in its range will use for options, lease times, and NextServer settings
-	// by default
+	// by default.  IPv4 subnets are served by the DHCP server, and
+	// IPv6 subnets are served by the DHCPv6 server.
 	//
 	// required: true
-	// pattern: ^([0-9]+\.){3}[0-9]+/[0-9]+$
+	// pattern: ^(([0-9]+\.){3}[0-9]+|[0-9a-fA-F:.]+)/[0-9]+$
 	Subnet string
 	// NextServer is the address of the next server
 	//
@@ -160,16 +314,16 @@ type Subnet struct {
 	// swagger:strfmt ipv4
 	NextServer net.IP
 	// ActiveStart is the first non-reserved IP address we will hand
-	// non-reserved leases from.
+	// non-reserved leases from.  It must be in the same address
+	// family as Subnet.
 	//
 	// required: true
-	// swagger:strfmt ipv4
 	ActiveStart net.IP
 	// ActiveEnd is the last non-reserved IP address we will hand
-	// non-reserved leases from.
+	// non-reserved leases from.  It must be in the same address
+	// family as Subnet.
 	//
 	// required: true
-	// swagger:strfmt ipv4
 	ActiveEnd net.IP
 	// ActiveLeaseTime is the default lease duration in seconds
 	// we will hand out to leases that do not have a reservation.
@@ -186,12 +340,71 @@ type Subnet struct {
 	//
 	// required: true
 	OnlyReservations bool
-	Options          []DhcpOption
+	// Proxy indicates that another DHCP server hands out addresses
+	// on this subnet.  We will never create leases for a proxy
+	// subnet, and will only answer PXE clients with boot
+	// information (next server, boot file, and PXE vendor options)
+	// as a proxyDHCP server.  ActiveStart and ActiveEnd are ignored
+	// for proxy subnets.
+	Proxy bool
+	// Shadow puts the DHCP server in shadow mode for this subnet.
+	// Clients are handled as usual, except that no replies are sent
+	// and no leases are created or changed.  What we would have sent
+	// is recorded as a DHCP transaction, and compared with the
+	// addresses clients actually get in the DHCP shadow report.
+	// This is meant for trying out dr-provision alongside the DHCP
+	// server it is replacing.
+	Shadow bool
+	// AutoMachines creates a Machine for each client that is handed
+	// a lease in this subnet in reply to a DHCPDISCOVER, unless a
+	// machine with its hardware address already exists.  The lease
+	// is linked to the machine either way.
+	AutoMachines bool
+	// AutoMachineName is a text/template for the name of machines
+	// created by AutoMachines.  It is expanded with the
+	// AutoMachineName fields, and the replace function can be used
+	// to clean them up.  If it is empty,
+	// `d{{replace .HardwareAddr ":" "-"}}` is used.
+	AutoMachineName string
+	// AutoMachineProfiles are the profiles given to machines
+	// created by AutoMachines.
+	AutoMachineProfiles []string
+	// Options is the list of DHCP options that will be handed out
+	// to leases in this subnet.  On IPv6 subnets, the option codes
+	// are DHCPv6 option codes.
+	Options []DhcpOption
+	// OptionClasses is the ordered list of option classes for
+	// clients in this subnet.  The first class a client matches
+	// adds its options to (and overrides) Options.  If it is not
+	// set when an IPv4 subnet is created and Options has no boot
+	// file (67), it is set to DefaultOptionClasses, which hand out
+	// a boot file to iPXE, legacy BIOS, and x86 UEFI clients.
+	OptionClasses []OptionClass
 	// Strategy is the leasing strategy that will be used determine what to use from
 	// the DHCP packet to handle lease management.
 	//
 	// required: true
 	Strategy string
+	// Strategies is the ordered list of leasing strategies that
+	// will be tried for clients in this subnet.  Strategies that
+	// cannot generate a token for a client (for example, ClientID
+	// when the client does not send option 61) are skipped, and
+	// the rest are tried until one of them finds or creates a
+	// lease for the client.  Each entry must be one of "MAC",
+	// "ClientID", "CircuitID", "RemoteID", or "DUID", and Strategy
+	// must be one of the entries.  If Strategies is empty, only
+	// Strategy is used.
+	Strategies []string
+	// DnsZone is the DNS zone that names for leases and machines
+	// with addresses in this subnet belong to.  If dynamic DNS
+	// updates are enabled, A (or AAAA) records are added to it as
+	// leases are handed out and machines are created.  If it is
+	// empty, no dynamic DNS updates are sent for this subnet.
+	DnsZone string
+	// DnsReverseZone is the reverse DNS zone (under in-addr.arpa or
+	// ip6.arpa) that PTR records for addresses in this subnet are
+	// added to.  If it is empty, no PTR records are sent.
+	DnsReverseZone string
 	// Pickers is list of methods that will allocate IP addresses.
 	// Each string must refer to a valid address picking strategy.  The current ones are:
 	//
@@ -216,11 +429,22 @@ type Subnet struct {
 	//
 	// "mostExpired" will try to recycle the most expired lease in the subnet's active range.
 	//
+	// "hashed", which will try to create a Lease with an address
+	// picked by hashing the strategy and token, so that a client
+	// tends to get the same address every time it asks, even after
+	// its lease has been removed.  If that address is taken, it
+	// uses the next free address after it.  It takes over an
+	// expired lease at the hashed address, and falls through to the
+	// next strategy if it cannot find a free IP.
+	//
+	// "random", which works like "nextFree", but starts looking at a
+	// random address in the active range to spread leases out.
+	//
 	// All of the address allocation strategies do not consider
 	// any addresses that are reserved, as lease creation will be
 	// handled by the reservation instead.
 	//
-	// We will consider adding more address allocation strategies in the future.
+	// More strategies can be added with RegisterPicker.
 	//
 	// required: true
 	Pickers []string
@@ -385,6 +609,46 @@ func (s *Subnet) subnet() *net.IPNet {
 	return res
 }
 
+// IsV6 returns whether this subnet hands out IPv6 addresses via DHCPv6.
+func (s *Subnet) IsV6() bool {
+	return s.subnet().IP.To4() == nil
+}
+
+// Classes returns the option classes clients in the subnet are
+// matched against.
+func (s *Subnet) Classes() []OptionClass {
+	return s.OptionClasses
+}
+
+// HasStrategy returns whether strat is one of the leasing strategies
+// this subnet uses.
+func (s *Subnet) HasStrategy(strat string) bool {
+	for _, candidate := range s.StrategyList() {
+		if candidate == strat {
+			return true
+		}
+	}
+	return false
+}
+
+// StrategyList returns the ordered list of leasing strategies this
+// subnet uses.
+func (s *Subnet) StrategyList() []string {
+	if len(s.Strategies) > 0 {
+		return s.Strategies
+	}
+	return []string{s.Strategy}
+}
+
+func validStrategy(strat string) bool {
+	for _, known := range DhcpStrategies {
+		if known == strat {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Subnet) Prefix() string {
 	return "subnets"
 }
@@ -425,25 +689,26 @@ func (s *Subnet) sBounds() (func(string) bool, func(string) bool) {
 	}
 	mask.SetBytes(notBits)
 	last.Or(first, mask)
-	firstBytes := first.Bytes()
-	lastBytes := last.Bytes()
+	firstHex := Hexaddr(intToIP(first, len(sub.IP)))
+	lastHex := Hexaddr(intToIP(last, len(sub.IP)))
 	// first "address" in this range is the network address, which cannot be handed out.
 	lower := func(key string) bool {
-		return key > Hexaddr(net.IP(firstBytes))
+		return len(key) == len(firstHex) && key > firstHex
 	}
 	// last "address" in this range is the broadcast address, which also cannot be handed out.
 	upper := func(key string) bool {
-		return key >= Hexaddr(net.IP(lastBytes))
+		return key >= lastHex
 	}
 	return lower, upper
 }
 
 func (s *Subnet) aBounds() (func(string) bool, func(string) bool) {
+	startHex, endHex := Hexaddr(s.ActiveStart), Hexaddr(s.ActiveEnd)
 	return func(key string) bool {
-			return key >= Hexaddr(s.ActiveStart)
+			return len(key) == len(startHex) && key >= startHex
 		},
 		func(key string) bool {
-			return key > Hexaddr(s.ActiveEnd)
+			return key > endHex
 		}
 }
 
@@ -503,32 +768,86 @@ func (s *Subnet) Validate() error {
 	if s.Strategy == "" {
 		e.Errorf("Strategy must have a value")
 	}
-
-	// Make sure that options have the netmask and broadcast options enabled
-	needMask := true
-	needBCast := true
-	for _, opt := range s.Options {
-		if opt.Code == dhcp.OptionBroadcastAddress {
-			needBCast = false
+	if len(s.Strategies) > 0 {
+		seen := map[string]bool{}
+		for _, strat := range s.Strategies {
+			if !validStrategy(strat) {
+				e.Errorf("Strategy %s is not a valid token strategy", strat)
+			}
+			if seen[strat] {
+				e.Errorf("Strategy %s is listed more than once", strat)
+			}
+			seen[strat] = true
 		}
-		if opt.Code == dhcp.OptionSubnetMask {
-			needMask = false
+		if !seen[s.Strategy] {
+			e.Errorf("Strategy %s must be listed in Strategies", s.Strategy)
 		}
 	}
-	if needMask || needBCast {
-		mask := net.IP([]byte(net.IP(subnet.Mask).To4()))
-		if needMask {
-			s.Options = append(s.Options, DhcpOption{dhcp.OptionSubnetMask, mask.String()})
+
+	if s.DnsZone != "" && !validDomain(s.DnsZone) {
+		e.Errorf("DnsZone %s is not a valid domain name", s.DnsZone)
+	}
+	if s.DnsReverseZone != "" {
+		rev := strings.ToLower(strings.TrimSuffix(s.DnsReverseZone, "."))
+		if !validDomain(rev) || !(strings.HasSuffix(rev, ".in-addr.arpa") || strings.HasSuffix(rev, ".ip6.arpa")) {
+			e.Errorf("DnsReverseZone %s is not a valid reverse zone", s.DnsReverseZone)
+		}
+	}
+
+	if s.Proxy && subnet.IP.To4() == nil {
+		e.Errorf("Proxy mode is not supported on IPv6 subnets")
+	}
+	if subnet.IP.To4() == nil {
+		// DHCPv6 clients can only be told apart by their DUID.
+		if s.Strategy != "" && s.Strategy != "DUID" {
+			e.Errorf("IPv6 subnets must use the DUID strategy, not %s", s.Strategy)
 		}
-		if needBCast {
-			bcastBits := binary.BigEndian.Uint32(subnet.IP) | ^binary.BigEndian.Uint32(mask)
-			buf := make([]byte, 4)
-			binary.BigEndian.PutUint32(buf, bcastBits)
-			s.Options = append(s.Options, DhcpOption{dhcp.OptionBroadcastAddress, net.IP(buf).String()})
+		for _, strat := range s.Strategies {
+			if strat != "DUID" {
+				e.Errorf("IPv6 subnets must use the DUID strategy, not %s", strat)
+			}
 		}
+		// DHCPv6 has no netmask or broadcast options, but we
+		// can only hand out options we know how to encode.
+		validateOptions6(e, s.Options)
+		if len(s.OptionClasses) > 0 {
+			e.Errorf("OptionClasses are not supported on IPv6 subnets")
+		}
+	} else {
+		// Make sure that options have the netmask and broadcast options enabled
+		needMask := true
+		needBCast := true
+		for _, opt := range s.Options {
+			if opt.Code == dhcp.OptionBroadcastAddress {
+				needBCast = false
+			}
+			if opt.Code == dhcp.OptionSubnetMask {
+				needMask = false
+			}
+		}
+		if needMask || needBCast {
+			mask := net.IP([]byte(net.IP(subnet.Mask).To4()))
+			if needMask {
+				s.Options = append(s.Options, DhcpOption{Code: dhcp.OptionSubnetMask, Value: mask.String()})
+			}
+			if needBCast {
+				bcastBits := binary.BigEndian.Uint32(subnet.IP) | ^binary.BigEndian.Uint32(mask)
+				buf := make([]byte, 4)
+				binary.BigEndian.PutUint32(buf, bcastBits)
+				s.Options = append(s.Options, DhcpOption{Code: dhcp.OptionBroadcastAddress, Value: net.IP(buf).String()})
+			}
+		}
+		validateSubOptions(e, s.Options)
+		validateOptionClasses(e, s.OptionClasses)
+	}
+	if s.AutoMachines && subnet.IP.To4() == nil {
+		e.Errorf("AutoMachines is not supported on IPv6 subnets")
+	}
+	if _, err := autoMachineNameTemplate(s.AutoMachineName); err != nil {
+		e.Errorf("Invalid AutoMachineName: %v", err)
 	}
 
-	if !s.OnlyReservations {
+	if !(s.OnlyReservations || s.Proxy) {
 		validateIP4(e, s.ActiveStart)
 		validateIP4(e, s.ActiveEnd)
 		if !subnet.Contains(s.ActiveStart) {
@@ -549,17 +868,21 @@ func (s *Subnet) Validate() error {
 		}
 	}
 	if s.Pickers == nil || len(s.Pickers) == 0 {
-		if s.OnlyReservations {
+		if s.OnlyReservations || s.Proxy {
 			s.Pickers = []string{"none"}
 		} else {
 			s.Pickers = []string{"hint", "nextFree", "mostExpired"}
 		}
 	}
+	seen := map[string]bool{}
 	for _, p := range s.Pickers {
 		_, ok := pickStrategies[p]
 		if !ok {
 			e.Errorf("Picker %s is not a valid lease picking strategy", p)
+		} else if seen[p] {
+			e.Errorf("Picker %s is listed more than once", p)
 		}
+		seen[p] = true
 	}
 	if s.ReservedLeaseTime < 7200 {
 		e.Errorf("ReservedLeaseTime must be greater than or equal to 7200 seconds, not %d", s.ReservedLeaseTime)
@@ -580,13 +903,76 @@ func (s *Subnet) Validate() error {
 	return e.OrNil()
 }
 
+// validDomain returns whether name is a syntactically valid domain
+// name, with or without the trailing dot.
+func validDomain(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 ||
+			strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, c := range label {
+			if !(c == '-' || c == '_' ||
+				(c >= 'a' && c <= 'z') ||
+				(c >= 'A' && c <= 'Z') ||
+				(c >= '0' && c <= '9')) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// OnCreate gives new IPv4 subnets that do not hand out a boot file
+// and have no option classes the DefaultOptionClasses.  Subnets that
+// already exist are left alone.
+func (s *Subnet) OnCreate() error {
+	if len(s.OptionClasses) > 0 {
+		return nil
+	}
+	if _, sn, err := net.ParseCIDR(s.Subnet); err != nil || sn.IP.To4() == nil {
+		return nil
+	}
+	for _, opt := range s.Options {
+		if opt.Code == dhcp.OptionBootFileName {
+			return nil
+		}
+	}
+	s.OptionClasses = DefaultOptionClasses()
+	return nil
+}
+
 func (s *Subnet) BeforeSave() error {
 	return s.Validate()
 }
 
-func (s *Subnet) next(used map[string]store.KeySaver, token string, hint net.IP) (*Lease, bool) {
+// AddressOwner decides whether this server may hand out a new lease
+// for an address.  DHCP failover uses it to keep two servers that
+// share a lease database from handing out the same address.
+type AddressOwner interface {
+	Owns(s *Subnet, addr net.IP) bool
+}
+
+// SetAddressOwner sets the AddressOwner that the address pickers
+// consult before handing out a new lease.  It must be called before
+// the DHCP servers are started.
+func (p *DataTracker) SetAddressOwner(o AddressOwner) {
+	p.addressOwner = o
+}
+
+// MayAllocate returns whether we may hand out a new lease for addr.
+// Leases that a client already holds are always renewed.
+func (s *Subnet) MayAllocate(addr net.IP) bool {
+	return s.p == nil || s.p.addressOwner == nil || s.p.addressOwner.Owns(s, addr)
+}
+
+func (s *Subnet) next(used map[string]store.KeySaver, strat, token string, hint net.IP) (*Lease, bool) {
 	for _, p := range s.Pickers {
-		l, f := pickStrategies[p](s, used, token, hint)
+		l, f := pickStrategies[p](s, used, strat, token, hint)
 		if !f {
 			return l, f
 		}
@@ -600,6 +986,7 @@ var subnetLockMap = map[string][]string{
 	"update": []string{"subnets"},
 	"patch":  []string{"subnets"},
 	"delete": []string{"subnets"},
+	"stats":  []string{"subnets", "reservations", "leases"},
 }
 
 func (s *Subnet) Locks(action string) []string {
@@ -0,0 +1,271 @@
+package backend
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/digitalrebar/provision/backend/index"
+	"github.com/digitalrebar/store"
+)
+
+// defaultSubnetUsageThresholds is the default value of the
+// subnetUsageThresholds preference.
+const defaultSubnetUsageThresholds = "80,90,95"
+
+// SubnetStats describes how full a Subnet is.
+//
+// swagger:model
+type SubnetStats struct {
+	// Subnet is the name of the subnet.
+	//
+	// required: true
+	Subnet string
+	// ActiveRangeSize is the number of addresses from ActiveStart
+	// to ActiveEnd.  It is capped at the largest int64, which only
+	// matters for very large IPv6 ranges.
+	//
+	// required: true
+	ActiveRangeSize int64
+	// ActiveLeases is the number of unexpired leases a client holds
+	// in the subnet.
+	//
+	// required: true
+	ActiveLeases int
+	// ExpiredLeases is the number of expired leases in the subnet.
+	//
+	// required: true
+	ExpiredLeases int
+	// InvalidatedLeases is the number of unexpired leases in the
+	// subnet that no client holds, because the address was declined
+	// or found to be in use by something else.
+	//
+	// required: true
+	InvalidatedLeases int
+	// Reservations is the number of reservations in the subnet.
+	//
+	// required: true
+	Reservations int
+	// Free is the number of addresses in the active range that
+	// have never been leased or reserved.
+	//
+	// required: true
+	Free int64
+	// Available is the number of addresses in the active range
+	// that can be handed out to a new client, which is Free plus
+	// the expired leases that are not reserved.
+	//
+	// required: true
+	Available int64
+	// Utilization is the percentage of the active range that is
+	// not Available.
+	//
+	// required: true
+	Utilization float64
+	// NextCandidate is the address the Pickers would hand out to
+	// the next new client, if there is one.
+	NextCandidate net.IP
+}
+
+// activeRangeSize returns the number of addresses in the active range.
+func (s *Subnet) activeRangeSize() int64 {
+	if s.ActiveStart == nil || s.ActiveEnd == nil {
+		return 0
+	}
+	start, end := &big.Int{}, &big.Int{}
+	start.SetBytes(familyIP(s.ActiveStart))
+	end.SetBytes(familyIP(s.ActiveEnd))
+	size := end.Sub(end, start)
+	size.Add(size, big.NewInt(1))
+	if size.Sign() < 0 {
+		return 0
+	}
+	if !size.IsInt64() {
+		return math.MaxInt64
+	}
+	return size.Int64()
+}
+
+// Stats returns how full the subnet is.  d must have the subnets,
+// reservations, and leases locked.
+func (s *Subnet) Stats(d Stores) *SubnetStats {
+	res := &SubnetStats{Subnet: s.Name}
+	sn := s.subnet()
+	for _, i := range d("reservations").Items() {
+		if sn.Contains(AsReservation(i).Addr) {
+			res.Reservations++
+		}
+	}
+	for _, i := range d("leases").Items() {
+		lease := AsLease(i)
+		if !sn.Contains(lease.Addr) {
+			continue
+		}
+		switch {
+		case lease.Expired():
+			res.ExpiredLeases++
+		case lease.Token == "":
+			res.InvalidatedLeases++
+		default:
+			res.ActiveLeases++
+		}
+	}
+	if s.Proxy || s.OnlyReservations {
+		return res
+	}
+	res.ActiveRangeSize = s.activeRangeSize()
+	if res.ActiveRangeSize == 0 {
+		return res
+	}
+	used := s.peekUsed(d)
+	res.Free = res.ActiveRangeSize - int64(len(used))
+	res.Available = res.Free
+	for _, i := range used {
+		if lease, ok := i.(*Lease); ok && lease.Expired() {
+			res.Available++
+		}
+	}
+	res.Utilization = float64(res.ActiveRangeSize-res.Available) * 100 / float64(res.ActiveRangeSize)
+	if lease, _ := s.peek(used, "", "", nil); lease != nil {
+		res.NextCandidate = lease.Addr
+	}
+	return res
+}
+
+// peekUsed builds the same map of used addresses that the pickers
+// see, with copies of the leases so that peeking at what they would
+// do next does not change anything.
+func (s *Subnet) peekUsed(d Stores) map[string]store.KeySaver {
+	used := map[string]store.KeySaver{}
+	keyLen := len(Hexaddr(s.ActiveStart))
+	leases, _ := index.Between(Hexaddr(s.ActiveStart), Hexaddr(s.ActiveEnd))(&d("leases").Index)
+	for _, i := range leases.Items() {
+		if len(i.Key()) != keyLen {
+			continue
+		}
+		lease := *AsLease(i)
+		used[lease.Key()] = &lease
+	}
+	reservations, _ := index.Between(Hexaddr(s.ActiveStart), Hexaddr(s.ActiveEnd))(&d("reservations").Index)
+	for _, i := range reservations.Items() {
+		if len(i.Key()) != keyLen {
+			continue
+		}
+		used[i.Key()] = i
+	}
+	return used
+}
+
+// peek returns the lease the pickers would hand out from used,
+// without changing where the next picker will start from.
+func (s *Subnet) peek(used map[string]store.KeySaver, strat, token string, hint net.IP) (*Lease, bool) {
+	peek := *s
+	if s.nextLeasableIP != nil {
+		peek.nextLeasableIP = append(net.IP{}, s.nextLeasableIP...)
+	}
+	return peek.next(used, strat, token, hint)
+}
+
+// SubnetThreshold is sent as a subnets.above event when the
+// utilization of a subnet rises to Threshold percent or more, and as
+// a subnets.below event when it drops back under Threshold.
+//
+// swagger:model
+type SubnetThreshold struct {
+	// Threshold is the percentage that was crossed.
+	//
+	// required: true
+	Threshold int
+	// Stats is how full the subnet was when it crossed Threshold.
+	//
+	// required: true
+	Stats *SubnetStats
+}
+
+// subnetUsage remembers the last utilization we saw for each subnet,
+// so that we only send threshold events when a threshold is crossed.
+type subnetUsage struct {
+	sync.Mutex
+	last map[string]float64
+}
+
+// ParseUsageThresholds parses a comma separated list of percentages,
+// as the subnetUsageThresholds preference is given.
+func ParseUsageThresholds(val string) ([]int, error) {
+	res := []int{}
+	for _, part := range strings.Split(val, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		t, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, err
+		}
+		if t < 1 || t > 100 {
+			return nil, fmt.Errorf("%d is not a percentage", t)
+		}
+		res = append(res, t)
+	}
+	sort.Ints(res)
+	return res, nil
+}
+
+func (p *DataTracker) usageThresholds() []int {
+	val := p.pref("subnetUsageThresholds")
+	if val == "" {
+		val = defaultSubnetUsageThresholds
+	}
+	res, err := ParseUsageThresholds(val)
+	if err != nil {
+		res, _ = ParseUsageThresholds(defaultSubnetUsageThresholds)
+	}
+	return res
+}
+
+// checkSubnetUsage sends threshold events for s if its utilization
+// has crossed any of the subnetUsageThresholds since we last looked.
+// d must have the subnets, reservations, and leases locked.
+func (p *DataTracker) checkSubnetUsage(d Stores, s *Subnet) {
+	stats := s.Stats(d)
+	if stats.ActiveRangeSize == 0 {
+		return
+	}
+	p.subnetUsage.Lock()
+	last := p.subnetUsage.last[s.Name]
+	p.subnetUsage.last[s.Name] = stats.Utilization
+	p.subnetUsage.Unlock()
+	for _, t := range p.usageThresholds() {
+		th := float64(t)
+		if last < th && stats.Utilization >= th {
+			p.Infof("debugDhcp", "Subnet %s is %.1f%% used, above %d%%", s.Name, stats.Utilization, t)
+			p.publishers.Publish("subnets", "above", s.Name, &SubnetThreshold{Threshold: t, Stats: stats})
+		} else if last >= th && stats.Utilization < th {
+			p.Infof("debugDhcp", "Subnet %s is %.1f%% used, below %d%%", s.Name, stats.Utilization, t)
+			p.publishers.Publish("subnets", "below", s.Name, &SubnetThreshold{Threshold: t, Stats: stats})
+		}
+	}
+}
+
+// checkAllSubnetUsage is checkSubnetUsage for every subnet, and
+// forgets about subnets that no longer exist.
+func (p *DataTracker) checkAllSubnetUsage(d Stores) {
+	seen := map[string]bool{}
+	for _, i := range d("subnets").Items() {
+		s := AsSubnet(i)
+		seen[s.Name] = true
+		p.checkSubnetUsage(d, s)
+	}
+	p.subnetUsage.Lock()
+	defer p.subnetUsage.Unlock()
+	for name := range p.subnetUsage.last {
+		if !seen[name] {
+			delete(p.subnetUsage.last, name)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package backend
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func (r *eventRecorder) thresholds(action string) []int {
+	res := []int{}
+	for _, e := range r.events {
+		if e.Type == "subnets" && e.Action == action {
+			res = append(res, e.Object.(*SubnetThreshold).Threshold)
+		}
+	}
+	return res
+}
+
+func TestSubnetStats(t *testing.T) {
+	dt := mkDT(nil)
+	rec := &eventRecorder{}
+	dt.publishers.Add(rec)
+	now := time.Now()
+	func() {
+		d, unlocker := dt.LockEnts("subnets", "reservations", "leases", "preferences", "bootenvs")
+		defer unlocker()
+		startObjs := []crudTest{
+			{"Initial Subnet", dt.Create, &Subnet{p: dt, Enabled: true, Name: "sn", Subnet: "10.1.1.0/24", ActiveStart: net.ParseIP("10.1.1.10"), ActiveEnd: net.ParseIP("10.1.1.14"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "MAC"}, true, nil},
+			{"Other Subnet", dt.Create, &Subnet{p: dt, Enabled: true, Name: "other", Subnet: "10.1.2.0/24", ActiveStart: net.ParseIP("10.1.2.10"), ActiveEnd: net.ParseIP("10.1.2.14"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "MAC"}, true, nil},
+			{"Active Lease", dt.Create, &Lease{p: dt, Addr: net.ParseIP("10.1.1.10"), Strategy: "MAC", Token: "l1", ExpireTime: now.Add(time.Hour)}, true, nil},
+			{"Expired Lease", dt.Create, &Lease{p: dt, Addr: net.ParseIP("10.1.1.11"), Strategy: "MAC", Token: "l2", ExpireTime: now.Add(-time.Minute)}, true, nil},
+			{"Lease to Invalidate", dt.Create, &Lease{p: dt, Addr: net.ParseIP("10.1.1.12"), Strategy: "MAC", Token: "l3", ExpireTime: now.Add(time.Hour)}, true, nil},
+			{"Other Lease", dt.Create, &Lease{p: dt, Addr: net.ParseIP("10.1.2.10"), Strategy: "MAC", Token: "l4", ExpireTime: now.Add(time.Hour)}, true, nil},
+			{"Reservation in Range", dt.Create, &Reservation{p: dt, Addr: net.ParseIP("10.1.1.13"), Strategy: "MAC", Token: "r1"}, true, nil},
+			{"Reservation out of Range", dt.Create, &Reservation{p: dt, Addr: net.ParseIP("10.1.1.50"), Strategy: "MAC", Token: "r2"}, true, nil},
+		}
+		for _, obj := range startObjs {
+			obj.Test(t, d)
+		}
+		l := AsLease(d("leases").Find(Hexaddr(net.ParseIP("10.1.1.12"))))
+		l.Invalidate()
+		l.ExpireTime = now.Add(time.Hour)
+		dt.Save(d, l, nil)
+		if err := dt.SetPrefs(d, map[string]string{"subnetUsageThresholds": "101"}); err == nil {
+			t.Errorf("Should not be able to set a threshold over 100%%")
+		}
+		if err := dt.SetPrefs(d, map[string]string{"subnetUsageThresholds": "75,50"}); err != nil {
+			t.Fatalf("Failed to set subnetUsageThresholds: %v", err)
+		}
+	}()
+	func() {
+		d, unlocker := dt.LockEnts(dt.NewSubnet().Locks("stats")...)
+		defer unlocker()
+		stats := AsSubnet(d("subnets").Find("sn")).Stats(d)
+		if stats.ActiveRangeSize != 5 {
+			t.Errorf("Expected an active range of 5 addresses, got %d", stats.ActiveRangeSize)
+		}
+		if stats.ActiveLeases != 1 || stats.ExpiredLeases != 1 || stats.InvalidatedLeases != 1 {
+			t.Errorf("Expected 1 active, expired, and invalidated lease each, got %d, %d, and %d", stats.ActiveLeases, stats.ExpiredLeases, stats.InvalidatedLeases)
+		}
+		if stats.Reservations != 2 {
+			t.Errorf("Expected 2 reservations, got %d", stats.Reservations)
+		}
+		if stats.Free != 1 || stats.Available != 2 || stats.Utilization != 60 {
+			t.Errorf("Expected 1 free, 2 available, and 60%% utilization, got %d, %d, and %v", stats.Free, stats.Available, stats.Utilization)
+		}
+		if !stats.NextCandidate.Equal(net.ParseIP("10.1.1.14")) {
+			t.Errorf("Expected next candidate 10.1.1.14, got %s", stats.NextCandidate)
+		}
+		if l := AsLease(d("leases").Find(Hexaddr(net.ParseIP("10.1.1.11")))); l.Token != "l2" {
+			t.Errorf("Getting stats should not change leases, but the expired lease now has token %s", l.Token)
+		}
+	}()
+	via := []net.IP{net.ParseIP("10.1.1.1")}
+	if lease, _, _ := FindOrCreateLease(dt, "MAC", "new1", nil, via); lease == nil || !lease.Addr.Equal(net.ParseIP("10.1.1.14")) {
+		t.Fatalf("Expected to be handed 10.1.1.14, got %v", lease)
+	}
+	if above := rec.thresholds("above"); len(above) != 0 {
+		t.Errorf("Handing out a lease should not check thresholds, got %v", above)
+	}
+	dt.NewLeaseSweeper().Sweep(time.Now())
+	if above := rec.thresholds("above"); len(above) != 2 || above[0] != 50 || above[1] != 75 {
+		t.Errorf("Expected above events for 50 and 75, got %v", above)
+	}
+	if lease, _, _ := FindOrCreateLease(dt, "MAC", "new2", nil, via); lease == nil || !lease.Addr.Equal(net.ParseIP("10.1.1.11")) {
+		t.Fatalf("Expected to be handed 10.1.1.11, got %v", lease)
+	}
+	dt.NewLeaseSweeper().Sweep(time.Now())
+	if above := rec.thresholds("above"); len(above) != 2 {
+		t.Errorf("Should not send more above events when no new threshold is crossed, got %v", above)
+	}
+	func() {
+		d, unlocker := dt.LockEnts("subnets", "reservations", "leases")
+		defer unlocker()
+		for _, addr := range []string{"10.1.1.10", "10.1.1.11", "10.1.1.14"} {
+			if ok, err := dt.Remove(d, d("leases").Find(Hexaddr(net.ParseIP(addr))), nil); !ok {
+				t.Fatalf("Failed to remove lease %s: %v", addr, err)
+			}
+		}
+	}()
+	dt.NewLeaseSweeper().Sweep(time.Now())
+	if below := rec.thresholds("below"); len(below) != 2 || below[0] != 50 || below[1] != 75 {
+		t.Errorf("Expected below events for 50 and 75, got %v", below)
+	}
+}
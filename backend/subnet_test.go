@@ -20,6 +20,18 @@ func TestSubnetCrud(t *testing.T) {
 		{"Create invalid Subnet(ActiveEnd out of range)", dt.Create, &Subnet{p: dt, Name: "test2", Subnet: "192.168.125.0/24", ActiveStart: net.ParseIP("192.168.125.80"), ActiveEnd: net.ParseIP("192.168.126.254"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "mac"}, false, nil},
 		{"Create invalid Subnet(ActiveLeaseTime too short)", dt.Create, &Subnet{p: dt, Name: "test2", Subnet: "192.168.125.0/24", ActiveStart: net.ParseIP("192.168.125.80"), ActiveEnd: net.ParseIP("192.168.125.254"), ActiveLeaseTime: 59, ReservedLeaseTime: 7200, Strategy: "mac"}, false, nil},
 		{"Create invalid Subnet(ReservedLeaseTime too short)", dt.Create, &Subnet{p: dt, Name: "test2", Subnet: "192.168.125.0/24", ActiveStart: net.ParseIP("192.168.125.80"), ActiveEnd: net.ParseIP("192.168.125.254"), ActiveLeaseTime: 60, ReservedLeaseTime: 7199, Strategy: "mac"}, false, nil},
+		{"Create valid IPv6 Subnet", dt.Create, &Subnet{p: dt, Name: "test6", Subnet: "2001:db8::/64", ActiveStart: net.ParseIP("2001:db8::80"), ActiveEnd: net.ParseIP("2001:db8::ff"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "DUID", Options: []DhcpOption{{Code: 59, Value: "http://[2001:db8::1]:8091/bootx64.efi"}}}, true, nil},
+		{"Create invalid IPv6 Subnet(IPv4 ActiveStart)", dt.Create, &Subnet{p: dt, Name: "test7", Subnet: "2001:db9::/64", ActiveStart: net.ParseIP("192.168.125.80"), ActiveEnd: net.ParseIP("2001:db9::ff"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "DUID"}, false, nil},
+		{"Create invalid IPv6 Subnet(unsupported option)", dt.Create, &Subnet{p: dt, Name: "test7", Subnet: "2001:db9::/64", ActiveStart: net.ParseIP("2001:db9::80"), ActiveEnd: net.ParseIP("2001:db9::ff"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "DUID", Options: []DhcpOption{{Code: 67, Value: "lpxelinux.0"}}}, false, nil},
+		{"Create invalid IPv6 Subnet(MAC Strategy)", dt.Create, &Subnet{p: dt, Name: "test7", Subnet: "2001:db9::/64", ActiveStart: net.ParseIP("2001:db9::80"), ActiveEnd: net.ParseIP("2001:db9::ff"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "MAC"}, false, nil},
+		{"Create invalid IPv6 Subnet(MAC in Strategies)", dt.Create, &Subnet{p: dt, Name: "test7", Subnet: "2001:db9::/64", ActiveStart: net.ParseIP("2001:db9::80"), ActiveEnd: net.ParseIP("2001:db9::ff"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "DUID", Strategies: []string{"DUID", "MAC"}}, false, nil},
+		{"Create invalid IPv6 Subnet(Proxy)", dt.Create, &Subnet{p: dt, Name: "test7", Subnet: "2001:db9::/64", Proxy: true, ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "DUID"}, false, nil},
+		{"Create invalid Subnet(unknown Strategies)", dt.Create, &Subnet{p: dt, Name: "test2", Subnet: "192.168.125.0/24", ActiveStart: net.ParseIP("192.168.125.80"), ActiveEnd: net.ParseIP("192.168.125.254"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "MAC", Strategies: []string{"MAC", "Serial"}}, false, nil},
+		{"Create invalid Subnet(Strategy not in Strategies)", dt.Create, &Subnet{p: dt, Name: "test2", Subnet: "192.168.125.0/24", ActiveStart: net.ParseIP("192.168.125.80"), ActiveEnd: net.ParseIP("192.168.125.254"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "MAC", Strategies: []string{"CircuitID", "RemoteID"}}, false, nil},
+		{"Create invalid Subnet(bad DnsZone)", dt.Create, &Subnet{p: dt, Name: "test2", Subnet: "192.168.125.0/24", ActiveStart: net.ParseIP("192.168.125.80"), ActiveEnd: net.ParseIP("192.168.125.254"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "MAC", DnsZone: "lab..example.com"}, false, nil},
+		{"Create invalid Subnet(bad DnsReverseZone)", dt.Create, &Subnet{p: dt, Name: "test2", Subnet: "192.168.125.0/24", ActiveStart: net.ParseIP("192.168.125.80"), ActiveEnd: net.ParseIP("192.168.125.254"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "MAC", DnsZone: "lab.example.com", DnsReverseZone: "lab.example.com"}, false, nil},
+		{"Create invalid Subnet(unnamed OptionClass)", dt.Create, &Subnet{p: dt, Name: "test2", Subnet: "192.168.125.0/24", ActiveStart: net.ParseIP("192.168.125.80"), ActiveEnd: net.ParseIP("192.168.125.254"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "MAC", OptionClasses: []OptionClass{{Arch: []int{7}, Options: []DhcpOption{{Code: 67, Value: "bootx64.efi"}}}}}, false, nil},
+		{"Create invalid IPv6 Subnet(OptionClasses)", dt.Create, &Subnet{p: dt, Name: "test7", Subnet: "2001:db9::/64", ActiveStart: net.ParseIP("2001:db9::80"), ActiveEnd: net.ParseIP("2001:db9::ff"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "DUID", OptionClasses: []OptionClass{{Name: "uefi", Arch: []int{7}}}}, false, nil},
 		{"Create invalid Subnet(no Strategy)", dt.Create, &Subnet{p: dt, Name: "test2", Subnet: "192.168.125.0/24", ActiveStart: net.ParseIP("192.168.125.80"), ActiveEnd: net.ParseIP("192.168.125.254"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: ""}, false, nil},
 	}
 	for _, test := range createTests {
@@ -28,10 +40,44 @@ func TestSubnetCrud(t *testing.T) {
 	// List test.
 	bes := d("subnets").Items()
 	if bes != nil {
-		if len(bes) != 1 {
-			t.Errorf("List function should have returned: 1, but got %d\n", len(bes))
+		if len(bes) != 2 {
+			t.Errorf("List function should have returned: 2, but got %d\n", len(bes))
 		}
 	} else {
 		t.Errorf("List function returned nil!!")
 	}
 }
+
+func TestSubnetDefaultOptionClasses(t *testing.T) {
+	dt := mkDT(nil)
+	d, unlocker := dt.LockEnts("subnets", "leases", "reservations")
+	defer unlocker()
+	plain := &Subnet{p: dt, Name: "plain", Subnet: "192.168.130.0/24", ActiveStart: net.ParseIP("192.168.130.80"), ActiveEnd: net.ParseIP("192.168.130.254"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "MAC"}
+	booting := &Subnet{p: dt, Name: "booting", Subnet: "192.168.131.0/24", ActiveStart: net.ParseIP("192.168.131.80"), ActiveEnd: net.ParseIP("192.168.131.254"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "MAC", Options: []DhcpOption{{Code: 67, Value: "lpxelinux.0"}}}
+	v6 := &Subnet{p: dt, Name: "v6", Subnet: "2001:db8:5::/64", ActiveStart: net.ParseIP("2001:db8:5::80"), ActiveEnd: net.ParseIP("2001:db8:5::ff"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "DUID"}
+	for _, test := range []crudTest{
+		{"Create Subnet without a boot file", dt.Create, plain, true, nil},
+		{"Create Subnet with a boot file", dt.Create, booting, true, nil},
+		{"Create IPv6 Subnet", dt.Create, v6, true, nil},
+	} {
+		test.Test(t, d)
+	}
+	if len(plain.Classes()) != len(DefaultOptionClasses()) {
+		t.Errorf("Expected a new subnet without a boot file to get the default option classes, got %v", plain.OptionClasses)
+	}
+	if booting.Classes() != nil || v6.Classes() != nil {
+		t.Errorf("Expected no default option classes for subnets with a boot file or IPv6 subnets")
+	}
+	plain.OptionClasses = []OptionClass{}
+	if ok, err := dt.Update(d, plain, nil); !ok {
+		t.Fatalf("Failed to remove the option classes: %v", err)
+	}
+	if len(AsSubnet(d("subnets").Find("plain")).Classes()) != 0 {
+		t.Errorf("Expected removed option classes to stay removed")
+	}
+	// Subnets from before option classes existed get none.
+	old := &Subnet{Subnet: "192.168.132.0/24"}
+	if old.Classes() != nil {
+		t.Errorf("Expected an existing subnet to be left without option classes")
+	}
+}
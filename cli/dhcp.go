@@ -0,0 +1,68 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/digitalrebar/provision/backend"
+	"github.com/digitalrebar/provision/client/dhcp"
+	models "github.com/digitalrebar/provision/genmodels"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	tree := addDhcpCommands()
+	App.AddCommand(tree)
+}
+
+func addDhcpCommands() (res *cobra.Command) {
+	res = &cobra.Command{
+		Use:   "dhcp",
+		Short: "DigitalRebar Provision DHCP Commands",
+	}
+
+	dryRun := false
+	importCmd := &cobra.Command{
+		Use:   "import [format] [- | file]",
+		Short: "Import reservations or leases from another DHCP server",
+		Long: fmt.Sprintf(`Creates Reservations or Leases from the configuration of another DHCP server.
+format must be one of %s.  With --dry-run, nothing is created,
+and the output shows what would be created and what conflicts with
+existing Reservations and Leases.`, strings.Join(backend.DhcpImportFormats, ", ")),
+		RunE: func(c *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("%v requires 2 arguments", c.UseLine())
+			}
+			dumpUsage = false
+
+			var buf []byte
+			var err error
+			if args[1] == `-` {
+				buf, err = ioutil.ReadAll(os.Stdin)
+				if err != nil {
+					return fmt.Errorf("Error reading from stdin: %v", err)
+				}
+			} else {
+				buf, err = ioutil.ReadFile(args[1])
+				if err != nil {
+					return fmt.Errorf("Error reading %s: %v", args[1], err)
+				}
+			}
+			data := string(buf)
+			params := dhcp.NewImportDhcpParams().
+				WithBody(&models.DhcpImport{Format: &args[0], Data: &data}).
+				WithDryrun(&dryRun)
+			d, err := session.Dhcp.ImportDhcp(params, basicAuth)
+			if err != nil {
+				return generateError(err, "Error importing %s", args[0])
+			}
+			return prettyPrint(d.Payload)
+		},
+	}
+	importCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only report what would be imported")
+
+	res.AddCommand(importCmd)
+	return res
+}
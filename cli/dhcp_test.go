@@ -0,0 +1,26 @@
+package cli
+
+import (
+	"testing"
+)
+
+var dhcpIntroString = "DigitalRebar Provision DHCP Commands\n"
+var dhcpImportNoArgErrorString = "Error: drpcli dhcp import [format] [- | file] [flags] requires 2 arguments\n"
+var dhcpImportTooManyArgErrorString = "Error: drpcli dhcp import [format] [- | file] [flags] requires 2 arguments\n"
+var dhcpImportMissingFileErrorString = "Error: Error reading /no/such/dhcpd.conf: open /no/such/dhcpd.conf: no such file or directory\n\n"
+var dhcpImportBadFormatErrorString = "Error: Format must be one of dhcpd.conf, dhcpd.leases, dnsmasq\n\n"
+var dhcpImportBadConfErrorString = "Error: dhcpd.conf: line 1: missing ;\n\n"
+
+func TestDhcpCli(t *testing.T) {
+	tests := []CliTest{
+		CliTest{true, false, []string{"dhcp"}, noStdinString, dhcpIntroString, noErrorString},
+		CliTest{true, true, []string{"dhcp", "import"}, noStdinString, noContentString, dhcpImportNoArgErrorString},
+		CliTest{true, true, []string{"dhcp", "import", "dnsmasq", "-", "john"}, noStdinString, noContentString, dhcpImportTooManyArgErrorString},
+		CliTest{false, true, []string{"dhcp", "import", "dhcpd.conf", "/no/such/dhcpd.conf"}, noStdinString, noContentString, dhcpImportMissingFileErrorString},
+		CliTest{false, true, []string{"dhcp", "import", "fred", "-"}, "dhcp-host=00:11:22:33:44:55,192.168.100.10\n", noContentString, dhcpImportBadFormatErrorString},
+		CliTest{false, true, []string{"dhcp", "import", "--dry-run", "dhcpd.conf", "-"}, "host john { fixed-address 192.168.100.10 }\n", noContentString, dhcpImportBadConfErrorString},
+	}
+	for _, test := range tests {
+		testCli(t, test)
+	}
+}
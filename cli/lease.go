@@ -138,6 +138,26 @@ func addLeaseCommands() (res *cobra.Command) {
 	}
 
 	commands := commonOps(&LeaseOps{CommonOps{Name: name, SingularName: singularName}})
+	commands = append(commands, &cobra.Command{
+		Use:   "history [id]",
+		Short: "Show who has held an address",
+		Long:  `Shows the clients that have held a lease on the address, oldest first, and when they got and gave up the address.`,
+		RunE: func(c *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("%v requires 1 argument", c.UseLine())
+			}
+			dumpUsage = false
+			s, e := convertStringToAddress(args[0])
+			if e != nil {
+				return e
+			}
+			d, e := session.Leases.GetLeaseHistory(leases.NewGetLeaseHistoryParams().WithAddress(s), basicAuth)
+			if e != nil {
+				return generateError(e, "Failed to fetch history for %v: %v", singularName, args[0])
+			}
+			return prettyPrint(d.Payload)
+		},
+	})
 	res.AddCommand(commands...)
 	return res
 }
@@ -113,6 +113,10 @@ var leaseDestroyMissingJohnString string = "Error: leases: DELETE C0A8646E: Not
 
 var leaseShowInvalidAddressErrorString string = "Error: lease get: address not valid: k192.168.100.110\n\n"
 var leaseUpdateInvalidAddressErrorString string = "Error: lease get: address not valid: k192.168.100.111\n\n"
+var leaseHistoryNoArgErrorString string = "Error: drpcli leases history [id] [flags] requires 1 argument\n"
+var leaseHistoryTooManyArgErrorString string = "Error: drpcli leases history [id] [flags] requires 1 argument\n"
+var leaseHistoryEmptyString string = "[]\n"
+var leaseHistoryInvalidAddressErrorString string = "Error: lease history: address not valid: k192.168.100.110\n\n"
 var leaseDestroyInvalidAddressErrorString string = "Error: lease delete: address not valid: k192.168.100.110\n\n"
 
 func TestLeaseCli(t *testing.T) {
@@ -174,6 +178,11 @@ func TestLeaseCli(t *testing.T) {
 		CliTest{false, true, []string{"leases", "patch", leasePatchMissingBaseString, leasePatchInputString}, noStdinString, noContentString, leasePatchJohnMissingErrorString},
 		CliTest{false, false, []string{"leases", "show", "192.168.100.110"}, noStdinString, leasePatchJohnString, noErrorString},
 
+		CliTest{true, true, []string{"leases", "history"}, noStdinString, noContentString, leaseHistoryNoArgErrorString},
+		CliTest{true, true, []string{"leases", "history", "john", "john2"}, noStdinString, noContentString, leaseHistoryTooManyArgErrorString},
+		CliTest{false, false, []string{"leases", "history", "192.168.100.111"}, noStdinString, leaseHistoryEmptyString, noErrorString},
+		CliTest{false, true, []string{"leases", "history", "k192.168.100.110"}, noStdinString, noContentString, leaseHistoryInvalidAddressErrorString},
+
 		CliTest{true, true, []string{"leases", "destroy"}, noStdinString, noContentString, leaseDestroyNoArgErrorString},
 		CliTest{true, true, []string{"leases", "destroy", "john", "june"}, noStdinString, noContentString, leaseDestroyTooManyArgErrorString},
 		CliTest{false, false, []string{"leases", "destroy", "192.168.100.110"}, noStdinString, leaseDestroyJohnString, noErrorString},
@@ -10,7 +10,18 @@ var prefsDefaultListString = `{
   "debugDhcp": "0",
   "debugRenderer": "0",
   "defaultBootEnv": "sledgehammer",
+  "dhcpClientRateLimit": "120",
+  "dhcpRelayRateLimit": "0",
+  "fileTransferBandwidth": "0",
+  "fileTransferClientLimit": "0",
+  "fileTransferLimit": "0",
+  "fileTransferQueueTimeout": "30",
   "knownTokenTimeout": "3600",
+  "leaseHistoryLength": "50",
+  "leaseHistoryRetention": "2592000",
+  "leaseReapGrace": "86400",
+  "leaseSweepInterval": "60",
+  "subnetUsageThresholds": "80,90,95",
   "unknownBootEnv": "ignore",
   "unknownTokenTimeout": "600"
 }
@@ -26,7 +37,18 @@ var prefsSetJSONResponseString string = `{
   "debugDhcp": "0",
   "debugRenderer": "0",
   "defaultBootEnv": "local",
+  "dhcpClientRateLimit": "120",
+  "dhcpRelayRateLimit": "0",
+  "fileTransferBandwidth": "0",
+  "fileTransferClientLimit": "0",
+  "fileTransferLimit": "0",
+  "fileTransferQueueTimeout": "30",
   "knownTokenTimeout": "3600",
+  "leaseHistoryLength": "50",
+  "leaseHistoryRetention": "2592000",
+  "leaseReapGrace": "86400",
+  "leaseSweepInterval": "60",
+  "subnetUsageThresholds": "80,90,95",
   "unknownBootEnv": "ignore",
   "unknownTokenTimeout": "600"
 }
@@ -39,7 +61,18 @@ var prefsChangedListString = `{
   "debugDhcp": "0",
   "debugRenderer": "0",
   "defaultBootEnv": "local",
+  "dhcpClientRateLimit": "120",
+  "dhcpRelayRateLimit": "0",
+  "fileTransferBandwidth": "0",
+  "fileTransferClientLimit": "0",
+  "fileTransferLimit": "0",
+  "fileTransferQueueTimeout": "30",
   "knownTokenTimeout": "3600",
+  "leaseHistoryLength": "50",
+  "leaseHistoryRetention": "2592000",
+  "leaseReapGrace": "86400",
+  "leaseSweepInterval": "60",
+  "subnetUsageThresholds": "80,90,95",
   "unknownBootEnv": "ignore",
   "unknownTokenTimeout": "600"
 }
@@ -55,13 +88,26 @@ var prefsSetStdinJSONString = `{
 
 var prefsSetBadKnownTokenTimeoutErrorString = "Error: Preference knownTokenTimeout: strconv.Atoi: parsing \"illegal\": invalid syntax\n\n"
 var prefsSetBadUnknownTokenTimeoutErrorString = "Error: Preference unknownTokenTimeout: strconv.Atoi: parsing \"illegal\": invalid syntax\n\n"
+var prefsSetBadLeaseReapGraceErrorString = "Error: Preference leaseReapGrace: strconv.Atoi: parsing \"illegal\": invalid syntax\n\n"
+var prefsSetBadSubnetUsageThresholdsErrorString = "Error: Preference subnetUsageThresholds: 120 is not a percentage\n\n"
 
 var prefsKnownChangedListString = `{
   "debugBootEnv": "0",
   "debugDhcp": "0",
   "debugRenderer": "0",
   "defaultBootEnv": "local",
+  "dhcpClientRateLimit": "120",
+  "dhcpRelayRateLimit": "0",
+  "fileTransferBandwidth": "0",
+  "fileTransferClientLimit": "0",
+  "fileTransferLimit": "0",
+  "fileTransferQueueTimeout": "30",
   "knownTokenTimeout": "5000",
+  "leaseHistoryLength": "50",
+  "leaseHistoryRetention": "2592000",
+  "leaseReapGrace": "86400",
+  "leaseSweepInterval": "60",
+  "subnetUsageThresholds": "80,90,95",
   "unknownBootEnv": "ignore",
   "unknownTokenTimeout": "600"
 }
@@ -71,7 +117,18 @@ var prefsBothPreDebugChangedListString = `{
   "debugDhcp": "0",
   "debugRenderer": "0",
   "defaultBootEnv": "local",
+  "dhcpClientRateLimit": "120",
+  "dhcpRelayRateLimit": "0",
+  "fileTransferBandwidth": "0",
+  "fileTransferClientLimit": "0",
+  "fileTransferLimit": "0",
+  "fileTransferQueueTimeout": "30",
   "knownTokenTimeout": "5000",
+  "leaseHistoryLength": "50",
+  "leaseHistoryRetention": "2592000",
+  "leaseReapGrace": "86400",
+  "leaseSweepInterval": "60",
+  "subnetUsageThresholds": "80,90,95",
   "unknownBootEnv": "ignore",
   "unknownTokenTimeout": "7000"
 }
@@ -81,7 +138,18 @@ var prefsBothChangedListString = `{
   "debugDhcp": "2",
   "debugRenderer": "1",
   "defaultBootEnv": "local",
+  "dhcpClientRateLimit": "120",
+  "dhcpRelayRateLimit": "0",
+  "fileTransferBandwidth": "0",
+  "fileTransferClientLimit": "0",
+  "fileTransferLimit": "0",
+  "fileTransferQueueTimeout": "30",
   "knownTokenTimeout": "5000",
+  "leaseHistoryLength": "50",
+  "leaseHistoryRetention": "2592000",
+  "leaseReapGrace": "86400",
+  "leaseSweepInterval": "60",
+  "subnetUsageThresholds": "80,90,95",
   "unknownBootEnv": "ignore",
   "unknownTokenTimeout": "7000"
 }
@@ -127,6 +195,8 @@ func TestPrefsCli(t *testing.T) {
 
 		CliTest{false, true, []string{"prefs", "set", "knownTokenTimeout", "illegal"}, noStdinString, noContentString, prefsSetBadKnownTokenTimeoutErrorString},
 		CliTest{false, true, []string{"prefs", "set", "unknownTokenTimeout", "illegal"}, noStdinString, noContentString, prefsSetBadUnknownTokenTimeoutErrorString},
+		CliTest{false, true, []string{"prefs", "set", "leaseReapGrace", "illegal"}, noStdinString, noContentString, prefsSetBadLeaseReapGraceErrorString},
+		CliTest{false, true, []string{"prefs", "set", "subnetUsageThresholds", "80,120"}, noStdinString, noContentString, prefsSetBadSubnetUsageThresholdsErrorString},
 		CliTest{false, false, []string{"prefs", "set", "knownTokenTimeout", "5000"}, noStdinString, prefsKnownChangedListString, noErrorString},
 		CliTest{false, false, []string{"prefs", "set", "unknownTokenTimeout", "7000"}, noStdinString, prefsBothPreDebugChangedListString, noErrorString},
 		CliTest{false, false, []string{"prefs", "set", "debugRenderer", "1", "debugDhcp", "2", "debugBootEnv", "1"}, noStdinString, prefsBothChangedListString, noErrorString},
@@ -108,6 +108,15 @@ func (be SubnetOps) Delete(id string) (interface{}, error) {
 	return d.Payload, nil
 }
 
+func validStrategy(strat string) bool {
+	for _, known := range backend.DhcpStrategies {
+		if strat == known {
+			return true
+		}
+	}
+	return false
+}
+
 func init() {
 	tree := addSubnetCommands()
 	App.AddCommand(tree)
@@ -202,16 +211,24 @@ func addSubnetCommands() (res *cobra.Command) {
 	})
 
 	commands = append(commands, &cobra.Command{
-		Use:   "strategy [subnetName] [MAC]",
+		Use:   "strategy [subnetName] [strategies]",
 		Short: fmt.Sprintf("Set Subnet strategy"),
-		Long:  `Helper function to set the strategy of a given subnet.`,
+		Long: `Helper function to set the leasing strategies of a given subnet.
+Accepts a list of strategies separated by commas, which will be tried in order.
+The first one becomes the Strategy of the subnet.`,
 		RunE: func(c *cobra.Command, args []string) error {
 			if len(args) != 2 {
 				return fmt.Errorf("%s requires 2 arguments", c.UseLine())
 			}
 			dumpUsage = false
 			subName := args[0]
-			MACAddress := args[1]
+			strats := strings.Split(args[1], ",")
+
+			for _, strat := range strats {
+				if !validStrategy(strat) {
+					return fmt.Errorf("%s is not a valid strategy", strat)
+				}
+			}
 
 			d, e := session.Subnets.GetSubnet(subnets.NewGetSubnetParams().WithName(subName), basicAuth)
 			if e != nil {
@@ -219,19 +236,33 @@ func addSubnetCommands() (res *cobra.Command) {
 			}
 			sub := d.Payload
 
-			_, e = net.ParseMAC(MACAddress)
-			if e != nil {
-				return fmt.Errorf("%s is not a valid MAC address", MACAddress)
+			sub.Strategy = &strats[0]
+			if len(strats) > 1 {
+				sub.Strategies = strats
+			} else {
+				sub.Strategies = nil
 			}
 
-			sub.Strategy = &MACAddress
-
 			_, e = session.Subnets.PutSubnet(subnets.NewPutSubnetParams().WithName(subName).WithBody(sub), basicAuth)
 			if e != nil {
 				return generateError(e, "Failed to post updated Subnet %s: %s", singularName, subName)
 			}
 
-			fmt.Printf("%v\n", *sub.Strategy)
+			fmt.Printf("%v\n", strings.Join(strats, ", "))
+			return nil
+		},
+	})
+
+	commands = append(commands, &cobra.Command{
+		Use:   "strategies",
+		Short: fmt.Sprintf("List the available leasing strategies"),
+		Long:  `Helper function that lists the leasing strategies a subnet can use.`,
+		RunE: func(c *cobra.Command, args []string) error {
+			if len(args) != 0 {
+				return fmt.Errorf("%v requires no arguments", c.UseLine())
+			}
+			dumpUsage = false
+			fmt.Printf("%v\n", strings.Join(backend.DhcpStrategies, "\n"))
 			return nil
 		},
 	})
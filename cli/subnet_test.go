@@ -276,10 +276,13 @@ var subnetSubnetTooManyArgErrorString string = "Error: drpcli subnets subnet [su
 var subnetSubnetCIDRSuccessString = "192.168.100.0/10\n"
 var subnetSubnetCIDRFailureString = "Error: 1111.11.2223.544/66666 is not a valid subnet CIDR\n\n"
 
-var subnetStrategyNoArgErrorString string = "Error: drpcli subnets strategy [subnetName] [MAC] [flags] requires 2 arguments\n"
-var subnetStrategyTooManyArgErrorString string = "Error: drpcli subnets strategy [subnetName] [MAC] [flags] requires 2 arguments\n"
-var subnetStrategyMacSuccessString string = "a3:b3:51:66:7e:11\n"
-var subnetStrategyMacFailureErrorString string = "Error: t5:44:llll:b is not a valid MAC address\n\n"
+var subnetStrategyNoArgErrorString string = "Error: drpcli subnets strategy [subnetName] [strategies] [flags] requires 2 arguments\n"
+var subnetStrategyTooManyArgErrorString string = "Error: drpcli subnets strategy [subnetName] [strategies] [flags] requires 2 arguments\n"
+var subnetStrategyMacSuccessString string = "MAC\n"
+var subnetStrategyListSuccessString string = "CircuitID, MAC\n"
+var subnetStrategyBadFailureErrorString string = "Error: a3:b3:51:66:7e:11 is not a valid strategy\n\n"
+var subnetStrategiesSuccessString string = "MAC\nClientID\nCircuitID\nRemoteID\nDUID\n"
+var subnetStrategiesTooManyArgErrorString string = "Error: drpcli subnets strategies [flags] requires no arguments\n"
 
 var subnetPickersNoArgErrorString string = "Error: drpcli subnets pickers [subnetName] [list] [flags] requires 2 arguments\n"
 var subnetPickersTooManyArgErrorString string = "Error: drpcli subnets pickers [subnetName] [list] [flags] requires 2 arguments\n"
@@ -385,9 +388,12 @@ func TestSubnetCli(t *testing.T) {
 		CliTest{false, true, []string{"subnets", "subnet", "john", "1111.11.2223.544/66666"}, noStdinString, noContentString, subnetSubnetCIDRFailureString},
 
 		CliTest{true, true, []string{"subnets", "strategy"}, noStdinString, noContentString, subnetStrategyNoArgErrorString},
-		CliTest{true, true, []string{"subnets", "strategy", "john", "june", "a3:b3:51:66:7e:11"}, noStdinString, noContentString, subnetStrategyTooManyArgErrorString},
-		CliTest{false, false, []string{"subnets", "strategy", "john", "a3:b3:51:66:7e:11"}, noStdinString, subnetStrategyMacSuccessString, noErrorString},
-		CliTest{false, true, []string{"subnets", "strategy", "john", "t5:44:llll:b"}, noStdinString, noContentString, subnetStrategyMacFailureErrorString},
+		CliTest{true, true, []string{"subnets", "strategy", "john", "june", "MAC"}, noStdinString, noContentString, subnetStrategyTooManyArgErrorString},
+		CliTest{false, false, []string{"subnets", "strategy", "john", "CircuitID,MAC"}, noStdinString, subnetStrategyListSuccessString, noErrorString},
+		CliTest{false, false, []string{"subnets", "strategy", "john", "MAC"}, noStdinString, subnetStrategyMacSuccessString, noErrorString},
+		CliTest{false, true, []string{"subnets", "strategy", "john", "a3:b3:51:66:7e:11"}, noStdinString, noContentString, subnetStrategyBadFailureErrorString},
+		CliTest{true, true, []string{"subnets", "strategies", "john"}, noStdinString, noContentString, subnetStrategiesTooManyArgErrorString},
+		CliTest{false, false, []string{"subnets", "strategies"}, noStdinString, subnetStrategiesSuccessString, noErrorString},
 
 		CliTest{true, true, []string{"subnets", "pickers"}, noStdinString, noContentString, subnetPickersNoArgErrorString},
 		CliTest{true, true, []string{"subnets", "pickers", "john", "june", "test1,test2,test3"}, noStdinString, noContentString, subnetPickersTooManyArgErrorString},
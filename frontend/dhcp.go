@@ -0,0 +1,162 @@
+package frontend
+
+import (
+	"net/http"
+
+	"github.com/digitalrebar/provision/backend"
+	"github.com/gin-gonic/gin"
+)
+
+// DhcpTransactionsResponse returned on a successful GET of DHCP transactions
+// swagger:response
+type DhcpTransactionsResponse struct {
+	// in: body
+	Body []*backend.DhcpTransaction
+}
+
+// swagger:parameters listDhcpTransactions
+type DhcpTransactionsQueryParameter struct {
+	// in: query
+	Mac string `json:"mac"`
+}
+
+// DhcpDropsResponse returned on a successful GET of DHCP drop counts
+// swagger:response
+type DhcpDropsResponse struct {
+	// in: body
+	Body *backend.DhcpDrops
+}
+
+// DhcpShadowResponse returned on a successful GET of the DHCP shadow
+// report
+// swagger:response
+type DhcpShadowResponse struct {
+	// in: body
+	Body *backend.DhcpShadowReport
+}
+
+// DhcpImportResponse returned on a successful DHCP import
+// swagger:response
+type DhcpImportResponse struct {
+	// in: body
+	Body *backend.DhcpImportResult
+}
+
+// DhcpImportParameters used to import DHCP configuration
+// swagger:parameters importDhcp
+type DhcpImportParameters struct {
+	// in: body
+	// required: true
+	Body *backend.DhcpImport
+	// in: query
+	DryRun bool `json:"dryrun"`
+}
+
+func (f *Frontend) InitDhcpApi() {
+	// swagger:route GET /dhcp/transactions Dhcp listDhcpTransactions
+	//
+	// Lists recent DHCP transactions
+	//
+	// Lists what the DHCP server did with the packets it most
+	// recently received, oldest first.  mac=<hardware address> only
+	// lists transactions for that client.
+	//
+	//     Produces:
+	//       application/json
+	//
+	//     Responses:
+	//       200: DhcpTransactionsResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	f.ApiGroup.GET("/dhcp/transactions",
+		func(c *gin.Context) {
+			if !assureAuth(c, f.Logger, "dhcp", "list", "") {
+				return
+			}
+			mac, _ := c.GetQuery("mac")
+			c.JSON(http.StatusOK, f.dt.DhcpTransactions(mac))
+		})
+
+	// swagger:route GET /dhcp/drops Dhcp getDhcpDrops
+	//
+	// Counts the DHCP packets dropped by rate limiting
+	//
+	// Packets from a client that sends more than the
+	// dhcpClientRateLimit preference allows, or through a relay
+	// agent that sends more than dhcpRelayRateLimit allows, are
+	// dropped without a reply.
+	//
+	//     Produces:
+	//       application/json
+	//
+	//     Responses:
+	//       200: DhcpDropsResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	f.ApiGroup.GET("/dhcp/drops",
+		func(c *gin.Context) {
+			if !assureAuth(c, f.Logger, "dhcp", "get", "") {
+				return
+			}
+			c.JSON(http.StatusOK, f.dt.DhcpDrops())
+		})
+
+	// swagger:route GET /dhcp/shadow Dhcp getDhcpShadow
+	//
+	// Compares shadow mode DHCP decisions with what clients got
+	//
+	// For each client handled in shadow mode, reports the address
+	// the DHCP server would have handed out, and the address the
+	// client was seen taking from another DHCP server or using.
+	//
+	//     Produces:
+	//       application/json
+	//
+	//     Responses:
+	//       200: DhcpShadowResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	f.ApiGroup.GET("/dhcp/shadow",
+		func(c *gin.Context) {
+			if !assureAuth(c, f.Logger, "dhcp", "get", "") {
+				return
+			}
+			c.JSON(http.StatusOK, f.dt.DhcpShadowReport())
+		})
+
+	// swagger:route POST /dhcp/import Dhcp importDhcp
+	//
+	// Import reservations or leases from another DHCP server
+	//
+	// Turns the host declarations of an ISC dhcpd.conf, the active
+	// leases of a dhcpd.leases file, or the dhcp-host lines of a
+	// dnsmasq configuration into Reservations or Leases that use
+	// the MAC strategy.  dryrun=true only reports what would be
+	// created and what conflicts with existing objects.  If there
+	// are any conflicts, nothing is created.
+	//
+	//     Responses:
+	//       200: DhcpImportResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       409: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.POST("/dhcp/import",
+		func(c *gin.Context) {
+			if !assureAuth(c, f.Logger, "dhcp", "import", "") {
+				return
+			}
+			imp := &backend.DhcpImport{}
+			if !assureDecode(c, imp) {
+				return
+			}
+			dryRun := c.Query("dryrun") == "true"
+			res, err := f.dt.ImportDhcp(imp, dryRun)
+			if err != nil {
+				jsonError(c, err, http.StatusBadRequest, "dhcp import: ")
+				return
+			}
+			c.JSON(http.StatusOK, res)
+		})
+}
@@ -48,6 +48,14 @@ type FileInfoResponse struct {
 	Body *FileInfo
 }
 
+// FileTransfersResponse returned on a successful GET of file transfer
+// stats
+// swagger:response
+type FileTransfersResponse struct {
+	// in: body
+	Body *backend.FileTransferStats
+}
+
 // swagger:parameters listFiles
 type FilesPathQueryParameter struct {
 	// in: query
@@ -107,6 +115,30 @@ func (f *Frontend) InitFileApi() {
 			c.JSON(http.StatusOK, res)
 		})
 
+	// swagger:route GET /transfers Files getFileTransfers
+	//
+	// Reports on the TFTP and HTTP file transfers in progress
+	//
+	// Counts the file transfers that are running and waiting for a
+	// slot because of the fileTransferLimit and
+	// fileTransferClientLimit preferences, and how long transfers
+	// have had to wait.
+	//
+	//     Produces:
+	//       application/json
+	//
+	//     Responses:
+	//       200: FileTransfersResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	f.ApiGroup.GET("/transfers",
+		func(c *gin.Context) {
+			if !assureAuth(c, f.Logger, "files", "get", "") {
+				return
+			}
+			c.JSON(http.StatusOK, f.dt.FileTransfers())
+		})
+
 	// swagger:route GET /files/{path} Files getFile
 	//
 	// Get a specific File with {path}
@@ -190,6 +190,7 @@ func NewFrontend(dt *backend.DataTracker, logger *log.Logger, address string, ap
 	me.InitSubnetApi()
 	me.InitUserApi(drpid)
 	me.InitInterfaceApi()
+	me.InitDhcpApi()
 	me.InitPrefApi()
 	me.InitParamApi()
 	me.InitInfoApi(drpid)
@@ -24,6 +24,20 @@ type LeasesResponse struct {
 	Body []*backend.Lease
 }
 
+// LeaseHistoryResponse returned on a successful GET of the history of an address
+// swagger:response
+type LeaseHistoryResponse struct {
+	//in: body
+	Body []*backend.LeaseHistoryEntry
+}
+
+// LeaseBootProgressResponse returned on a successful GET of the boot milestones of the client holding an address
+// swagger:response
+type LeaseBootProgressResponse struct {
+	//in: body
+	Body []*backend.BootMilestone
+}
+
 // LeaseBodyParameter used to inject a Lease
 // swagger:parameters createLease putLease
 type LeaseBodyParameter struct {
@@ -41,7 +55,7 @@ type LeasePatchBodyParameter struct {
 }
 
 // LeasePathParameter used to address a Lease in the path
-// swagger:parameters putLeases getLease putLease patchLease deleteLease
+// swagger:parameters putLeases getLease putLease patchLease deleteLease getLeaseHistory getLeaseBootProgress
 type LeasePathParameter struct {
 	// in: path
 	// required: true
@@ -148,6 +162,63 @@ func (f *Frontend) InitLeaseApi() {
 			f.Fetch(c, f.dt.NewLease(), backend.Hexaddr(ip))
 		})
 
+	// swagger:route GET /leases/{address}/history Leases getLeaseHistory
+	//
+	// Get the history of an address
+	//
+	// Get who has held the address specified by {address}, oldest
+	// first.  Each entry has the strategy and token of the client,
+	// and when the client got and gave up the address.
+	//
+	//     Responses:
+	//       200: LeaseHistoryResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	f.ApiGroup.GET("/leases/:address/history",
+		func(c *gin.Context) {
+			ip := net.ParseIP(c.Param(`address`))
+			if ip == nil {
+				c.JSON(http.StatusBadRequest,
+					backend.NewError("API_ERROR", http.StatusBadRequest,
+						fmt.Sprintf("lease history: address not valid: %v", c.Param(`address`))))
+				return
+			}
+			if !assureAuth(c, f.Logger, "leases", "history", ip.String()) {
+				return
+			}
+			c.JSON(http.StatusOK, f.dt.LeaseHistory(ip))
+		})
+
+	// swagger:route GET /leases/{address}/bootprogress Leases getLeaseBootProgress
+	//
+	// Get the boot progress of the client holding an address
+	//
+	// Get the boot milestones of the client holding the address
+	// specified by {address}, oldest first.  Only milestones that
+	// have not been matched to a Machine yet are kept here; once the
+	// client has a Machine, they move to it.
+	//
+	//     Responses:
+	//       200: LeaseBootProgressResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	f.ApiGroup.GET("/leases/:address/bootprogress",
+		func(c *gin.Context) {
+			ip := net.ParseIP(c.Param(`address`))
+			if ip == nil {
+				c.JSON(http.StatusBadRequest,
+					backend.NewError("API_ERROR", http.StatusBadRequest,
+						fmt.Sprintf("lease boot progress: address not valid: %v", c.Param(`address`))))
+				return
+			}
+			if !assureAuth(c, f.Logger, "leases", "get", backend.Hexaddr(ip)) {
+				return
+			}
+			c.JSON(http.StatusOK, f.dt.LeaseBootProgress(ip))
+		})
+
 	// swagger:route PATCH /leases/{address} Leases patchLease
 	//
 	// Patch a Lease
@@ -46,6 +46,13 @@ type MachineParamsResponse struct {
 	Body map[string]interface{}
 }
 
+// MachineBootProgressResponse return on a successful GET of a Machine's boot milestones
+// swagger:response
+type MachineBootProgressResponse struct {
+	// in: body
+	Body []*backend.BootMilestone
+}
+
 // MachineActionPostResponse return on a successful POST of action
 // swagger:response
 type MachineActionPostResponse struct {
@@ -53,6 +60,14 @@ type MachineActionPostResponse struct {
 	Body string
 }
 
+// MachineRenderResponse returned on a successful render preview of a
+// Machine
+// swagger:response
+type MachineRenderResponse struct {
+	// in: body
+	Body *backend.RenderPreview
+}
+
 // MachineBodyParameter used to inject a Machine
 // swagger:parameters createMachine putMachine
 type MachineBodyParameter struct {
@@ -74,7 +89,7 @@ type MachinePatchBodyParameter struct {
 }
 
 // MachinePathParameter used to find a Machine in the path
-// swagger:parameters putMachines getMachine putMachine patchMachine deleteMachine getMachineParams postMachineParams getMachineActions
+// swagger:parameters putMachines getMachine putMachine patchMachine deleteMachine getMachineParams postMachineParams getMachineActions getMachineBootProgress getMachineRender postMachineRender
 type MachinePathParameter struct {
 	// in: path
 	// required: true
@@ -117,6 +132,23 @@ type MachineParamsBodyParameter struct {
 	Body map[string]interface{}
 }
 
+// MachineRenderQueryParameter picks what to render for a Machine
+// swagger:parameters getMachineRender postMachineRender
+type MachineRenderQueryParameter struct {
+	// in: query
+	BootEnv string `json:"bootenv"`
+	// in: query
+	Task string `json:"task"`
+}
+
+// MachineRenderBodyParameter used to override Machine Params when
+// rendering
+// swagger:parameters postMachineRender
+type MachineRenderBodyParameter struct {
+	// in: body
+	Body map[string]interface{}
+}
+
 // MachineListPathParameter used to limit lists of Machine by path options
 // swagger:parameters listMachines
 type MachineListPathParameter struct {
@@ -369,6 +401,93 @@ func (f *Frontend) InitMachineApi() {
 			c.JSON(http.StatusOK, p)
 		})
 
+	// swagger:route GET /machines/{uuid}/bootprogress Machines getMachineBootProgress
+	//
+	// Get the boot progress of a Machine
+	//
+	// Get the boot milestones of the Machine specified by {uuid},
+	// oldest first.  There is one for each file the machine
+	// fetched over TFTP or HTTP that is part of booting: the files
+	// rendered from its boot environment, and the kernels and
+	// initrds of boot environments.
+	//
+	//     Responses:
+	//       200: MachineBootProgressResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/machines/:uuid/bootprogress",
+		func(c *gin.Context) {
+			uuid := c.Param(`uuid`)
+			b := f.dt.NewMachine()
+			var ref store.KeySaver
+			func() {
+				d, unlocker := f.dt.LockEnts(store.KeySaver(b).(Lockable).Locks("get")...)
+				defer unlocker()
+				ref = d("machines").Find(uuid)
+			}()
+			if ref == nil {
+				err := &backend.Error{
+					Code:  http.StatusNotFound,
+					Type:  "API_ERROR",
+					Model: "machines",
+					Key:   uuid,
+				}
+				err.Errorf("%s GET BootProgress: %s: Not Found", err.Model, err.Key)
+				c.JSON(err.Code, err)
+				return
+			}
+			if !assureAuth(c, f.Logger, ref.Prefix(), "get", ref.Key()) {
+				return
+			}
+			c.JSON(http.StatusOK, f.dt.MachineBootProgress(ref.Key()))
+		})
+
+	// swagger:route GET /machines/{uuid}/render Machines getMachineRender
+	//
+	// Preview the templates of a BootEnv or Task for a Machine
+	//
+	// Renders the templates of the BootEnv given by bootenv=<name>,
+	// or of the Task given by task=<name>, for the Machine specified
+	// by {uuid}, without making them available over TFTP or HTTP.
+	// With neither, the Machine's own BootEnv is rendered.  Missing
+	// required parameters and template errors are returned with the
+	// rendered files.
+	//
+	//     Responses:
+	//       200: MachineRenderResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/machines/:uuid/render",
+		func(c *gin.Context) {
+			f.renderMachine(c, nil)
+		})
+
+	// swagger:route POST /machines/{uuid}/render Machines postMachineRender
+	//
+	// Preview the templates of a BootEnv or Task with different Params
+	//
+	// Like GET /machines/{uuid}/render, but the parameters in the
+	// body are used in place of the ones the Machine has, to see
+	// what a change to them would render.
+	//
+	//     Responses:
+	//       200: MachineRenderResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.POST("/machines/:uuid/render",
+		func(c *gin.Context) {
+			var val map[string]interface{}
+			if !assureDecode(c, &val) {
+				return
+			}
+			f.renderMachine(c, val)
+		})
+
 	// swagger:route POST /machines/{uuid}/params Machines postMachineParams
 	//
 	// Set/Replace all the Parameters for a machine specified by {uuid}
@@ -689,3 +808,19 @@ func validateMachineAction(f *Frontend, d backend.Stores, name string, m *backen
 	}
 	return aa, err
 }
+
+func (f *Frontend) renderMachine(c *gin.Context, overrides map[string]interface{}) {
+	uuid := c.Param(`uuid`)
+	if !assureAuth(c, f.Logger, "machines", "get", uuid) {
+		return
+	}
+	bootEnv, _ := c.GetQuery("bootenv")
+	task, _ := c.GetQuery("task")
+	res, err := f.dt.RenderPreview(uuid, bootEnv, task, overrides)
+	if err != nil {
+		be, _ := err.(*backend.Error)
+		c.JSON(be.Code, be)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
@@ -69,7 +69,9 @@ func (f *Frontend) InitPrefApi() {
 						return
 					}
 					continue
-				case "knownTokenTimeout", "unknownTokenTimeout", "debugRenderer", "debugDhcp", "debugBootEnv":
+				case "knownTokenTimeout", "unknownTokenTimeout", "leaseSweepInterval", "leaseReapGrace", "debugRenderer", "debugDhcp", "debugBootEnv",
+					"dhcpClientRateLimit", "dhcpRelayRateLimit", "leaseHistoryLength", "leaseHistoryRetention",
+					"fileTransferLimit", "fileTransferClientLimit", "fileTransferBandwidth", "fileTransferQueueTimeout":
 					if !assureAuth(c, f.Logger, "prefs", "post", k) {
 						return
 					}
@@ -77,6 +79,14 @@ func (f *Frontend) InitPrefApi() {
 						err.Errorf("Preference %s: %v", k, e)
 					}
 					continue
+				case "subnetUsageThresholds":
+					if !assureAuth(c, f.Logger, "prefs", "post", k) {
+						return
+					}
+					if _, e := backend.ParseUsageThresholds(prefs[k]); e != nil {
+						err.Errorf("Preference %s: %v", k, e)
+					}
+					continue
 				default:
 					err.Errorf("Unknown Preference %s", k)
 				}
@@ -1,6 +1,8 @@
 package frontend
 
 import (
+	"net/http"
+
 	"github.com/VictorLowther/jsonpatch2"
 	"github.com/digitalrebar/provision/backend"
 	"github.com/gin-gonic/gin"
@@ -20,6 +22,13 @@ type SubnetsResponse struct {
 	Body []*backend.Subnet
 }
 
+// SubnetStatsResponse returned on a successful GET of the stats of a subnet
+// swagger:response
+type SubnetStatsResponse struct {
+	// in: body
+	Body *backend.SubnetStats
+}
+
 // SubnetBodyParameter used to inject a Subnet
 // swagger:parameters createSubnet putSubnet
 type SubnetBodyParameter struct {
@@ -37,7 +46,7 @@ type SubnetPatchBodyParameter struct {
 }
 
 // SubnetPathParameter used to name a Subnet in the path
-// swagger:parameters putSubnets getSubnet putSubnet patchSubnet deleteSubnet
+// swagger:parameters putSubnets getSubnet putSubnet patchSubnet deleteSubnet getSubnetStats
 type SubnetPathParameter struct {
 	// in: path
 	// required: true
@@ -138,6 +147,40 @@ func (f *Frontend) InitSubnetApi() {
 			f.Fetch(c, f.dt.NewSubnet(), c.Param(`name`))
 		})
 
+	// swagger:route GET /subnets/{name}/stats Subnets getSubnetStats
+	//
+	// Get the stats of a Subnet
+	//
+	// Get how full the Subnet specified by {name} is.
+	//
+	//     Responses:
+	//       200: SubnetStatsResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/subnets/:name/stats",
+		func(c *gin.Context) {
+			name := c.Param(`name`)
+			if !assureAuth(c, f.Logger, "subnets", "stats", name) {
+				return
+			}
+			d, unlocker := f.dt.LockEnts(f.dt.NewSubnet().Locks("stats")...)
+			defer unlocker()
+			ref := d("subnets").Find(name)
+			if ref == nil {
+				err := &backend.Error{
+					Code:  http.StatusNotFound,
+					Type:  "API_ERROR",
+					Model: "subnets",
+					Key:   name,
+				}
+				err.Errorf("%s Stats Get: %s: Not Found", err.Model, err.Key)
+				c.JSON(err.Code, err)
+				return
+			}
+			c.JSON(http.StatusOK, backend.AsSubnet(ref).Stats(d))
+		})
+
 	// swagger:route PATCH /subnets/{name} Subnets patchSubnet
 	//
 	// Patch a Subnet
@@ -0,0 +1,431 @@
+package midlayer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/digitalrebar/provision/backend"
+	"github.com/miekg/dns"
+)
+
+// How often and how many times we will retry a dynamic DNS update
+// that the DNS server could not be reached for or failed with
+// SERVFAIL.  The delay doubles after each failure, up to
+// ddnsRetryMax.
+var (
+	ddnsRetryBase = time.Second
+	ddnsRetryMax  = 5 * time.Minute
+)
+
+const (
+	ddnsMaxTries  = 10
+	ddnsMaxQueued = 10000
+)
+
+// LeaseHostname returns the name we use in DNS for a lease that
+// has no other name, which is "dhcp-" followed by the address with
+// dots or colons replaced by dashes.
+func LeaseHostname(addr net.IP) string {
+	if v4 := addr.To4(); v4 != nil {
+		return "dhcp-" + strings.Replace(v4.String(), ".", "-", -1)
+	}
+	return "dhcp-" + strings.Replace(addr.String(), ":", "-", -1)
+}
+
+// dnsName returns the fully qualified name for name in zone.  Names
+// that are already qualified are used as is if they are in zone, and
+// otherwise have their first label moved into zone.
+func dnsName(name, zone string) string {
+	zone = dns.Fqdn(zone)
+	if strings.Contains(strings.TrimSuffix(name, "."), ".") {
+		if fqdn := dns.Fqdn(name); dns.IsSubDomain(zone, fqdn) {
+			return fqdn
+		}
+		name = strings.SplitN(name, ".", 2)[0]
+	}
+	return dns.Fqdn(name + "." + zone)
+}
+
+// ddnsBinding is a name we have put in DNS for an address.
+type ddnsBinding struct {
+	name    string
+	addr    net.IP
+	zone    string
+	revZone string
+}
+
+func (b *ddnsBinding) equal(o *ddnsBinding) bool {
+	if b == nil || o == nil {
+		return b == o
+	}
+	return b.name == o.name && b.addr.Equal(o.addr) && b.zone == o.zone && b.revZone == o.revZone
+}
+
+// ddnsChange is a lease or machine event, stripped down to what we
+// need to update DNS.
+type ddnsChange struct {
+	key  string
+	name string
+	addr net.IP
+	// remove is set when the lease or machine has gone away.  name
+	// and addr are still filled in if they are known, so that we
+	// can remove records we put in DNS before we were restarted.
+	remove bool
+}
+
+// ddnsUpdate is a single RFC 2136 update message for one zone.
+type ddnsUpdate struct {
+	zone        string
+	removeRRset []dns.RR
+	remove      []dns.RR
+	insert      []dns.RR
+	tries       int
+}
+
+func (u *ddnsUpdate) String() string {
+	parts := []string{}
+	for _, rr := range u.remove {
+		parts = append(parts, "delete "+rr.String())
+	}
+	for _, rr := range u.insert {
+		parts = append(parts, "add "+rr.String())
+	}
+	return fmt.Sprintf("%s: %s", u.zone, strings.Join(parts, ", "))
+}
+
+// Ddns sends RFC 2136 dynamic DNS updates to a DNS server as leases
+// are handed out and machines are created, changed, and removed.
+// Which zones names and PTR records go in is set per Subnet by
+// DnsZone and DnsReverseZone.  Leases are named with LeaseHostname,
+// and machines with their Name.
+//
+// Updates are sent in order from a queue.  If the DNS server cannot
+// be reached or answers SERVFAIL, the update is retried with an
+// increasing delay, and later updates wait for it.
+type Ddns struct {
+	bk      *backend.DataTracker
+	pubs    *backend.Publishers
+	server  string
+	client  *dns.Client
+	keyName string
+	alg     string
+	ttl     uint32
+	changes chan *ddnsChange
+	done    chan struct{}
+	stopped chan struct{}
+	// bound is what we have put in DNS for each lease and machine.
+	bound map[string]*ddnsBinding
+	queue []*ddnsUpdate
+}
+
+// StartDdns starts sending dynamic DNS updates to the DNS server at
+// server.  If keyName is not empty, updates are signed with TSIG
+// using the base64 encoded secret and alg, which defaults to
+// hmac-sha256.  ttl is the TTL of the records we add.
+func StartDdns(dt *backend.DataTracker,
+	pubs *backend.Publishers,
+	server, keyName, secret, alg string,
+	ttl int) (*Ddns, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	d := &Ddns{
+		bk:      dt,
+		pubs:    pubs,
+		server:  server,
+		client:  &dns.Client{Timeout: 5 * time.Second},
+		ttl:     uint32(ttl),
+		changes: make(chan *ddnsChange, 1000),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		bound:   map[string]*ddnsBinding{},
+	}
+	// The leases and machines we already have were put in DNS
+	// before we were restarted.
+	for _, c := range d.current() {
+		if b := d.binding(c.name, c.addr); b != nil {
+			d.bound[c.key] = b
+		}
+	}
+	if keyName != "" {
+		switch strings.ToLower(alg) {
+		case "", "hmac-sha256":
+			d.alg = dns.HmacSHA256
+		case "hmac-sha1":
+			d.alg = dns.HmacSHA1
+		case "hmac-sha512":
+			d.alg = dns.HmacSHA512
+		case "hmac-md5":
+			d.alg = dns.HmacMD5
+		default:
+			return nil, fmt.Errorf("Unknown TSIG algorithm %s", alg)
+		}
+		d.keyName = dns.Fqdn(keyName)
+		d.client.TsigSecret = map[string]string{d.keyName: secret}
+	}
+	pubs.Add(d)
+	go d.run()
+	return d, nil
+}
+
+// Publish turns lease and machine events into DNS changes.  It is
+// called with the DataTracker locks held, so the real work happens
+// in run.
+func (d *Ddns) Publish(e *backend.Event) error {
+	c := &ddnsChange{}
+	switch obj := e.Object.(type) {
+	case *backend.Lease:
+		c.key = "leases:" + e.Key
+		c.name, c.addr = LeaseHostname(obj.Addr), obj.Addr
+		switch e.Action {
+		case "create", "update", "save":
+			c.remove = obj.Token == "" || obj.Expired()
+		case "delete", "expire", "reap":
+			c.remove = true
+		default:
+			return nil
+		}
+	case *backend.Machine:
+		c.key = "machines:" + e.Key
+		if obj.Address != nil && !obj.Address.IsUnspecified() {
+			c.name, c.addr = obj.Name, obj.Address
+		}
+		switch e.Action {
+		case "create", "update", "save":
+		case "delete":
+			c.remove = true
+		default:
+			return nil
+		}
+	default:
+		return nil
+	}
+	select {
+	case d.changes <- c:
+	default:
+		d.bk.Printf("DDNS: too many changes queued, dropping %s", c.key)
+	}
+	return nil
+}
+
+func (d *Ddns) Reserve() error { return nil }
+func (d *Ddns) Release()       {}
+func (d *Ddns) Unload()        {}
+
+func (d *Ddns) run() {
+	defer close(d.stopped)
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-d.done:
+			return
+		case c := <-d.changes:
+			d.change(c)
+		case <-retry:
+			retry = nil
+		}
+		if retry == nil {
+			if delay := d.flush(); delay > 0 {
+				retry = time.After(delay)
+			}
+		}
+	}
+}
+
+// current returns the leases and machines that should be in DNS
+// right now.
+func (d *Ddns) current() []*ddnsChange {
+	dt, unlocker := d.bk.LockEnts("leases", "machines")
+	defer unlocker()
+	res := []*ddnsChange{}
+	for _, i := range dt("leases").Items() {
+		lease := backend.AsLease(i)
+		if lease.Token != "" && !lease.Expired() {
+			res = append(res, &ddnsChange{key: "leases:" + lease.Key(), name: LeaseHostname(lease.Addr), addr: lease.Addr})
+		}
+	}
+	for _, i := range dt("machines").Items() {
+		machine := backend.AsMachine(i)
+		if machine.Address != nil && !machine.Address.IsUnspecified() {
+			res = append(res, &ddnsChange{key: "machines:" + machine.Key(), name: machine.Name, addr: machine.Address})
+		}
+	}
+	return res
+}
+
+// binding returns the binding for name and addr, or nil if the
+// subnet addr is in does not put names in DNS.
+func (d *Ddns) binding(name string, addr net.IP) *ddnsBinding {
+	if addr == nil || name == "" {
+		return nil
+	}
+	subnet := backend.FindSubnet(d.bk, []net.IP{addr})
+	if subnet == nil || subnet.DnsZone == "" {
+		return nil
+	}
+	b := &ddnsBinding{
+		name:    dnsName(name, subnet.DnsZone),
+		addr:    addr,
+		zone:    dns.Fqdn(subnet.DnsZone),
+		revZone: subnet.DnsReverseZone,
+	}
+	if b.revZone != "" {
+		b.revZone = dns.Fqdn(b.revZone)
+	}
+	return b
+}
+
+// change works out what DNS updates c needs and queues them.
+func (d *Ddns) change(c *ddnsChange) {
+	b := d.binding(c.name, c.addr)
+	old := d.bound[c.key]
+	if c.remove {
+		// If we do not know what we bound, it is what we would
+		// have bound.
+		if old == nil {
+			old = b
+		}
+		if old != nil {
+			d.unbind(old)
+		}
+		delete(d.bound, c.key)
+		return
+	}
+	if old.equal(b) {
+		return
+	}
+	if old != nil {
+		d.unbind(old)
+		delete(d.bound, c.key)
+	}
+	if b != nil {
+		d.bind(b)
+		d.bound[c.key] = b
+	}
+}
+
+func (d *Ddns) addrRR(b *ddnsBinding) dns.RR {
+	hdr := dns.RR_Header{Name: b.name, Class: dns.ClassINET, Ttl: d.ttl}
+	if v4 := b.addr.To4(); v4 != nil {
+		hdr.Rrtype = dns.TypeA
+		return &dns.A{Hdr: hdr, A: v4}
+	}
+	hdr.Rrtype = dns.TypeAAAA
+	return &dns.AAAA{Hdr: hdr, AAAA: b.addr}
+}
+
+// ptrRR returns the PTR record for b, or nil if it does not have
+// one.
+func (d *Ddns) ptrRR(b *ddnsBinding) dns.RR {
+	if b.revZone == "" {
+		return nil
+	}
+	rev, err := dns.ReverseAddr(b.addr.String())
+	if err != nil || !dns.IsSubDomain(b.revZone, rev) {
+		return nil
+	}
+	return &dns.PTR{
+		Hdr: dns.RR_Header{Name: rev, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: d.ttl},
+		Ptr: b.name,
+	}
+}
+
+func (d *Ddns) bind(b *ddnsBinding) {
+	rr := d.addrRR(b)
+	d.enqueue(&ddnsUpdate{zone: b.zone, removeRRset: []dns.RR{rr}, insert: []dns.RR{rr}})
+	if ptr := d.ptrRR(b); ptr != nil {
+		d.enqueue(&ddnsUpdate{zone: b.revZone, removeRRset: []dns.RR{ptr}, insert: []dns.RR{ptr}})
+	}
+}
+
+func (d *Ddns) unbind(b *ddnsBinding) {
+	d.enqueue(&ddnsUpdate{zone: b.zone, remove: []dns.RR{d.addrRR(b)}})
+	if ptr := d.ptrRR(b); ptr != nil {
+		d.enqueue(&ddnsUpdate{zone: b.revZone, remove: []dns.RR{ptr}})
+	}
+}
+
+func (d *Ddns) enqueue(u *ddnsUpdate) {
+	if len(d.queue) >= ddnsMaxQueued {
+		d.bk.Printf("DDNS: too many updates queued, dropping %s", d.queue[0])
+		d.queue = d.queue[1:]
+	}
+	d.queue = append(d.queue, u)
+}
+
+// flush sends queued updates until the queue is empty or an update
+// needs to be retried, in which case it returns how long to wait
+// before trying again.
+func (d *Ddns) flush() time.Duration {
+	for len(d.queue) > 0 {
+		u := d.queue[0]
+		err := d.send(u)
+		if err == nil {
+			d.bk.Infof("debugDhcp", "DDNS: sent %s", u)
+			d.queue = d.queue[1:]
+			continue
+		}
+		u.tries++
+		if _, retry := err.(ddnsRetry); !retry || u.tries >= ddnsMaxTries {
+			d.bk.Printf("DDNS: giving up on %s: %v", u, err)
+			d.queue = d.queue[1:]
+			continue
+		}
+		delay := ddnsRetryBase << uint(u.tries-1)
+		if delay > ddnsRetryMax {
+			delay = ddnsRetryMax
+		}
+		d.bk.Infof("debugDhcp", "DDNS: will retry %s in %s: %v", u, delay, err)
+		return delay
+	}
+	return 0
+}
+
+// ddnsRetry marks errors that are worth retrying.
+type ddnsRetry struct {
+	error
+}
+
+func (d *Ddns) send(u *ddnsUpdate) error {
+	m := &dns.Msg{}
+	m.SetUpdate(u.zone)
+	if len(u.removeRRset) > 0 {
+		m.RemoveRRset(u.removeRRset)
+	}
+	if len(u.remove) > 0 {
+		m.Remove(u.remove)
+	}
+	if len(u.insert) > 0 {
+		m.Insert(u.insert)
+	}
+	if d.keyName != "" {
+		m.SetTsig(d.keyName, d.alg, 300, time.Now().Unix())
+	}
+	r, _, err := d.client.Exchange(m, d.server)
+	if err != nil {
+		return ddnsRetry{err}
+	}
+	switch r.Rcode {
+	case dns.RcodeSuccess:
+		return nil
+	case dns.RcodeServerFailure:
+		return ddnsRetry{fmt.Errorf("%s answered %s", d.server, dns.RcodeToString[r.Rcode])}
+	}
+	return fmt.Errorf("%s answered %s", d.server, dns.RcodeToString[r.Rcode])
+}
+
+// Shutdown stops sending dynamic DNS updates.  Updates that have not
+// been sent yet are dropped.
+func (d *Ddns) Shutdown(ctx context.Context) error {
+	d.pubs.Remove(d)
+	close(d.done)
+	select {
+	case <-d.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package midlayer
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/provision/backend"
+	"github.com/miekg/dns"
+	"github.com/pborman/uuid"
+)
+
+// ddnsRecorder is a DNS server that records the updates it gets.
+// It answers SERVFAIL to the first fail updates.
+type ddnsRecorder struct {
+	sync.Mutex
+	fail    int
+	updates []*dns.Msg
+	badSig  int
+}
+
+func (r *ddnsRecorder) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	r.Lock()
+	defer r.Unlock()
+	res := &dns.Msg{}
+	res.SetReply(req)
+	if req.IsTsig() == nil || w.TsigStatus() != nil {
+		r.badSig++
+		res.Rcode = dns.RcodeNotAuth
+	} else if r.fail > 0 {
+		r.fail--
+		res.Rcode = dns.RcodeServerFailure
+	} else {
+		r.updates = append(r.updates, req)
+	}
+	if t := req.IsTsig(); t != nil {
+		res.SetTsig(t.Hdr.Name, t.Algorithm, 300, time.Now().Unix())
+	}
+	w.WriteMsg(res)
+}
+
+func (r *ddnsRecorder) wait(n int) []*dns.Msg {
+	for i := 0; i < 100; i++ {
+		r.Lock()
+		if len(r.updates) >= n {
+			res := r.updates
+			r.Unlock()
+			return res
+		}
+		r.Unlock()
+		time.Sleep(20 * time.Millisecond)
+	}
+	r.Lock()
+	defer r.Unlock()
+	return r.updates
+}
+
+func TestDdnsNames(t *testing.T) {
+	if n := LeaseHostname(net.ParseIP("10.1.2.3")); n != "dhcp-10-1-2-3" {
+		t.Errorf("Expected dhcp-10-1-2-3, got %s", n)
+	}
+	if n := LeaseHostname(net.ParseIP("2001:db8::5")); n != "dhcp-2001-db8--5" {
+		t.Errorf("Expected dhcp-2001-db8--5, got %s", n)
+	}
+	tests := [][3]string{
+		{"m1", "lab.example.com", "m1.lab.example.com."},
+		{"m1.lab.example.com", "lab.example.com.", "m1.lab.example.com."},
+		{"m1.other.com", "lab.example.com", "m1.lab.example.com."},
+	}
+	for _, test := range tests {
+		if n := dnsName(test[0], test[1]); n != test[2] {
+			t.Errorf("Expected %s in %s to be %s, got %s", test[0], test[1], test[2], n)
+		}
+	}
+}
+
+func TestDdns(t *testing.T) {
+	ddnsRetryBase = 10 * time.Millisecond
+	defer func() { ddnsRetryBase = time.Second }()
+	dt, pubs := mkSubnetDT(t, func(sn *backend.Subnet) {
+		sn.DnsZone = "lab.example.com"
+		sn.DnsReverseZone = "60.50.10.in-addr.arpa"
+	})
+	const secret = "c2VjcmV0c2VjcmV0c2VjcmV0"
+	rec := &ddnsRecorder{fail: 1}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv := &dns.Server{
+		PacketConn: conn,
+		Handler:    rec,
+		TsigSecret: map[string]string{"ddns-key.": secret},
+	}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+	if _, err := StartDdns(dt, pubs, conn.LocalAddr().String(), "ddns-key", secret, "hmac-md4", 60); err == nil {
+		t.Errorf("Should not be able to use an unknown TSIG algorithm")
+	}
+	dd, err := StartDdns(dt, pubs, conn.LocalAddr().String(), "ddns-key", secret, "", 60)
+	if err != nil {
+		t.Fatalf("Failed to start DDNS: %v", err)
+	}
+	defer func() { dd.Shutdown(context.Background()) }()
+	lease, _, _ := backend.FindOrCreateLease(dt, "MAC", "02:00:00:00:00:01", nil, []net.IP{net.ParseIP("10.50.60.1")})
+	if lease == nil {
+		t.Fatalf("Failed to create a lease")
+	}
+	// Renewing the lease should not send anything new.
+	backend.FindOrCreateLease(dt, "MAC", "02:00:00:00:00:01", nil, []net.IP{net.ParseIP("10.50.60.1")})
+	pubs.Publish("machines", "create", "m1", &backend.Machine{Name: "m1", Uuid: uuid.NewRandom(), Address: net.ParseIP("10.50.60.100")})
+	pubs.Publish("machines", "create", "m2", &backend.Machine{Name: "m2", Uuid: uuid.NewRandom(), Address: net.ParseIP("10.99.0.1")})
+	pubs.Publish("leases", "expire", lease.Key(), lease)
+	expected := []struct {
+		zone, rr string
+		insert   bool
+	}{
+		{"lab.example.com.", "dhcp-10-50-60-10.lab.example.com.\t60\tIN\tA\t10.50.60.10", true},
+		{"60.50.10.in-addr.arpa.", "10.60.50.10.in-addr.arpa.\t60\tIN\tPTR\tdhcp-10-50-60-10.lab.example.com.", true},
+		{"lab.example.com.", "m1.lab.example.com.\t60\tIN\tA\t10.50.60.100", true},
+		{"60.50.10.in-addr.arpa.", "100.60.50.10.in-addr.arpa.\t60\tIN\tPTR\tm1.lab.example.com.", true},
+		{"lab.example.com.", "dhcp-10-50-60-10.lab.example.com.\t0\tNONE\tA\t10.50.60.10", false},
+		{"60.50.10.in-addr.arpa.", "10.60.50.10.in-addr.arpa.\t0\tNONE\tPTR\tdhcp-10-50-60-10.lab.example.com.", false},
+	}
+	updates := rec.wait(len(expected))
+	if len(updates) != len(expected) {
+		t.Fatalf("Expected %d updates, got %d: %v", len(expected), len(updates), updates)
+	}
+	for i, exp := range expected {
+		u := updates[i]
+		if len(u.Question) != 1 || u.Question[0].Name != exp.zone {
+			t.Errorf("Update %d: expected zone %s, got %v", i, exp.zone, u.Question)
+			continue
+		}
+		last := u.Ns[len(u.Ns)-1]
+		if last.String() != exp.rr {
+			t.Errorf("Update %d: expected %q, got %q", i, exp.rr, last.String())
+		}
+		if exp.insert && (len(u.Ns) != 2 || u.Ns[0].Header().Class != dns.ClassANY) {
+			t.Errorf("Update %d: expected the old records to be replaced", i)
+		}
+	}
+	// After a restart, records added before it should still be
+	// removed, and records for existing leases not added again.
+	dd.Shutdown(context.Background())
+	lease2, _, _ := backend.FindOrCreateLease(dt, "MAC", "02:00:00:00:00:02", nil, []net.IP{net.ParseIP("10.50.60.1")})
+	if lease2 == nil {
+		t.Fatalf("Failed to create a second lease")
+	}
+	dd, err = StartDdns(dt, pubs, conn.LocalAddr().String(), "ddns-key", secret, "", 60)
+	if err != nil {
+		t.Fatalf("Failed to restart DDNS: %v", err)
+	}
+	pubs.Publish("leases", "save", lease2.Key(), lease2)
+	pubs.Publish("machines", "delete", "m1", &backend.Machine{Name: "m1", Address: net.ParseIP("10.50.60.100")})
+	updates = rec.wait(len(expected) + 2)
+	if len(updates) != len(expected)+2 {
+		t.Fatalf("Expected %d updates after the restart, got %d: %v", len(expected)+2, len(updates), updates)
+	}
+	for i, exp := range []string{
+		"m1.lab.example.com.\t0\tNONE\tA\t10.50.60.100",
+		"100.60.50.10.in-addr.arpa.\t0\tNONE\tPTR\tm1.lab.example.com.",
+	} {
+		u := updates[len(expected)+i]
+		if last := u.Ns[len(u.Ns)-1]; last.String() != exp {
+			t.Errorf("Update %d after the restart: expected %q, got %q", i, exp, last.String())
+		}
+	}
+	rec.Lock()
+	defer rec.Unlock()
+	if rec.badSig != 0 {
+		t.Errorf("Expected all updates to be signed, %d were not", rec.badSig)
+	}
+	if rec.fail != 0 {
+		t.Errorf("Expected the first update to have been retried")
+	}
+}
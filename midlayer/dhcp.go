@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -31,6 +32,43 @@ func MacStrategy(p dhcp.Packet, options dhcp.Options) string {
 	return p.CHAddr().String()
 }
 
+// ClientIDStrategy uses the client identifier (option 61) as the
+// token, formatted like a MAC address.
+func ClientIDStrategy(p dhcp.Packet, options dhcp.Options) string {
+	return hexToken(options[dhcp.OptionClientIdentifier])
+}
+
+// CircuitIDStrategy uses the circuit-id that a relay agent added to
+// the request (option 82, sub-option 1) as the token.  This
+// identifies the switch port the client is plugged into rather than
+// the client itself.
+func CircuitIDStrategy(p dhcp.Packet, options dhcp.Options) string {
+	return hexToken(backend.ParseRelayInfo(options[dhcp.OptionRelayAgentInformation])[backend.RelayCircuitID])
+}
+
+// RemoteIDStrategy uses the remote-id that a relay agent added to
+// the request (option 82, sub-option 2) as the token.
+func RemoteIDStrategy(p dhcp.Packet, options dhcp.Options) string {
+	return hexToken(backend.ParseRelayInfo(options[dhcp.OptionRelayAgentInformation])[backend.RelayRemoteID])
+}
+
+func hexToken(buf []byte) string {
+	if len(buf) == 0 {
+		return ""
+	}
+	return net.HardwareAddr(buf).String()
+}
+
+// dhcpStrategies are all the token strategies the DHCP handler
+// knows about, in the order they are tried when a client is not in
+// a subnet that says otherwise.
+var dhcpStrategies = []*Strategy{
+	&Strategy{Name: "MAC", GenToken: MacStrategy},
+	&Strategy{Name: "ClientID", GenToken: ClientIDStrategy},
+	&Strategy{Name: "CircuitID", GenToken: CircuitIDStrategy},
+	&Strategy{Name: "RemoteID", GenToken: RemoteIDStrategy},
+}
+
 type DhcpHandler struct {
 	waitGroup  *sync.WaitGroup
 	closing    bool
@@ -41,67 +79,519 @@ type DhcpHandler struct {
 	cm         *ipv4.ControlMessage
 	strats     []*Strategy
 	publishers *backend.Publishers
+	// proxyAll treats every subnet as a proxy subnet.
+	proxyAll bool
+	// proxyOnly is set on the handler listening on the PXE boot
+	// server port, which only ever sends proxyDHCP replies.
+	proxyOnly bool
+	// prober, if set, is used to make sure nothing is using an
+	// address before we offer it.
+	prober Prober
+	// probes is what we have found out by probing addresses.
+	probes   map[string]*probeResult
+	probeMux sync.Mutex
+	// dnsDomain is set when we are also answering DNS queries, in
+	// which case we hand out ourselves as the DNS server.
+	dnsDomain string
+	// shadow handles every subnet in shadow mode, as if they all
+	// had Shadow set.
+	shadow bool
 }
 
-func (h *DhcpHandler) buildOptions(p dhcp.Packet,
-	l *backend.Lease,
-	s *backend.Subnet,
-	r *backend.Reservation) (dhcp.Options, time.Duration, net.IP) {
-	var leaseTime uint32 = 7200
-	if s != nil {
-		leaseTime = uint32(s.LeaseTimeFor(l.Addr) / time.Second)
+// renderInto renders opts for p into res.
+func (h *DhcpHandler) renderInto(res dhcp.Options, srcOpts map[int]string, opts []backend.DhcpOption) {
+	for _, opt := range opts {
+		if opt.Value == "" && len(opt.SubOptions) == 0 {
+			h.Printf("Ignoring DHCP option %d with zero-length value", opt.Code)
+			continue
+		}
+		c, v, err := opt.RenderToDHCP(srcOpts)
+		if err != nil {
+			h.Printf("Failed to render option %v: %v, %v", opt.Code, opt.Value, err)
+			continue
+		}
+		res[c] = v
 	}
+}
 
+// renderOptions renders the options from the subnet and reservation
+// for p, and figures out the next server the client should use.  The
+// options of the first option class the client matches in each are
+// rendered after (and override) the options they are attached to.
+func (h *DhcpHandler) renderOptions(p dhcp.Packet,
+	addr net.IP,
+	s *backend.Subnet,
+	r *backend.Reservation) (dhcp.Options, net.IP) {
 	opts := make(dhcp.Options)
+	options := p.ParseOptions()
 	srcOpts := map[int]string{}
-	for c, v := range p.ParseOptions() {
+	for c, v := range options {
 		srcOpts[int(c)] = backend.ConvertByteToOptionValue(c, v)
 		h.Debugf("Received option: %v: %v", c, srcOpts[int(c)])
 	}
-	rt := make([]byte, 4)
-	binary.BigEndian.PutUint32(rt, leaseTime/2)
-	rbt := make([]byte, 4)
-	binary.BigEndian.PutUint32(rbt, leaseTime*3/4)
-	opts[dhcp.OptionRenewalTimeValue] = rt
-	opts[dhcp.OptionRebindingTimeValue] = rbt
-	nextServer := h.respondFrom(l.Addr)
+	nextServer := h.respondFrom(addr)
 	if s != nil {
-		for _, opt := range s.Options {
-			if opt.Value == "" {
-				h.Printf("Ignoring DHCP option %d with zero-length value", opt.Code)
-				continue
-			}
-			c, v, err := opt.RenderToDHCP(srcOpts)
-			if err != nil {
-				h.Printf("Failed to render option %v: %v, %v", opt.Code, opt.Value, err)
-				continue
-			}
-			opts[c] = v
-		}
+		h.renderInto(opts, srcOpts, s.Options)
 		if s.NextServer.IsGlobalUnicast() {
 			nextServer = s.NextServer
 		}
-	}
-	if r != nil {
-		for _, opt := range r.Options {
-			if opt.Value == "" {
-				h.Printf("Ignoring DHCP option %d with zero-length value", opt.Code)
-				continue
-			}
-			c, v, err := opt.RenderToDHCP(srcOpts)
-			if err != nil {
-				h.Printf("Failed to render option %v: %v, %v", opt.Code, opt.Value, err)
-				continue
+		if class := backend.MatchOptionClass(s.Classes(), options); class != nil {
+			h.Debugf("%s: Using option class %s from subnet %s", xid(p), class.Name, s.Name)
+			h.renderInto(opts, srcOpts, class.Options)
+			if class.NextServer.IsGlobalUnicast() {
+				nextServer = class.NextServer
 			}
-			opts[c] = v
 		}
+	}
+	if r != nil {
+		h.renderInto(opts, srcOpts, r.Options)
 		if r.NextServer.IsGlobalUnicast() {
 			nextServer = r.NextServer
 		}
+		if class := backend.MatchOptionClass(r.OptionClasses, options); class != nil {
+			h.Debugf("%s: Using option class %s from reservation %s", xid(p), class.Name, r.Addr)
+			h.renderInto(opts, srcOpts, class.Options)
+			if class.NextServer.IsGlobalUnicast() {
+				nextServer = class.NextServer
+			}
+		}
+	}
+	return opts, nextServer
+}
+
+// dnsOptions points clients at our DNS server, unless the subnet or
+// reservation says otherwise.
+func (h *DhcpHandler) dnsOptions(opts dhcp.Options, addr net.IP) {
+	if h.dnsDomain == "" {
+		return
+	}
+	if _, ok := opts[dhcp.OptionDomainNameServer]; !ok {
+		if ours := h.respondFrom(addr).To4(); ours != nil {
+			opts[dhcp.OptionDomainNameServer] = []byte(ours)
+		}
+	}
+	if _, ok := opts[dhcp.OptionDomainName]; !ok {
+		opts[dhcp.OptionDomainName] = []byte(h.dnsDomain)
+	}
+}
+
+func (h *DhcpHandler) buildOptions(p dhcp.Packet,
+	l *backend.Lease,
+	s *backend.Subnet,
+	r *backend.Reservation) (dhcp.Options, time.Duration, net.IP) {
+	var leaseTime uint32 = 7200
+	if s != nil {
+		leaseTime = uint32(s.LeaseTimeFor(l.Addr) / time.Second)
+	}
+	opts, nextServer := h.renderOptions(p, l.Addr, s, r)
+	h.httpBoot(p, p.ParseOptions(), l.Addr, opts)
+	h.dnsOptions(opts, l.Addr)
+	if _, ok := opts[dhcp.OptionRenewalTimeValue]; !ok {
+		rt := make([]byte, 4)
+		binary.BigEndian.PutUint32(rt, leaseTime/2)
+		opts[dhcp.OptionRenewalTimeValue] = rt
+	}
+	if _, ok := opts[dhcp.OptionRebindingTimeValue]; !ok {
+		rbt := make([]byte, 4)
+		binary.BigEndian.PutUint32(rbt, leaseTime*3/4)
+		opts[dhcp.OptionRebindingTimeValue] = rbt
 	}
 	return opts, time.Duration(leaseTime) * time.Second, nextServer
 }
 
+const optionClientMachineID dhcp.OptionCode = 97
+
+// proxyOptionCodes are the only subnet and reservation options a
+// proxyDHCP reply may carry, as everything else belongs to the DHCP
+// server that handed out the address.
+var proxyOptionCodes = []dhcp.OptionCode{
+	dhcp.OptionBootFileSize,
+	dhcp.OptionVendorSpecificInformation,
+	dhcp.OptionTFTPServerName,
+	dhcp.OptionBootFileName,
+}
+
+// pxeVendorOptions sets PXE_DISCOVERY_CONTROL to tell PXE clients to
+// boot the file we hand them instead of doing boot server discovery.
+var pxeVendorOptions = []byte{6, 1, 8, 255}
+
+// proxied returns whether some other DHCP server hands out addresses
+// for via.
+func (h *DhcpHandler) proxied(p dhcp.Packet, options dhcp.Options, via []net.IP) bool {
+	if h.proxyAll {
+		return true
+	}
+	for _, s := range h.strategiesFor(via) {
+		if subnet, _ := backend.FindProxy(h.bk, s.Name, s.GenToken(p, options), via, false); subnet != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func isPXEClient(options dhcp.Options) bool {
+	return strings.HasPrefix(string(options[dhcp.OptionVendorClassIdentifier]), "PXEClient")
+}
+
+// isHTTPClient returns whether the client is doing UEFI HTTP Boot.
+func isHTTPClient(options dhcp.Options) bool {
+	return strings.HasPrefix(string(options[dhcp.OptionVendorClassIdentifier]), "HTTPClient")
+}
+
+// httpBoot points UEFI HTTP Boot clients at the file they should
+// load.  They want a full URL as their boot file and HTTPClient as
+// our vendor class, and ignore replies that do not have both.  A boot
+// file that is already a URL is left alone, otherwise the
+// HttpBootFile of the client's boot environment is used if it has
+// one, and the boot file is turned into a URL on our static file
+// server.
+func (h *DhcpHandler) httpBoot(p dhcp.Packet, options dhcp.Options, addr net.IP, opts dhcp.Options) {
+	if !isHTTPClient(options) {
+		return
+	}
+	file := string(opts[dhcp.OptionBootFileName])
+	if !strings.Contains(file, "://") {
+		envFile, err := backend.HttpBootFile(h.bk, addr, p.CHAddr().String())
+		if err != nil {
+			h.Printf("%s: Failed to render HTTP boot file for %s: %v", xid(p), p.CHAddr(), err)
+		} else if envFile != "" {
+			file = envFile
+		}
+	}
+	if file == "" {
+		h.Debugf("%s: No HTTP boot file for %s", xid(p), p.CHAddr())
+		return
+	}
+	if !strings.Contains(file, "://") {
+		file = h.bk.HttpBootURL(h.respondFrom(addr), file)
+	}
+	opts[dhcp.OptionBootFileName] = []byte(file)
+	opts[dhcp.OptionVendorClassIdentifier] = []byte("HTTPClient")
+}
+
+// proxyReply figures out if we should act as a proxyDHCP server for
+// p. If so, isProxy will be true and res will be the reply to send,
+// if any.
+func (h *DhcpHandler) proxyReply(tx *transaction,
+	p dhcp.Packet,
+	msgType dhcp.MessageType,
+	options dhcp.Options,
+	via []net.IP) (res dhcp.Packet, isProxy bool) {
+	proxyAll := h.proxyAll || h.proxyOnly
+	var subnet *backend.Subnet
+	var reservation *backend.Reservation
+	for _, s := range h.strategiesFor(via) {
+		token := s.GenToken(p, options)
+		if token == "" {
+			continue
+		}
+		subnet, reservation = backend.FindProxy(h.bk, s.Name, token, via, proxyAll)
+		if subnet != nil || reservation != nil {
+			tx.Strategy, tx.Token = s.Name, token
+			break
+		}
+	}
+	if subnet == nil && !proxyAll {
+		return nil, false
+	}
+	if !isPXEClient(options) && !isHTTPClient(options) {
+		tx.Infof("Not answering non-PXE client %s in proxy mode", p.CHAddr())
+		return nil, true
+	}
+	tx.use(nil, subnet, reservation)
+	if subnet == nil && reservation == nil {
+		tx.Infof("No boot information for %s, not answering in proxy mode", p.CHAddr())
+		return nil, true
+	}
+	addr := p.CIAddr()
+	if !addr.IsGlobalUnicast() {
+		addr = p.GIAddr()
+	}
+	opts, nextServer := h.renderOptions(p, addr, subnet, reservation)
+	h.httpBoot(p, options, addr, opts)
+	resOpts := dhcp.Options{}
+	for _, c := range proxyOptionCodes {
+		if v, ok := opts[c]; ok {
+			resOpts[c] = v
+		}
+	}
+	if isHTTPClient(options) {
+		resOpts[dhcp.OptionVendorClassIdentifier] = []byte("HTTPClient")
+	} else {
+		if _, ok := resOpts[dhcp.OptionVendorSpecificInformation]; !ok {
+			resOpts[dhcp.OptionVendorSpecificInformation] = pxeVendorOptions
+		}
+		resOpts[dhcp.OptionVendorClassIdentifier] = []byte("PXEClient")
+	}
+	if guid, ok := options[optionClientMachineID]; ok {
+		resOpts[optionClientMachineID] = guid
+	}
+	mt := dhcp.Offer
+	if msgType != dhcp.Discover {
+		mt = dhcp.ACK
+	}
+	res = dhcp.ReplyPacket(p, mt, h.respondFrom(addr), net.IPv4zero, 0, echoRelayInfo(options, resOpts.SelectOrderOrAll(nil)))
+	res.SetCIAddr(p.CIAddr())
+	if nextServer.IsGlobalUnicast() {
+		res.SetSIAddr(nextServer)
+	}
+	if bootFile, ok := resOpts[dhcp.OptionBootFileName]; ok {
+		res.SetFile(bootFile)
+	}
+	tx.Infof("Proxy handing out boot information to %s via %s", p.CHAddr(), h.respondFrom(addr))
+	return res, true
+}
+
+// strategiesFor returns the strategies to try, in order, for a
+// client talking to us via one of the passed addresses.  If the
+// client is in a subnet, we use the strategies the subnet lists.
+func (h *DhcpHandler) strategiesFor(via []net.IP) []*Strategy {
+	subnet := backend.FindSubnet(h.bk, via)
+	if subnet == nil {
+		return h.strats
+	}
+	res := []*Strategy{}
+	for _, name := range subnet.StrategyList() {
+		for _, s := range h.strats {
+			if s.Name == name {
+				res = append(res, s)
+			}
+		}
+	}
+	if len(res) == 0 {
+		return h.strats
+	}
+	return res
+}
+
+// leaseStrategies returns the strategies to try, in order, for a
+// client requesting req.  If we already have a lease for req, the
+// strategy the lease was created with goes first.
+func (h *DhcpHandler) leaseStrategies(req net.IP) []*Strategy {
+	strat := ""
+	func() {
+		d, unlocker := h.bk.LockEnts("leases")
+		defer unlocker()
+		if l := d("leases").Find(backend.Hexaddr(req)); l != nil {
+			strat = backend.AsLease(l).Strategy
+		}
+	}()
+	res := []*Strategy{}
+	for _, s := range h.strats {
+		if s.Name == strat {
+			res = append([]*Strategy{s}, res...)
+		} else {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// probeCacheTime is how long we remember that nothing answered a
+// probe of an address.
+const probeCacheTime = 30 * time.Second
+
+// probeResult is what we found out by probing an address.
+type probeResult struct {
+	// done is set once the probe has finished.
+	done bool
+	// at is when the probe finished.
+	at time.Time
+}
+
+// AddressConflict is published as a leases.conflict event when
+// something answers for an address we were about to offer.
+type AddressConflict struct {
+	// Addr is the address that was in use.
+	Addr net.IP
+	// HardwareAddr is the MAC address that answered for Addr, if
+	// we could find it.
+	HardwareAddr string
+	// Subnet is the name of the subnet Addr is in.
+	Subnet string
+}
+
+// heldLease returns the address of the unexpired lease for
+// strat:token, if there is one.
+func (h *DhcpHandler) heldLease(strat, token string) net.IP {
+	d, unlocker := h.bk.LockEnts("leases")
+	defer unlocker()
+	for _, i := range d("leases").Items() {
+		lease := backend.AsLease(i)
+		if lease.Strategy == strat && lease.Token == token && !lease.Expired() {
+			return lease.Addr
+		}
+	}
+	return nil
+}
+
+// probeState returns what we know about addr from probing it, or nil
+// if we have not probed it recently.
+func (h *DhcpHandler) probeState(addr net.IP) *probeResult {
+	h.probeMux.Lock()
+	defer h.probeMux.Unlock()
+	res := h.probes[addr.String()]
+	if res != nil && res.done && time.Since(res.at) > probeCacheTime {
+		delete(h.probes, addr.String())
+		return nil
+	}
+	return res
+}
+
+// startProbe probes the address of lease in the background.  If
+// something answers, the lease is invalidated and held for the
+// active lease time of the subnet so that we do not try to hand it
+// out again right away.  Otherwise we remember that the address is
+// free to offer.
+func (h *DhcpHandler) startProbe(p dhcp.Packet, lease *backend.Lease, subnet *backend.Subnet) {
+	key := lease.Addr.String()
+	h.probeMux.Lock()
+	if h.probes == nil {
+		h.probes = map[string]*probeResult{}
+	}
+	for k, res := range h.probes {
+		if res.done && time.Since(res.at) > probeCacheTime {
+			delete(h.probes, k)
+		}
+	}
+	h.probes[key] = &probeResult{}
+	h.probeMux.Unlock()
+	// p may be reused once we have answered it.
+	id, client := xid(p), p.CHAddr().String()
+	go func() {
+		inUse, hw := h.prober.Probe(lease.Addr)
+		if inUse {
+			h.conflict(id, client, lease, subnet, hw)
+		}
+		h.probeMux.Lock()
+		defer h.probeMux.Unlock()
+		if inUse {
+			delete(h.probes, key)
+		} else {
+			h.probes[key] = &probeResult{done: true, at: time.Now()}
+		}
+	}()
+}
+
+// conflict records that hw answered a probe for the address of lease,
+// which we were about to offer to client.
+func (h *DhcpHandler) conflict(id, client string, lease *backend.Lease, subnet *backend.Subnet, hw net.HardwareAddr) {
+	hwAddr := ""
+	if hw != nil {
+		hwAddr = hw.String()
+	}
+	h.Infof("%s: %s is already in use by %s, not offering it to %s", id, lease.Addr, hwAddr, client)
+	func() {
+		d, unlocker := h.bk.LockEnts("leases", "reservations", "subnets")
+		defer unlocker()
+		if l := d("leases").Find(lease.Key()); l != nil {
+			held := backend.AsLease(l)
+			held.Invalidate()
+			held.ExpireTime = time.Now().Add(time.Duration(subnet.ActiveLeaseTime) * time.Second)
+			h.bk.Save(d, held, nil)
+		}
+	}()
+	if h.publishers != nil {
+		h.publishers.Publish("leases", "conflict", lease.Key(), &AddressConflict{
+			Addr:         lease.Addr,
+			HardwareAddr: hwAddr,
+			Subnet:       subnet.Name,
+		})
+	}
+}
+
+// findOrCreateLease is backend.FindOrCreateLease, except that if we
+// have a prober, addresses that are new to the client are probed
+// before we offer them.  Reserved addresses are never probed, as the
+// machine they are reserved for may well be using them already.
+//
+// Probes run in the background so that they do not hold up other
+// clients.  While an address is being probed, probing is returned
+// set and nothing should be offered; the client will ask again, and
+// by then we will either know the address is free or will have
+// picked another one.
+func (h *DhcpHandler) findOrCreateLease(p dhcp.Packet,
+	strat, token string,
+	req net.IP,
+	via []net.IP) (lease *backend.Lease, subnet *backend.Subnet, reservation *backend.Reservation, probing bool) {
+	if h.prober == nil {
+		lease, subnet, reservation = backend.FindOrCreateLease(h.bk, strat, token, req, via)
+		return
+	}
+	held := h.heldLease(strat, token)
+	lease, subnet, reservation = backend.FindOrCreateLease(h.bk, strat, token, req, via)
+	if lease == nil || subnet == nil || reservation != nil {
+		return
+	}
+	switch res := h.probeState(lease.Addr); {
+	case res != nil && res.done:
+		return
+	case res != nil:
+		return nil, nil, nil, true
+	case lease.Addr.Equal(held):
+		// The client may well already be using it.
+		return
+	}
+	h.startProbe(p, lease, subnet)
+	return nil, nil, nil, true
+}
+
+// transaction is what we record about a single DHCP packet while we
+// handle it.
+type transaction struct {
+	*backend.DhcpTransaction
+	h *DhcpHandler
+	p dhcp.Packet
+	// decided is set in shadow mode once we know what we would
+	// have done with a DHCPDISCOVER or DHCPREQUEST.
+	decided bool
+}
+
+// Infof logs what we did with the packet, and keeps it as the
+// outcome of the transaction.
+func (t *transaction) Infof(f string, args ...interface{}) {
+	t.Outcome = fmt.Sprintf(f, args...)
+	t.h.Infof("%s: %s", xid(t.p), t.Outcome)
+}
+
+// use records the lease, subnet, and reservation we found for the
+// client.  Any of them may be nil.
+func (t *transaction) use(lease *backend.Lease, subnet *backend.Subnet, reservation *backend.Reservation) {
+	if lease != nil {
+		t.Strategy, t.Token, t.Addr = lease.Strategy, lease.Token, lease.Addr
+	}
+	if subnet != nil {
+		t.Subnet = subnet.Name
+	}
+	if reservation != nil {
+		t.Reservation = reservation.Addr
+		t.Strategy, t.Token = reservation.Strategy, reservation.Token
+	}
+}
+
+// replied records the reply we are sending.
+func (t *transaction) replied(res dhcp.Packet) {
+	opts := res.ParseOptions()
+	if mt, ok := opts[dhcp.OptionDHCPMessageType]; ok && len(mt) == 1 {
+		t.Reply = messageTypeName(dhcp.MessageType(mt[0]))
+	}
+	if yiaddr := res.YIAddr(); !yiaddr.IsUnspecified() {
+		t.Addr = yiaddr
+	}
+	codes := []int{}
+	for code := range opts {
+		if code != dhcp.OptionDHCPMessageType {
+			codes = append(codes, int(code))
+		}
+	}
+	sort.Ints(codes)
+	t.Options = make([]backend.DhcpOption, 0, len(codes))
+	for _, code := range codes {
+		c := dhcp.OptionCode(code)
+		t.Options = append(t.Options, backend.DhcpOption{Code: c, Value: backend.ConvertByteToOptionValue(c, opts[c])})
+	}
+}
+
 func (h *DhcpHandler) Strategy(name string) StrategyFunc {
 	for i := range h.strats {
 		if h.strats[i].Name == name {
@@ -121,8 +611,37 @@ func (h *DhcpHandler) Debugf(f string, args ...interface{}) {
 	h.bk.Debugf("debugDhcp", f, args...)
 }
 
-func (h *DhcpHandler) nak(p dhcp.Packet, addr net.IP) dhcp.Packet {
-	return dhcp.ReplyPacket(p, dhcp.NAK, addr, nil, 0, nil)
+func (h *DhcpHandler) nak(p dhcp.Packet, options dhcp.Options, addr net.IP) dhcp.Packet {
+	return dhcp.ReplyPacket(p, dhcp.NAK, addr, nil, 0, echoRelayInfo(options, nil))
+}
+
+// echoRelayInfo appends the relay agent information option from the
+// request to opts.  RFC 3046 requires us to echo it back unchanged
+// as the last option in the reply.
+func echoRelayInfo(options dhcp.Options, opts []dhcp.Option) []dhcp.Option {
+	if info, ok := options[dhcp.OptionRelayAgentInformation]; ok {
+		opts = append(opts, dhcp.Option{Code: dhcp.OptionRelayAgentInformation, Value: info})
+	}
+	return opts
+}
+
+// linkAddrs returns the address that identifies the link the client
+// is on.  In order of preference, that is the link selection
+// sub-option of the relay agent information option (RFC 3527), the
+// subnet selection option (RFC 3011), or giaddr.  If none of them
+// are present, the client is on one of our local links.
+func (h *DhcpHandler) linkAddrs(p dhcp.Packet, options dhcp.Options) []net.IP {
+	relayInfo := backend.ParseRelayInfo(options[dhcp.OptionRelayAgentInformation])
+	if link, ok := relayInfo[backend.RelayLinkSelection]; ok && len(link) == 4 {
+		return []net.IP{net.IP(link)}
+	}
+	if link, ok := options[backend.OptionSubnetSelection]; ok && len(link) == 4 {
+		return []net.IP{net.IP(link)}
+	}
+	if gi := p.GIAddr(); gi != nil && !gi.IsUnspecified() {
+		return []net.IP{gi}
+	}
+	return h.listenIPs()
 }
 
 const (
@@ -246,7 +765,7 @@ func (h *DhcpHandler) Serve() error {
 			continue
 		} else {
 			reqType = dhcp.MessageType(t[0])
-			if reqType < dhcp.Discover || reqType > dhcp.Inform {
+			if (reqType < dhcp.Discover || reqType > dhcp.Inform) && reqType != LeaseQuery {
 				continue
 			}
 		}
@@ -265,6 +784,9 @@ func (h *DhcpHandler) Serve() error {
 				continue
 			}
 		}
+		if !h.bk.AllowDhcp(req.CHAddr().String(), req.GIAddr()) {
+			continue
+		}
 
 		if res := h.ServeDHCP(req, reqType, options); res != nil {
 			// If IP not available, broadcast
@@ -290,9 +812,42 @@ func (h *DhcpHandler) Serve() error {
 	}
 }
 
-func (h *DhcpHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) (res dhcp.Packet) {
+// ServeDHCP handles a single DHCP packet, and returns the reply to
+// send, if any.  What happened is recorded as a DHCP transaction.
+func (h *DhcpHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) dhcp.Packet {
+	tx := &transaction{
+		DhcpTransaction: &backend.DhcpTransaction{
+			Time:         time.Now(),
+			Xid:          fmt.Sprintf("0x%x", binary.BigEndian.Uint32(p.XId())),
+			HardwareAddr: p.CHAddr().String(),
+			MessageType:  messageTypeName(msgType),
+		},
+		h: h,
+		p: p,
+	}
+	res := h.serveDHCP(tx, p, msgType, options)
+	if res != nil {
+		tx.replied(res)
+	} else if tx.Outcome == "" {
+		tx.Outcome = "Not answered"
+	}
+	if tx.Shadow {
+		if tx.decided {
+			var offered net.IP
+			if res != nil && !res.YIAddr().IsUnspecified() {
+				offered = res.YIAddr()
+			}
+			h.bk.RecordShadowDecision(tx.DhcpTransaction, offered)
+		}
+		res = nil
+	}
+	h.bk.RecordDhcpTransaction(tx.DhcpTransaction)
+	return res
+}
+
+func (h *DhcpHandler) serveDHCP(tx *transaction, p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) (res dhcp.Packet) {
 	h.Infof("Received DHCP packet: type %s %s ciaddr %s yiaddr %s giaddr %s chaddr %s",
-		msgType.String(),
+		messageTypeName(msgType),
 		xid(p),
 		p.CIAddr(),
 		p.YIAddr(),
@@ -300,24 +855,41 @@ func (h *DhcpHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options
 		p.CHAddr().String())
 	// need code to figure out which interface or relay it came from
 	req, reqState := reqAddr(p, msgType, options)
+	tx.Addr = req
 	var err error
+	if h.proxyOnly {
+		switch msgType {
+		case dhcp.Request, dhcp.Inform:
+			res, _ = h.proxyReply(tx, p, msgType, options, append(h.linkAddrs(p, options), p.CIAddr()))
+		}
+		return
+	}
+	if h.shadowed(p, options, req) {
+		tx.Shadow = true
+		return h.shadowServe(tx, p, msgType, options, req, reqState)
+	}
 	switch msgType {
+	case LeaseQuery:
+		return h.leaseQuery(tx, p, options)
+	case dhcp.Inform:
+		return h.inform(tx, p, options)
 	case dhcp.Decline:
 		d, unlocker := h.bk.LockEnts("leases", "reservations", "subnets")
 		defer unlocker()
 		leaseThing := d("leases").Find(backend.Hexaddr(req))
 		if leaseThing == nil {
-			h.Infof("%s: Asked to decline a lease we didn't issue by %s, ignoring", xid(p), req)
+			tx.Infof("Asked to decline a lease we didn't issue by %s, ignoring", req)
 			return nil
 		}
 		lease := backend.AsLease(leaseThing)
+		tx.use(lease, nil, nil)
 		stratfn := h.Strategy(lease.Strategy)
 		if stratfn != nil && stratfn(p, options) == lease.Token {
-			h.Infof("%s: Lease for %s declined, invalidating.", xid(p), lease.Addr)
+			tx.Infof("Lease for %s declined, invalidating.", lease.Addr)
 			lease.Invalidate()
 			h.bk.Save(d, lease, nil)
 		} else {
-			h.Infof("%s: Received spoofed decline for %s, ignoring", xid(p), lease.Addr)
+			tx.Infof("Received spoofed decline for %s, ignoring", lease.Addr)
 		}
 		return nil
 	case dhcp.Release:
@@ -325,50 +897,53 @@ func (h *DhcpHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options
 		defer unlocker()
 		leaseThing := d("leases").Find(backend.Hexaddr(req))
 		if leaseThing == nil {
-			h.Infof("%s: Asked to release a lease we didn't issue by %s, ignoring", xid(p), req)
+			tx.Infof("Asked to release a lease we didn't issue by %s, ignoring", req)
 			return nil
 		}
 		lease := backend.AsLease(leaseThing)
+		tx.use(lease, nil, nil)
 		stratfn := h.Strategy(lease.Strategy)
 		if stratfn != nil && stratfn(p, options) == lease.Token {
-			h.Infof("%s: Lease for %s released, expiring.", xid(p), lease.Addr)
+			tx.Infof("Lease for %s released, expiring.", lease.Addr)
 			lease.Expire()
 			h.bk.Save(d, lease, nil)
 		} else {
-			h.Infof("%s: Received spoofed release for %s, ignoring", xid(p), lease.Addr)
+			tx.Infof("Received spoofed release for %s, ignoring", lease.Addr)
 		}
 		return nil
 	case dhcp.Request:
 		serverBytes, ok := options[dhcp.OptionServerIdentifier]
 		server := net.IP(serverBytes)
 		if ok && !h.listenOn(server) {
-			h.Infof("%s: Ignoring request for DHCP server %s", xid(p), net.IP(server))
+			tx.Infof("Ignoring request for DHCP server %s", net.IP(server))
+			return nil
+		}
+		if h.proxied(p, options, append(h.linkAddrs(p, options), req)) {
+			tx.Infof("Ignoring request for %s, which another DHCP server owns", req)
 			return nil
 		}
 		if !req.IsGlobalUnicast() {
-			h.Infof("%s: NAK'ing invalid requested IP %s", xid(p), req)
-			return h.nak(p, h.respondFrom(req))
+			tx.Infof("NAK'ing invalid requested IP %s", req)
+			return h.nak(p, options, h.respondFrom(req))
 		}
 		var lease *backend.Lease
 		var reservation *backend.Reservation
 		var subnet *backend.Subnet
-		for _, s := range h.strats {
+		for _, s := range h.leaseStrategies(req) {
 			lease, subnet, reservation, err = backend.FindLease(h.bk, s.Name, s.GenToken(p, options), req)
 			if err != nil {
 				if lease != nil {
-					h.Infof("%s: %s already leased to %s:%s: %s",
-						xid(p),
+					tx.Infof("%s already leased to %s:%s: %s",
 						req,
 						lease.Strategy,
 						lease.Token,
 						err)
 				} else {
-					h.Infof("%s: %s is no longer able to be leased: %s",
-						xid(p),
+					tx.Infof("%s is no longer able to be leased: %s",
 						req,
 						err)
 				}
-				return h.nak(p, h.respondFrom(req))
+				return h.nak(p, options, h.respondFrom(req))
 			}
 			if lease != nil {
 				break
@@ -376,48 +951,123 @@ func (h *DhcpHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options
 		}
 		if lease == nil {
 			if reqState == reqInitReboot {
-				h.Infof("%s: No lease for %s in database, client in INIT-REBOOT.  Ignoring request.", xid(p), req)
+				tx.Infof("No lease for %s in database, client in INIT-REBOOT.  Ignoring request.", req)
 				return nil
 			} else {
-				h.Infof("%s: No lease for %s in database, NAK'ing", xid(p), req)
-				return h.nak(p, h.respondFrom(req))
+				tx.Infof("No lease for %s in database, NAK'ing", req)
+				return h.nak(p, options, h.respondFrom(req))
 			}
 		}
-		opts, duration, nextServer := h.buildOptions(p, lease, subnet, reservation)
-		reply := dhcp.ReplyPacket(p, dhcp.ACK,
-			h.respondFrom(lease.Addr),
-			lease.Addr,
-			duration,
-			opts.SelectOrderOrAll(opts[dhcp.OptionParameterRequestList]))
-		if nextServer.IsGlobalUnicast() {
-			reply.SetSIAddr(nextServer)
-		}
-		h.Infof("%s: Request handing out: %s to %s via %s", xid(p), reply.YIAddr(), reply.CHAddr(), h.respondFrom(lease.Addr))
+		tx.use(lease, subnet, reservation)
+		reply := h.leaseReply(p, options, dhcp.ACK, lease, subnet, reservation)
+		tx.Infof("Request handing out: %s to %s via %s", reply.YIAddr(), reply.CHAddr(), h.respondFrom(lease.Addr))
 		return reply
 	case dhcp.Discover:
-		for _, s := range h.strats {
+		via := h.linkAddrs(p, options)
+		if reply, isProxy := h.proxyReply(tx, p, msgType, options, via); isProxy {
+			return reply
+		}
+		for _, s := range h.strategiesFor(via) {
 			strat := s.Name
 			token := s.GenToken(p, options)
-			via := []net.IP{p.GIAddr()}
-			if via[0] == nil || via[0].IsUnspecified() {
-				via = h.listenIPs()
+			if token == "" {
+				continue
+			}
+			lease, subnet, reservation, probing := h.findOrCreateLease(p, strat, token, req, via)
+			if probing {
+				tx.Infof("Waiting for a probe of the address for %s to finish", p.CHAddr())
+				return nil
 			}
-			lease, subnet, reservation := backend.FindOrCreateLease(h.bk, strat, token, req, via)
 			if lease != nil {
-				opts, duration, _ := h.buildOptions(p, lease, subnet, reservation)
-				reply := dhcp.ReplyPacket(p, dhcp.Offer,
-					h.respondFrom(lease.Addr),
-					lease.Addr,
-					duration,
-					opts.SelectOrderOrAll(opts[dhcp.OptionParameterRequestList]))
-				h.Infof("%s: Discovery handing out: %s to %s via %s", xid(p), reply.YIAddr(), reply.CHAddr(), h.respondFrom(lease.Addr))
+				tx.use(lease, subnet, reservation)
+				if _, err := backend.AutoMachine(h.bk, lease, p.CHAddr().String(), string(options[dhcp.OptionHostName])); err != nil {
+					h.Printf("%s: Failed to create a machine for %s: %v", xid(p), p.CHAddr(), err)
+				}
+				reply := h.leaseReply(p, options, dhcp.Offer, lease, subnet, reservation)
+				tx.Infof("Discovery handing out: %s to %s via %s", reply.YIAddr(), reply.CHAddr(), h.respondFrom(lease.Addr))
 				return reply
 			}
 		}
+		tx.Infof("No address available for %s", p.CHAddr())
 	}
 	return nil
 }
 
+// leaseReply builds a reply of type mt that hands lease out to the
+// client that sent p.
+func (h *DhcpHandler) leaseReply(p dhcp.Packet,
+	options dhcp.Options,
+	mt dhcp.MessageType,
+	lease *backend.Lease,
+	subnet *backend.Subnet,
+	reservation *backend.Reservation) dhcp.Packet {
+	opts, duration, nextServer := h.buildOptions(p, lease, subnet, reservation)
+	reply := dhcp.ReplyPacket(p, mt,
+		h.respondFrom(lease.Addr),
+		lease.Addr,
+		duration,
+		echoRelayInfo(options, opts.SelectOrderOrAll(opts[dhcp.OptionParameterRequestList])))
+	if nextServer.IsGlobalUnicast() {
+		reply.SetSIAddr(nextServer)
+	}
+	return reply
+}
+
+// inform answers a DHCPINFORM from a client that already has an
+// address, with the options of the subnet and reservation for that
+// address.  No lease is involved, so the reply carries no lease times.
+func (h *DhcpHandler) inform(tx *transaction, p dhcp.Packet, options dhcp.Options) dhcp.Packet {
+	addr := p.CIAddr()
+	if !addr.IsGlobalUnicast() {
+		tx.Infof("Ignoring inform without a client address")
+		return nil
+	}
+	if h.proxied(p, options, []net.IP{addr}) {
+		tx.Infof("Ignoring inform for %s, which another DHCP server owns", addr)
+		return nil
+	}
+	subnet := backend.FindSubnet(h.bk, []net.IP{addr})
+	var reservation *backend.Reservation
+	func() {
+		d, unlocker := h.bk.LockEnts("reservations")
+		defer unlocker()
+		if r := d("reservations").Find(backend.Hexaddr(addr)); r != nil {
+			reservation = backend.AsReservation(r)
+		}
+	}()
+	if reservation != nil {
+		if stratfn := h.Strategy(reservation.Strategy); stratfn == nil || stratfn(p, options) != reservation.Token {
+			reservation = nil
+		}
+	}
+	if subnet == nil && reservation == nil {
+		tx.Infof("Ignoring inform from %s, which is not in any of our subnets", addr)
+		return nil
+	}
+	tx.use(nil, subnet, reservation)
+	tx.Addr = addr
+	opts, nextServer := h.renderOptions(p, addr, subnet, reservation)
+	h.dnsOptions(opts, addr)
+	for _, c := range []dhcp.OptionCode{
+		dhcp.OptionIPAddressLeaseTime,
+		dhcp.OptionRenewalTimeValue,
+		dhcp.OptionRebindingTimeValue,
+	} {
+		delete(opts, c)
+	}
+	reply := dhcp.ReplyPacket(p, dhcp.ACK,
+		h.respondFrom(addr),
+		nil,
+		0,
+		echoRelayInfo(options, opts.SelectOrderOrAll(opts[dhcp.OptionParameterRequestList])))
+	reply.SetCIAddr(addr)
+	if nextServer.IsGlobalUnicast() {
+		reply.SetSIAddr(nextServer)
+	}
+	tx.Infof("Inform handing out options to %s", addr)
+	return reply
+}
+
 func (h *DhcpHandler) Shutdown(ctx context.Context) error {
 	h.Printf("Shutting down DHCP handler")
 	h.closing = true
@@ -431,7 +1081,29 @@ type Service interface {
 	Shutdown(context.Context) error
 }
 
-func StartDhcpHandler(dhcpInfo *backend.DataTracker, dhcpIfs string, dhcpPort int, pubs *backend.Publishers) (Service, error) {
+// StartDhcpHandler starts the DHCP server.  If prober is not nil, it
+// will be used to make sure addresses are not in use before they are
+// offered.  If dnsDomain is not empty, we are also the DNS server for
+// that domain, and will tell clients so.  If shadow is set, every
+// subnet is handled in shadow mode.
+func StartDhcpHandler(dhcpInfo *backend.DataTracker, dhcpIfs string, dhcpPort int, pubs *backend.Publishers, proxyAll, shadow bool, prober Prober, dnsDomain string) (Service, error) {
+	return startDhcpHandler(dhcpInfo, dhcpIfs, dhcpPort, pubs, proxyAll, false, shadow, prober, dnsDomain)
+}
+
+// StartProxyDhcpHandler starts a handler for the PXE boot server port
+// (usually 4011), which answers PXE clients with boot information
+// and never hands out addresses.
+func StartProxyDhcpHandler(dhcpInfo *backend.DataTracker, dhcpIfs string, dhcpPort int, pubs *backend.Publishers) (Service, error) {
+	return startDhcpHandler(dhcpInfo, dhcpIfs, dhcpPort, pubs, true, true, false, nil, "")
+}
+
+func startDhcpHandler(dhcpInfo *backend.DataTracker,
+	dhcpIfs string,
+	dhcpPort int,
+	pubs *backend.Publishers,
+	proxyAll, proxyOnly, shadow bool,
+	prober Prober,
+	dnsDomain string) (Service, error) {
 	ifs := []string{}
 	if dhcpIfs != "" {
 		ifs = strings.Split(dhcpIfs, ",")
@@ -441,8 +1113,13 @@ func StartDhcpHandler(dhcpInfo *backend.DataTracker, dhcpIfs string, dhcpPort in
 		ifs:        ifs,
 		bk:         dhcpInfo,
 		port:       dhcpPort,
-		strats:     []*Strategy{&Strategy{Name: "MAC", GenToken: MacStrategy}},
+		strats:     dhcpStrategies,
 		publishers: pubs,
+		proxyAll:   proxyAll,
+		proxyOnly:  proxyOnly,
+		prober:     prober,
+		dnsDomain:  dnsDomain,
+		shadow:     shadow,
 	}
 
 	l, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", handler.port))
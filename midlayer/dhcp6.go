@@ -0,0 +1,734 @@
+package midlayer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv6"
+
+	"github.com/digitalrebar/provision/backend"
+	"github.com/pborman/uuid"
+)
+
+// DHCPv6 message types from RFC 8415
+const (
+	dhcp6Solicit     byte = 1
+	dhcp6Advertise   byte = 2
+	dhcp6Request     byte = 3
+	dhcp6Confirm     byte = 4
+	dhcp6Renew       byte = 5
+	dhcp6Rebind      byte = 6
+	dhcp6Reply       byte = 7
+	dhcp6Release     byte = 8
+	dhcp6Decline     byte = 9
+	dhcp6InfoRequest byte = 11
+	dhcp6RelayForw   byte = 12
+	dhcp6RelayRepl   byte = 13
+)
+
+var dhcp6MsgNames = map[byte]string{
+	dhcp6Solicit:     "Solicit",
+	dhcp6Advertise:   "Advertise",
+	dhcp6Request:     "Request",
+	dhcp6Confirm:     "Confirm",
+	dhcp6Renew:       "Renew",
+	dhcp6Rebind:      "Rebind",
+	dhcp6Reply:       "Reply",
+	dhcp6Release:     "Release",
+	dhcp6Decline:     "Decline",
+	dhcp6InfoRequest: "Information-Request",
+	dhcp6RelayForw:   "Relay-Forward",
+	dhcp6RelayRepl:   "Relay-Reply",
+}
+
+// DHCPv6 status codes from RFC 8415
+const (
+	status6Success      uint16 = 0
+	status6UnspecFail   uint16 = 1
+	status6NoAddrsAvail uint16 = 2
+	status6NoBinding    uint16 = 3
+	status6NotOnLink    uint16 = 4
+)
+
+// dhcp6HopLimit is the maximum number of relay agents we will
+// unwrap before giving up on a message.
+const dhcp6HopLimit = 32
+
+var dhcp6AllServers = net.ParseIP("ff02::1:2")
+
+type dhcp6Option struct {
+	Code uint16
+	Data []byte
+}
+
+type dhcp6Options []dhcp6Option
+
+func parseDhcp6Options(b []byte) (dhcp6Options, error) {
+	res := dhcp6Options{}
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, errors.New("Truncated DHCPv6 option header")
+		}
+		code := binary.BigEndian.Uint16(b)
+		l := int(binary.BigEndian.Uint16(b[2:]))
+		b = b[4:]
+		if l > len(b) {
+			return nil, fmt.Errorf("DHCPv6 option %d overruns message", code)
+		}
+		res = append(res, dhcp6Option{Code: code, Data: b[:l]})
+		b = b[l:]
+	}
+	return res, nil
+}
+
+func (o dhcp6Options) get(code uint16) ([]byte, bool) {
+	for _, opt := range o {
+		if opt.Code == code {
+			return opt.Data, true
+		}
+	}
+	return nil, false
+}
+
+func (o dhcp6Options) all(code uint16) [][]byte {
+	res := [][]byte{}
+	for _, opt := range o {
+		if opt.Code == code {
+			res = append(res, opt.Data)
+		}
+	}
+	return res
+}
+
+func (o dhcp6Options) marshal() []byte {
+	buf := &bytes.Buffer{}
+	for _, opt := range o {
+		hdr := make([]byte, 4)
+		binary.BigEndian.PutUint16(hdr, opt.Code)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(opt.Data)))
+		buf.Write(hdr)
+		buf.Write(opt.Data)
+	}
+	return buf.Bytes()
+}
+
+type dhcp6Relay struct {
+	hopCount byte
+	linkAddr net.IP
+	peerAddr net.IP
+	options  dhcp6Options
+}
+
+// Dhcp6Packet is a DHCPv6 client or server message, along with the
+// Relay-Forward messages (if any) that it arrived wrapped in.
+type Dhcp6Packet struct {
+	MsgType byte
+	XId     []byte
+	Options dhcp6Options
+	// relays is ordered from the outermost relay to the innermost one.
+	relays []*dhcp6Relay
+}
+
+// ParseDhcp6 decodes a DHCPv6 message, unwrapping any Relay-Forward
+// messages around it.
+func ParseDhcp6(b []byte) (*Dhcp6Packet, error) {
+	res := &Dhcp6Packet{}
+	for {
+		if len(b) < 4 {
+			return nil, errors.New("DHCPv6 message too short")
+		}
+		if b[0] != dhcp6RelayForw {
+			break
+		}
+		if len(res.relays) >= dhcp6HopLimit {
+			return nil, errors.New("Too many DHCPv6 relays")
+		}
+		if len(b) < 34 {
+			return nil, errors.New("Relay-Forward message too short")
+		}
+		relay := &dhcp6Relay{
+			hopCount: b[1],
+			linkAddr: net.IP(append([]byte{}, b[2:18]...)),
+			peerAddr: net.IP(append([]byte{}, b[18:34]...)),
+		}
+		opts, err := parseDhcp6Options(b[34:])
+		if err != nil {
+			return nil, err
+		}
+		relay.options = opts
+		res.relays = append(res.relays, relay)
+		inner, ok := opts.get(backend.Option6RelayMsg)
+		if !ok {
+			return nil, errors.New("Relay-Forward message without a Relay Message option")
+		}
+		b = inner
+	}
+	res.MsgType = b[0]
+	res.XId = append([]byte{}, b[1:4]...)
+	opts, err := parseDhcp6Options(b[4:])
+	if err != nil {
+		return nil, err
+	}
+	res.Options = opts
+	return res, nil
+}
+
+// Marshal encodes the message, wrapping it in Relay-Reply messages
+// for each relay it needs to traverse on the way back to the client.
+func (p *Dhcp6Packet) Marshal() []byte {
+	msg := append([]byte{p.MsgType}, p.XId...)
+	msg = append(msg, p.Options.marshal()...)
+	for i := len(p.relays) - 1; i >= 0; i-- {
+		relay := p.relays[i]
+		opts := dhcp6Options{}
+		// RFC 8415 requires us to echo the Interface-Id option.
+		if ifID, ok := relay.options.get(backend.Option6InterfaceID); ok {
+			opts = append(opts, dhcp6Option{backend.Option6InterfaceID, ifID})
+		}
+		opts = append(opts, dhcp6Option{backend.Option6RelayMsg, msg})
+		hdr := append([]byte{dhcp6RelayRepl, relay.hopCount}, relay.linkAddr.To16()...)
+		hdr = append(hdr, relay.peerAddr.To16()...)
+		msg = append(hdr, opts.marshal()...)
+	}
+	return msg
+}
+
+func (p *Dhcp6Packet) reply(msgType byte) *Dhcp6Packet {
+	return &Dhcp6Packet{
+		MsgType: msgType,
+		XId:     p.XId,
+		Options: dhcp6Options{},
+		relays:  p.relays,
+	}
+}
+
+// linkAddr returns the address that the innermost relay agent
+// received the message on, if the message was relayed.
+func (p *Dhcp6Packet) linkAddr() net.IP {
+	for i := len(p.relays) - 1; i >= 0; i-- {
+		if p.relays[i].linkAddr.IsGlobalUnicast() {
+			return p.relays[i].linkAddr
+		}
+	}
+	return nil
+}
+
+func (p *Dhcp6Packet) xid() string {
+	return fmt.Sprintf("xid6 0x%x", p.XId)
+}
+
+func (p *Dhcp6Packet) clientID() []byte {
+	id, _ := p.Options.get(backend.Option6ClientID)
+	return id
+}
+
+type iaNA struct {
+	iaid   []byte
+	t1, t2 uint32
+	addrs  []net.IP
+}
+
+func parseIANA(b []byte) (*iaNA, error) {
+	if len(b) < 12 {
+		return nil, errors.New("IA_NA option too short")
+	}
+	res := &iaNA{
+		iaid: b[:4],
+		t1:   binary.BigEndian.Uint32(b[4:]),
+		t2:   binary.BigEndian.Uint32(b[8:]),
+	}
+	opts, err := parseDhcp6Options(b[12:])
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range opts.all(backend.Option6IAAddr) {
+		if len(addr) < 24 {
+			return nil, errors.New("IAADDR option too short")
+		}
+		res.addrs = append(res.addrs, net.IP(addr[:16]))
+	}
+	return res, nil
+}
+
+func (p *Dhcp6Packet) iaNAs() []*iaNA {
+	res := []*iaNA{}
+	for _, buf := range p.Options.all(backend.Option6IANA) {
+		if ia, err := parseIANA(buf); err == nil {
+			res = append(res, ia)
+		}
+	}
+	return res
+}
+
+func status6(code uint16, msg string) dhcp6Option {
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, code)
+	return dhcp6Option{backend.Option6StatusCode, append(buf, []byte(msg)...)}
+}
+
+// buildIANA builds an IA_NA option.  If addr is nil, the IA_NA will
+// carry status instead of an address.
+func buildIANA(iaid []byte, addr net.IP, leaseTime time.Duration, status *dhcp6Option) dhcp6Option {
+	secs := uint32(leaseTime / time.Second)
+	buf := make([]byte, 12)
+	copy(buf, iaid)
+	opts := dhcp6Options{}
+	if addr != nil {
+		binary.BigEndian.PutUint32(buf[4:], secs/2)
+		binary.BigEndian.PutUint32(buf[8:], secs*4/5)
+		iaAddr := make([]byte, 24)
+		copy(iaAddr, addr.To16())
+		binary.BigEndian.PutUint32(iaAddr[16:], secs)
+		binary.BigEndian.PutUint32(iaAddr[20:], secs)
+		opts = append(opts, dhcp6Option{backend.Option6IAAddr, iaAddr})
+	}
+	if status != nil {
+		opts = append(opts, *status)
+	}
+	return dhcp6Option{backend.Option6IANA, append(buf, opts.marshal()...)}
+}
+
+type Dhcp6StrategyFunc func(p *Dhcp6Packet) string
+
+type Strategy6 struct {
+	Name     string
+	GenToken Dhcp6StrategyFunc
+}
+
+// DuidStrategy uses the DUID from the client identifier option as
+// the token, formatted like a MAC address.
+func DuidStrategy(p *Dhcp6Packet) string {
+	id := p.clientID()
+	if len(id) == 0 {
+		return ""
+	}
+	return net.HardwareAddr(id).String()
+}
+
+type Dhcp6Handler struct {
+	waitGroup  *sync.WaitGroup
+	closing    bool
+	ifs        []string
+	port       int
+	conn       *ipv6.PacketConn
+	bk         *backend.DataTracker
+	cm         *ipv6.ControlMessage
+	strats     []*Strategy6
+	publishers *backend.Publishers
+	serverID   []byte
+}
+
+func (h *Dhcp6Handler) Printf(f string, args ...interface{}) {
+	h.bk.Printf(f, args...)
+}
+func (h *Dhcp6Handler) Infof(f string, args ...interface{}) {
+	h.bk.Infof("debugDhcp", f, args...)
+}
+func (h *Dhcp6Handler) Debugf(f string, args ...interface{}) {
+	h.bk.Debugf("debugDhcp", f, args...)
+}
+
+func (h *Dhcp6Handler) Strategy(name string) Dhcp6StrategyFunc {
+	for i := range h.strats {
+		if h.strats[i].Name == name {
+			return h.strats[i].GenToken
+		}
+	}
+	return nil
+}
+
+func (h *Dhcp6Handler) intf() *net.Interface {
+	if h.cm == nil {
+		return nil
+	}
+	iface, err := net.InterfaceByIndex(h.cm.IfIndex)
+	if err != nil {
+		h.Printf("Error looking up interface index %d: %v", h.cm.IfIndex, err)
+	}
+	return iface
+}
+
+func (h *Dhcp6Handler) listenIPs() []net.IP {
+	res := []net.IP{}
+	iface := h.intf()
+	if iface == nil {
+		return res
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		h.Printf("Error getting addrs for interface %s: %v", iface.Name, err)
+		return res
+	}
+	for _, addr := range addrs {
+		ip, _, err := net.ParseCIDR(addr.String())
+		if err == nil && ip.To4() == nil && ip.IsGlobalUnicast() {
+			res = append(res, ip)
+		}
+	}
+	return res
+}
+
+func (h *Dhcp6Handler) buildOptions(p *Dhcp6Packet,
+	l *backend.Lease,
+	s *backend.Subnet,
+	r *backend.Reservation) (dhcp6Options, time.Duration) {
+	leaseTime := 7200 * time.Second
+	if s != nil {
+		leaseTime = s.LeaseTimeFor(l.Addr)
+	}
+	srcOpts := map[int]string{}
+	for _, opt := range p.Options {
+		srcOpts[int(opt.Code)] = backend.ConvertByteToOptionValue6(opt.Code, opt.Data)
+		h.Debugf("Received option: %v: %v", opt.Code, srcOpts[int(opt.Code)])
+	}
+	rendered := map[uint16][]byte{}
+	order := []uint16{}
+	render := func(opts []backend.DhcpOption) {
+		for _, opt := range opts {
+			if opt.Value == "" {
+				h.Printf("Ignoring DHCPv6 option %d with zero-length value", opt.Code)
+				continue
+			}
+			c, v, err := opt.RenderToDHCP6(srcOpts)
+			if err != nil {
+				h.Printf("Failed to render option %v: %v, %v", opt.Code, opt.Value, err)
+				continue
+			}
+			if _, ok := rendered[c]; !ok {
+				order = append(order, c)
+			}
+			rendered[c] = v
+		}
+	}
+	if s != nil {
+		render(s.Options)
+	}
+	if r != nil {
+		render(r.Options)
+	}
+	// Only hand out options the client asked for, if it asked.
+	if oro, ok := p.Options.get(backend.Option6ORO); ok {
+		order = []uint16{}
+		for len(oro) >= 2 {
+			order = append(order, binary.BigEndian.Uint16(oro))
+			oro = oro[2:]
+		}
+	}
+	res := dhcp6Options{}
+	for _, c := range order {
+		if v, ok := rendered[c]; ok {
+			res = append(res, dhcp6Option{c, v})
+		}
+	}
+	return res, leaseTime
+}
+
+func (h *Dhcp6Handler) leaseReply(p *Dhcp6Packet,
+	msgType byte,
+	ia *iaNA,
+	lease *backend.Lease,
+	subnet *backend.Subnet,
+	reservation *backend.Reservation) *Dhcp6Packet {
+	opts, leaseTime := h.buildOptions(p, lease, subnet, reservation)
+	reply := h.statusReply(p, msgType, nil)
+	reply.Options = append(reply.Options, buildIANA(ia.iaid, lease.Addr, leaseTime, nil))
+	reply.Options = append(reply.Options, opts...)
+	return reply
+}
+
+func (h *Dhcp6Handler) statusReply(p *Dhcp6Packet, msgType byte, status *dhcp6Option) *Dhcp6Packet {
+	reply := p.reply(msgType)
+	reply.Options = append(reply.Options,
+		dhcp6Option{backend.Option6ServerID, h.serverID},
+		dhcp6Option{backend.Option6ClientID, p.clientID()})
+	if status != nil {
+		reply.Options = append(reply.Options, *status)
+	}
+	return reply
+}
+
+func (h *Dhcp6Handler) iaStatusReply(p *Dhcp6Packet, ia *iaNA, code uint16, msg string) *Dhcp6Packet {
+	status := status6(code, msg)
+	reply := h.statusReply(p, dhcp6Reply, nil)
+	reply.Options = append(reply.Options, buildIANA(ia.iaid, nil, 0, &status))
+	return reply
+}
+
+func (h *Dhcp6Handler) forUs(p *Dhcp6Packet) bool {
+	sid, ok := p.Options.get(backend.Option6ServerID)
+	return ok && bytes.Equal(sid, h.serverID)
+}
+
+func (h *Dhcp6Handler) ServeDHCP6(p *Dhcp6Packet) *Dhcp6Packet {
+	h.Infof("Received DHCPv6 packet: type %s %s link %s client %s",
+		dhcp6MsgNames[p.MsgType],
+		p.xid(),
+		p.linkAddr(),
+		DuidStrategy(p))
+	if len(p.clientID()) == 0 {
+		h.Infof("%s: Ignoring message without a client identifier", p.xid())
+		return nil
+	}
+	_, hasSID := p.Options.get(backend.Option6ServerID)
+	switch p.MsgType {
+	case dhcp6Solicit, dhcp6Rebind:
+		if hasSID {
+			h.Infof("%s: Ignoring %s with a server identifier", p.xid(), dhcp6MsgNames[p.MsgType])
+			return nil
+		}
+	case dhcp6Request, dhcp6Renew, dhcp6Release, dhcp6Decline:
+		if !h.forUs(p) {
+			h.Infof("%s: Ignoring %s for another server", p.xid(), dhcp6MsgNames[p.MsgType])
+			return nil
+		}
+	default:
+		// We only handle stateful address assignment.  In particular,
+		// RFC 8415 requires us to stay silent on a Confirm when we
+		// cannot tell if the addresses are on link.
+		h.Infof("%s: Ignoring unhandled message type %d", p.xid(), p.MsgType)
+		return nil
+	}
+	ias := p.iaNAs()
+	if len(ias) == 0 {
+		h.Infof("%s: Ignoring %s without an IA_NA", p.xid(), dhcp6MsgNames[p.MsgType])
+		return nil
+	}
+	// We only hand out one address per client, so only the first
+	// IA_NA is considered.
+	ia := ias[0]
+	var req net.IP
+	if len(ia.addrs) > 0 {
+		req = ia.addrs[0]
+	}
+	via := []net.IP{p.linkAddr()}
+	if via[0] == nil {
+		via = h.listenIPs()
+	}
+	switch p.MsgType {
+	case dhcp6Release, dhcp6Decline:
+		d, unlocker := h.bk.LockEnts("leases", "reservations", "subnets")
+		defer unlocker()
+		for _, addr := range ia.addrs {
+			leaseThing := d("leases").Find(backend.Hexaddr(addr))
+			if leaseThing == nil {
+				h.Infof("%s: Asked to release or decline a lease we didn't issue for %s, ignoring", p.xid(), addr)
+				continue
+			}
+			lease := backend.AsLease(leaseThing)
+			stratfn := h.Strategy(lease.Strategy)
+			if stratfn == nil || stratfn(p) != lease.Token {
+				h.Infof("%s: Received spoofed release or decline for %s, ignoring", p.xid(), lease.Addr)
+				continue
+			}
+			if p.MsgType == dhcp6Decline {
+				h.Infof("%s: Lease for %s declined, invalidating.", p.xid(), lease.Addr)
+				lease.Invalidate()
+			} else {
+				h.Infof("%s: Lease for %s released, expiring.", p.xid(), lease.Addr)
+				lease.Expire()
+			}
+			h.bk.Save(d, lease, nil)
+		}
+		status := status6(status6Success, "")
+		return h.statusReply(p, dhcp6Reply, &status)
+	case dhcp6Solicit:
+		for _, s := range h.strats {
+			token := s.GenToken(p)
+			if token == "" {
+				continue
+			}
+			lease, subnet, reservation := backend.FindOrCreateLease(h.bk, s.Name, token, req, via)
+			if lease != nil {
+				h.Infof("%s: Solicit handing out: %s to %s", p.xid(), lease.Addr, token)
+				return h.leaseReply(p, dhcp6Advertise, ia, lease, subnet, reservation)
+			}
+		}
+		return nil
+	}
+	// Request, Renew, and Rebind
+	for _, s := range h.strats {
+		token := s.GenToken(p)
+		if token == "" {
+			continue
+		}
+		if req == nil && p.MsgType == dhcp6Request {
+			lease, _, _ := backend.FindOrCreateLease(h.bk, s.Name, token, nil, via)
+			if lease == nil {
+				continue
+			}
+			req = lease.Addr
+		}
+		lease, subnet, reservation, err := backend.FindLease(h.bk, s.Name, token, req)
+		if err != nil {
+			h.Infof("%s: %s is no longer able to be leased: %s", p.xid(), req, err)
+			if p.MsgType == dhcp6Request {
+				return h.iaStatusReply(p, ia, status6NoAddrsAvail, err.Error())
+			}
+			return h.iaStatusReply(p, ia, status6NoBinding, err.Error())
+		}
+		if lease == nil {
+			// The subnet is not enabled, so act like we are silent.
+			return nil
+		}
+		h.Infof("%s: %s handing out: %s to %s", p.xid(), dhcp6MsgNames[p.MsgType], lease.Addr, token)
+		return h.leaseReply(p, dhcp6Reply, ia, lease, subnet, reservation)
+	}
+	if p.MsgType == dhcp6Rebind {
+		// Some other server may own this binding.
+		return nil
+	}
+	return h.iaStatusReply(p, ia, status6NoAddrsAvail, "No addresses available")
+}
+
+func (h *Dhcp6Handler) Serve() error {
+	defer h.waitGroup.Done()
+	defer h.conn.Close()
+	buf := make([]byte, 16384)
+	for {
+		h.conn.SetReadDeadline(time.Now().Add(time.Second))
+		h.cm = nil
+		cnt, control, srcAddr, err := h.conn.ReadFrom(buf)
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		req, err := ParseDhcp6(append([]byte{}, buf[:cnt]...))
+		if err != nil {
+			h.Debugf("Ignoring malformed DHCPv6 packet from %s: %v", srcAddr, err)
+			continue
+		}
+		h.cm = control
+		if len(h.ifs) > 0 {
+			canProcess := false
+			tgtIf := h.intf()
+			for _, ifName := range h.ifs {
+				if tgtIf != nil && strings.TrimSpace(ifName) == tgtIf.Name {
+					canProcess = true
+					break
+				}
+			}
+			if !canProcess {
+				h.Infof("DHCPv6: Completly ignoring packet from %s", srcAddr)
+				continue
+			}
+		}
+		if res := h.ServeDHCP6(req); res != nil {
+			var cm *ipv6.ControlMessage
+			if h.cm != nil {
+				cm = &ipv6.ControlMessage{IfIndex: h.cm.IfIndex}
+			}
+			if _, e := h.conn.WriteTo(res.Marshal(), cm, srcAddr); e != nil {
+				return e
+			}
+		}
+	}
+}
+
+func (h *Dhcp6Handler) Shutdown(ctx context.Context) error {
+	h.Printf("Shutting down DHCPv6 handler")
+	h.closing = true
+	h.conn.Close()
+	h.waitGroup.Wait()
+	h.Printf("DHCPv6 handler shut down")
+	return nil
+}
+
+// dhcp6Interfaces returns the interfaces we should join the
+// All_DHCP_Relay_Agents_and_Servers group on.
+func dhcp6Interfaces(ifs []string) ([]net.Interface, error) {
+	intfs, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	res := []net.Interface{}
+	for _, intf := range intfs {
+		if intf.Flags&net.FlagUp == 0 ||
+			intf.Flags&net.FlagLoopback != 0 ||
+			intf.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		if len(ifs) > 0 {
+			found := false
+			for _, ifName := range ifs {
+				if strings.TrimSpace(ifName) == intf.Name {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		res = append(res, intf)
+	}
+	return res, nil
+}
+
+// makeServerID builds a DUID-LL from the first usable interface, or
+// a DUID-UUID if there is no interface with an Ethernet address.  The
+// UUID is derived from drpId (or the host name, if drpId is empty),
+// so that the server keeps the same DUID across restarts.
+func makeServerID(intfs []net.Interface, drpId string) []byte {
+	for _, intf := range intfs {
+		if len(intf.HardwareAddr) == 6 {
+			return append([]byte{0, 3, 0, 1}, intf.HardwareAddr...)
+		}
+	}
+	if drpId == "" {
+		drpId, _ = os.Hostname()
+	}
+	return append([]byte{0, 4}, uuid.NewSHA1(uuid.NameSpace_OID, []byte("dr-provision/dhcp6/"+drpId))...)
+}
+
+func StartDhcp6Handler(dhcpInfo *backend.DataTracker, dhcpIfs string, dhcpPort int, pubs *backend.Publishers, drpId string) (Service, error) {
+	ifs := []string{}
+	if dhcpIfs != "" {
+		ifs = strings.Split(dhcpIfs, ",")
+	}
+	intfs, err := dhcp6Interfaces(ifs)
+	if err != nil {
+		return nil, err
+	}
+	handler := &Dhcp6Handler{
+		waitGroup:  &sync.WaitGroup{},
+		ifs:        ifs,
+		bk:         dhcpInfo,
+		port:       dhcpPort,
+		strats:     []*Strategy6{&Strategy6{Name: "DUID", GenToken: DuidStrategy}},
+		publishers: pubs,
+		serverID:   makeServerID(intfs, drpId),
+	}
+
+	l, err := net.ListenPacket("udp6", fmt.Sprintf("[::]:%d", handler.port))
+	if err != nil {
+		return nil, err
+	}
+	handler.conn = ipv6.NewPacketConn(l)
+	if err := handler.conn.SetControlMessage(ipv6.FlagInterface, true); err != nil {
+		l.Close()
+		return nil, err
+	}
+	for i := range intfs {
+		if err := handler.conn.JoinGroup(&intfs[i], &net.UDPAddr{IP: dhcp6AllServers}); err != nil {
+			dhcpInfo.Printf("DHCPv6: unable to listen for multicast on %s: %v", intfs[i].Name, err)
+		}
+	}
+	handler.waitGroup.Add(1)
+	go func() {
+		err := handler.Serve()
+		if !handler.closing {
+			dhcpInfo.Logger.Fatalf("DHCPv6 handler died: %v", err)
+		}
+	}()
+	return handler, nil
+}
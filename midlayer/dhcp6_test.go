@@ -0,0 +1,190 @@
+package midlayer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/digitalrebar/provision/backend"
+)
+
+func mkSolicit6(msgType byte, duid []byte, addr net.IP, serverID []byte) *Dhcp6Packet {
+	p := &Dhcp6Packet{
+		MsgType: msgType,
+		XId:     []byte{1, 2, 3},
+		Options: dhcp6Options{{backend.Option6ClientID, duid}},
+	}
+	ia := []byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}
+	if addr != nil {
+		iaAddr := make([]byte, 24)
+		copy(iaAddr, addr.To16())
+		ia = append(ia, dhcp6Options{{backend.Option6IAAddr, iaAddr}}.marshal()...)
+	}
+	p.Options = append(p.Options, dhcp6Option{backend.Option6IANA, ia})
+	if serverID != nil {
+		p.Options = append(p.Options, dhcp6Option{backend.Option6ServerID, serverID})
+	}
+	oro := make([]byte, 2)
+	binary.BigEndian.PutUint16(oro, backend.Option6BootFileURL)
+	p.Options = append(p.Options, dhcp6Option{backend.Option6ORO, oro})
+	return p
+}
+
+// relay6 wraps a client message in a Relay-Forward message the same
+// way a relay agent on link would.
+func relay6(p *Dhcp6Packet, link net.IP) []byte {
+	inner := p.Marshal()
+	hdr := append([]byte{dhcp6RelayForw, 0}, link.To16()...)
+	hdr = append(hdr, net.ParseIP("fe80::1").To16()...)
+	opts := dhcp6Options{
+		{backend.Option6InterfaceID, []byte("eth0")},
+		{backend.Option6RelayMsg, inner},
+	}
+	return append(hdr, opts.marshal()...)
+}
+
+func TestDhcp6Codec(t *testing.T) {
+	duid := []byte{0, 3, 0, 1, 1, 2, 3, 4, 5, 6}
+	pkt := mkSolicit6(dhcp6Solicit, duid, nil, nil)
+	buf := relay6(pkt, net.ParseIP("2001:db8:1::1"))
+	res, err := ParseDhcp6(buf)
+	if err != nil {
+		t.Fatalf("Failed to parse relayed packet: %v", err)
+	}
+	if res.MsgType != dhcp6Solicit || !bytes.Equal(res.XId, pkt.XId) {
+		t.Errorf("Relayed packet decoded as type %d xid %v", res.MsgType, res.XId)
+	}
+	if !res.linkAddr().Equal(net.ParseIP("2001:db8:1::1")) {
+		t.Errorf("Expected link address 2001:db8:1::1, got %s", res.linkAddr())
+	}
+	if tok := DuidStrategy(res); tok != "00:03:00:01:01:02:03:04:05:06" {
+		t.Errorf("Unexpected DUID token %s", tok)
+	}
+	// Replies to relayed messages must be wrapped in a Relay-Reply
+	// with the same header as the Relay-Forward.
+	out := res.reply(dhcp6Advertise).Marshal()
+	if out[0] != dhcp6RelayRepl || !bytes.Equal(out[2:34], buf[2:34]) {
+		t.Errorf("Reply was not wrapped in a matching Relay-Reply")
+	}
+	opts, err := parseDhcp6Options(out[34:])
+	if err != nil {
+		t.Fatalf("Failed to parse Relay-Reply options: %v", err)
+	}
+	if ifID, ok := opts.get(backend.Option6InterfaceID); !ok || string(ifID) != "eth0" {
+		t.Errorf("Relay-Reply did not echo the Interface-Id option")
+	}
+	if inner, ok := opts.get(backend.Option6RelayMsg); !ok || inner[0] != dhcp6Advertise {
+		t.Errorf("Relay-Reply did not contain the Advertise")
+	}
+	if _, err := ParseDhcp6([]byte{dhcp6RelayForw, 0, 1}); err == nil {
+		t.Errorf("Expected truncated relay message to fail to parse")
+	}
+}
+
+func TestDhcp6Handler(t *testing.T) {
+	func() {
+		d, unlocker := dataTracker.LockEnts("subnets")
+		defer unlocker()
+		sn := dataTracker.NewSubnet()
+		sn.Name = "v6"
+		sn.Enabled = true
+		sn.Subnet = "2001:db8:1::/64"
+		sn.ActiveStart = net.ParseIP("2001:db8:1::100")
+		sn.ActiveEnd = net.ParseIP("2001:db8:1::1ff")
+		sn.ActiveLeaseTime = 60
+		sn.ReservedLeaseTime = 7200
+		sn.Strategy = "DUID"
+		sn.Options = []backend.DhcpOption{{Code: 59, Value: "http://[2001:db8:1::1]/bootx64.efi"}}
+		if _, err := dataTracker.Create(d, sn, nil); err != nil {
+			t.Fatalf("Failed to create IPv6 subnet: %v", err)
+		}
+	}()
+	handler := &Dhcp6Handler{
+		bk:       dataTracker,
+		strats:   []*Strategy6{&Strategy6{Name: "DUID", GenToken: DuidStrategy}},
+		serverID: []byte{0, 3, 0, 1, 6, 5, 4, 3, 2, 1},
+	}
+	duid := []byte{0, 3, 0, 1, 1, 2, 3, 4, 5, 6}
+	link := net.ParseIP("2001:db8:1::1")
+	parse := func(p *Dhcp6Packet) *Dhcp6Packet {
+		res, err := ParseDhcp6(relay6(p, link))
+		if err != nil {
+			t.Fatalf("Failed to parse: %v", err)
+		}
+		return res
+	}
+	adv := handler.ServeDHCP6(parse(mkSolicit6(dhcp6Solicit, duid, nil, nil)))
+	if adv == nil || adv.MsgType != dhcp6Advertise {
+		t.Fatalf("Expected an Advertise in response to a Solicit, got %v", adv)
+	}
+	ias := adv.iaNAs()
+	if len(ias) != 1 || len(ias[0].addrs) != 1 {
+		t.Fatalf("Expected one address in the Advertise, got %v", ias)
+	}
+	addr := ias[0].addrs[0]
+	if !addr.Equal(net.ParseIP("2001:db8:1::100")) {
+		t.Errorf("Expected to be offered 2001:db8:1::100, got %s", addr)
+	}
+	if url, ok := adv.Options.get(backend.Option6BootFileURL); !ok || string(url) != "http://[2001:db8:1::1]/bootx64.efi" {
+		t.Errorf("Expected a boot file URL, got %q", string(url))
+	}
+	if sid, _ := adv.Options.get(backend.Option6ServerID); !bytes.Equal(sid, handler.serverID) {
+		t.Errorf("Advertise did not carry our server ID")
+	}
+	if res := handler.ServeDHCP6(parse(mkSolicit6(dhcp6Request, duid, addr, []byte{0, 3, 0, 1, 9, 9, 9, 9, 9, 9}))); res != nil {
+		t.Errorf("Should have ignored a Request for another server")
+	}
+	reply := handler.ServeDHCP6(parse(mkSolicit6(dhcp6Request, duid, addr, handler.serverID)))
+	if reply == nil || reply.MsgType != dhcp6Reply {
+		t.Fatalf("Expected a Reply in response to a Request, got %v", reply)
+	}
+	if ias := reply.iaNAs(); len(ias) != 1 || len(ias[0].addrs) != 1 || !ias[0].addrs[0].Equal(addr) {
+		t.Errorf("Expected Reply to confirm %s, got %v", addr, ias)
+	}
+	other := []byte{0, 3, 0, 1, 1, 1, 1, 1, 1, 1}
+	reply = handler.ServeDHCP6(parse(mkSolicit6(dhcp6Renew, other, addr, handler.serverID)))
+	if reply == nil {
+		t.Fatalf("Expected a Reply to a Renew for an address owned by someone else")
+	}
+	if ias := reply.iaNAs(); len(ias) != 1 || len(ias[0].addrs) != 0 {
+		t.Errorf("Expected a Reply with no addresses, got %v", ias)
+	}
+	reply = handler.ServeDHCP6(parse(mkSolicit6(dhcp6Request, other, addr, handler.serverID)))
+	if reply == nil {
+		t.Fatalf("Expected a Reply to a Request for an address owned by someone else")
+	}
+	if buf, ok := reply.Options.get(backend.Option6IANA); !ok || len(buf) < 12 {
+		t.Errorf("Expected the Reply to carry an IA_NA")
+	} else if opts, err := parseDhcp6Options(buf[12:]); err != nil {
+		t.Errorf("Failed to parse IA_NA options: %v", err)
+	} else if st, ok := opts.get(backend.Option6StatusCode); !ok || len(st) < 2 || binary.BigEndian.Uint16(st) != status6NoAddrsAvail {
+		t.Errorf("Expected the Request to be refused with NoAddrsAvail, got %v", st)
+	}
+	reply = handler.ServeDHCP6(parse(mkSolicit6(dhcp6Release, duid, addr, handler.serverID)))
+	if reply == nil || reply.MsgType != dhcp6Reply {
+		t.Errorf("Expected a Reply to a Release")
+	}
+	d, unlocker := dataTracker.LockEnts("leases")
+	defer unlocker()
+	if l := d("leases").Find(backend.Hexaddr(addr)); l == nil || !backend.AsLease(l).Expired() {
+		t.Errorf("Expected released lease for %s to be expired", addr)
+	}
+}
+
+func TestDhcp6ServerID(t *testing.T) {
+	intfs := []net.Interface{{Name: "lo"}, {Name: "eth0", HardwareAddr: net.HardwareAddr{6, 5, 4, 3, 2, 1}}}
+	if sid := makeServerID(intfs, "drp"); !bytes.Equal(sid, []byte{0, 3, 0, 1, 6, 5, 4, 3, 2, 1}) {
+		t.Errorf("Expected a DUID-LL from eth0, got %x", sid)
+	}
+	sid := makeServerID(intfs[:1], "drp")
+	if len(sid) != 18 || sid[0] != 0 || sid[1] != 4 {
+		t.Errorf("Expected a DUID-UUID without an Ethernet interface, got %x", sid)
+	}
+	if !bytes.Equal(sid, makeServerID(intfs[:1], "drp")) {
+		t.Errorf("Expected the DUID-UUID to be the same every time")
+	}
+	if bytes.Equal(sid, makeServerID(intfs[:1], "other")) {
+		t.Errorf("Expected a different DUID-UUID for a different DRP id")
+	}
+}
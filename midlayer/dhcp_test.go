@@ -1,11 +1,14 @@
 package midlayer
 
 import (
+	"bytes"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/digitalrebar/provision/backend"
 	"github.com/digitalrebar/store"
@@ -75,3 +78,652 @@ func TestMain(m *testing.M) {
 	}
 	os.Exit(ret)
 }
+
+func TestDhcpProxy(t *testing.T) {
+	func() {
+		d, unlocker := dataTracker.LockEnts("subnets")
+		defer unlocker()
+		sn := dataTracker.NewSubnet()
+		sn.Name = "proxy"
+		sn.Enabled = true
+		sn.Proxy = true
+		sn.Subnet = "10.10.10.0/24"
+		sn.ActiveLeaseTime = 60
+		sn.ReservedLeaseTime = 7200
+		sn.Strategy = "MAC"
+		sn.Options = []backend.DhcpOption{{Code: 67, Value: "lpxelinux.0"}}
+		if _, err := dataTracker.Create(d, sn, nil); err != nil {
+			t.Fatalf("Failed to create proxy subnet: %v", err)
+		}
+	}()
+	handler := &DhcpHandler{
+		ifs:    []string{},
+		bk:     dataTracker,
+		strats: []*Strategy{&Strategy{Name: "MAC", GenToken: MacStrategy}},
+	}
+	hw, _ := net.ParseMAC("01:23:45:67:89:ab")
+	relay := net.ParseIP("10.10.10.1")
+	pxeOpts := []dhcp.Option{{Code: dhcp.OptionVendorClassIdentifier, Value: []byte("PXEClient:Arch:00000:UNDI:002001")}}
+	serve := func(p dhcp.Packet, mt dhcp.MessageType) dhcp.Packet {
+		p.SetGIAddr(relay)
+		return handler.ServeDHCP(p, mt, p.ParseOptions())
+	}
+	offer := serve(dhcp.RequestPacket(dhcp.Discover, hw, nil, []byte("prx1"), false, pxeOpts), dhcp.Discover)
+	if offer == nil {
+		t.Fatalf("Expected a proxy offer for a PXE client")
+	}
+	if !offer.YIAddr().Equal(net.IPv4zero) {
+		t.Errorf("Proxy offer should not hand out an address, got %s", offer.YIAddr())
+	}
+	opts := offer.ParseOptions()
+	if string(opts[dhcp.OptionBootFileName]) != "lpxelinux.0" {
+		t.Errorf("Expected boot file lpxelinux.0, got %q", string(opts[dhcp.OptionBootFileName]))
+	}
+	if string(opts[dhcp.OptionVendorClassIdentifier]) != "PXEClient" {
+		t.Errorf("Proxy offer should identify as PXEClient, got %q", string(opts[dhcp.OptionVendorClassIdentifier]))
+	}
+	if mt := opts[dhcp.OptionDHCPMessageType]; len(mt) != 1 || dhcp.MessageType(mt[0]) != dhcp.Offer {
+		t.Errorf("Expected an Offer, got %v", mt)
+	}
+	if res := serve(dhcp.RequestPacket(dhcp.Discover, hw, nil, []byte("prx2"), false, nil), dhcp.Discover); res != nil {
+		t.Errorf("Should not answer non-PXE clients in a proxy subnet")
+	}
+	if res := serve(dhcp.RequestPacket(dhcp.Request, hw, net.ParseIP("10.10.10.50"), []byte("prx3"), false, pxeOpts), dhcp.Request); res != nil {
+		t.Errorf("Should not answer requests in a proxy subnet, got %v", res.ParseOptions()[dhcp.OptionDHCPMessageType])
+	}
+	d, unlocker := dataTracker.LockEnts("leases")
+	defer unlocker()
+	for _, l := range d("leases").Items() {
+		if lease := backend.AsLease(l); lease.Token == hw.String() {
+			t.Errorf("Proxy mode should not have created lease %s", lease.Addr)
+		}
+	}
+}
+
+func TestDhcpStrategies(t *testing.T) {
+	hw, _ := net.ParseMAC("01:23:45:67:89:ab")
+	relayInfo := []byte{backend.RelayCircuitID, 3, 0, 1, 2, backend.RelayRemoteID, 2, 'r', '1'}
+	req := dhcp.RequestPacket(dhcp.Discover, hw, nil, []byte("strt"), false, []dhcp.Option{
+		{Code: dhcp.OptionClientIdentifier, Value: []byte{1, 1, 2, 3, 4, 5, 6}},
+		{Code: dhcp.OptionRelayAgentInformation, Value: relayInfo},
+	})
+	opts := req.ParseOptions()
+	tests := []struct {
+		name     string
+		fn       StrategyFunc
+		expected string
+	}{
+		{"ClientID", ClientIDStrategy, "01:01:02:03:04:05:06"},
+		{"CircuitID", CircuitIDStrategy, "00:01:02"},
+		{"RemoteID", RemoteIDStrategy, "72:31"},
+	}
+	for _, test := range tests {
+		if s := test.fn(req, opts); s != test.expected {
+			t.Errorf("%s strategy processing, expected: %s got: %s", test.name, test.expected, s)
+		}
+		if s := test.fn(req, dhcp.Options{}); s != "" {
+			t.Errorf("%s strategy should not generate a token without the option, got: %s", test.name, s)
+		}
+	}
+	if s := CircuitIDStrategy(req, dhcp.Options{dhcp.OptionRelayAgentInformation: []byte{backend.RelayCircuitID, 5, 0}}); s != "" {
+		t.Errorf("CircuitID strategy should ignore a truncated sub-option, got: %s", s)
+	}
+}
+
+func TestDhcpRelayInfo(t *testing.T) {
+	func() {
+		d, unlocker := dataTracker.LockEnts("subnets")
+		defer unlocker()
+		sn := dataTracker.NewSubnet()
+		sn.Name = "relayed"
+		sn.Enabled = true
+		sn.Subnet = "10.20.30.0/24"
+		sn.ActiveStart = net.ParseIP("10.20.30.100")
+		sn.ActiveEnd = net.ParseIP("10.20.30.200")
+		sn.ActiveLeaseTime = 60
+		sn.ReservedLeaseTime = 7200
+		sn.Strategy = "MAC"
+		sn.Options = []backend.DhcpOption{{Code: 67, Value: `{{if eq (relay 1) "00:01:02"}}port1.ipxe{{else}}other.ipxe{{end}}`}}
+		if _, err := dataTracker.Create(d, sn, nil); err != nil {
+			t.Fatalf("Failed to create relayed subnet: %v", err)
+		}
+	}()
+	handler := &DhcpHandler{
+		ifs:    []string{},
+		bk:     dataTracker,
+		strats: dhcpStrategies,
+	}
+	hw, _ := net.ParseMAC("01:23:45:67:89:ac")
+	relayInfo := []byte{backend.RelayCircuitID, 3, 0, 1, 2, backend.RelayLinkSelection, 4, 10, 20, 30, 0}
+	req := dhcp.RequestPacket(dhcp.Discover, hw, nil, []byte("rly1"), false, []dhcp.Option{
+		{Code: dhcp.OptionRelayAgentInformation, Value: relayInfo},
+	})
+	// giaddr is not in any subnet, so the link selection sub-option
+	// must be what picks the subnet.
+	req.SetGIAddr(net.ParseIP("10.99.99.1"))
+	offer := handler.ServeDHCP(req, dhcp.Discover, req.ParseOptions())
+	if offer == nil {
+		t.Fatalf("Expected an offer from the link selected subnet")
+	}
+	if !offer.YIAddr().Equal(net.ParseIP("10.20.30.100")) {
+		t.Errorf("Expected to be offered 10.20.30.100, got %s", offer.YIAddr())
+	}
+	opts := offer.ParseOptions()
+	if string(opts[dhcp.OptionBootFileName]) != "port1.ipxe" {
+		t.Errorf("Expected the boot file template to see the circuit-id, got %q", string(opts[dhcp.OptionBootFileName]))
+	}
+	if !bytes.Equal(opts[dhcp.OptionRelayAgentInformation], relayInfo) {
+		t.Errorf("Expected the relay agent information to be echoed, got %v", opts[dhcp.OptionRelayAgentInformation])
+	}
+	nakReq := dhcp.RequestPacket(dhcp.Request, hw, nil, []byte("rly2"), false, []dhcp.Option{
+		{Code: dhcp.OptionRequestedIPAddress, Value: net.ParseIP("10.20.30.150").To4()},
+		{Code: dhcp.OptionRelayAgentInformation, Value: relayInfo},
+	})
+	nakReq.SetGIAddr(net.ParseIP("10.99.99.1"))
+	nak := handler.ServeDHCP(nakReq, dhcp.Request, nakReq.ParseOptions())
+	if nak == nil {
+		t.Fatalf("Expected a NAK for an address we did not offer")
+	}
+	opts = nak.ParseOptions()
+	if mt := opts[dhcp.OptionDHCPMessageType]; len(mt) != 1 || dhcp.MessageType(mt[0]) != dhcp.NAK {
+		t.Errorf("Expected a NAK, got %v", mt)
+	}
+	if !bytes.Equal(opts[dhcp.OptionRelayAgentInformation], relayInfo) {
+		t.Errorf("Expected the relay agent information to be echoed in the NAK")
+	}
+	sel := dhcp.RequestPacket(dhcp.Discover, hw, nil, []byte("rly3"), false, []dhcp.Option{
+		{Code: backend.OptionSubnetSelection, Value: net.ParseIP("10.20.30.0").To4()},
+	})
+	if offer := handler.ServeDHCP(sel, dhcp.Discover, sel.ParseOptions()); offer == nil || string(offer.ParseOptions()[dhcp.OptionBootFileName]) != "other.ipxe" {
+		t.Errorf("Expected an offer from the subnet picked by the subnet selection option")
+	}
+}
+
+type fakeProber struct {
+	inUse map[string]net.HardwareAddr
+}
+
+func (p *fakeProber) Probe(addr net.IP) (bool, net.HardwareAddr) {
+	hw, ok := p.inUse[addr.String()]
+	return ok, hw
+}
+
+type conflictRecorder struct {
+	conflicts []*AddressConflict
+}
+
+func (r *conflictRecorder) Publish(e *backend.Event) error {
+	if e.Type == "leases" && e.Action == "conflict" {
+		r.conflicts = append(r.conflicts, e.Object.(*AddressConflict))
+	}
+	return nil
+}
+func (r *conflictRecorder) Reserve() error { return nil }
+func (r *conflictRecorder) Release()       {}
+func (r *conflictRecorder) Unload()        {}
+
+func TestDhcpConflictProbe(t *testing.T) {
+	func() {
+		d, unlocker := dataTracker.LockEnts("subnets")
+		defer unlocker()
+		sn := dataTracker.NewSubnet()
+		sn.Name = "probed"
+		sn.Enabled = true
+		sn.Subnet = "10.40.50.0/24"
+		sn.ActiveStart = net.ParseIP("10.40.50.10")
+		sn.ActiveEnd = net.ParseIP("10.40.50.12")
+		sn.ActiveLeaseTime = 60
+		sn.ReservedLeaseTime = 7200
+		sn.Strategy = "MAC"
+		if _, err := dataTracker.Create(d, sn, nil); err != nil {
+			t.Fatalf("Failed to create subnet: %v", err)
+		}
+	}()
+	squatter, _ := net.ParseMAC("de:ad:be:ef:00:01")
+	rec := &conflictRecorder{}
+	pubs := backend.NewPublishers(log.New(ioutil.Discard, "", 0))
+	pubs.Add(rec)
+	handler := &DhcpHandler{
+		ifs:        []string{},
+		bk:         dataTracker,
+		strats:     []*Strategy{&Strategy{Name: "MAC", GenToken: MacStrategy}},
+		publishers: pubs,
+		prober:     &fakeProber{inUse: map[string]net.HardwareAddr{"10.40.50.10": squatter}},
+	}
+	hw, _ := net.ParseMAC("02:23:45:67:89:ab")
+	// Addresses are probed in the background, so nothing is offered
+	// until the client asks again once the probe has finished.
+	discover := func(id string) dhcp.Packet {
+		req := dhcp.RequestPacket(dhcp.Discover, hw, nil, []byte(id), false, nil)
+		req.SetGIAddr(net.ParseIP("10.40.50.1"))
+		for i := 0; i < 50; i++ {
+			if offer := handler.ServeDHCP(req, dhcp.Discover, req.ParseOptions()); offer != nil {
+				return offer
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return nil
+	}
+	req := dhcp.RequestPacket(dhcp.Discover, hw, nil, []byte("cnf0"), false, nil)
+	req.SetGIAddr(net.ParseIP("10.40.50.1"))
+	if offer := handler.ServeDHCP(req, dhcp.Discover, req.ParseOptions()); offer != nil {
+		t.Errorf("Expected no offer while the address is being probed, got %s", offer.YIAddr())
+	}
+	offer := discover("cnf1")
+	if offer == nil {
+		t.Fatalf("Expected an offer")
+	}
+	if !offer.YIAddr().Equal(net.ParseIP("10.40.50.11")) {
+		t.Errorf("Expected to be offered 10.40.50.11, got %s", offer.YIAddr())
+	}
+	if len(rec.conflicts) != 1 {
+		t.Fatalf("Expected 1 conflict event, got %d", len(rec.conflicts))
+	}
+	if c := rec.conflicts[0]; !c.Addr.Equal(net.ParseIP("10.40.50.10")) || c.HardwareAddr != squatter.String() || c.Subnet != "probed" {
+		t.Errorf("Unexpected conflict event %#v", c)
+	}
+	func() {
+		d, unlocker := dataTracker.LockEnts("leases")
+		defer unlocker()
+		l := d("leases").Find(backend.Hexaddr(net.ParseIP("10.40.50.10")))
+		if l == nil {
+			t.Fatalf("Expected the conflicting address to be held by a lease")
+		}
+		if lease := backend.AsLease(l); lease.Token != "" || lease.Expired() {
+			t.Errorf("Expected the conflicting lease to be invalidated and held, got token %q expiring %s", lease.Token, lease.ExpireTime)
+		}
+	}()
+	// Offering the same address to the same client again should not
+	// probe it, as the client may well already be using it.
+	handler.prober = &fakeProber{inUse: map[string]net.HardwareAddr{"10.40.50.11": hw}}
+	handler.probes = nil
+	req = dhcp.RequestPacket(dhcp.Discover, hw, nil, []byte("cnf2"), false, nil)
+	req.SetGIAddr(net.ParseIP("10.40.50.1"))
+	offer = handler.ServeDHCP(req, dhcp.Discover, req.ParseOptions())
+	if offer == nil || !offer.YIAddr().Equal(net.ParseIP("10.40.50.11")) {
+		t.Errorf("Expected to be offered 10.40.50.11 again")
+	}
+	if len(rec.conflicts) != 1 {
+		t.Errorf("Should not have probed the address the client already holds")
+	}
+}
+
+type txRecorder struct {
+	txs []*backend.DhcpTransaction
+}
+
+func (r *txRecorder) Publish(e *backend.Event) error {
+	if e.Type == "dhcp" && e.Action == "transaction" {
+		r.txs = append(r.txs, e.Object.(*backend.DhcpTransaction))
+	}
+	return nil
+}
+func (r *txRecorder) Reserve() error { return nil }
+func (r *txRecorder) Release()       {}
+func (r *txRecorder) Unload()        {}
+
+func TestDhcpTransactions(t *testing.T) {
+	dt, pubs := mkSubnetDT(t, nil)
+	rec := &txRecorder{}
+	pubs.Add(rec)
+	handler := &DhcpHandler{
+		ifs:    []string{},
+		bk:     dt,
+		strats: []*Strategy{&Strategy{Name: "MAC", GenToken: MacStrategy}},
+	}
+	hwA, _ := net.ParseMAC("02:00:00:00:0a:01")
+	hwB, _ := net.ParseMAC("02:00:00:00:0b:01")
+	req := dhcp.RequestPacket(dhcp.Discover, hwA, nil, []byte("tx01"), false, nil)
+	req.SetGIAddr(net.ParseIP("10.50.60.1"))
+	if handler.ServeDHCP(req, dhcp.Discover, req.ParseOptions()) == nil {
+		t.Fatalf("Expected an offer")
+	}
+	req = dhcp.RequestPacket(dhcp.Request, hwB, net.ParseIP("10.50.60.200"), []byte("tx02"), false, nil)
+	req.SetGIAddr(net.ParseIP("10.50.60.1"))
+	if nak := handler.ServeDHCP(req, dhcp.Request, req.ParseOptions()); nak == nil {
+		t.Fatalf("Expected a NAK")
+	}
+	if len(rec.txs) != 2 {
+		t.Fatalf("Expected 2 transaction events, got %d", len(rec.txs))
+	}
+	all := dt.DhcpTransactions("")
+	if len(all) != 2 {
+		t.Fatalf("Expected 2 transactions, got %d", len(all))
+	}
+	offer := all[0]
+	if offer.Xid != "0x74783031" || offer.HardwareAddr != hwA.String() || offer.MessageType != "Discover" {
+		t.Errorf("Unexpected request details in %#v", offer)
+	}
+	if offer.Strategy != "MAC" || offer.Token != hwA.String() || offer.Subnet != "test" || offer.Reservation != nil {
+		t.Errorf("Unexpected lease details in %#v", offer)
+	}
+	if offer.Reply != "Offer" || !offer.Addr.Equal(net.ParseIP("10.50.60.10")) || offer.Outcome == "" {
+		t.Errorf("Unexpected outcome in %#v", offer)
+	}
+	found := false
+	for _, o := range offer.Options {
+		if o.Code == dhcp.OptionIPAddressLeaseTime {
+			found = o.Value == "60"
+		}
+	}
+	if !found {
+		t.Errorf("Expected the offer to record a lease time of 60, got %v", offer.Options)
+	}
+	byMac := dt.DhcpTransactions("02-00-00-00-0B-01")
+	if len(byMac) != 1 {
+		t.Fatalf("Expected 1 transaction for %s, got %d", hwB, len(byMac))
+	}
+	if nak := byMac[0]; nak != rec.txs[1] || nak.Reply != "NAK" || !strings.Contains(nak.Outcome, "10.50.60.200") {
+		t.Errorf("Unexpected NAK transaction %#v", nak)
+	}
+}
+
+func TestDhcpOptionClasses(t *testing.T) {
+	dt, _ := mkSubnetDT(t, func(sn *backend.Subnet) {
+		sn.OptionClasses = []backend.OptionClass{
+			{
+				Name:       "arm64",
+				Arch:       []int{11},
+				NextServer: net.ParseIP("10.50.60.5"),
+				Options:    []backend.DhcpOption{{Code: 67, Value: "ipxe-arm64.efi"}},
+			},
+		}
+	})
+	func() {
+		d, unlocker := dt.LockEnts("reservations", "subnets")
+		defer unlocker()
+		r := dt.NewReservation()
+		r.Addr = net.ParseIP("10.50.60.20")
+		r.Strategy = "MAC"
+		r.Token = "02:00:00:00:0c:03"
+		r.Options = []backend.DhcpOption{{Code: 67, Value: "special.0"}}
+		r.OptionClasses = []backend.OptionClass{
+			{Name: "ipxe", UserClass: "iPXE", Options: []backend.DhcpOption{{Code: 67, Value: "special.ipxe"}}},
+		}
+		if _, err := dt.Create(d, r, nil); err != nil {
+			t.Fatalf("Failed to create reservation: %v", err)
+		}
+	}()
+	handler := &DhcpHandler{
+		ifs:    []string{},
+		bk:     dt,
+		strats: []*Strategy{&Strategy{Name: "MAC", GenToken: MacStrategy}},
+	}
+	discover := func(mac, xid string, arch byte, userClass string) dhcp.Packet {
+		hw, _ := net.ParseMAC(mac)
+		opts := []dhcp.Option{{Code: dhcp.OptionClientArchitecture, Value: []byte{0, arch}}}
+		if userClass != "" {
+			opts = append(opts, dhcp.Option{Code: dhcp.OptionUserClass, Value: []byte(userClass)})
+		}
+		req := dhcp.RequestPacket(dhcp.Discover, hw, nil, []byte(xid), false, opts)
+		req.SetGIAddr(net.ParseIP("10.50.60.1"))
+		offer := handler.ServeDHCP(req, dhcp.Discover, req.ParseOptions())
+		if offer == nil {
+			t.Fatalf("%s: Expected an offer", xid)
+		}
+		return offer
+	}
+	offer := discover("02:00:00:00:0c:01", "cls1", 11, "")
+	if bf := string(offer.ParseOptions()[dhcp.OptionBootFileName]); bf != "ipxe-arm64.efi" {
+		t.Errorf("Expected ARM64 client to get ipxe-arm64.efi, got %q", bf)
+	}
+	if !offer.SIAddr().Equal(net.ParseIP("10.50.60.5")) {
+		t.Errorf("Expected ARM64 client to get next server 10.50.60.5, got %s", offer.SIAddr())
+	}
+	// The subnet sets its own classes, so the defaults do not apply.
+	offer = discover("02:00:00:00:0c:02", "cls2", 7, "")
+	if bf, ok := offer.ParseOptions()[dhcp.OptionBootFileName]; ok {
+		t.Errorf("Expected x86_64 UEFI client to get no boot file, got %q", string(bf))
+	}
+	offer = discover("02:00:00:00:0c:03", "cls3", 7, "")
+	if bf := string(offer.ParseOptions()[dhcp.OptionBootFileName]); bf != "special.0" {
+		t.Errorf("Expected reserved client to get special.0, got %q", bf)
+	}
+	offer = discover("02:00:00:00:0c:03", "cls4", 7, "iPXE")
+	if bf := string(offer.ParseOptions()[dhcp.OptionBootFileName]); bf != "special.ipxe" {
+		t.Errorf("Expected reserved iPXE client to get special.ipxe, got %q", bf)
+	}
+
+	dt, _ = mkSubnetDT(t, nil)
+	handler.bk = dt
+	offer = discover("02:00:00:00:0c:02", "cls5", 7, "")
+	if bf := string(offer.ParseOptions()[dhcp.OptionBootFileName]); bf != "bootx64.efi" {
+		t.Errorf("Expected default classes to give x86_64 UEFI client bootx64.efi, got %q", bf)
+	}
+	offer = discover("02:00:00:00:0c:02", "cls6", 7, "iPXE")
+	if bf := string(offer.ParseOptions()[dhcp.OptionBootFileName]); bf != "default.ipxe" {
+		t.Errorf("Expected default classes to give iPXE client default.ipxe, got %q", bf)
+	}
+}
+
+func TestDhcpInform(t *testing.T) {
+	dt, _ := mkSubnetDT(t, func(sn *backend.Subnet) {
+		sn.Options = []backend.DhcpOption{{Code: dhcp.OptionRouter, Value: "10.50.60.1"}}
+	})
+	handler := &DhcpHandler{
+		ifs:    []string{},
+		bk:     dt,
+		strats: []*Strategy{&Strategy{Name: "MAC", GenToken: MacStrategy}},
+	}
+	hw, _ := net.ParseMAC("02:00:00:00:0d:01")
+	inform := func(addr, xid string) dhcp.Packet {
+		req := dhcp.RequestPacket(dhcp.Inform, hw, net.ParseIP(addr), []byte(xid), false, nil)
+		return handler.ServeDHCP(req, dhcp.Inform, req.ParseOptions())
+	}
+	ack := inform("10.50.60.50", "inf1")
+	if ack == nil {
+		t.Fatalf("Expected an ACK for an inform from one of our subnets")
+	}
+	opts := ack.ParseOptions()
+	if mt := opts[dhcp.OptionDHCPMessageType]; len(mt) != 1 || dhcp.MessageType(mt[0]) != dhcp.ACK {
+		t.Errorf("Expected an ACK, got %v", mt)
+	}
+	if !ack.YIAddr().Equal(net.IPv4zero) {
+		t.Errorf("Inform replies should not hand out an address, got %s", ack.YIAddr())
+	}
+	if !ack.CIAddr().Equal(net.ParseIP("10.50.60.50")) {
+		t.Errorf("Expected ciaddr 10.50.60.50, got %s", ack.CIAddr())
+	}
+	if !net.IP(opts[dhcp.OptionRouter]).Equal(net.ParseIP("10.50.60.1")) {
+		t.Errorf("Expected router 10.50.60.1, got %v", opts[dhcp.OptionRouter])
+	}
+	for _, c := range []dhcp.OptionCode{dhcp.OptionIPAddressLeaseTime, dhcp.OptionRenewalTimeValue, dhcp.OptionRebindingTimeValue} {
+		if _, ok := opts[c]; ok {
+			t.Errorf("Inform replies should not have option %d", c)
+		}
+	}
+	if res := inform("10.99.60.50", "inf2"); res != nil {
+		t.Errorf("Should not answer an inform from outside our subnets")
+	}
+	d, unlocker := dt.LockEnts("leases")
+	defer unlocker()
+	if len(d("leases").Items()) != 0 {
+		t.Errorf("Inform should not create leases")
+	}
+}
+
+func TestDhcpLeaseQuery(t *testing.T) {
+	dt, _ := mkSubnetDT(t, func(sn *backend.Subnet) {
+		sn.Strategies = []string{"MAC", "ClientID"}
+	})
+	func() {
+		d, unlocker := dt.LockEnts("leases", "reservations", "subnets")
+		defer unlocker()
+		for _, l := range []*backend.Lease{
+			{Addr: net.ParseIP("10.50.60.10"), Strategy: "MAC", Token: "02:00:00:00:0e:01", ExpireTime: time.Now().Add(time.Hour)},
+			{Addr: net.ParseIP("10.50.60.11"), Strategy: "ClientID", Token: "01:02:00:00:00:0e:02", ExpireTime: time.Now().Add(time.Hour)},
+			{Addr: net.ParseIP("10.50.60.12"), Strategy: "MAC", Token: "02:00:00:00:0e:03", ExpireTime: time.Now().Add(-time.Hour)},
+		} {
+			lease := dt.NewLease()
+			*lease = *l
+			if _, err := dt.Create(d, lease, nil); err != nil {
+				t.Fatalf("Failed to create lease %s: %v", l.Addr, err)
+			}
+		}
+	}()
+	handler := &DhcpHandler{
+		ifs:    []string{},
+		bk:     dt,
+		strats: dhcpStrategies,
+	}
+	relay := net.ParseIP("10.50.60.1")
+	query := func(hw net.HardwareAddr, addr string, xid string, opts []dhcp.Option, expect dhcp.MessageType) dhcp.Packet {
+		req := dhcp.RequestPacket(LeaseQuery, hw, net.ParseIP(addr), []byte(xid), false, opts)
+		req.SetGIAddr(relay)
+		res := handler.ServeDHCP(req, LeaseQuery, req.ParseOptions())
+		if res == nil {
+			t.Fatalf("%s: Expected a reply", xid)
+		}
+		if mt := res.ParseOptions()[dhcp.OptionDHCPMessageType]; len(mt) != 1 || dhcp.MessageType(mt[0]) != expect {
+			t.Errorf("%s: Expected %s, got %v", xid, messageTypeName(expect), mt)
+		}
+		return res
+	}
+	res := query(nil, "10.50.60.10", "lq01", nil, LeaseActive)
+	if res.CHAddr().String() != "02:00:00:00:0e:01" {
+		t.Errorf("Expected chaddr 02:00:00:00:0e:01 for 10.50.60.10, got %s", res.CHAddr())
+	}
+	if _, ok := res.ParseOptions()[dhcp.OptionIPAddressLeaseTime]; !ok {
+		t.Errorf("Expected the remaining lease time for 10.50.60.10")
+	}
+	query(nil, "10.50.60.12", "lq02", nil, LeaseUnassigned)
+	query(nil, "10.99.60.12", "lq03", nil, LeaseUnknown)
+
+	hw, _ := net.ParseMAC("02:00:00:00:0e:01")
+	res = query(hw, "", "lq04", nil, LeaseActive)
+	if !res.CIAddr().Equal(net.ParseIP("10.50.60.10")) {
+		t.Errorf("Expected ciaddr 10.50.60.10 for %s, got %s", hw, res.CIAddr())
+	}
+	hw, _ = net.ParseMAC("02:00:00:00:0e:03")
+	query(hw, "", "lq05", nil, LeaseUnknown)
+
+	clientID := []byte{1, 2, 0, 0, 0, 0xe, 2}
+	res = query(nil, "", "lq06", []dhcp.Option{{Code: dhcp.OptionClientIdentifier, Value: clientID}}, LeaseActive)
+	if !res.CIAddr().Equal(net.ParseIP("10.50.60.11")) {
+		t.Errorf("Expected ciaddr 10.50.60.11 for client id, got %s", res.CIAddr())
+	}
+	if !bytes.Equal(res.ParseOptions()[dhcp.OptionClientIdentifier], clientID) {
+		t.Errorf("Expected the client id to be returned, got %v", res.ParseOptions()[dhcp.OptionClientIdentifier])
+	}
+
+	req := dhcp.RequestPacket(LeaseQuery, nil, net.ParseIP("10.50.60.10"), []byte("lq07"), false, nil)
+	if res := handler.ServeDHCP(req, LeaseQuery, req.ParseOptions()); res != nil {
+		t.Errorf("Should not answer lease queries that do not come from a relay agent")
+	}
+	txs := dt.DhcpTransactions("")
+	if last := txs[len(txs)-1]; last.MessageType != "LeaseQuery" {
+		t.Errorf("Expected the transaction to be recorded as a LeaseQuery, got %s", last.MessageType)
+	}
+}
+
+func TestDhcpShadow(t *testing.T) {
+	dt, _ := mkSubnetDT(t, func(sn *backend.Subnet) {
+		sn.Shadow = true
+	})
+	handler := &DhcpHandler{
+		ifs:    []string{},
+		bk:     dt,
+		strats: []*Strategy{&Strategy{Name: "MAC", GenToken: MacStrategy}},
+	}
+	relay := net.ParseIP("10.50.60.1")
+	other := net.ParseIP("10.50.60.250")
+	serve := func(mac, xid string, msgType dhcp.MessageType, ciaddr net.IP, opts []dhcp.Option) *backend.DhcpTransaction {
+		hw, _ := net.ParseMAC(mac)
+		req := dhcp.RequestPacket(msgType, hw, ciaddr, []byte(xid), false, opts)
+		req.SetGIAddr(relay)
+		if res := handler.ServeDHCP(req, msgType, req.ParseOptions()); res != nil {
+			t.Errorf("%s: Expected nothing to be sent in shadow mode", xid)
+		}
+		txs := dt.DhcpTransactions(mac)
+		tx := txs[len(txs)-1]
+		if !tx.Shadow {
+			t.Errorf("%s: Expected the transaction to be marked as shadow", xid)
+		}
+		return tx
+	}
+	selecting := func(addr net.IP) []dhcp.Option {
+		return []dhcp.Option{
+			{Code: dhcp.OptionRequestedIPAddress, Value: []byte(addr.To4())},
+			{Code: dhcp.OptionServerIdentifier, Value: []byte(other.To4())},
+		}
+	}
+	tx := serve("02:00:00:00:0f:01", "sh1", dhcp.Discover, nil, nil)
+	if tx.Reply == "" || !tx.Addr.Equal(net.ParseIP("10.50.60.10")) {
+		t.Errorf("Expected to record an offer of 10.50.60.10, got %s %s", tx.Reply, tx.Addr)
+	}
+	tx = serve("02:00:00:00:0f:02", "sh2", dhcp.Discover, nil, nil)
+	if !tx.Addr.Equal(net.ParseIP("10.50.60.11")) {
+		t.Errorf("Expected the shadow lease for 10.50.60.10 to be skipped, got %s", tx.Addr)
+	}
+	serve("02:00:00:00:0f:01", "sh3", dhcp.Request, nil, selecting(net.ParseIP("10.50.60.10")))
+	serve("02:00:00:00:0f:02", "sh4", dhcp.Request, nil, selecting(net.ParseIP("10.50.60.20")))
+	tx = serve("02:00:00:00:0f:03", "sh5", dhcp.Request, net.ParseIP("10.50.60.30"), nil)
+	if tx.Reply == "" || tx.Reply == "ACK" {
+		t.Errorf("Expected to record a NAK for a renewal we know nothing about, got %q", tx.Reply)
+	}
+	serve("02:00:00:00:0f:04", "sh6", dhcp.Discover, nil, nil)
+
+	report := dt.DhcpShadowReport()
+	if len(report.Clients) != 4 || report.Matched != 1 || report.Mismatched != 1 || report.NotOffered != 1 || report.Unobserved != 1 {
+		t.Errorf("Unexpected shadow report: %+v", report)
+	}
+	if c := report.Clients[1]; c.HardwareAddr != "02:00:00:00:0f:02" || !c.Offered.Equal(net.ParseIP("10.50.60.11")) || !c.Actual.Equal(net.ParseIP("10.50.60.20")) || c.Match {
+		t.Errorf("Unexpected shadow report for 02:00:00:00:0f:02: %+v", c)
+	}
+	d, unlocker := dt.LockEnts("leases")
+	defer unlocker()
+	if len(d("leases").Items()) != 0 {
+		t.Errorf("Shadow mode should not create leases")
+	}
+}
+
+func TestDhcpHttpBoot(t *testing.T) {
+	dt, _ := mkSubnetDT(t, nil)
+	handler := &DhcpHandler{
+		ifs:    []string{},
+		bk:     dt,
+		strats: []*Strategy{&Strategy{Name: "MAC", GenToken: MacStrategy}},
+	}
+	discover := func(mac, xid, vendorClass string) dhcp.Packet {
+		hw, _ := net.ParseMAC(mac)
+		opts := []dhcp.Option{
+			{Code: dhcp.OptionClientArchitecture, Value: []byte{0, 16}},
+			{Code: dhcp.OptionVendorClassIdentifier, Value: []byte(vendorClass)},
+		}
+		req := dhcp.RequestPacket(dhcp.Discover, hw, nil, []byte(xid), false, opts)
+		req.SetGIAddr(net.ParseIP("10.50.60.1"))
+		return handler.ServeDHCP(req, dhcp.Discover, req.ParseOptions())
+	}
+	offer := discover("02:00:00:00:0d:01", "http1", "HTTPClient:Arch:00016:UNDI:003001")
+	if offer == nil {
+		t.Fatalf("Expected an offer for an HTTP Boot client")
+	}
+	opts := offer.ParseOptions()
+	if bf := string(opts[dhcp.OptionBootFileName]); bf != "http://127.0.0.1:8091/ipxe.efi" {
+		t.Errorf("Expected HTTP Boot client to get http://127.0.0.1:8091/ipxe.efi, got %q", bf)
+	}
+	if vc := string(opts[dhcp.OptionVendorClassIdentifier]); vc != "HTTPClient" {
+		t.Errorf("Expected HTTP Boot offer to identify as HTTPClient, got %q", vc)
+	}
+	dt.StaticHttpsPort = 8443
+	offer = discover("02:00:00:00:0d:01", "http2", "HTTPClient:Arch:00016:UNDI:003001")
+	if bf := string(offer.ParseOptions()[dhcp.OptionBootFileName]); bf != "https://127.0.0.1:8443/ipxe.efi" {
+		t.Errorf("Expected HTTP Boot client to get https://127.0.0.1:8443/ipxe.efi, got %q", bf)
+	}
+	offer = discover("02:00:00:00:0d:02", "http3", "PXEClient:Arch:00007:UNDI:003016")
+	if offer == nil {
+		t.Fatalf("Expected an offer for a PXE client")
+	}
+	if vc, ok := offer.ParseOptions()[dhcp.OptionVendorClassIdentifier]; ok {
+		t.Errorf("Expected PXE offer to not carry a vendor class, got %q", string(vc))
+	}
+
+	dt, _ = mkSubnetDT(t, func(sn *backend.Subnet) {
+		sn.Options = []backend.DhcpOption{{Code: 67, Value: "http://boot.example.com/shim.efi"}}
+	})
+	handler.bk = dt
+	offer = discover("02:00:00:00:0d:01", "http4", "HTTPClient:Arch:00016:UNDI:003001")
+	if bf := string(offer.ParseOptions()[dhcp.OptionBootFileName]); bf != "http://boot.example.com/shim.efi" {
+		t.Errorf("Expected HTTP Boot client to keep the subnet boot file URL, got %q", bf)
+	}
+}
@@ -0,0 +1,236 @@
+package midlayer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/digitalrebar/provision/backend"
+	"github.com/miekg/dns"
+)
+
+// dnsTTL is the TTL of the records the DNS server hands out.  It is
+// short because leases come and go.
+const dnsTTL = 60
+
+// DnsServer is a small authoritative DNS server for the names of the
+// machines and leases that dr-provision knows about.  It answers for
+// a single domain, where each machine is named after the machine and
+// each active lease is named with LeaseHostname.  It also answers
+// PTR queries for addresses in any of our subnets.  Everything else
+// is refused.
+type DnsServer struct {
+	bk      *backend.DataTracker
+	domain  string
+	servers []*dns.Server
+}
+
+// StartDnsServer starts answering DNS queries for domain on port,
+// over both UDP and TCP.
+func StartDnsServer(dt *backend.DataTracker, domain string, port int) (*DnsServer, error) {
+	if domain == "" {
+		return nil, fmt.Errorf("The DNS server needs a domain to answer for")
+	}
+	s := &DnsServer{bk: dt, domain: strings.ToLower(dns.Fqdn(domain))}
+	pc, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	// Use the same port for TCP, even if we were asked for any port.
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", pc.LocalAddr().(*net.UDPAddr).Port))
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	s.servers = []*dns.Server{
+		&dns.Server{PacketConn: pc, Handler: s},
+		&dns.Server{Listener: l, Handler: s},
+	}
+	for _, srv := range s.servers {
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go func(srv *dns.Server) {
+			if err := srv.ActivateAndServe(); err != nil {
+				dt.Printf("DNS server stopped: %v", err)
+			}
+		}(srv)
+		<-started
+	}
+	return s, nil
+}
+
+// Addr returns the UDP address the DNS server is listening on.
+func (s *DnsServer) Addr() net.Addr {
+	return s.servers[0].PacketConn.LocalAddr()
+}
+
+func (s *DnsServer) soa() dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: s.domain, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: dnsTTL},
+		Ns:      s.domain,
+		Mbox:    "hostmaster." + s.domain,
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  dnsTTL,
+	}
+}
+
+// namesFor returns the names we have for addr, if any.
+func (s *DnsServer) namesFor(d backend.Stores, addr net.IP) []string {
+	res := []string{}
+	for _, i := range d("machines").Items() {
+		m := backend.AsMachine(i)
+		if m.Address != nil && m.Address.Equal(addr) {
+			res = append(res, strings.ToLower(dnsName(m.Name, s.domain)))
+		}
+	}
+	if l := d("leases").Find(backend.Hexaddr(addr)); l != nil {
+		lease := backend.AsLease(l)
+		if lease.Token != "" && !lease.Expired() {
+			res = append(res, dnsName(LeaseHostname(addr), s.domain))
+		}
+	}
+	return res
+}
+
+// addrsFor returns the addresses that name is for, if any.
+func (s *DnsServer) addrsFor(d backend.Stores, name string) []net.IP {
+	res := []net.IP{}
+	for _, i := range d("machines").Items() {
+		m := backend.AsMachine(i)
+		if m.Address != nil && !m.Address.IsUnspecified() && strings.ToLower(dnsName(m.Name, s.domain)) == name {
+			res = append(res, m.Address)
+		}
+	}
+	if len(res) > 0 || !strings.HasPrefix(name, "dhcp-") {
+		return res
+	}
+	for _, i := range d("leases").Items() {
+		lease := backend.AsLease(i)
+		if lease.Token != "" && !lease.Expired() && dnsName(LeaseHostname(lease.Addr), s.domain) == name {
+			res = append(res, lease.Addr)
+		}
+	}
+	return res
+}
+
+// ptrAddr returns the address a name under in-addr.arpa or ip6.arpa
+// is for, or nil if it is not a complete address.
+func ptrAddr(name string) net.IP {
+	labels := dns.SplitDomainName(name)
+	if len(labels) == 6 && strings.HasSuffix(name, ".in-addr.arpa.") {
+		parts := []string{}
+		for i := 3; i >= 0; i-- {
+			parts = append(parts, labels[i])
+		}
+		return net.ParseIP(strings.Join(parts, ".")).To4()
+	}
+	if len(labels) == 34 && strings.HasSuffix(name, ".ip6.arpa.") {
+		buf := make([]byte, 0, 39)
+		for i := 31; i >= 0; i-- {
+			if len(labels[i]) != 1 {
+				return nil
+			}
+			buf = append(buf, labels[i][0])
+			if i%4 == 0 && i > 0 {
+				buf = append(buf, ':')
+			}
+		}
+		return net.ParseIP(string(buf))
+	}
+	return nil
+}
+
+// ServeDNS answers a DNS query.
+func (s *DnsServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	res := &dns.Msg{}
+	res.SetReply(req)
+	if len(req.Question) != 1 {
+		res.Rcode = dns.RcodeFormatError
+		w.WriteMsg(res)
+		return
+	}
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+	switch {
+	case dns.IsSubDomain(s.domain, name):
+		s.forward(res, q.Qtype, name)
+	case dns.IsSubDomain("in-addr.arpa.", name) || dns.IsSubDomain("ip6.arpa.", name):
+		s.reverse(res, q.Qtype, name)
+	default:
+		res.Rcode = dns.RcodeRefused
+	}
+	w.WriteMsg(res)
+}
+
+func (s *DnsServer) forward(res *dns.Msg, qtype uint16, name string) {
+	res.Authoritative = true
+	if name == s.domain {
+		if qtype == dns.TypeSOA || qtype == dns.TypeANY {
+			res.Answer = append(res.Answer, s.soa())
+		} else {
+			res.Ns = append(res.Ns, s.soa())
+		}
+		return
+	}
+	d, unlocker := s.bk.LockEnts("machines", "leases")
+	addrs := s.addrsFor(d, name)
+	unlocker()
+	if len(addrs) == 0 {
+		res.Rcode = dns.RcodeNameError
+		res.Ns = append(res.Ns, s.soa())
+		return
+	}
+	for _, addr := range addrs {
+		hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: dnsTTL}
+		if v4 := addr.To4(); v4 != nil {
+			if qtype == dns.TypeA || qtype == dns.TypeANY {
+				hdr.Rrtype = dns.TypeA
+				res.Answer = append(res.Answer, &dns.A{Hdr: hdr, A: v4})
+			}
+		} else if qtype == dns.TypeAAAA || qtype == dns.TypeANY {
+			hdr.Rrtype = dns.TypeAAAA
+			res.Answer = append(res.Answer, &dns.AAAA{Hdr: hdr, AAAA: addr})
+		}
+	}
+	if len(res.Answer) == 0 {
+		res.Ns = append(res.Ns, s.soa())
+	}
+}
+
+func (s *DnsServer) reverse(res *dns.Msg, qtype uint16, name string) {
+	addr := ptrAddr(name)
+	if addr == nil || backend.FindSubnet(s.bk, []net.IP{addr}) == nil {
+		res.Rcode = dns.RcodeRefused
+		return
+	}
+	res.Authoritative = true
+	d, unlocker := s.bk.LockEnts("machines", "leases")
+	names := s.namesFor(d, addr)
+	unlocker()
+	if len(names) == 0 {
+		res.Rcode = dns.RcodeNameError
+		return
+	}
+	if qtype != dns.TypePTR && qtype != dns.TypeANY {
+		return
+	}
+	for _, n := range names {
+		res.Answer = append(res.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: dnsTTL},
+			Ptr: n,
+		})
+	}
+}
+
+// Shutdown stops the DNS server.
+func (s *DnsServer) Shutdown(ctx context.Context) error {
+	for _, srv := range s.servers {
+		srv.Shutdown()
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package midlayer
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/digitalrebar/provision/backend"
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/miekg/dns"
+	"github.com/pborman/uuid"
+)
+
+func TestDnsPtrAddr(t *testing.T) {
+	tests := map[string]string{
+		"4.3.2.10.in-addr.arpa.": "10.2.3.4",
+		"3.2.10.in-addr.arpa.":   "<nil>",
+		"5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.": "2001:db8::5",
+		"example.com.": "<nil>",
+	}
+	for name, expected := range tests {
+		if addr := ptrAddr(name).String(); addr != expected {
+			t.Errorf("Expected %s to be for %s, got %s", name, expected, addr)
+		}
+	}
+}
+
+func TestDnsServer(t *testing.T) {
+	dt, _ := mkSubnetDT(t, nil)
+	if lease, _, _ := backend.FindOrCreateLease(dt, "MAC", "02:00:00:00:00:01", nil, []net.IP{net.ParseIP("10.50.60.1")}); lease == nil {
+		t.Fatalf("Failed to create a lease")
+	}
+	func() {
+		d, unlocker := dt.LockEnts("machines")
+		defer unlocker()
+		m := dt.NewMachine()
+		m.Name = "Node1"
+		m.Uuid = uuid.NewRandom()
+		m.Address = net.ParseIP("10.50.60.100")
+		d("machines").Add(m)
+	}()
+	if _, err := StartDnsServer(dt, "", 0); err == nil {
+		t.Errorf("Should not be able to start a DNS server without a domain")
+	}
+	srv, err := StartDnsServer(dt, "Lab.Example.com", 0)
+	if err != nil {
+		t.Fatalf("Failed to start DNS server: %v", err)
+	}
+	defer srv.Shutdown(context.Background())
+	tests := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer string
+	}{
+		{"node1.lab.example.com.", dns.TypeA, dns.RcodeSuccess, "node1.lab.example.com.\t60\tIN\tA\t10.50.60.100"},
+		{"dhcp-10-50-60-10.lab.example.com.", dns.TypeA, dns.RcodeSuccess, "dhcp-10-50-60-10.lab.example.com.\t60\tIN\tA\t10.50.60.10"},
+		{"node1.lab.example.com.", dns.TypeAAAA, dns.RcodeSuccess, ""},
+		{"dhcp-10-50-60-11.lab.example.com.", dns.TypeA, dns.RcodeNameError, ""},
+		{"100.60.50.10.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, "100.60.50.10.in-addr.arpa.\t60\tIN\tPTR\tnode1.lab.example.com."},
+		{"10.60.50.10.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, "10.60.50.10.in-addr.arpa.\t60\tIN\tPTR\tdhcp-10-50-60-10.lab.example.com."},
+		{"11.60.50.10.in-addr.arpa.", dns.TypePTR, dns.RcodeNameError, ""},
+		{"1.0.0.192.in-addr.arpa.", dns.TypePTR, dns.RcodeRefused, ""},
+		{"www.example.org.", dns.TypeA, dns.RcodeRefused, ""},
+	}
+	for _, proto := range []string{"udp", "tcp"} {
+		c := &dns.Client{Net: proto}
+		for _, test := range tests {
+			m := &dns.Msg{}
+			m.SetQuestion(test.name, test.qtype)
+			res, _, err := c.Exchange(m, srv.Addr().String())
+			if err != nil {
+				t.Errorf("%s: failed to look up %s: %v", proto, test.name, err)
+				continue
+			}
+			if res.Rcode != test.rcode {
+				t.Errorf("%s: expected %s for %s, got %s", proto, dns.RcodeToString[test.rcode], test.name, dns.RcodeToString[res.Rcode])
+			}
+			answer := ""
+			if len(res.Answer) == 1 {
+				answer = res.Answer[0].String()
+			}
+			if answer != test.answer || len(res.Answer) > 1 {
+				t.Errorf("%s: expected %q for %s, got %v", proto, test.answer, test.name, res.Answer)
+			}
+		}
+	}
+	m := &dns.Msg{}
+	m.SetQuestion("lab.example.com.", dns.TypeSOA)
+	if res, _, err := (&dns.Client{}).Exchange(m, srv.Addr().String()); err != nil || len(res.Answer) != 1 || !res.Authoritative {
+		t.Errorf("Expected an authoritative SOA for the domain, got %v %v", res, err)
+	}
+	handler := &DhcpHandler{
+		ifs:       []string{},
+		bk:        dt,
+		strats:    []*Strategy{&Strategy{Name: "MAC", GenToken: MacStrategy}},
+		dnsDomain: "lab.example.com",
+	}
+	hw, _ := net.ParseMAC("02:00:00:00:00:01")
+	req := dhcp.RequestPacket(dhcp.Discover, hw, nil, []byte("dns1"), false, nil)
+	req.SetGIAddr(net.ParseIP("10.50.60.1"))
+	offer := handler.ServeDHCP(req, dhcp.Discover, req.ParseOptions())
+	if offer == nil {
+		t.Fatalf("Expected an offer")
+	}
+	if domain := string(offer.ParseOptions()[dhcp.OptionDomainName]); domain != "lab.example.com" {
+		t.Errorf("Expected the offer to have our domain, got %q", domain)
+	}
+}
@@ -0,0 +1,582 @@
+package midlayer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/digitalrebar/provision/backend"
+)
+
+// Failover roles.  A failover pair must have one of each.
+const (
+	FailoverPrimary   = "primary"
+	FailoverSecondary = "secondary"
+)
+
+// failoverHeartbeat is how often we ping our partner when there is
+// nothing else to send it.
+var failoverHeartbeat = time.Second
+
+// failoverPort is the port we listen for our partner on if we are
+// not told where to listen.
+const failoverPort = "8093"
+
+// failoverMsg is what failover partners send each other.  Each
+// message is a single JSON object on a TCP stream.
+//
+// The partner that accepted the connection sends a challenge first.
+// The partner that made it answers with hello, and the other partner
+// answers that with welcome.  Both hello and welcome prove the sender
+// knows the shared secret, and nothing else is sent until they have.
+type failoverMsg struct {
+	// Type is one of challenge, hello, welcome, ping, lease, or
+	// remove.
+	Type string
+	// Role is the role of the sender, sent with hello and welcome.
+	Role string `json:",omitempty"`
+	// Nonce is a random value the other partner must prove it
+	// knows the shared secret with, sent with challenge and hello.
+	Nonce []byte `json:",omitempty"`
+	// Auth is the proof that the sender knows the shared secret,
+	// sent with hello and welcome.
+	Auth []byte `json:",omitempty"`
+	// Lease is the lease that was created, updated, or removed.
+	Lease *backend.Lease `json:",omitempty"`
+	// Sync is set for leases sent as part of the full lease table
+	// when a connection is first made.
+	Sync bool `json:",omitempty"`
+}
+
+// Failover keeps the lease tables of two dr-provision servers in sync
+// so that they can both serve DHCP for the same subnets.
+//
+// The active range of each subnet is split in half.  The primary
+// hands out new leases from the lower half, and the secondary from
+// the upper half.  Either partner will renew a lease it knows about
+// no matter which half it is in.  If we have not heard from our
+// partner for longer than the partner down delay, we assume it is
+// down and hand out addresses from the whole range until it comes
+// back.
+//
+// Each partner listens for a connection from the other, and connects
+// to the other to send it lease updates.  When a connection is made,
+// the full lease table is sent first.  After that, every lease that
+// is created, updated, or removed is sent as it happens, and a ping
+// is sent every heartbeat if nothing else is.
+type Failover struct {
+	bk          *backend.DataTracker
+	pubs        *backend.Publishers
+	role        string
+	peer        string
+	secret      []byte
+	heartbeat   time.Duration
+	partnerDown time.Duration
+	listener    net.Listener
+	out         chan *failoverMsg
+	done        chan struct{}
+	wg          sync.WaitGroup
+
+	mux       sync.Mutex
+	lastHeard time.Time
+	down      bool
+	resync    bool
+	conns     map[net.Conn]struct{}
+	// applied holds the leases we have just applied from our
+	// partner, so that we do not send them straight back.  Removed
+	// leases are recorded as nil.
+	applied map[string]*backend.Lease
+}
+
+// StartFailover starts replicating leases with the failover partner
+// at peer, and listens for the partner on listen.  role must be
+// FailoverPrimary or FailoverSecondary, and must not be the same as
+// the role of the partner.  Both partners must have the same secret,
+// and connections from anywhere but the address of peer are refused.
+// If we do not hear from the partner for partnerDown, we will start
+// handing out addresses that the partner would otherwise own.
+//
+// listen must be a specific address, not all interfaces.  If it is
+// empty, we listen on port 8093 of the address we reach peer from.
+//
+// StartFailover must be called before the DHCP servers are started.
+func StartFailover(dt *backend.DataTracker,
+	pubs *backend.Publishers,
+	role, listen, peer, secret string,
+	partnerDown time.Duration) (*Failover, error) {
+	if role != FailoverPrimary && role != FailoverSecondary {
+		return nil, fmt.Errorf("Failover role must be %s or %s, not %q", FailoverPrimary, FailoverSecondary, role)
+	}
+	if peer == "" {
+		return nil, fmt.Errorf("Failover needs the address of a partner")
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("Failover needs a secret shared with the partner")
+	}
+	if listen == "" {
+		c, err := net.Dial("udp", peer)
+		if err != nil {
+			return nil, fmt.Errorf("Failover cannot find an address to reach %s from: %v", peer, err)
+		}
+		listen = net.JoinHostPort(c.LocalAddr().(*net.UDPAddr).IP.String(), failoverPort)
+		c.Close()
+	}
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		return nil, fmt.Errorf("Failover must listen on a specific address, not %q", listen)
+	}
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	f := &Failover{
+		bk:          dt,
+		pubs:        pubs,
+		role:        role,
+		peer:        peer,
+		secret:      []byte(secret),
+		heartbeat:   failoverHeartbeat,
+		partnerDown: partnerDown,
+		listener:    l,
+		out:         make(chan *failoverMsg, 1000),
+		done:        make(chan struct{}),
+		lastHeard:   time.Now(),
+		conns:       map[net.Conn]struct{}{},
+		applied:     map[string]*backend.Lease{},
+	}
+	dt.SetAddressOwner(f)
+	pubs.Add(f)
+	f.wg.Add(2)
+	go f.accept()
+	go f.send()
+	return f, nil
+}
+
+// Addr returns the address we are listening for our partner on.
+func (f *Failover) Addr() net.Addr {
+	return f.listener.Addr()
+}
+
+// PartnerDown returns whether we think our partner is down.
+func (f *Failover) PartnerDown() bool {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if !f.down && f.partnerDown > 0 && time.Since(f.lastHeard) > f.partnerDown {
+		f.bk.Printf("Failover: have not heard from %s since %s, taking over its addresses", f.peer, f.lastHeard)
+		f.down = true
+	}
+	return f.down
+}
+
+func (f *Failover) heard() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.down {
+		f.bk.Printf("Failover: %s is back, no longer handing out its addresses", f.peer)
+		f.down = false
+	}
+	f.lastHeard = time.Now()
+}
+
+// Owns returns whether we may hand out a new lease for addr.
+func (f *Failover) Owns(s *backend.Subnet, addr net.IP) bool {
+	if !s.InActiveRange(addr) || f.PartnerDown() {
+		return true
+	}
+	start, end, a := &big.Int{}, &big.Int{}, &big.Int{}
+	start.SetBytes(s.ActiveStart.To16())
+	end.SetBytes(s.ActiveEnd.To16())
+	a.SetBytes(addr.To16())
+	// The primary gets the first half of the range, rounded up.
+	mid := &big.Int{}
+	mid.Sub(end, start)
+	mid.Rsh(mid, 1)
+	mid.Add(mid, start)
+	if f.role == FailoverPrimary {
+		return a.Cmp(mid) < 1
+	}
+	return a.Cmp(mid) == 1
+}
+
+func copyLease(l *backend.Lease) *backend.Lease {
+	return &backend.Lease{
+		Addr:       l.Addr,
+		Token:      l.Token,
+		Strategy:   l.Strategy,
+		ExpireTime: l.ExpireTime,
+	}
+}
+
+func sameLease(a, b *backend.Lease) bool {
+	return a.Addr.Equal(b.Addr) &&
+		a.Token == b.Token &&
+		a.Strategy == b.Strategy &&
+		a.ExpireTime.Equal(b.ExpireTime)
+}
+
+// Publish queues lease changes to be sent to our partner.
+func (f *Failover) Publish(e *backend.Event) error {
+	if e.Type != "leases" {
+		return nil
+	}
+	lease, ok := e.Object.(*backend.Lease)
+	if !ok {
+		return nil
+	}
+	msg := &failoverMsg{Lease: copyLease(lease)}
+	switch e.Action {
+	case "create", "update", "save":
+		msg.Type = "lease"
+	case "delete":
+		msg.Type = "remove"
+	default:
+		return nil
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if applied, ok := f.applied[e.Key]; ok {
+		delete(f.applied, e.Key)
+		if (applied == nil && msg.Type == "remove") ||
+			(applied != nil && msg.Type == "lease" && sameLease(applied, msg.Lease)) {
+			return nil
+		}
+	}
+	select {
+	case f.out <- msg:
+	default:
+		// Our partner is too far behind.  Make sure it gets
+		// the whole lease table again when we reconnect.
+		f.resync = true
+	}
+	return nil
+}
+
+func (f *Failover) Reserve() error { return nil }
+func (f *Failover) Release()       {}
+func (f *Failover) Unload()        {}
+
+func (f *Failover) track(c net.Conn, add bool) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if add {
+		f.conns[c] = struct{}{}
+	} else {
+		delete(f.conns, c)
+	}
+}
+
+// proof is how a partner with role proves it knows the shared secret
+// when challenged with nonce.
+func (f *Failover) proof(nonce []byte, role string) []byte {
+	mac := hmac.New(sha256.New, f.secret)
+	mac.Write(nonce)
+	mac.Write([]byte(role))
+	return mac.Sum(nil)
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, 32)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// fromPartner returns whether addr is the address of our partner.
+func (f *Failover) fromPartner(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	host, _, err := net.SplitHostPort(f.peer)
+	if err != nil {
+		return false
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if ip.Equal(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Failover) stopping() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// send keeps a connection to our partner open and sends it lease
+// updates over it.
+func (f *Failover) send() {
+	defer f.wg.Done()
+	for !f.stopping() {
+		conn, err := net.DialTimeout("tcp", f.peer, f.heartbeat)
+		if err == nil {
+			f.track(conn, true)
+			if err = f.sendTo(conn); err != nil && !f.stopping() {
+				f.bk.Infof("debugDhcp", "Failover: lost connection to %s: %v", f.peer, err)
+			}
+			f.track(conn, false)
+			conn.Close()
+		}
+		select {
+		case <-f.done:
+		case <-time.After(f.heartbeat):
+		}
+	}
+}
+
+func (f *Failover) sendTo(conn net.Conn) error {
+	enc, dec := json.NewEncoder(conn), json.NewDecoder(conn)
+	write := func(msg *failoverMsg) error {
+		conn.SetWriteDeadline(time.Now().Add(3 * f.heartbeat))
+		return enc.Encode(msg)
+	}
+	read := func(msg *failoverMsg) error {
+		conn.SetReadDeadline(time.Now().Add(3 * f.heartbeat))
+		return dec.Decode(msg)
+	}
+	challenge := &failoverMsg{}
+	if err := read(challenge); err != nil {
+		return err
+	}
+	if challenge.Type != "challenge" || len(challenge.Nonce) == 0 {
+		return fmt.Errorf("expected challenge, got %s", challenge.Type)
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	if err := write(&failoverMsg{Type: "hello", Role: f.role, Nonce: nonce, Auth: f.proof(challenge.Nonce, f.role)}); err != nil {
+		return err
+	}
+	welcome := &failoverMsg{}
+	if err := read(welcome); err != nil {
+		return err
+	}
+	if welcome.Type != "welcome" || !hmac.Equal(welcome.Auth, f.proof(nonce, welcome.Role)) {
+		f.bk.Printf("Failover: %s does not know our secret, not sending it our leases", f.peer)
+		return fmt.Errorf("partner failed to authenticate")
+	}
+	// We never read from this connection again, so nothing should
+	// time it out.
+	conn.SetReadDeadline(time.Time{})
+	// Anything queued is covered by the lease table we are about
+	// to send.
+	f.mux.Lock()
+	f.resync = false
+	for len(f.out) > 0 {
+		<-f.out
+	}
+	f.mux.Unlock()
+	for _, lease := range f.leases() {
+		if err := write(&failoverMsg{Type: "lease", Lease: lease, Sync: true}); err != nil {
+			return err
+		}
+	}
+	f.bk.Infof("debugDhcp", "Failover: connected to %s and sent our leases", f.peer)
+	ticker := time.NewTicker(f.heartbeat)
+	defer ticker.Stop()
+	for {
+		var msg *failoverMsg
+		select {
+		case <-f.done:
+			return nil
+		case msg = <-f.out:
+		case <-ticker.C:
+			f.mux.Lock()
+			resync := f.resync
+			f.mux.Unlock()
+			if resync {
+				return fmt.Errorf("too many lease updates queued, resyncing")
+			}
+			msg = &failoverMsg{Type: "ping"}
+		}
+		if err := write(msg); err != nil {
+			return err
+		}
+	}
+}
+
+func (f *Failover) leases() []*backend.Lease {
+	d, unlocker := f.bk.LockEnts("leases")
+	defer unlocker()
+	res := []*backend.Lease{}
+	for _, i := range d("leases").Items() {
+		res = append(res, copyLease(backend.AsLease(i)))
+	}
+	return res
+}
+
+// accept handles connections from our partner.
+func (f *Failover) accept() {
+	defer f.wg.Done()
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			if f.stopping() {
+				return
+			}
+			f.bk.Printf("Failover: error accepting connection: %v", err)
+			continue
+		}
+		if !f.fromPartner(conn.RemoteAddr()) {
+			f.bk.Printf("Failover: refusing connection from %s, which is not %s", conn.RemoteAddr(), f.peer)
+			conn.Close()
+			continue
+		}
+		f.track(conn, true)
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			if err := f.receive(conn); err != nil && !f.stopping() {
+				f.bk.Infof("debugDhcp", "Failover: connection from %s closed: %v", conn.RemoteAddr(), err)
+			}
+			f.track(conn, false)
+			conn.Close()
+		}()
+	}
+}
+
+func (f *Failover) receive(conn net.Conn) error {
+	enc, dec := json.NewEncoder(conn), json.NewDecoder(conn)
+	write := func(msg *failoverMsg) error {
+		conn.SetWriteDeadline(time.Now().Add(3 * f.heartbeat))
+		return enc.Encode(msg)
+	}
+	read := func(msg *failoverMsg) error {
+		conn.SetReadDeadline(time.Now().Add(3 * f.heartbeat))
+		return dec.Decode(msg)
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	if err := write(&failoverMsg{Type: "challenge", Nonce: nonce}); err != nil {
+		return err
+	}
+	hello := &failoverMsg{}
+	if err := read(hello); err != nil {
+		return err
+	}
+	if hello.Type != "hello" || len(hello.Nonce) == 0 {
+		return fmt.Errorf("expected hello, got %s", hello.Type)
+	}
+	if !hmac.Equal(hello.Auth, f.proof(nonce, hello.Role)) {
+		f.bk.Printf("Failover: %s does not know our secret, refusing to replicate with it", conn.RemoteAddr())
+		return fmt.Errorf("partner failed to authenticate")
+	}
+	if hello.Role == f.role {
+		f.bk.Printf("Failover: %s is also %s, refusing to replicate with it", conn.RemoteAddr(), f.role)
+		return fmt.Errorf("partner has the same role")
+	}
+	if err := write(&failoverMsg{Type: "welcome", Role: f.role, Auth: f.proof(hello.Nonce, f.role)}); err != nil {
+		return err
+	}
+	f.heard()
+	for {
+		msg := &failoverMsg{}
+		if err := read(msg); err != nil {
+			return err
+		}
+		f.heard()
+		if msg.Lease == nil || msg.Lease.Addr == nil {
+			continue
+		}
+		switch msg.Type {
+		case "lease":
+			f.applyLease(msg.Lease, msg.Sync)
+		case "remove":
+			f.applyRemove(msg.Lease)
+		}
+	}
+}
+
+// applyLease stores a lease our partner sent us.  Updates always
+// win, but leases from the full lease table only win if they expire
+// later than ours.
+func (f *Failover) applyLease(l *backend.Lease, sync bool) {
+	d, unlocker := f.bk.LockEnts("leases", "reservations", "subnets")
+	defer unlocker()
+	key := backend.Hexaddr(l.Addr)
+	var lease *backend.Lease
+	if found := d("leases").Find(key); found != nil {
+		lease = backend.AsLease(found)
+		if sameLease(lease, l) || (sync && !l.ExpireTime.After(lease.ExpireTime)) {
+			return
+		}
+		lease.Token, lease.Strategy, lease.ExpireTime = l.Token, l.Strategy, l.ExpireTime
+	} else {
+		lease = f.bk.NewLease()
+		lease.Addr, lease.Token, lease.Strategy, lease.ExpireTime = l.Addr, l.Token, l.Strategy, l.ExpireTime
+		d("leases").Add(lease)
+	}
+	f.mux.Lock()
+	f.applied[key] = copyLease(lease)
+	f.mux.Unlock()
+	if saved, err := f.bk.Save(d, lease, nil); !saved {
+		f.mux.Lock()
+		delete(f.applied, key)
+		f.mux.Unlock()
+		f.bk.Printf("Failover: failed to save lease %s from %s: %v", l.Addr, f.peer, err)
+	}
+}
+
+// applyRemove removes a lease our partner removed.
+func (f *Failover) applyRemove(l *backend.Lease) {
+	d, unlocker := f.bk.LockEnts("leases")
+	defer unlocker()
+	key := backend.Hexaddr(l.Addr)
+	found := d("leases").Find(key)
+	if found == nil {
+		return
+	}
+	f.mux.Lock()
+	f.applied[key] = nil
+	f.mux.Unlock()
+	if removed, err := f.bk.Remove(d, found, nil); !removed {
+		f.mux.Lock()
+		delete(f.applied, key)
+		f.mux.Unlock()
+		f.bk.Printf("Failover: failed to remove lease %s for %s: %v", l.Addr, f.peer, err)
+	}
+}
+
+// Shutdown stops replicating leases with our partner.
+func (f *Failover) Shutdown(ctx context.Context) error {
+	close(f.done)
+	f.listener.Close()
+	f.mux.Lock()
+	for c := range f.conns {
+		c.Close()
+	}
+	f.mux.Unlock()
+	f.pubs.Remove(f)
+	stopped := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package midlayer
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/provision/backend"
+	"github.com/digitalrebar/store"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// mkSubnetDT makes a DataTracker with its own memory store and a
+// single subnet, which setup can change before it is created.
+func mkSubnetDT(t *testing.T, setup func(*backend.Subnet)) (*backend.DataTracker, *backend.Publishers) {
+	bs, _ := store.Open("memory:///")
+	logger := log.New(ioutil.Discard, "", 0)
+	pubs := backend.NewPublishers(logger)
+	dt := backend.NewDataTracker(bs,
+		tmpDir,
+		tmpDir,
+		"127.0.0.1",
+		8091,
+		8092,
+		logger,
+		map[string]string{"defaultBootEnv": "default", "unknownBootEnv": "ignore"},
+		pubs)
+	d, unlocker := dt.LockEnts("subnets")
+	defer unlocker()
+	sn := dt.NewSubnet()
+	sn.Name = "test"
+	sn.Enabled = true
+	sn.Subnet = "10.50.60.0/24"
+	sn.ActiveStart = net.ParseIP("10.50.60.10")
+	sn.ActiveEnd = net.ParseIP("10.50.60.13")
+	sn.ActiveLeaseTime = 60
+	sn.ReservedLeaseTime = 7200
+	sn.Strategy = "MAC"
+	if setup != nil {
+		setup(sn)
+	}
+	if _, err := dt.Create(d, sn, nil); err != nil {
+		t.Fatalf("Failed to create subnet: %v", err)
+	}
+	return dt, pubs
+}
+
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func waitForLease(dt *backend.DataTracker, addr, token string) bool {
+	for i := 0; i < 100; i++ {
+		found := func() bool {
+			d, unlocker := dt.LockEnts("leases")
+			defer unlocker()
+			l := d("leases").Find(backend.Hexaddr(net.ParseIP(addr)))
+			return l != nil && backend.AsLease(l).Token == token
+		}()
+		if found {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+func TestFailover(t *testing.T) {
+	failoverHeartbeat = 50 * time.Millisecond
+	defer func() { failoverHeartbeat = time.Second }()
+	dtA, pubsA := mkSubnetDT(t, nil)
+	dtB, pubsB := mkSubnetDT(t, nil)
+	addrA, addrB := freePort(t), freePort(t)
+	if _, err := StartFailover(dtA, pubsA, FailoverPrimary, addrA, "", "secret", 0); err == nil {
+		t.Errorf("Should not be able to start failover without a partner")
+	}
+	if _, err := StartFailover(dtA, pubsA, "tertiary", addrA, addrB, "secret", 0); err == nil {
+		t.Errorf("Should not be able to start failover with an unknown role")
+	}
+	if _, err := StartFailover(dtA, pubsA, FailoverPrimary, addrA, addrB, "", 0); err == nil {
+		t.Errorf("Should not be able to start failover without a secret")
+	}
+	_, port, _ := net.SplitHostPort(addrA)
+	if _, err := StartFailover(dtA, pubsA, FailoverPrimary, ":"+port, addrB, "secret", 0); err == nil {
+		t.Errorf("Should not be able to start failover listening on all interfaces")
+	}
+	foA, err := StartFailover(dtA, pubsA, FailoverPrimary, addrA, addrB, "secret", 300*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to start primary: %v", err)
+	}
+	defer foA.Shutdown(context.Background())
+	foB, err := StartFailover(dtB, pubsB, FailoverSecondary, addrB, addrA, "secret", 0)
+	if err != nil {
+		t.Fatalf("Failed to start secondary: %v", err)
+	}
+	handler := func(dt *backend.DataTracker) *DhcpHandler {
+		return &DhcpHandler{
+			ifs:    []string{},
+			bk:     dt,
+			strats: []*Strategy{&Strategy{Name: "MAC", GenToken: MacStrategy}},
+		}
+	}
+	hA, hB := handler(dtA), handler(dtB)
+	discover := func(h *DhcpHandler, mac string) net.IP {
+		hw, _ := net.ParseMAC(mac)
+		req := dhcp.RequestPacket(dhcp.Discover, hw, nil, []byte("fail"), false, nil)
+		req.SetGIAddr(net.ParseIP("10.50.60.1"))
+		offer := h.ServeDHCP(req, dhcp.Discover, req.ParseOptions())
+		if offer == nil {
+			return nil
+		}
+		return offer.YIAddr()
+	}
+	if addr := discover(hA, "02:00:00:00:00:01"); !addr.Equal(net.ParseIP("10.50.60.10")) {
+		t.Errorf("Expected primary to offer 10.50.60.10, got %s", addr)
+	}
+	if !waitForLease(dtB, "10.50.60.10", "02:00:00:00:00:01") {
+		t.Errorf("Lease for 10.50.60.10 was not replicated to the secondary")
+	}
+	if addr := discover(hB, "02:00:00:00:00:02"); !addr.Equal(net.ParseIP("10.50.60.12")) {
+		t.Errorf("Expected secondary to offer 10.50.60.12, got %s", addr)
+	}
+	if !waitForLease(dtA, "10.50.60.12", "02:00:00:00:00:02") {
+		t.Errorf("Lease for 10.50.60.12 was not replicated to the primary")
+	}
+	if addr := discover(hA, "02:00:00:00:00:03"); !addr.Equal(net.ParseIP("10.50.60.11")) {
+		t.Errorf("Expected primary to offer 10.50.60.11, got %s", addr)
+	}
+	if addr := discover(hA, "02:00:00:00:00:04"); addr != nil {
+		t.Errorf("Primary should not offer addresses the secondary owns, offered %s", addr)
+	}
+	// Renewing a lease the partner handed out is fine.
+	if addr := discover(hA, "02:00:00:00:00:02"); !addr.Equal(net.ParseIP("10.50.60.12")) {
+		t.Errorf("Expected primary to renew 10.50.60.12, got %s", addr)
+	}
+	foB.Shutdown(context.Background())
+	for i := 0; i < 100 && !foA.PartnerDown(); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !foA.PartnerDown() {
+		t.Fatalf("Primary did not notice the secondary went away")
+	}
+	if addr := discover(hA, "02:00:00:00:00:04"); !addr.Equal(net.ParseIP("10.50.60.13")) {
+		t.Errorf("Expected primary to offer 10.50.60.13 with its partner down, got %s", addr)
+	}
+	// When the secondary comes back, it gets everything it missed.
+	foB, err = StartFailover(dtB, pubsB, FailoverSecondary, addrB, addrA, "secret", 0)
+	if err != nil {
+		t.Fatalf("Failed to restart secondary: %v", err)
+	}
+	defer foB.Shutdown(context.Background())
+	if !waitForLease(dtB, "10.50.60.13", "02:00:00:00:00:04") {
+		t.Errorf("Lease for 10.50.60.13 was not sent to the secondary when it came back")
+	}
+	if foA.PartnerDown() {
+		t.Errorf("Primary should know the secondary is back")
+	}
+}
+
+func TestFailoverAuth(t *testing.T) {
+	failoverHeartbeat = 50 * time.Millisecond
+	defer func() { failoverHeartbeat = time.Second }()
+	start := func(dt *backend.DataTracker, pubs *backend.Publishers, role, listen, peer, secret string) *Failover {
+		fo, err := StartFailover(dt, pubs, role, listen, peer, secret, 0)
+		if err != nil {
+			t.Fatalf("Failed to start %s: %v", role, err)
+		}
+		return fo
+	}
+	discover := func(dt *backend.DataTracker, mac string) {
+		h := &DhcpHandler{
+			ifs:    []string{},
+			bk:     dt,
+			strats: []*Strategy{&Strategy{Name: "MAC", GenToken: MacStrategy}},
+		}
+		hw, _ := net.ParseMAC(mac)
+		req := dhcp.RequestPacket(dhcp.Discover, hw, nil, []byte("auth"), false, nil)
+		req.SetGIAddr(net.ParseIP("10.50.60.1"))
+		if offer := h.ServeDHCP(req, dhcp.Discover, req.ParseOptions()); offer == nil {
+			t.Fatalf("Expected an offer for %s", mac)
+		}
+	}
+	// B has the wrong secret, so A should not send it leases.
+	dtA, pubsA := mkSubnetDT(t, nil)
+	dtB, pubsB := mkSubnetDT(t, nil)
+	addrA, addrB := freePort(t), freePort(t)
+	foA := start(dtA, pubsA, FailoverPrimary, addrA, addrB, "secret")
+	defer foA.Shutdown(context.Background())
+	foB := start(dtB, pubsB, FailoverSecondary, addrB, addrA, "wrong")
+	defer foB.Shutdown(context.Background())
+	discover(dtA, "02:00:00:00:00:05")
+	if waitForLease(dtB, "10.50.60.10", "02:00:00:00:00:05") {
+		t.Errorf("Leases should not be sent to a partner with the wrong secret")
+	}
+	// D knows the secret, but C expects its partner somewhere
+	// else, so C should not take leases from D.
+	dtC, pubsC := mkSubnetDT(t, nil)
+	dtD, pubsD := mkSubnetDT(t, nil)
+	addrC, addrD := freePort(t), freePort(t)
+	_, port, _ := net.SplitHostPort(addrD)
+	foC := start(dtC, pubsC, FailoverSecondary, addrC, "127.0.0.2:"+port, "secret")
+	defer foC.Shutdown(context.Background())
+	foD := start(dtD, pubsD, FailoverPrimary, addrD, addrC, "secret")
+	defer foD.Shutdown(context.Background())
+	discover(dtD, "02:00:00:00:00:06")
+	if waitForLease(dtC, "10.50.60.10", "02:00:00:00:00:06") {
+		t.Errorf("Leases should only be taken from the partner address")
+	}
+}
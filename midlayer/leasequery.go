@@ -0,0 +1,142 @@
+package midlayer
+
+import (
+	"encoding/hex"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/digitalrebar/provision/backend"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// DHCP message types for lease queries (RFC 4388).
+const (
+	LeaseQuery      dhcp.MessageType = 10
+	LeaseUnassigned dhcp.MessageType = 11
+	LeaseUnknown    dhcp.MessageType = 12
+	LeaseActive     dhcp.MessageType = 13
+)
+
+// optionAssociatedIP lists the other addresses a client holds in a
+// DHCPLEASEACTIVE reply (RFC 4388).
+const optionAssociatedIP dhcp.OptionCode = 92
+
+// messageTypeName is MessageType.String, with names for the lease
+// query message types.
+func messageTypeName(mt dhcp.MessageType) string {
+	switch mt {
+	case LeaseQuery:
+		return "LeaseQuery"
+	case LeaseUnassigned:
+		return "LeaseUnassigned"
+	case LeaseUnknown:
+		return "LeaseUnknown"
+	case LeaseActive:
+		return "LeaseActive"
+	}
+	return mt.String()
+}
+
+// queriedLeases returns the active leases for strat:token, the one
+// that will last the longest first.
+func queriedLeases(d backend.Stores, strat, token string) []*backend.Lease {
+	res := []*backend.Lease{}
+	for _, i := range d("leases").Items() {
+		lease := backend.AsLease(i)
+		if lease.Strategy == strat && lease.Token == token && !lease.Expired() {
+			res = append(res, lease)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ExpireTime.After(res[j].ExpireTime) })
+	return res
+}
+
+// leaseQuery answers a DHCPLEASEQUERY (RFC 4388) from a relay agent
+// that wants to know who holds an address.  The query is by address
+// if ciaddr is set, by client identifier if option 61 is present,
+// and by hardware address otherwise.
+func (h *DhcpHandler) leaseQuery(tx *transaction, p dhcp.Packet, options dhcp.Options) dhcp.Packet {
+	if p.GIAddr().IsUnspecified() {
+		tx.Infof("Ignoring lease query that did not come from a relay agent")
+		return nil
+	}
+	addr := p.CIAddr()
+	strat, token := "", ""
+	switch {
+	case !addr.IsUnspecified():
+	case len(options[dhcp.OptionClientIdentifier]) > 0:
+		strat, token = "ClientID", ClientIDStrategy(p, options)
+	case len(p.CHAddr()) > 0:
+		strat, token = "MAC", MacStrategy(p, options)
+	default:
+		tx.Infof("Ignoring lease query without an address, hardware address, or client identifier")
+		return nil
+	}
+	inSubnet := token == "" && backend.FindSubnet(h.bk, []net.IP{addr}) != nil
+	d, unlocker := h.bk.LockEnts("leases", "reservations", "subnets")
+	defer unlocker()
+	var leases []*backend.Lease
+	if token == "" {
+		if l := d("leases").Find(backend.Hexaddr(addr)); l != nil {
+			if lease := backend.AsLease(l); lease.Token != "" && !lease.Expired() {
+				leases = []*backend.Lease{lease}
+			}
+		}
+		if len(leases) == 0 {
+			if inSubnet || d("reservations").Find(backend.Hexaddr(addr)) != nil {
+				tx.Infof("Lease query: %s is not leased", addr)
+				return h.leaseQueryReply(p, LeaseUnassigned, nil, nil)
+			}
+			tx.Infof("Lease query: %s is not one of our addresses", addr)
+			return h.leaseQueryReply(p, LeaseUnknown, nil, nil)
+		}
+	} else {
+		tx.Strategy, tx.Token = strat, token
+		leases = queriedLeases(d, strat, token)
+		if len(leases) == 0 {
+			tx.Infof("Lease query: no active lease for %s:%s", strat, token)
+			return h.leaseQueryReply(p, LeaseUnknown, nil, nil)
+		}
+	}
+	tx.use(leases[0], leases[0].Subnet(d), leases[0].Reservation(d))
+	tx.Infof("Lease query: %s is leased to %s:%s", leases[0].Addr, leases[0].Strategy, leases[0].Token)
+	return h.leaseQueryReply(p, LeaseActive, leases[0], leases[1:])
+}
+
+// leaseQueryReply builds the reply to a lease query.  For
+// DHCPLEASEACTIVE, lease is the lease that was found, and others are
+// any other leases the same client holds.
+func (h *DhcpHandler) leaseQueryReply(p dhcp.Packet, mt dhcp.MessageType, lease *backend.Lease, others []*backend.Lease) dhcp.Packet {
+	if lease == nil {
+		return dhcp.ReplyPacket(p, mt, h.respondFrom(p.GIAddr()), nil, 0, nil)
+	}
+	opts := []dhcp.Option{}
+	if lease.Strategy == "ClientID" {
+		if id, err := hex.DecodeString(strings.Replace(lease.Token, ":", "", -1)); err == nil {
+			opts = append(opts, dhcp.Option{Code: dhcp.OptionClientIdentifier, Value: id})
+		}
+	}
+	if len(others) > 0 {
+		addrs := make([]net.IP, 0, len(others)+1)
+		addrs = append(addrs, lease.Addr.To4())
+		for _, o := range others {
+			addrs = append(addrs, o.Addr.To4())
+		}
+		opts = append(opts, dhcp.Option{Code: optionAssociatedIP, Value: dhcp.JoinIPs(addrs)})
+	}
+	remaining := lease.ExpireTime.Sub(time.Now())
+	if remaining < time.Second {
+		remaining = time.Second
+	}
+	res := dhcp.ReplyPacket(p, mt, h.respondFrom(p.GIAddr()), nil, remaining, opts)
+	res.SetCIAddr(lease.Addr)
+	if lease.Strategy == "MAC" {
+		if hw, err := net.ParseMAC(lease.Token); err == nil {
+			res.SetHType(1)
+			res.SetCHAddr(hw)
+		}
+	}
+	return res
+}
@@ -0,0 +1,155 @@
+package midlayer
+
+import (
+	"bufio"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// Prober checks whether something is already using an address
+// before the DHCP handler offers it to a client.
+type Prober interface {
+	// Probe returns whether something answered for addr, and
+	// the hardware address that answered if it can be found.
+	Probe(addr net.IP) (inUse bool, hw net.HardwareAddr)
+}
+
+// IcmpProber probes addresses by sending them an ICMP echo request.
+// It needs to be able to open raw sockets, which it does once when it
+// is created.  Any number of probes can be in flight at once.
+type IcmpProber struct {
+	// Timeout is how long to wait for an echo reply.
+	Timeout time.Duration
+	conn    *icmp.PacketConn
+	id      int
+	mux     sync.Mutex
+	seq     int
+	waiters map[echoKey]chan struct{}
+}
+
+// echoKey matches an echo reply to the probe waiting for it.
+type echoKey struct {
+	seq  int
+	addr string
+}
+
+// NewIcmpProber opens the raw socket the prober sends echo requests
+// and receives echo replies on.  It fails if we are not allowed to
+// open raw sockets.
+func NewIcmpProber(timeout time.Duration) (*IcmpProber, error) {
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return nil, err
+	}
+	p := &IcmpProber{
+		Timeout: timeout,
+		conn:    conn,
+		id:      rand.Intn(0xffff),
+		waiters: map[echoKey]chan struct{}{},
+	}
+	go p.receive()
+	return p, nil
+}
+
+// receive hands echo replies to the probes waiting for them.  Replies
+// are matched by sequence number, and only count if they came from
+// the address that was probed.
+func (p *IcmpProber) receive() {
+	reply := make([]byte, 1500)
+	for {
+		n, from, err := p.conn.ReadFrom(reply)
+		if err != nil {
+			return
+		}
+		res, err := icmp.ParseMessage(1, reply[:n])
+		if err != nil || res.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		echo, ok := res.Body.(*icmp.Echo)
+		if !ok || echo.ID != p.id {
+			continue
+		}
+		ip, ok := from.(*net.IPAddr)
+		if !ok {
+			continue
+		}
+		p.mux.Lock()
+		key := echoKey{echo.Seq, ip.IP.String()}
+		if ch, ok := p.waiters[key]; ok {
+			close(ch)
+			delete(p.waiters, key)
+		}
+		p.mux.Unlock()
+	}
+}
+
+func (p *IcmpProber) Probe(addr net.IP) (bool, net.HardwareAddr) {
+	addr = addr.To4()
+	if addr == nil {
+		return false, nil
+	}
+	p.mux.Lock()
+	p.seq = (p.seq + 1) & 0xffff
+	seq := p.seq
+	key := echoKey{seq, addr.String()}
+	ch := make(chan struct{})
+	p.waiters[key] = ch
+	p.mux.Unlock()
+	defer func() {
+		p.mux.Lock()
+		delete(p.waiters, key)
+		p.mux.Unlock()
+	}()
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: p.id, Seq: seq, Data: []byte("dr-provision")},
+	}
+	buf, err := msg.Marshal(nil)
+	if err != nil {
+		return false, nil
+	}
+	if _, err := p.conn.WriteTo(buf, &net.IPAddr{IP: addr}); err != nil {
+		return false, nil
+	}
+	select {
+	case <-ch:
+		return true, arpLookup(addr)
+	case <-time.After(p.Timeout):
+		// Nothing answered.
+		return false, nil
+	}
+}
+
+// Close closes the raw socket of the prober.
+func (p *IcmpProber) Close() error {
+	return p.conn.Close()
+}
+
+// arpLookup finds the hardware address for addr in the kernel ARP
+// cache, which will have it if addr is on a local network and has
+// just answered us.
+func arpLookup(addr net.IP) net.HardwareAddr {
+	f, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !net.ParseIP(fields[0]).Equal(addr) {
+			continue
+		}
+		if hw, err := net.ParseMAC(fields[3]); err == nil {
+			return hw
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package midlayer
+
+import (
+	"net"
+
+	"github.com/digitalrebar/provision/backend"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// shadowed returns whether p should be handled in shadow mode,
+// either because the whole handler is or because the client is in a
+// subnet that is.
+func (h *DhcpHandler) shadowed(p dhcp.Packet, options dhcp.Options, req net.IP) bool {
+	if h.shadow {
+		return true
+	}
+	subnet := backend.FindSubnet(h.bk, append(h.linkAddrs(p, options), req))
+	return subnet != nil && subnet.Shadow
+}
+
+// shadowServe works out what serveDHCP would do with p, using shadow
+// leases instead of creating or changing real ones.  ServeDHCP
+// records the reply, but never sends it.  Along the way, we note the
+// addresses clients take from other DHCP servers or are already
+// using, so that they can be compared with what we would have done.
+func (h *DhcpHandler) shadowServe(tx *transaction,
+	p dhcp.Packet,
+	msgType dhcp.MessageType,
+	options dhcp.Options,
+	req net.IP,
+	reqState int) dhcp.Packet {
+	switch msgType {
+	case LeaseQuery:
+		return h.leaseQuery(tx, p, options)
+	case dhcp.Inform:
+		if addr := p.CIAddr(); addr.IsGlobalUnicast() {
+			h.bk.RecordShadowActual(tx.HardwareAddr, addr)
+		}
+		return h.inform(tx, p, options)
+	case dhcp.Decline, dhcp.Release:
+		tx.Infof("Shadow mode: ignoring %s for %s", messageTypeName(msgType), req)
+		return nil
+	case dhcp.Request:
+		serverBytes, ok := options[dhcp.OptionServerIdentifier]
+		server := net.IP(serverBytes)
+		if ok && !h.listenOn(server) {
+			if req.IsGlobalUnicast() {
+				h.bk.RecordShadowActual(tx.HardwareAddr, req)
+			}
+			tx.Infof("Shadow mode: %s is taking %s from DHCP server %s", p.CHAddr(), req, server)
+			return nil
+		}
+		if reqState == reqRenewing && req.IsGlobalUnicast() {
+			h.bk.RecordShadowActual(tx.HardwareAddr, req)
+		}
+		if h.proxied(p, options, append(h.linkAddrs(p, options), req)) {
+			tx.Infof("Shadow mode: would ignore request for %s, which another DHCP server owns", req)
+			return nil
+		}
+		tx.decided = true
+		if !req.IsGlobalUnicast() {
+			tx.Infof("Shadow mode: would NAK invalid requested IP %s", req)
+			return h.nak(p, options, h.respondFrom(req))
+		}
+		var lease *backend.Lease
+		var reservation *backend.Reservation
+		var subnet *backend.Subnet
+		var err error
+		for _, s := range h.leaseStrategies(req) {
+			lease, subnet, reservation, err = backend.ShadowFindLease(h.bk, s.Name, s.GenToken(p, options), req)
+			if err != nil {
+				tx.Infof("Shadow mode: would NAK %s: %s", req, err)
+				return h.nak(p, options, h.respondFrom(req))
+			}
+			if lease != nil {
+				break
+			}
+		}
+		if lease == nil {
+			if reqState == reqInitReboot {
+				tx.Infof("Shadow mode: no lease for %s, would ignore client in INIT-REBOOT", req)
+				return nil
+			}
+			tx.Infof("Shadow mode: no lease for %s, would NAK", req)
+			return h.nak(p, options, h.respondFrom(req))
+		}
+		tx.use(lease, subnet, reservation)
+		reply := h.leaseReply(p, options, dhcp.ACK, lease, subnet, reservation)
+		tx.Infof("Shadow mode: request would hand out %s to %s", reply.YIAddr(), reply.CHAddr())
+		return reply
+	case dhcp.Discover:
+		via := h.linkAddrs(p, options)
+		if reply, isProxy := h.proxyReply(tx, p, msgType, options, via); isProxy {
+			return reply
+		}
+		tx.decided = true
+		for _, s := range h.strategiesFor(via) {
+			token := s.GenToken(p, options)
+			if token == "" {
+				continue
+			}
+			lease, subnet, reservation := backend.ShadowLease(h.bk, s.Name, token, req, via)
+			if lease != nil {
+				tx.use(lease, subnet, reservation)
+				reply := h.leaseReply(p, options, dhcp.Offer, lease, subnet, reservation)
+				tx.Infof("Shadow mode: discovery would hand out %s to %s", reply.YIAddr(), reply.CHAddr())
+				return reply
+			}
+		}
+		tx.Infof("Shadow mode: no address available for %s", p.CHAddr())
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package midlayer
 
 import (
+	"crypto/tls"
 	"log"
 	"net"
 	"net/http"
@@ -13,6 +14,25 @@ func ServeStatic(listenAt string, responder http.Handler, logger *log.Logger, pu
 	if err != nil {
 		return nil, err
 	}
+	return serveStatic(conn, listenAt, responder, logger), nil
+}
+
+// ServeStaticTLS is ServeStatic over HTTPS, using the certificate and
+// key in certFile and keyFile.  UEFI HTTP Boot clients that have been
+// told to trust the certificate can load their boot files from it.
+func ServeStaticTLS(listenAt string, responder http.Handler, logger *log.Logger, pubs *backend.Publishers, certFile, keyFile string) (*http.Server, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Listen("tcp", listenAt)
+	if err != nil {
+		return nil, err
+	}
+	return serveStatic(tls.NewListener(conn, &tls.Config{Certificates: []tls.Certificate{cert}}), listenAt, responder, logger), nil
+}
+
+func serveStatic(conn net.Listener, listenAt string, responder http.Handler, logger *log.Logger) *http.Server {
 	svr := &http.Server{
 		Addr:    listenAt,
 		Handler: responder,
@@ -32,5 +52,5 @@ func ServeStatic(listenAt string, responder http.Handler, logger *log.Logger, pu
 			}
 		}
 	}()
-	return svr, nil
+	return svr
 }
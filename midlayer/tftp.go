@@ -1,7 +1,6 @@
 package midlayer
 
 import (
-	"bytes"
 	"context"
 	"io"
 	"log"
@@ -49,16 +48,20 @@ func ServeTftp(listen string, responder func(string, net.IP) (io.Reader, error),
 		if err != nil {
 			return err
 		}
+		if c, ok := source.(io.Closer); ok {
+			defer c.Close()
+		}
 		if outgoing {
 			var size int64
 			switch src := source.(type) {
+			case interface {
+				Size() int64
+			}:
+				size = src.Size()
 			case *os.File:
-				defer src.Close()
 				if fi, err := src.Stat(); err == nil {
 					size = fi.Size()
 				}
-			case *bytes.Reader:
-				size = src.Size()
 			}
 			t.SetSize(size)
 		}
@@ -36,12 +36,14 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/digitalrebar/provision"
 	"github.com/digitalrebar/provision/backend"
 	"github.com/digitalrebar/provision/frontend"
 	"github.com/digitalrebar/provision/midlayer"
 	"github.com/digitalrebar/provision/plugin"
+	"github.com/digitalrebar/store"
 )
 
 type ProgOpts struct {
@@ -50,9 +52,39 @@ type ProgOpts struct {
 	DisableProvisioner  bool   `long:"disable-provisioner" description:"Disable provisioner"`
 	DisableDHCP         bool   `long:"disable-dhcp" description:"Disable DHCP server"`
 	StaticPort          int    `long:"static-port" description:"Port the static HTTP file server should listen on" default:"8091"`
+	StaticHttpsPort     int    `long:"static-https-port" description:"Port the static file server should also serve HTTPS on, or 0 to only serve HTTP.  UEFI HTTP Boot clients are handed HTTPS URLs when it is set" default:"0"`
 	TftpPort            int    `long:"tftp-port" description:"Port for the TFTP server to listen on" default:"69"`
 	ApiPort             int    `long:"api-port" description:"Port for the API server to listen on" default:"8092"`
 	DhcpPort            int    `long:"dhcp-port" description:"Port for the DHCP server to listen on" default:"67"`
+	ProxyDHCP           bool   `long:"proxy-dhcp" description:"Only supply PXE boot information from the DHCP server, and never hand out addresses"`
+	DhcpShadow          bool   `long:"dhcp-shadow" description:"Handle DHCP packets and record what the DHCP server would have done, but never reply or change leases"`
+	ProxyDhcpPort       int    `long:"proxy-dhcp-port" description:"Port for the proxyDHCP (PXE boot server) to listen on when --proxy-dhcp is set or there are proxy subnets" default:"4011"`
+	ConflictProbe       int    `long:"conflict-probe" description:"Milliseconds to wait for an ICMP echo reply when checking whether an address is in use before offering it, or 0 to not check" default:"0"`
+	FailoverRole        string `long:"failover-role" description:"Share leases with a DHCP failover partner, as either 'primary' or 'secondary'" default:""`
+	FailoverListen      string `long:"failover-listen" description:"Address to listen for the DHCP failover partner on, which must not be all interfaces.  Defaults to port 8093 of the address the partner is reached from"`
+	FailoverPeer        string `long:"failover-peer" description:"Address of the DHCP failover partner"`
+	FailoverSecret      string `long:"failover-secret" description:"Secret shared with the DHCP failover partner, which both partners must prove they know"`
+	FailoverPartnerDown int    `long:"failover-partner-down" description:"Seconds without hearing from the DHCP failover partner before handing out its addresses, or 0 to never do so" default:"300"`
+	DdnsServer          string `long:"ddns-server" description:"DNS server to send dynamic DNS updates for leases and machines to"`
+	DdnsKeyName         string `long:"ddns-key-name" description:"Name of the TSIG key to sign dynamic DNS updates with"`
+	DdnsKeySecret       string `long:"ddns-key-secret" description:"Base64 encoded secret of the TSIG key to sign dynamic DNS updates with"`
+	DdnsKeyAlgorithm    string `long:"ddns-key-algorithm" description:"Algorithm of the TSIG key to sign dynamic DNS updates with" default:"hmac-sha256"`
+	DdnsTTL             int    `long:"ddns-ttl" description:"TTL in seconds of the DNS records added by dynamic DNS updates" default:"300"`
+	DnsDomain           string `long:"dns-domain" description:"Answer DNS queries for machines and leases in this domain, and hand ourselves out as the DNS server"`
+	DnsPort             int    `long:"dns-port" description:"Port for the DNS server to listen on" default:"53"`
+	EnableDHCP6         bool   `long:"enable-dhcp6" description:"Enable DHCPv6 server"`
+	Dhcp6Port           int    `long:"dhcp6-port" description:"Port for the DHCPv6 server to listen on" default:"547"`
+	LeaseSweepInterval  int    `long:"lease-sweep-interval" description:"How often in seconds to look for expired leases, or 0 to never look" default:"60"`
+	LeaseReapGrace      int    `long:"lease-reap-grace" description:"How long in seconds a lease must be expired before it is removed" default:"86400"`
+	LeaseHistoryLength  int    `long:"lease-history-length" description:"How many past owners to remember for each address, or 0 to not keep lease history" default:"50"`
+	LeaseHistoryMaxAge  int    `long:"lease-history-retention" description:"How long in seconds to remember past owners of an address, or 0 to keep them until there are too many" default:"2592000"`
+	SubnetThresholds    string `long:"subnet-usage-thresholds" description:"Comma separated percentages of subnet utilization to send threshold events at" default:"80,90,95"`
+	DhcpClientRateLimit int    `long:"dhcp-client-rate-limit" description:"How many DHCP packets per minute to handle from each client, or 0 for no limit" default:"120"`
+	DhcpRelayRateLimit  int    `long:"dhcp-relay-rate-limit" description:"How many DHCP packets per minute to handle from each relay agent, or 0 for no limit" default:"0"`
+	FileTransferLimit   int    `long:"file-transfer-limit" description:"How many TFTP and HTTP file transfers may run at once, or 0 for no limit" default:"0"`
+	FileClientLimit     int    `long:"file-transfer-client-limit" description:"How many TFTP and HTTP file transfers each client may run at once, or 0 for no limit" default:"0"`
+	FileBandwidth       int    `long:"file-transfer-bandwidth" description:"How many KiB per second all TFTP and HTTP file transfers together may send, or 0 for no limit" default:"0"`
+	FileQueueTimeout    int    `long:"file-transfer-queue-timeout" description:"How long in seconds a file transfer may wait for a slot before it is refused, or 0 to wait forever" default:"30"`
 	UnknownTokenTimeout int    `long:"unknown-token-timeout" description:"The default timeout in seconds for the machine create authorization token" default:"600"`
 	KnownTokenTimeout   int    `long:"known-token-timeout" description:"The default timeout in seconds for the machine update authorization token" default:"3600"`
 	OurAddress          string `long:"static-ip" description:"IP address to advertise for the static HTTP file server" default:"192.168.124.11"`
@@ -65,6 +97,7 @@ type ProgOpts struct {
 	DataRoot        string `long:"data-root" description:"Location we should store runtime information in" default:"digitalrebar"`
 	PluginRoot      string `long:"plugin-root" description:"Directory for plugins" default:"plugins"`
 	LogRoot         string `long:"log-root" description:"Directory for job logs" default:"job-logs"`
+	LeaseHistRoot   string `long:"lease-history-root" description:"Directory for lease history" default:"lease-history"`
 	SaasContentRoot string `long:"saas-content-root" description:"Directory for additional content" default:"saas-content"`
 	FileRoot        string `long:"file-root" description:"Root of filesystem we should manage" default:"tftpboot"`
 
@@ -114,6 +147,9 @@ func Server(c_opts *ProgOpts) {
 	if strings.IndexRune(c_opts.LogRoot, filepath.Separator) != 0 {
 		c_opts.LogRoot = filepath.Join(c_opts.BaseRoot, c_opts.LogRoot)
 	}
+	if strings.IndexRune(c_opts.LeaseHistRoot, filepath.Separator) != 0 {
+		c_opts.LeaseHistRoot = filepath.Join(c_opts.BaseRoot, c_opts.LeaseHistRoot)
+	}
 	if strings.IndexRune(c_opts.SaasContentRoot, filepath.Separator) != 0 {
 		c_opts.SaasContentRoot = filepath.Join(c_opts.BaseRoot, c_opts.SaasContentRoot)
 	}
@@ -121,6 +157,7 @@ func Server(c_opts *ProgOpts) {
 	mkdir(c_opts.PluginRoot, logger)
 	mkdir(c_opts.DataRoot, logger)
 	mkdir(c_opts.LogRoot, logger)
+	mkdir(c_opts.LeaseHistRoot, logger)
 	mkdir(c_opts.SaasContentRoot, logger)
 	logger.Printf("Extracting Default Assets\n")
 	if err := ExtractAssets(c_opts.FileRoot); err != nil {
@@ -146,15 +183,35 @@ func Server(c_opts *ProgOpts) {
 		c_opts.ApiPort,
 		logger,
 		map[string]string{
-			"debugBootEnv":        fmt.Sprintf("%d", c_opts.DebugBootEnv),
-			"debugDhcp":           fmt.Sprintf("%d", c_opts.DebugDhcp),
-			"debugRenderer":       fmt.Sprintf("%d", c_opts.DebugRenderer),
-			"defaultBootEnv":      c_opts.DefaultBootEnv,
-			"unknownBootEnv":      c_opts.UnknownBootEnv,
-			"knownTokenTimeout":   fmt.Sprintf("%d", c_opts.KnownTokenTimeout),
-			"unknownTokenTimeout": fmt.Sprintf("%d", c_opts.UnknownTokenTimeout),
+			"debugBootEnv":             fmt.Sprintf("%d", c_opts.DebugBootEnv),
+			"debugDhcp":                fmt.Sprintf("%d", c_opts.DebugDhcp),
+			"debugRenderer":            fmt.Sprintf("%d", c_opts.DebugRenderer),
+			"defaultBootEnv":           c_opts.DefaultBootEnv,
+			"unknownBootEnv":           c_opts.UnknownBootEnv,
+			"knownTokenTimeout":        fmt.Sprintf("%d", c_opts.KnownTokenTimeout),
+			"unknownTokenTimeout":      fmt.Sprintf("%d", c_opts.UnknownTokenTimeout),
+			"leaseSweepInterval":       fmt.Sprintf("%d", c_opts.LeaseSweepInterval),
+			"leaseReapGrace":           fmt.Sprintf("%d", c_opts.LeaseReapGrace),
+			"leaseHistoryLength":       fmt.Sprintf("%d", c_opts.LeaseHistoryLength),
+			"leaseHistoryRetention":    fmt.Sprintf("%d", c_opts.LeaseHistoryMaxAge),
+			"subnetUsageThresholds":    c_opts.SubnetThresholds,
+			"dhcpClientRateLimit":      fmt.Sprintf("%d", c_opts.DhcpClientRateLimit),
+			"dhcpRelayRateLimit":       fmt.Sprintf("%d", c_opts.DhcpRelayRateLimit),
+			"fileTransferLimit":        fmt.Sprintf("%d", c_opts.FileTransferLimit),
+			"fileTransferClientLimit":  fmt.Sprintf("%d", c_opts.FileClientLimit),
+			"fileTransferBandwidth":    fmt.Sprintf("%d", c_opts.FileBandwidth),
+			"fileTransferQueueTimeout": fmt.Sprintf("%d", c_opts.FileQueueTimeout),
 		},
 		publishers)
+	dt.StaticHttpsPort = c_opts.StaticHttpsPort
+
+	histStore, err := store.Open("directory://" + c_opts.LeaseHistRoot)
+	if err != nil {
+		logger.Fatalf("Unable to open lease history: %v", err)
+	}
+	if err := dt.SetLeaseHistoryStore(histStore); err != nil {
+		logger.Fatalf("Unable to load lease history: %v", err)
+	}
 
 	// No DrpId - get a mac address
 	if c_opts.DrpId == "" {
@@ -212,15 +269,89 @@ func Server(c_opts *ProgOpts) {
 		} else {
 			services = append(services, svc)
 		}
+		if c_opts.StaticHttpsPort != 0 {
+			logger.Printf("Starting static HTTPS file server")
+			if svc, err := midlayer.ServeStaticTLS(fmt.Sprintf(":%d", c_opts.StaticHttpsPort), dt.FS, logger, publishers,
+				c_opts.TlsCertFile, c_opts.TlsKeyFile); err != nil {
+				logger.Fatalf("Error starting static HTTPS file server: %v", err)
+			} else {
+				services = append(services, svc)
+			}
+		}
+	}
+
+	logger.Printf("Starting lease sweeper")
+	services = append(services, dt.NewLeaseSweeper().Start())
+
+	if c_opts.DdnsServer != "" {
+		logger.Printf("Starting dynamic DNS updates to %s", c_opts.DdnsServer)
+		if svc, err := midlayer.StartDdns(dt, publishers,
+			c_opts.DdnsServer,
+			c_opts.DdnsKeyName,
+			c_opts.DdnsKeySecret,
+			c_opts.DdnsKeyAlgorithm,
+			c_opts.DdnsTTL); err != nil {
+			logger.Fatalf("Error starting dynamic DNS updates: %v", err)
+		} else {
+			services = append(services, svc)
+		}
+	}
+
+	if c_opts.DnsDomain != "" {
+		logger.Printf("Starting DNS server for %s", c_opts.DnsDomain)
+		if svc, err := midlayer.StartDnsServer(dt, c_opts.DnsDomain, c_opts.DnsPort); err != nil {
+			logger.Fatalf("Error starting DNS server: %v", err)
+		} else {
+			services = append(services, svc)
+		}
 	}
 
 	if !c_opts.DisableDHCP {
+		if c_opts.FailoverRole != "" {
+			logger.Printf("Starting DHCP failover as %s", c_opts.FailoverRole)
+			if svc, err := midlayer.StartFailover(dt, publishers,
+				c_opts.FailoverRole,
+				c_opts.FailoverListen,
+				c_opts.FailoverPeer,
+				c_opts.FailoverSecret,
+				time.Duration(c_opts.FailoverPartnerDown)*time.Second); err != nil {
+				logger.Fatalf("Error starting DHCP failover: %v", err)
+			} else {
+				services = append(services, svc)
+			}
+		}
 		logger.Printf("Starting DHCP server")
-		if svc, err := midlayer.StartDhcpHandler(dt, c_opts.DhcpInterfaces, c_opts.DhcpPort, publishers); err != nil {
+		var prober midlayer.Prober
+		if c_opts.ConflictProbe > 0 {
+			if icmp, err := midlayer.NewIcmpProber(time.Duration(c_opts.ConflictProbe) * time.Millisecond); err != nil {
+				logger.Printf("Not probing for address conflicts, cannot open ICMP socket: %v", err)
+			} else {
+				prober = icmp
+			}
+		}
+		if svc, err := midlayer.StartDhcpHandler(dt, c_opts.DhcpInterfaces, c_opts.DhcpPort, publishers, c_opts.ProxyDHCP, c_opts.DhcpShadow, prober, c_opts.DnsDomain); err != nil {
 			logger.Fatalf("Error starting DHCP server: %v", err)
 		} else {
 			services = append(services, svc)
 		}
+		// Only listen on the PXE Boot Server port when proxyDHCP
+		// was asked for, and do not refuse to start over it.
+		if c_opts.ProxyDHCP || backend.HaveProxySubnets(dt) {
+			logger.Printf("Starting proxyDHCP server")
+			if svc, err := midlayer.StartProxyDhcpHandler(dt, c_opts.DhcpInterfaces, c_opts.ProxyDhcpPort, publishers); err != nil {
+				logger.Printf("Error starting proxyDHCP server, PXE Boot Server requests will not be answered: %v", err)
+			} else {
+				services = append(services, svc)
+			}
+		}
+		if c_opts.EnableDHCP6 {
+			logger.Printf("Starting DHCPv6 server")
+			if svc, err := midlayer.StartDhcp6Handler(dt, c_opts.DhcpInterfaces, c_opts.Dhcp6Port, publishers, c_opts.DrpId); err != nil {
+				logger.Fatalf("Error starting DHCPv6 server: %v", err)
+			} else {
+				services = append(services, svc)
+			}
+		}
 	}
 
 	srv := &http.Server{Addr: fmt.Sprintf(":%d", c_opts.ApiPort), Handler: fe.MgmtApi}